@@ -0,0 +1,212 @@
+package cetusguard
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/hectorm/cetusguard/internal/logger"
+	"github.com/hectorm/cetusguard/internal/utils/proxyproto"
+)
+
+const (
+	// Maximum time to receive the PROXY protocol header of a connection
+	proxyHeaderTimeout = 10 * time.Second
+)
+
+var (
+	aclLineRegex = regexp.MustCompile(`^[\t ]*(allow|deny)((?:;[a-z0-9-]+=[^\t ;]*)*)[\t ]+([^\t ]+)[\t ]*$`)
+)
+
+// Allows or denies connections from a network on TCP listeners. The first rule that applies to the listener
+// and matches the client address is used, and if none matches, clients are denied if any of them allows a network
+type AclRule struct {
+	Allow   bool
+	Network *net.IPNet
+	// Frontend address, as specified in the configuration, the rule applies to, all TCP listeners if empty
+	Listener string
+}
+
+func (rule AclRule) String() string {
+	action := "deny"
+	if rule.Allow {
+		action = "allow"
+	}
+	if rule.Listener != "" {
+		action += ";listener=" + rule.Listener
+	}
+	return fmt.Sprintf("%s %s", action, rule.Network)
+}
+
+var aclOptionParsers = map[string]func(rule *AclRule, val string) error{
+	"listener": func(rule *AclRule, val string) error {
+		proto, _, err := parseAddr(val)
+		if err != nil {
+			return err
+		}
+		if !strings.HasPrefix(proto, "tcp") {
+			return fmt.Errorf("not a TCP address: %s", val)
+		}
+		rule.Listener = val
+		return nil
+	},
+}
+
+func BuildAclRules(str string) ([]AclRule, error) {
+	var rules []AclRule
+
+	lines := newLineRegex.Split(str, -1)
+	for _, line := range lines {
+		if commentLineRegex.MatchString(line) {
+			continue
+		}
+
+		matches := aclLineRegex.FindStringSubmatch(line)
+		if len(matches) != 4 {
+			return nil, fmt.Errorf("invalid ACL rule line: %s", line)
+		}
+		actionFrag := matches[1]
+		optionsFrag := matches[2]
+		networkFrag := matches[3]
+
+		rule := AclRule{Allow: actionFrag == "allow"}
+		if optionsFrag != "" {
+			for _, option := range strings.Split(optionsFrag[1:], ";") {
+				k, v, _ := strings.Cut(option, "=")
+				parse, ok := aclOptionParsers[k]
+				if !ok {
+					return nil, fmt.Errorf("unknown ACL rule option: %s", k)
+				}
+				if err := parse(&rule, v); err != nil {
+					return nil, fmt.Errorf("invalid ACL rule option: %s: %w", option, err)
+				}
+			}
+		}
+
+		var err error
+		rule.Network, err = parseCidr(networkFrag)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ACL rule network: %s: %w", networkFrag, err)
+		}
+
+		rules = append(rules, rule)
+
+		logger.Debugf("loaded ACL rule: %s\n", rule)
+	}
+
+	return rules, nil
+}
+
+// Returns a function that reports whether a client address is allowed on the listener,
+// or nil if no rule applies to it
+func listenerAcl(rules []AclRule, listener string) func(ip net.IP) bool {
+	var listenerRules []AclRule
+	for _, rule := range rules {
+		if rule.Listener == "" || rule.Listener == listener {
+			listenerRules = append(listenerRules, rule)
+		}
+	}
+	if len(listenerRules) == 0 {
+		return nil
+	}
+
+	defaultAllow := !slices.ContainsFunc(listenerRules, func(rule AclRule) bool { return rule.Allow })
+	return func(ip net.IP) bool {
+		for _, rule := range listenerRules {
+			if rule.Network.Contains(ip) {
+				return rule.Allow
+			}
+		}
+		return defaultAllow
+	}
+}
+
+func addrIp(addr net.Addr) net.IP {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP
+	}
+	return nil
+}
+
+// Parses a network as an IP address or CIDR range
+func ParseNetwork(val string) (*net.IPNet, error) {
+	return parseCidr(val)
+}
+
+// Closes the connections from clients that are not allowed by the ACL, or from peers that are not trusted
+// proxies, before they are served
+type aclListener struct {
+	net.Listener
+	listener string
+	allowed  func(ip net.IP) bool
+	reason   string
+}
+
+func (l *aclListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if l.allowed(addrIp(conn.RemoteAddr())) {
+			return conn, nil
+		}
+		logger.Warningf("rejected connection from %s on %s: %s\n", conn.RemoteAddr(), l.listener, l.reason)
+		_ = conn.Close()
+	}
+}
+
+// Wraps a TCP frontend listener to read the PROXY protocol header of its connections if enabled, only from
+// trusted proxies, and to reject the clients that are not allowed by the ACL, which is checked with the address
+// in the header
+func frontendListener(l net.Listener, frontend *Frontend, listener string) net.Listener {
+	allowed := listenerAcl(frontend.Acl, listener)
+
+	if slices.Contains(frontend.ProxyProtocol, listener) {
+		trusted := func(ip net.IP) bool {
+			return slices.ContainsFunc(frontend.ProxyTrusted, func(network *net.IPNet) bool { return network.Contains(ip) })
+		}
+		return &proxyproto.Listener{
+			Listener: &aclListener{Listener: l, listener: listener, allowed: trusted, reason: "not a trusted proxy"},
+			Timeout:  proxyHeaderTimeout,
+			Check: func(addr net.Addr) error {
+				if allowed != nil && !allowed(addrIp(addr)) {
+					logger.Warningf("rejected connection from %s on %s: not allowed by the ACL\n", addr, listener)
+					return errors.New("connection not allowed")
+				}
+				return nil
+			},
+		}
+	}
+
+	if allowed != nil {
+		return &aclListener{Listener: l, listener: listener, allowed: allowed, reason: "not allowed by the ACL"}
+	}
+	return l
+}
+
+// Checks that the ACL rules and the listeners with PROXY protocol refer to TCP frontend addresses,
+// and that the proxies trusted to send the header are specified
+func checkListenerOptions(frontend *Frontend) error {
+	for _, rule := range frontend.Acl {
+		if rule.Listener != "" && !slices.Contains(frontend.Addr, rule.Listener) {
+			return fmt.Errorf("unknown listener in ACL rule: %s", rule)
+		}
+	}
+	if len(frontend.ProxyProtocol) > 0 && len(frontend.ProxyTrusted) == 0 {
+		return errors.New("PROXY protocol requires trusted proxies")
+	}
+	for _, addr := range frontend.ProxyProtocol {
+		if !slices.Contains(frontend.Addr, addr) {
+			return fmt.Errorf("unknown listener with PROXY protocol: %s", addr)
+		}
+		if proto, _, err := parseAddr(addr); err != nil || !strings.HasPrefix(proto, "tcp") {
+			return fmt.Errorf("PROXY protocol requires a TCP listener: %s", addr)
+		}
+	}
+	return nil
+}
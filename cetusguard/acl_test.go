@@ -0,0 +1,93 @@
+package cetusguard
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestBuildAclRules(t *testing.T) {
+	_, network, _ := net.ParseCIDR("10.0.0.0/8")
+	_, host, _ := net.ParseCIDR("127.0.0.1/32")
+
+	rules, err := BuildAclRules("! Internal network\n" +
+		"allow;listener=tcp://0.0.0.0:2375 10.0.0.0/8\n" +
+		" \t deny \t 127.0.0.1 \t \n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wanted := []AclRule{
+		{Allow: true, Network: network, Listener: "tcp://0.0.0.0:2375"},
+		{Allow: false, Network: host},
+	}
+	if len(rules) != len(wanted) {
+		t.Fatalf("rules = %v, want %v", rules, wanted)
+	}
+	for i, rule := range rules {
+		if rule.String() != wanted[i].String() || !reflect.DeepEqual(rule.Network.Mask, wanted[i].Network.Mask) {
+			t.Errorf("rule = %s, want %s", rule, wanted[i])
+		}
+	}
+}
+
+func TestBuildInvalidAclRules(t *testing.T) {
+	lines := []string{
+		"allow",
+		"permit 10.0.0.0/8",
+		"allow 10.0.0.0/33",
+		"allow 10.0.0.0/8 192.168.0.0/16",
+		"allow;listener=unix:///run/cetusguard.sock 10.0.0.0/8",
+		"allow;foo=bar 10.0.0.0/8",
+	}
+
+	for _, line := range lines {
+		rules, err := BuildAclRules(line)
+		if err == nil || rules != nil {
+			t.Errorf("%q: rules = %v, want an error", line, rules)
+		}
+	}
+}
+
+func TestListenerAcl(t *testing.T) {
+	rules, err := BuildAclRules("deny 10.0.99.0/24\n" +
+		"allow 10.0.0.0/8\n" +
+		"allow;listener=tcp://0.0.0.0:2376 192.168.0.0/16\n" +
+		"deny;listener=tcp://0.0.0.0:2377 192.168.0.0/16")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if allowed := listenerAcl(nil, "tcp://0.0.0.0:2375"); allowed != nil {
+		t.Errorf("ACL without rules, want nil")
+	}
+
+	testCases := []struct {
+		listener string
+		ip       string
+		wanted   bool
+	}{
+		{"tcp://0.0.0.0:2375", "10.0.0.1", true},
+		{"tcp://0.0.0.0:2375", "10.0.99.1", false},
+		{"tcp://0.0.0.0:2375", "192.168.0.1", false},
+		{"tcp://0.0.0.0:2376", "192.168.0.1", true},
+		{"tcp://0.0.0.0:2376", "172.16.0.1", false},
+		{"tcp://0.0.0.0:2377", "192.168.0.1", false},
+	}
+
+	for _, c := range testCases {
+		allowed := listenerAcl(rules, c.listener)
+		if allowed(net.ParseIP(c.ip)) != c.wanted {
+			t.Errorf("%s %s: allowed = %t, want %t", c.listener, c.ip, !c.wanted, c.wanted)
+		}
+	}
+
+	// Listeners whose rules only deny networks accept any other client
+	denyRules, err := BuildAclRules("deny 10.0.99.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !listenerAcl(denyRules, "tcp://0.0.0.0:2375")(net.ParseIP("172.16.0.1")) {
+		t.Errorf("client denied, want allowed")
+	}
+}
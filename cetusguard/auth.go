@@ -0,0 +1,299 @@
+package cetusguard
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/hectorm/cetusguard/internal/logger"
+)
+
+const (
+	// Failed authentication attempts allowed from the same client within the window
+	authMaxFailures = 5
+	// Time after the first failed attempt during which failures are counted
+	authFailureWindow = time.Minute
+)
+
+// Identity of an authenticated client and the name of its rule set, if it has one
+type credential struct {
+	name    string
+	ruleSet string
+}
+
+type passwordEntry struct {
+	credential
+	hash []byte
+}
+
+type authFailures struct {
+	count int
+	first time.Time
+}
+
+// Authenticates requests with bearer tokens, signed JWTs or with bcrypt hashed passwords from htpasswd-style files
+type authenticator struct {
+	passwords map[string]passwordEntry
+	tokens    map[[sha256.Size]byte]credential
+	jwt       *jwtVerifier
+
+	// Passwords that have already been verified, as bcrypt is deliberately slow and every API call is authenticated
+	verified map[[sha256.Size]byte]credential
+	failures map[string]*authFailures
+	mu       sync.Mutex
+}
+
+// Loads the credentials from an htpasswd file with "NAME:BCRYPT_HASH" lines and a tokens file with
+// "NAME:TOKEN" lines, both optional, where an additional ":RULE_SET" field maps the credential to a rule set.
+// JWTs are accepted if a JWKS is given, and mapped to rule sets by the claim rules
+func newAuthenticator(htpasswdPath string, tokensPath string, jwks string, jwtClaims []JwtClaimRule) (*authenticator, error) {
+	auth := &authenticator{
+		passwords: make(map[string]passwordEntry),
+		tokens:    make(map[[sha256.Size]byte]credential),
+		verified:  make(map[[sha256.Size]byte]credential),
+		failures:  make(map[string]*authFailures),
+	}
+
+	if htpasswdPath != "" {
+		err := readCredentials(htpasswdPath, func(cred credential, secret string) error {
+			if _, err := bcrypt.Cost([]byte(secret)); err != nil {
+				return fmt.Errorf("unsupported password hash for %s, only bcrypt is supported", cred.name)
+			}
+			if _, ok := auth.passwords[cred.name]; ok {
+				return fmt.Errorf("duplicate user: %s", cred.name)
+			}
+			auth.passwords[cred.name] = passwordEntry{cred, []byte(secret)}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if tokensPath != "" {
+		err := readCredentials(tokensPath, func(cred credential, secret string) error {
+			digest := sha256.Sum256([]byte(secret))
+			if _, ok := auth.tokens[digest]; ok {
+				return fmt.Errorf("duplicate token: %s", cred.name)
+			}
+			auth.tokens[digest] = cred
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if jwks != "" {
+		var err error
+		auth.jwt, err = newJwtVerifier(jwks, jwtClaims)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return auth, nil
+}
+
+func readCredentials(path string, add func(cred credential, secret string) error) error {
+	file, err := os.Open(filepath.Clean(path))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Split(line, ":")
+		if len(fields) < 2 || len(fields) > 3 || fields[0] == "" || fields[1] == "" {
+			return fmt.Errorf("invalid credentials line %s:%d", path, n)
+		}
+		cred := credential{name: fields[0]}
+		if len(fields) == 3 {
+			cred.ruleSet = fields[2]
+		}
+		if err := add(cred, fields[1]); err != nil {
+			return fmt.Errorf("invalid credentials line %s:%d: %w", path, n, err)
+		}
+	}
+
+	return scanner.Err()
+}
+
+// Returns a nil credential if the request does not have an Authorization header
+func (auth *authenticator) authenticate(req *http.Request) (*credential, error) {
+	header := req.Header.Get("Authorization")
+	if header == "" {
+		return nil, nil
+	}
+
+	scheme, val, _ := strings.Cut(header, " ")
+	switch strings.ToLower(scheme) {
+	case "bearer":
+		token := strings.TrimSpace(val)
+		if cred, ok := auth.tokens[sha256.Sum256([]byte(token))]; ok {
+			return &cred, nil
+		}
+		if auth.jwt != nil && strings.Count(token, ".") == 2 {
+			return auth.jwt.verify(token, time.Now())
+		}
+		return nil, errors.New("invalid token")
+	case "basic":
+		user, password, ok := req.BasicAuth()
+		if !ok {
+			return nil, errors.New("malformed credentials")
+		}
+		entry, ok := auth.passwords[user]
+		if !ok {
+			return nil, fmt.Errorf("unknown user: %s", user)
+		}
+
+		digest := sha256.Sum256([]byte(user + "\x00" + password))
+		auth.mu.Lock()
+		cred, ok := auth.verified[digest]
+		auth.mu.Unlock()
+		if ok {
+			return &cred, nil
+		}
+
+		if err := bcrypt.CompareHashAndPassword(entry.hash, []byte(password)); err != nil {
+			return nil, fmt.Errorf("invalid password for user: %s", user)
+		}
+		auth.mu.Lock()
+		auth.verified[digest] = entry.credential
+		auth.mu.Unlock()
+		return &entry.credential, nil
+	default:
+		return nil, fmt.Errorf("unsupported authorization scheme: %s", scheme)
+	}
+}
+
+// Reports whether the client has exceeded the failed attempts allowed within the window
+func (auth *authenticator) blocked(client string, now time.Time) bool {
+	auth.mu.Lock()
+	defer auth.mu.Unlock()
+
+	f, ok := auth.failures[client]
+	return ok && now.Sub(f.first) < authFailureWindow && f.count >= authMaxFailures
+}
+
+func (auth *authenticator) fail(client string, now time.Time) {
+	auth.mu.Lock()
+	defer auth.mu.Unlock()
+
+	for k, f := range auth.failures {
+		if now.Sub(f.first) >= authFailureWindow {
+			delete(auth.failures, k)
+		}
+	}
+
+	f, ok := auth.failures[client]
+	if !ok {
+		f = &authFailures{first: now}
+		auth.failures[client] = f
+	}
+	f.count++
+}
+
+func (auth *authenticator) challenge(wri http.ResponseWriter) {
+	if len(auth.passwords) > 0 {
+		wri.Header().Add("WWW-Authenticate", `Basic realm="cetusguard"`)
+	}
+	if len(auth.tokens) > 0 || auth.jwt != nil {
+		wri.Header().Add("WWW-Authenticate", `Bearer realm="cetusguard"`)
+	}
+}
+
+// Returns the filter rules that apply to the request, or writes an error response if it is not authenticated.
+// Clients are identified by their credentials or by a verified certificate, in that order, and TLS clients
+// without either only get the anonymous rules, if there are any
+func (cg *Server) requestRules(wri http.ResponseWriter, req *http.Request) ([]Rule, bool) {
+	if cg.auth != nil {
+		// Clients are identified as for rate limiting, so that the clients of a Unix socket listener
+		// are not blocked by the failures of another user, except where the peer user ID is not available
+		client := clientIdentity(req)
+		now := time.Now()
+		if req.Header.Get("Authorization") != "" && cg.auth.blocked(client, now) {
+			logger.Warningf("rate limited request %s from %s: too many failed authentication attempts\n", requestId(req), req.RemoteAddr)
+			wri.WriteHeader(http.StatusTooManyRequests)
+			return nil, false
+		}
+
+		cred, err := cg.auth.authenticate(req)
+		if err != nil {
+			cg.auth.fail(client, now)
+			logger.Warningf("failed authentication for request %s from %s: %v\n", requestId(req), req.RemoteAddr, err)
+			cg.auth.challenge(wri)
+			wri.WriteHeader(http.StatusUnauthorized)
+			return nil, false
+		}
+		// The credentials are not meant for the daemon
+		req.Header.Del("Authorization")
+
+		if cred != nil {
+			logger.Debugf("authenticated request %s as %s\n", requestId(req), cred.name)
+			if cred.ruleSet != "" {
+				return cg.RuleSets[cred.ruleSet], true
+			}
+			return cg.Rules, true
+		}
+	}
+
+	if clientCertificate(req) != nil {
+		return cg.Rules, true
+	}
+
+	// Requests received over a TLS listener without a client certificate are only allowed by the anonymous rules
+	if len(cg.AnonymousRules) > 0 && req.TLS != nil {
+		logger.Debugf("anonymous request %s from %s\n", requestId(req), req.RemoteAddr)
+		return cg.AnonymousRules, true
+	}
+
+	if cg.auth != nil {
+		logger.Warningf("unauthenticated request %s from %s\n", requestId(req), req.RemoteAddr)
+		cg.auth.challenge(wri)
+		wri.WriteHeader(http.StatusUnauthorized)
+		return nil, false
+	}
+
+	return cg.Rules, true
+}
+
+// Checks that the credentials only refer to rule sets that exist
+func (auth *authenticator) checkRuleSets(ruleSets map[string][]Rule) error {
+	var creds []credential
+	for _, entry := range auth.passwords {
+		creds = append(creds, entry.credential)
+	}
+	for _, cred := range auth.tokens {
+		creds = append(creds, cred)
+	}
+	if auth.jwt != nil {
+		for _, rule := range auth.jwt.rules {
+			creds = append(creds, credential{name: "JWT claim rule " + rule.String(), ruleSet: rule.RuleSet})
+		}
+	}
+
+	for _, cred := range creds {
+		if _, ok := ruleSets[cred.ruleSet]; cred.ruleSet != "" && !ok {
+			return fmt.Errorf("unknown rule set for %s: %s", cred.name, cred.ruleSet)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+package cetusguard
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func writeAuthFiles(t *testing.T, htpasswd string, tokens string) (string, string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	htpasswdPath := filepath.Join(dir, "htpasswd")
+	tokensPath := filepath.Join(dir, "tokens")
+	if err := os.WriteFile(htpasswdPath, []byte(htpasswd), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(tokensPath, []byte(tokens), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return htpasswdPath, tokensPath
+}
+
+func TestAuthenticate(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("s3cret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	htpasswdPath, tokensPath := writeAuthFiles(t,
+		"# users\nalice:"+string(hash)+"\n\nbob:"+string(hash)+":readonly\n",
+		"ci:ci-token\nmonitor:monitor-token:readonly\n",
+	)
+	auth, err := newAuthenticator(htpasswdPath, tokensPath, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		header  string
+		name    string
+		ruleSet string
+		fails   bool
+	}{
+		{"", "", "", false},
+		{"Bearer ci-token", "ci", "", false},
+		{"bearer monitor-token", "monitor", "readonly", false},
+		{"Bearer unknown-token", "", "", true},
+		{"Basic YWxpY2U6czNjcmV0", "alice", "", false},
+		{"Basic YWxpY2U6czNjcmV0", "alice", "", false},
+		{"Basic Ym9iOnMzY3JldA==", "bob", "readonly", false},
+		{"Basic YWxpY2U6d3Jvbmc=", "", "", true},
+		{"Basic bWFsbG9yeTpzM2NyZXQ=", "", "", true},
+		{"Basic !!!", "", "", true},
+		{"Digest username=alice", "", "", true},
+	}
+
+	for _, c := range testCases {
+		req, err := http.NewRequest("GET", "http://localhost/_ping", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.header != "" {
+			req.Header.Set("Authorization", c.header)
+		}
+
+		cred, err := auth.authenticate(req)
+		if c.fails {
+			if err == nil {
+				t.Errorf("%q: authenticated as %v, want an error", c.header, cred)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", c.header, err)
+			continue
+		}
+		if c.name == "" {
+			if cred != nil {
+				t.Errorf("%q: cred = %v, want nil", c.header, cred)
+			}
+			continue
+		}
+		if cred == nil || cred.name != c.name || cred.ruleSet != c.ruleSet {
+			t.Errorf("%q: cred = %v, want {%s %s}", c.header, cred, c.name, c.ruleSet)
+		}
+	}
+
+	if err := auth.checkRuleSets(map[string][]Rule{}); err == nil {
+		t.Errorf("unknown rule set accepted, want an error")
+	}
+	if err := auth.checkRuleSets(map[string][]Rule{"readonly": nil}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestInvalidCredentialFiles(t *testing.T) {
+	testCases := []struct {
+		htpasswd string
+		tokens   string
+	}{
+		{"alice:$apr1$abcdefgh$0123456789abcdefghijkl\n", ""},
+		{"alice\n", ""},
+		{"", ":token\n"},
+		{"", "ci:\n"},
+		{"", "ci:token:readonly:extra\n"},
+		{"", "ci:token\nother:token\n"},
+	}
+
+	for _, c := range testCases {
+		htpasswdPath, tokensPath := writeAuthFiles(t, c.htpasswd, c.tokens)
+		if _, err := newAuthenticator(htpasswdPath, tokensPath, "", nil); err == nil {
+			t.Errorf("%q %q: authenticator created, want an error", c.htpasswd, c.tokens)
+		}
+	}
+
+	if _, err := newAuthenticator(filepath.Join(t.TempDir(), "missing"), "", "", nil); err == nil {
+		t.Errorf("authenticator created from a missing file, want an error")
+	}
+}
+
+func TestAuthFailureRateLimit(t *testing.T) {
+	auth, err := newAuthenticator("", "", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	for i := 0; i < authMaxFailures; i++ {
+		if auth.blocked("10.0.0.1", now) {
+			t.Fatalf("client blocked after %d failures, want %d", i, authMaxFailures)
+		}
+		auth.fail("10.0.0.1", now)
+	}
+
+	if !auth.blocked("10.0.0.1", now) {
+		t.Errorf("client not blocked after %d failures", authMaxFailures)
+	}
+	if auth.blocked("10.0.0.2", now) {
+		t.Errorf("other client blocked")
+	}
+	if auth.blocked("10.0.0.1", now.Add(authFailureWindow)) {
+		t.Errorf("client blocked after the failure window")
+	}
+}
+
+func TestAuthFailureRateLimitUnixClients(t *testing.T) {
+	_, tokensPath := writeAuthFiles(t, "", "alice:secret\n")
+	auth, err := newAuthenticator("", tokensPath, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cg := &Server{auth: auth}
+
+	request := func(uid int, token string) int {
+		req := httptest.NewRequest("GET", "/_ping", nil)
+		req.RemoteAddr = "@"
+		req = req.WithContext(context.WithValue(req.Context(), contextUidKey{}, uid))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		if _, ok := cg.requestRules(rec, req); ok {
+			return http.StatusOK
+		}
+		return rec.Code
+	}
+
+	for i := 0; i < authMaxFailures; i++ {
+		request(1000, "wrong")
+	}
+	if code := request(1000, "secret"); code != http.StatusTooManyRequests {
+		t.Errorf("blocked client: status = %d, want %d", code, http.StatusTooManyRequests)
+	}
+	// Other users of the same Unix socket are not blocked
+	if code := request(1001, "secret"); code != http.StatusOK {
+		t.Errorf("other client: status = %d, want %d", code, http.StatusOK)
+	}
+}
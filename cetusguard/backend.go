@@ -0,0 +1,327 @@
+package cetusguard
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hectorm/cetusguard/internal/logger"
+)
+
+const (
+	defaultBackendHealthCheckInterval = 10 * time.Second
+	backendHealthCheckTimeout         = 5 * time.Second
+)
+
+// Container daemon that requests can be forwarded to
+type backendTarget struct {
+	addr       string
+	proto      string
+	host       string
+	tlsConfig  *tls.Config
+	httpClient *http.Client
+	sshDialer  *sshDialer
+	healthy    atomic.Bool
+}
+
+func newBackendTarget(addr string, tlsConfig *tls.Config) (*backendTarget, error) {
+	bt := &backendTarget{
+		addr:      addr,
+		tlsConfig: tlsConfig,
+	}
+	bt.healthy.Store(true)
+
+	var dial func(ctx context.Context) (net.Conn, error)
+	if isSshAddr(addr) {
+		// The daemon socket is reached through the SSH connection, so TLS is not used
+		sd, err := newSshDialer(addr)
+		if err != nil {
+			return nil, err
+		}
+		bt.proto = "ssh"
+		bt.host = sd.host
+		bt.tlsConfig = nil
+		bt.sshDialer = sd
+		dial = sd.DialContext
+	} else {
+		proto, host, err := parseAddr(addr)
+		if err != nil {
+			return nil, err
+		}
+		bt.proto = proto
+		bt.host = host
+
+		dialer := &net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 90 * time.Second,
+		}
+		dial = func(ctx context.Context) (net.Conn, error) {
+			return dialer.DialContext(ctx, bt.proto, bt.host)
+		}
+	}
+
+	bt.httpClient = &http.Client{
+		Timeout: 30 * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig:       bt.tlsConfig,
+			MaxIdleConns:          10,
+			MaxIdleConnsPerHost:   10,
+			TLSHandshakeTimeout:   10 * time.Second,
+			IdleConnTimeout:       90 * time.Second,
+			ExpectContinueTimeout: 1 * time.Second,
+			DialContext: func(ctx context.Context, _ string, _ string) (net.Conn, error) {
+				return dial(ctx)
+			},
+		},
+	}
+
+	return bt, nil
+}
+
+// Points the request to this backend
+func (bt *backendTarget) direct(req *http.Request) {
+	if bt.tlsConfig != nil {
+		req.URL.Scheme = "https"
+	} else {
+		req.URL.Scheme = "http"
+	}
+	if bt.proto == "unix" || bt.proto == "ssh" {
+		req.URL.Host = "localhost"
+	} else {
+		req.URL.Host = bt.host
+	}
+}
+
+func (bt *backendTarget) check(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, backendHealthCheckTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "/_ping", nil)
+	if err != nil {
+		return err
+	}
+	bt.direct(req)
+
+	res, err := bt.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = res.Body.Close()
+	}()
+	_, _ = io.Copy(io.Discard, res.Body)
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code: %d", res.StatusCode)
+	}
+	return nil
+}
+
+// Updates the health state of the backend and logs its changes
+func (bt *backendTarget) setHealthy(healthy bool, err error) {
+	if bt.healthy.Swap(healthy) == healthy {
+		return
+	}
+	if healthy {
+		logger.Infof("backend %s is healthy\n", bt.addr)
+	} else {
+		logger.Warningf("backend %s is unhealthy: %v\n", bt.addr, err)
+	}
+}
+
+// Set of interchangeable backends, requests are forwarded to the first healthy one
+// unless the client is pinned to another healthy backend
+type backendPool struct {
+	targets             []*backendTarget
+	tlsFiles            *tlsFiles
+	healthCheckInterval time.Duration
+	affinityTtl         time.Duration
+	affinity            map[string]backendAffinity
+	stopCh              chan struct{}
+	stopOnce            sync.Once
+	wg                  sync.WaitGroup
+	mu                  sync.Mutex
+}
+
+type backendAffinity struct {
+	target   *backendTarget
+	lastUsed time.Time
+}
+
+// Returns the address of the backend followed by its failover addresses
+func (backend *Backend) addrs() []string {
+	var addrs []string
+	if backend.Addr != "" {
+		addrs = append(addrs, backend.Addr)
+	}
+	return append(addrs, backend.FailoverAddr...)
+}
+
+func newBackendPool(backend *Backend) (*backendPool, error) {
+	addrs := backend.addrs()
+	if len(addrs) == 0 {
+		return nil, errors.New("no backend address specified")
+	}
+
+	tlsConfig, tf, err := clientTlsConfig(backend)
+	if err != nil {
+		return nil, err
+	}
+
+	bp := &backendPool{
+		tlsFiles:            tf,
+		healthCheckInterval: backend.HealthCheckInterval,
+		affinityTtl:         backend.AffinityTtl,
+		stopCh:              make(chan struct{}),
+	}
+	if bp.healthCheckInterval <= 0 {
+		bp.healthCheckInterval = defaultBackendHealthCheckInterval
+	}
+	for _, addr := range addrs {
+		bt, err := newBackendTarget(addr, tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+		bp.targets = append(bp.targets, bt)
+	}
+
+	return bp, nil
+}
+
+// Returns the backends in the order they should be tried for the given client:
+// the pinned backend if it is healthy, then the healthy ones and finally the unhealthy ones
+func (bp *backendPool) candidates(client string) []*backendTarget {
+	candidates := make([]*backendTarget, 0, len(bp.targets))
+
+	if bp.affinityTtl > 0 {
+		bp.mu.Lock()
+		entry, ok := bp.affinity[client]
+		bp.mu.Unlock()
+		if ok && entry.target.healthy.Load() && time.Since(entry.lastUsed) < bp.affinityTtl {
+			candidates = append(candidates, entry.target)
+		}
+	}
+
+	for _, healthy := range []bool{true, false} {
+		for _, bt := range bp.targets {
+			if bt.healthy.Load() == healthy && (len(candidates) == 0 || candidates[0] != bt) {
+				candidates = append(candidates, bt)
+			}
+		}
+	}
+
+	return candidates
+}
+
+// Pins the client to the given backend if affinity is enabled
+func (bp *backendPool) pin(client string, bt *backendTarget) {
+	if bp.affinityTtl <= 0 {
+		return
+	}
+
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+
+	now := time.Now()
+	if bp.affinity == nil {
+		bp.affinity = make(map[string]backendAffinity)
+	}
+	for k, v := range bp.affinity {
+		if now.Sub(v.lastUsed) >= bp.affinityTtl {
+			delete(bp.affinity, k)
+		}
+	}
+	bp.affinity[client] = backendAffinity{target: bt, lastUsed: now}
+}
+
+// Periodically checks the health of every backend until the pool is stopped,
+// there is nothing to fail over to with a single backend, so it is not checked
+func (bp *backendPool) startHealthChecks() {
+	if len(bp.targets) < 2 {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	bp.wg.Add(1)
+	go func() {
+		defer bp.wg.Done()
+		defer cancel()
+
+		ticker := time.NewTicker(bp.healthCheckInterval)
+		defer ticker.Stop()
+
+		for {
+			bp.checkAll(ctx)
+			select {
+			case <-bp.stopCh:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	go func() {
+		<-bp.stopCh
+		cancel()
+	}()
+}
+
+func (bp *backendPool) checkAll(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, bt := range bp.targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := bt.check(ctx)
+			if ctx.Err() != nil {
+				return
+			}
+			bt.setHealthy(err == nil, err)
+		}()
+	}
+	wg.Wait()
+}
+
+func (bp *backendPool) stop() {
+	bp.stopOnce.Do(func() { close(bp.stopCh) })
+	bp.wg.Wait()
+}
+
+func (bp *backendPool) closeIdleConnections() {
+	for _, bt := range bp.targets {
+		bt.httpClient.CloseIdleConnections()
+	}
+}
+
+// Closes the connections shared by the backends, it must be called once no requests are in flight
+func (bp *backendPool) close() {
+	for _, bt := range bp.targets {
+		if bt.sshDialer != nil {
+			_ = bt.sshDialer.Close()
+		}
+	}
+}
+
+// Reports whether the request could not reach the backend at all,
+// so it can be safely retried on another one
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// Identifies the client for backend affinity purposes
+func clientKey(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,120 @@
+package cetusguard
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBackendPoolCandidates(t *testing.T) {
+	bp, err := newBackendPool(&Backend{Addr: "tcp://127.0.0.1:1", FailoverAddr: []string{"tcp://127.0.0.1:2", "tcp://127.0.0.1:3"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bp.targets[0].setHealthy(false, nil)
+
+	wanted := []string{"127.0.0.1:2", "127.0.0.1:3", "127.0.0.1:1"}
+	candidates := bp.candidates("client")
+	if len(candidates) != len(wanted) {
+		t.Fatalf("len(candidates) = %d, want %d", len(candidates), len(wanted))
+	}
+	for i, bt := range candidates {
+		if bt.host != wanted[i] {
+			t.Errorf(`candidates[%d] = "%s", want "%s"`, i, bt.host, wanted[i])
+		}
+	}
+
+	// Without affinity the client is never pinned
+	bp.pin("client", bp.targets[2])
+	if bt := bp.candidates("client")[0]; bt != bp.targets[1] {
+		t.Errorf(`candidates[0] = "%s", want "%s"`, bt.host, bp.targets[1].host)
+	}
+}
+
+func TestBackendPoolAffinity(t *testing.T) {
+	bp, err := newBackendPool(&Backend{Addr: "tcp://127.0.0.1:1", FailoverAddr: []string{"tcp://127.0.0.1:2"}, AffinityTtl: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The client was failed over to the second backend and must stay there after the first one recovers
+	bp.pin("client", bp.targets[1])
+	if bt := bp.candidates("client")[0]; bt != bp.targets[1] {
+		t.Errorf(`candidates[0] = "%s", want "%s"`, bt.host, bp.targets[1].host)
+	}
+	if bt := bp.candidates("other")[0]; bt != bp.targets[0] {
+		t.Errorf(`candidates[0] = "%s", want "%s"`, bt.host, bp.targets[0].host)
+	}
+	if n := len(bp.candidates("client")); n != 2 {
+		t.Errorf("len(candidates) = %d, want %d", n, 2)
+	}
+
+	// The pinned backend is skipped while it is unhealthy
+	bp.targets[1].setHealthy(false, nil)
+	if bt := bp.candidates("client")[0]; bt != bp.targets[0] {
+		t.Errorf(`candidates[0] = "%s", want "%s"`, bt.host, bp.targets[0].host)
+	}
+	bp.targets[1].setHealthy(true, nil)
+
+	// The pin expires after the TTL
+	time.Sleep(150 * time.Millisecond)
+	if bt := bp.candidates("client")[0]; bt != bp.targets[0] {
+		t.Errorf(`candidates[0] = "%s", want "%s"`, bt.host, bp.targets[0].host)
+	}
+}
+
+func TestBackendPoolHealthChecks(t *testing.T) {
+	var failing atomic.Bool
+	failing.Store(true)
+
+	healthy := httptest.NewServer(http.HandlerFunc(func(wri http.ResponseWriter, req *http.Request) {
+		wri.WriteHeader(http.StatusOK)
+	}))
+	defer healthy.Close()
+
+	unhealthy := httptest.NewServer(http.HandlerFunc(func(wri http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/_ping" || failing.Load() {
+			wri.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		wri.WriteHeader(http.StatusOK)
+	}))
+	defer unhealthy.Close()
+
+	toAddr := func(url string) string { return strings.Replace(url, "http://", "tcp://", 1) }
+	bp, err := newBackendPool(&Backend{Addr: toAddr(unhealthy.URL), FailoverAddr: []string{toAddr(healthy.URL)}, HealthCheckInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bp.checkAll(context.Background())
+	if bp.targets[0].healthy.Load() || !bp.targets[1].healthy.Load() {
+		t.Fatalf("healthy = [%t %t], want [%t %t]", bp.targets[0].healthy.Load(), bp.targets[1].healthy.Load(), false, true)
+	}
+
+	failing.Store(false)
+	bp.startHealthChecks()
+	defer bp.stop()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !bp.targets[0].healthy.Load() {
+		if time.Now().After(deadline) {
+			t.Fatalf("backend unhealthy, want healthy")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestNewBackendPoolInvalid(t *testing.T) {
+	if _, err := newBackendPool(&Backend{}); err == nil {
+		t.Errorf("pool created, want an error")
+	}
+	if _, err := newBackendPool(&Backend{Addr: "tcp://127.0.0.1:1", FailoverAddr: []string{"invalid"}}); err == nil {
+		t.Errorf("pool created, want an error")
+	}
+}
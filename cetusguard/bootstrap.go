@@ -0,0 +1,184 @@
+package cetusguard
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/hectorm/cetusguard/internal/logger"
+)
+
+const (
+	// Same validity as the certificates generated by examples/compose/mkcerts.sh
+	bootstrapCertValidity = 7300 * 24 * time.Hour
+)
+
+// Paths of the files generated in a bootstrap directory, laid out as examples/compose/mkcerts.sh does,
+// so that the client directory can be used as DOCKER_CERT_PATH
+type tlsBootstrap struct {
+	dir string
+}
+
+func (tb tlsBootstrap) path(elem ...string) string {
+	return filepath.Join(append([]string{tb.dir}, elem...)...)
+}
+
+// Generates the CA, server and client certificates that do not exist yet in the directory,
+// the server certificate is valid for the local host and the hosts of the frontend addresses
+func bootstrapTls(dir string, frontendAddrs []string) (*tlsBootstrap, error) {
+	tb := &tlsBootstrap{dir: dir}
+
+	for _, sub := range []string{"ca", "server", "client"} {
+		if err := os.MkdirAll(tb.path(sub), 0700); err != nil {
+			return nil, fmt.Errorf("error creating TLS bootstrap directory: %w", err)
+		}
+	}
+
+	ca, err := tb.loadOrCreate("ca", nil, func(template *x509.Certificate) {
+		template.Subject = pkix.Name{CommonName: "CetusGuard CA"}
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+		template.BasicConstraintsValid = true
+		template.IsCA = true
+		template.MaxPathLenZero = true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	dnsNames, ipAddresses := bootstrapServerNames(frontendAddrs)
+	if _, err := tb.loadOrCreate("server", ca, func(template *x509.Certificate) {
+		template.Subject = pkix.Name{CommonName: "CetusGuard server"}
+		template.KeyUsage = x509.KeyUsageDigitalSignature
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		template.DNSNames = dnsNames
+		template.IPAddresses = ipAddresses
+	}); err != nil {
+		return nil, err
+	}
+
+	if _, err := tb.loadOrCreate("client", ca, func(template *x509.Certificate) {
+		template.Subject = pkix.Name{CommonName: "CetusGuard client"}
+		template.KeyUsage = x509.KeyUsageDigitalSignature
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	}); err != nil {
+		return nil, err
+	}
+
+	return tb, nil
+}
+
+// Loads the certificate and key of the subdirectory, or generates them signed by the given CA,
+// or self-signed if it is nil, when any of them is missing
+func (tb tlsBootstrap) loadOrCreate(sub string, ca *tls.Certificate, configure func(template *x509.Certificate)) (*tls.Certificate, error) {
+	certPath, keyPath := tb.path(sub, "cert.pem"), tb.path(sub, "key.pem")
+
+	_, certErr := os.Stat(certPath)
+	_, keyErr := os.Stat(keyPath)
+	if certErr == nil && keyErr == nil {
+		cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+		if err != nil {
+			return nil, fmt.Errorf("error loading TLS bootstrap certificate: %w", err)
+		}
+		return &cert, nil
+	}
+	if !errors.Is(certErr, os.ErrNotExist) && certErr != nil {
+		return nil, certErr
+	}
+	if !errors.Is(keyErr, os.ErrNotExist) && keyErr != nil {
+		return nil, keyErr
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(bootstrapCertValidity),
+	}
+	configure(template)
+
+	parent, signer := template, any(key)
+	if ca != nil {
+		parent, signer = ca.Leaf, ca.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	if err != nil {
+		return nil, err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+
+	// The key is written first, so that a certificate is never left without its key
+	if err := os.WriteFile(keyPath, keyPem, 0600); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(certPath, certPem, 0600); err != nil {
+		return nil, err
+	}
+	if ca != nil {
+		caPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Leaf.Raw})
+		if err := os.WriteFile(tb.path(sub, "ca.pem"), caPem, 0600); err != nil {
+			return nil, err
+		}
+	}
+	logger.Infof("generated TLS bootstrap certificate %s\n", certPath)
+
+	cert, err := tls.X509KeyPair(certPem, keyPem)
+	if err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+func bootstrapServerNames(frontendAddrs []string) ([]string, []net.IP) {
+	dnsNames := []string{"localhost"}
+	ipAddresses := []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}
+	if hostname, err := os.Hostname(); err == nil && hostname != "" {
+		dnsNames = append(dnsNames, hostname)
+	}
+
+	for _, addr := range frontendAddrs {
+		proto, host, err := parseAddr(addr)
+		if err != nil || proto == "unix" {
+			continue
+		}
+		host, _, err = net.SplitHostPort(host)
+		if err != nil || host == "" {
+			continue
+		}
+		if ip := net.ParseIP(host); ip != nil {
+			if !ip.IsUnspecified() && !slices.ContainsFunc(ipAddresses, ip.Equal) {
+				ipAddresses = append(ipAddresses, ip)
+			}
+		} else if !slices.Contains(dnsNames, host) {
+			dnsNames = append(dnsNames, host)
+		}
+	}
+
+	return dnsNames, ipAddresses
+}
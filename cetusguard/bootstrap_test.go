@@ -0,0 +1,109 @@
+package cetusguard
+
+import (
+	"bytes"
+	"crypto/x509"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestBootstrapTls(t *testing.T) {
+	tmpdir := t.TempDir()
+
+	tb, err := bootstrapTls(tmpdir, []string{"tcp://10.0.0.1:2376", "tcp://proxy.example.com:2376", "tcp://0.0.0.0:2375", "unix:///run/cetusguard.sock"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{
+		"ca/cert.pem", "ca/key.pem",
+		"server/cert.pem", "server/key.pem", "server/ca.pem",
+		"client/cert.pem", "client/key.pem", "client/ca.pem",
+	} {
+		fileInfo, err := os.Stat(tb.path(path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if perm := fileInfo.Mode().Perm(); perm != 0600 {
+			t.Errorf("%s: perm = %o, want %o", path, perm, 0600)
+		}
+	}
+
+	cacertPem, err := os.ReadFile(tb.path("ca", "cert.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cacertPool := x509.NewCertPool()
+	cacertPool.AddCert(parseTestCert(t, cacertPem))
+
+	serverCertPem, err := os.ReadFile(tb.path("server", "cert.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverCert := parseTestCert(t, serverCertPem)
+	for _, name := range []string{"localhost", "127.0.0.1", "10.0.0.1", "proxy.example.com"} {
+		opts := x509.VerifyOptions{Roots: cacertPool, DNSName: name, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}}
+		if _, err := serverCert.Verify(opts); err != nil {
+			t.Errorf("%s: err = %v, want nil", name, err)
+		}
+	}
+	if slices.ContainsFunc(serverCert.IPAddresses, net.IPv4zero.Equal) {
+		t.Errorf("IP addresses = %v, want the unspecified address to be excluded", serverCert.IPAddresses)
+	}
+
+	clientCertPem, err := os.ReadFile(tb.path("client", "cert.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := x509.VerifyOptions{Roots: cacertPool, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}
+	if _, err := parseTestCert(t, clientCertPem).Verify(opts); err != nil {
+		t.Errorf("err = %v, want nil", err)
+	}
+
+	// The files are kept on later starts
+	if _, err := bootstrapTls(tmpdir, nil); err != nil {
+		t.Fatal(err)
+	}
+	newCacertPem, err := os.ReadFile(tb.path("ca", "cert.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(newCacertPem, cacertPem) {
+		t.Errorf("CA certificate regenerated, want it to be kept")
+	}
+
+	// Missing certificates are generated with the existing CA
+	if err := os.Remove(tb.path("client", "cert.pem")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bootstrapTls(tmpdir, nil); err != nil {
+		t.Fatal(err)
+	}
+	clientCertPem, err = os.ReadFile(tb.path("client", "cert.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseTestCert(t, clientCertPem).Verify(opts); err != nil {
+		t.Errorf("err = %v, want nil", err)
+	}
+}
+
+func TestBootstrapTlsInvalid(t *testing.T) {
+	tmpdir := t.TempDir()
+
+	if err := os.MkdirAll(filepath.Join(tmpdir, "ca"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"cert.pem", "key.pem"} {
+		if err := os.WriteFile(filepath.Join(tmpdir, "ca", name), []byte("invalid"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := bootstrapTls(tmpdir, nil); err == nil {
+		t.Errorf("certificates bootstrapped, want an error")
+	}
+}
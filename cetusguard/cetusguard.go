@@ -1,19 +1,25 @@
 package cetusguard
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
 	"crypto/tls"
-	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
 	"os"
 	"os/signal"
 	"path"
-	"path/filepath"
+	"slices"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -21,16 +27,28 @@ import (
 	"time"
 
 	"github.com/hectorm/cetusguard/internal/logger"
+	"github.com/hectorm/cetusguard/internal/utils/metrics"
 	"github.com/hectorm/cetusguard/internal/utils/middleware"
+	"github.com/hectorm/cetusguard/internal/utils/netcopy"
 )
 
 const (
 	minTlsVersion = tls.VersionTLS12
 )
 
+const (
+	// Same as the delay used by net/http to avoid sending a TCP RST on close
+	hijackCloseDelay = 500 * time.Millisecond
+	// Maximum time that the data of a non-interactive response is buffered before being flushed
+	batchedFlushInterval = 100 * time.Millisecond
+	// Size of the reads used to forward the data buffered by the backend transport for an upgraded connection
+	upgradeDrainSize = 64 * 1024
+)
+
 const (
 	mediaTypeRawStream         = "application/vnd.docker.raw-stream"
 	mediaTypeMultiplexedStream = "application/vnd.docker.multiplexed-stream"
+	mediaTypeTar               = "application/x-tar"
 )
 
 type Backend struct {
@@ -38,6 +56,18 @@ type Backend struct {
 	TlsCacert string
 	TlsCert   string
 	TlsKey    string
+	// Name used to verify the daemon certificate instead of the host of its address
+	TlsServerName string
+	// SHA-256 digests of the public keys the daemon certificate must have, in sha256//BASE64 format
+	TlsPin []string
+	// Minimum TLS version, "1.2" or "1.3"
+	TlsMinVersion string
+	// Names of the TLS 1.2 cipher suites that can be negotiated
+	TlsCipherSuites []string
+	// Addresses of other daemons that requests fail over to, in order, when the previous ones are unhealthy
+	FailoverAddr        []string
+	HealthCheckInterval time.Duration
+	AffinityTtl         time.Duration
 }
 
 type Frontend struct {
@@ -45,22 +75,98 @@ type Frontend struct {
 	TlsCacert string
 	TlsCert   string
 	TlsKey    string
+	// Paths to the CRLs of the CA, in PEM or DER format
+	TlsCrl []string
+	// Client certificates that are rejected, in "serial:HEX" or "sha256:HEX" format
+	TlsDeny []string
+	// Verified client certificates that may connect, any of them if empty
+	TlsAllow []TlsAllowRule
+	// Use TLS also on Unix socket listeners
+	TlsUnix bool
+	// Directory where a CA, server and client certificates are generated on first start and used afterwards
+	TlsBootstrapDir string
+	// Path to an htpasswd-style file with bcrypt hashed passwords for basic authentication
+	AuthHtpasswd string
+	// Path to a file with tokens for bearer authentication
+	AuthTokens string
+	// Path or URL of a JWKS with the keys used to verify JWTs for bearer authentication
+	AuthJwks string
+	// Claims JWTs must have and the rule sets they are mapped to, required with a JWKS
+	AuthJwtClaims []JwtClaimRule
+	// Networks that clients may connect from on TCP listeners, any of them if empty
+	Acl []AclRule
+	// TCP addresses, as specified in Addr, whose connections start with a PROXY protocol header
+	ProxyProtocol []string
+	// Networks of the proxies that may send a PROXY protocol header, required with ProxyProtocol
+	ProxyTrusted []*net.IPNet
 }
 
-type Server struct {
-	Backend  *Backend
-	Frontend *Frontend
-	Rules    []Rule
+type contextKey int
 
-	backendProto      string
-	backendHost       string
-	backendTlsConfig  *tls.Config
-	backendHttpClient *http.Client
+const (
+	requestIdContextKey contextKey = iota
+	listenerContextKey
+)
+
+type Server struct {
+	Backend             *Backend
+	Backends            map[string]*Backend
+	Routes              []Route
+	Frontend            *Frontend
+	Rules               []Rule
+	RecordDir           string
+	SessionMaxLifetime  time.Duration
+	SessionIdleTimeout  time.Duration
+	ShutdownGracePeriod time.Duration
+	// Filter rules for TLS clients that do not present a certificate, which makes client certificates optional
+	AnonymousRules []Rule
+	// Filter rules that credentials can be mapped to instead of the default ones
+	RuleSets map[string][]Rule
+	// Address where metrics are exposed in the Prometheus text format, disabled if empty
+	MetricsAddr string
+	// Requests allowed for each client, unlimited if zero
+	RateLimit Rate
+	// Requests a client can make in a burst above the rate limit, the number of requests of the rate if zero
+	RateLimitBurst int
+	// Requests of each client handled at the same time, unlimited if zero
+	MaxInFlight int
+	// Hijacked connections and exec or attach sessions open at the same time across all clients, unlimited if zero
+	MaxSessions int
+	// Security defaults enforced on the containers that are created, none if nil
+	Hardening *Hardening
+	// Restrictions on the host paths and volumes that containers can mount, none if nil
+	MountPolicy *MountPolicy
+	// Restrictions on the ports that containers can publish and the use of the host network, none if nil
+	PortPolicy *PortPolicy
+	// Restrictions on the images that can be pulled and run, none if nil
+	ImagePolicy *ImagePolicy
+	// Restrictions on the commands, users and environment of exec instances, none if nil
+	ExecPolicy *ExecPolicy
+	// Labels that the containers, volumes and networks used by each client must have, none if empty
+	OwnerRules []OwnerRule
+
+	backendPools map[string]*backendPool
+
+	auth *authenticator
+
+	limiter      *requestLimiter
+	ruleLimiters map[*Rule]*requestLimiter
+
+	policies []requestPolicy
+	owners   map[string]*ownerCache
+
+	metrics         *metrics.Registry
+	metricsListener net.Listener
+	metricsServer   *http.Server
+	tlsWatcher      *tlsWatcher
 
 	frontendNetListeners []net.Listener
 	frontendTlsConfig    *tls.Config
 	frontendHttpServer   *http.Server
 
+	execs    execRegistry
+	sessions *sessionRegistry
+
 	runningState int32
 	mu           sync.Mutex
 }
@@ -79,37 +185,83 @@ func (cg *Server) Start(ready chan<- any) error {
 	defer cg.setIsRunning(false)
 
 	var err error
-	cg.backendProto, cg.backendHost, err = parseAddr(cg.Backend.Addr)
+	cg.backendPools = make(map[string]*backendPool)
+	cg.backendPools[DefaultBackendName], err = newBackendPool(cg.Backend)
 	if err != nil {
 		return err
 	}
+	for name, backend := range cg.Backends {
+		if name == DefaultBackendName {
+			return fmt.Errorf("reserved backend name: %s", name)
+		}
+		cg.backendPools[name], err = newBackendPool(backend)
+		if err != nil {
+			return fmt.Errorf("backend %s: %w", name, err)
+		}
+	}
+	for _, route := range cg.Routes {
+		if _, ok := cg.backendPools[route.Backend]; !ok {
+			return fmt.Errorf("unknown backend in route: %s", route)
+		}
+	}
 
-	cg.backendTlsConfig, err = clientTlsConfig(cg.Backend.TlsCacert, cg.Backend.TlsCert, cg.Backend.TlsKey)
-	if err != nil {
+	if cg.RecordDir != "" {
+		fileInfo, err := os.Stat(cg.RecordDir)
+		if err != nil {
+			return err
+		}
+		if !fileInfo.IsDir() {
+			return fmt.Errorf("stat %s: not a directory", cg.RecordDir)
+		}
+	}
+
+	if err := cg.Hardening.load(); err != nil {
+		return err
+	}
+	if err := cg.MountPolicy.load(); err != nil {
 		return err
 	}
+	if err := cg.PortPolicy.load(); err != nil {
+		return err
+	}
+	if err := cg.ImagePolicy.load(); err != nil {
+		return err
+	}
+	if err := cg.ExecPolicy.load(); err != nil {
+		return err
+	}
+	cg.policies = cg.requestPolicies()
 
-	backendDialer := &net.Dialer{
-		Timeout:   30 * time.Second,
-		KeepAlive: 90 * time.Second,
+	cg.owners = make(map[string]*ownerCache)
+	if len(cg.OwnerRules) > 0 {
+		for name, pool := range cg.backendPools {
+			cg.owners[name] = newOwnerCache(pool)
+		}
 	}
 
-	cg.backendHttpClient = &http.Client{
-		Timeout: 30 * time.Second,
-		Transport: &http.Transport{
-			TLSClientConfig:       cg.backendTlsConfig,
-			MaxIdleConns:          10,
-			MaxIdleConnsPerHost:   10,
-			TLSHandshakeTimeout:   10 * time.Second,
-			IdleConnTimeout:       90 * time.Second,
-			ExpectContinueTimeout: 1 * time.Second,
-			DialContext: func(ctx context.Context, _ string, _ string) (net.Conn, error) {
-				return backendDialer.DialContext(ctx, cg.backendProto, cg.backendHost)
-			},
-		},
+	cg.sessions = &sessionRegistry{}
+	cg.buildLimiters()
+
+	cg.auth = nil
+	if len(cg.Frontend.AuthJwtClaims) > 0 && cg.Frontend.AuthJwks == "" {
+		return errors.New("JWT claim rules require a JWKS")
+	}
+	if cg.Frontend.AuthHtpasswd != "" || cg.Frontend.AuthTokens != "" || cg.Frontend.AuthJwks != "" {
+		cg.auth, err = newAuthenticator(cg.Frontend.AuthHtpasswd, cg.Frontend.AuthTokens, cg.Frontend.AuthJwks, cg.Frontend.AuthJwtClaims)
+		if err != nil {
+			return err
+		}
+		if err := cg.auth.checkRuleSets(cg.RuleSets); err != nil {
+			return err
+		}
+	}
+
+	if err := checkListenerOptions(cg.Frontend); err != nil {
+		return err
 	}
 
 	cg.frontendNetListeners = nil
+	listenerAddrs := make(map[net.Listener]string)
 	for _, addr := range cg.Frontend.Addr {
 		proto, host, err := parseAddr(addr)
 		if err != nil {
@@ -120,6 +272,7 @@ func (cg *Server) Start(ready chan<- any) error {
 			return err
 		}
 		cg.frontendNetListeners = append(cg.frontendNetListeners, l)
+		listenerAddrs[l] = addr
 	}
 	defer func() {
 		for _, l := range cg.frontendNetListeners {
@@ -127,10 +280,31 @@ func (cg *Server) Start(ready chan<- any) error {
 		}
 	}()
 
-	cg.frontendTlsConfig, err = serverTlsConfig(cg.Frontend.TlsCacert, cg.Frontend.TlsCert, cg.Frontend.TlsKey)
+	frontend := cg.Frontend
+	if frontend.TlsBootstrapDir != "" {
+		if frontend.TlsCacert != "" || frontend.TlsCert != "" || frontend.TlsKey != "" {
+			return errors.New("TLS bootstrap directory cannot be used with other frontend TLS certificates")
+		}
+		tb, err := bootstrapTls(frontend.TlsBootstrapDir, frontend.Addr)
+		if err != nil {
+			return err
+		}
+		bootstrapped := *frontend
+		bootstrapped.TlsCacert = tb.path("ca", "cert.pem")
+		bootstrapped.TlsCert = tb.path("server", "cert.pem")
+		bootstrapped.TlsKey = tb.path("server", "key.pem")
+		frontend = &bootstrapped
+		logger.Infof("client TLS certificate bundle in %s\n", tb.path("client"))
+	}
+
+	var frontendTlsFiles *tlsFiles
+	cg.frontendTlsConfig, frontendTlsFiles, err = serverTlsConfig(frontend, len(cg.AnonymousRules) > 0)
 	if err != nil {
 		return err
 	}
+	if cg.frontendTlsConfig == nil && frontend.TlsUnix {
+		return errors.New("TLS on Unix socket listeners requires a certificate")
+	}
 
 	cg.frontendHttpServer = &http.Server{
 		TLSConfig:         cg.frontendTlsConfig,
@@ -139,9 +313,23 @@ func (cg *Server) Start(ready chan<- any) error {
 		WriteTimeout:      120 * time.Minute,
 		IdleTimeout:       90 * time.Second,
 		ErrorLog:          logger.LgrError(),
+		BaseContext: func(l net.Listener) context.Context {
+			return context.WithValue(context.Background(), listenerContextKey, listenerAddrs[l])
+		},
+		ConnContext: connContext,
 		Handler: http.HandlerFunc(func(wri http.ResponseWriter, req *http.Request) {
-			if cg.validateRequest(req) {
-				err := cg.handleValidRequest(wri, req)
+			req = req.WithContext(context.WithValue(req.Context(), requestIdContextKey, newRequestId()))
+			rules, ok := cg.requestRules(wri, req)
+			if !ok {
+				return
+			}
+			if rule, ok := cg.validateRequest(req, rules); ok {
+				release, ok := cg.limitRequest(wri, req, rule)
+				if !ok {
+					return
+				}
+				defer release()
+				err := cg.handleValidRequest(wri, req, rule)
 				if err != nil {
 					logger.Error(err)
 				}
@@ -151,6 +339,54 @@ func (cg *Server) Start(ready chan<- any) error {
 		}),
 	}
 
+	cg.metrics = metrics.NewRegistry()
+
+	watchedTlsFiles := make([]*tlsFiles, 0, len(cg.backendPools)+1)
+	if frontendTlsFiles != nil {
+		watchedTlsFiles = append(watchedTlsFiles, frontendTlsFiles)
+	}
+	for _, pool := range cg.backendPools {
+		if pool.tlsFiles != nil {
+			watchedTlsFiles = append(watchedTlsFiles, pool.tlsFiles)
+		}
+	}
+	cg.tlsWatcher = newTlsWatcher(watchedTlsFiles, cg.metrics)
+	cg.tlsWatcher.start()
+	defer cg.tlsWatcher.stop()
+
+	cg.metricsListener = nil
+	cg.metricsServer = nil
+	if cg.MetricsAddr != "" {
+		proto, host, err := parseAddr(cg.MetricsAddr)
+		if err != nil {
+			return err
+		}
+		cg.metricsListener, err = net.Listen(proto, host)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = cg.metricsListener.Close()
+		}()
+
+		mux := http.NewServeMux()
+		mux.Handle("GET /metrics", cg.metrics)
+		cg.metricsServer = &http.Server{
+			ReadHeaderTimeout: 10 * time.Second,
+			ErrorLog:          logger.LgrError(),
+			Handler:           mux,
+		}
+	}
+
+	for _, pool := range cg.backendPools {
+		pool.startHealthChecks()
+		defer pool.stop()
+	}
+	for _, oc := range cg.owners {
+		oc.start()
+		defer oc.stop()
+	}
+
 	chErr := make(chan error, 1)
 
 	go func() {
@@ -163,19 +399,39 @@ func (cg *Server) Start(ready chan<- any) error {
 		chErr <- cg.Stop()
 	}()
 
+	// The TLS listeners are created here instead of by http.Server.ServeTLS,
+	// so that each one has its own configuration and is known by BaseContext
+	servedListeners := make([]net.Listener, 0, len(cg.frontendNetListeners))
 	for _, l := range cg.frontendNetListeners {
+		addr := listenerAddrs[l]
+		if l.Addr().Network() != "unix" {
+			l = frontendListener(l, cg.Frontend, addr)
+		}
+		if cg.frontendTlsConfig != nil && (l.Addr().Network() != "unix" || cg.Frontend.TlsUnix) {
+			l = tls.NewListener(l, listenerTlsConfig(cg.frontendTlsConfig, cg.Frontend, addr))
+		}
+		listenerAddrs[l] = addr
+		servedListeners = append(servedListeners, l)
+	}
+
+	for _, l := range servedListeners {
 		logger.Infof("serve on %s\n", l.Addr())
-		go func(l net.Listener, srv *http.Server, tls *tls.Config) {
-			var err error
-			if tls != nil && l.Addr().Network() != "unix" {
-				err = srv.ServeTLS(l, "", "")
-			} else {
-				err = srv.Serve(l)
+		go func(l net.Listener, srv *http.Server) {
+			err := srv.Serve(l)
+			if err != http.ErrServerClosed {
+				chErr <- err
 			}
+		}(l, cg.frontendHttpServer)
+	}
+
+	if cg.metricsServer != nil {
+		logger.Infof("serve metrics on %s\n", cg.metricsListener.Addr())
+		go func(l net.Listener, srv *http.Server) {
+			err := srv.Serve(l)
 			if err != http.ErrServerClosed {
 				chErr <- err
 			}
-		}(l, cg.frontendHttpServer, cg.frontendTlsConfig)
+		}(cg.metricsListener, cg.metricsServer)
 	}
 
 	cg.setIsRunning(true)
@@ -194,11 +450,47 @@ func (cg *Server) Stop() error {
 	}
 	defer cg.setIsRunning(false)
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	gracePeriod := cg.ShutdownGracePeriod
+	if gracePeriod <= 0 {
+		gracePeriod = defaultShutdownGracePeriod
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), gracePeriod)
 	defer cancel()
 
-	cg.backendHttpClient.CloseIdleConnections()
-	err := cg.frontendHttpServer.Shutdown(ctx)
+	for _, pool := range cg.backendPools {
+		pool.stop()
+		pool.closeIdleConnections()
+	}
+	for _, oc := range cg.owners {
+		oc.stop()
+	}
+	cg.tlsWatcher.stop()
+	if cg.metricsServer != nil {
+		_ = cg.metricsServer.Close()
+	}
+
+	chErr := make(chan error, 1)
+	go func() {
+		chErr <- cg.frontendHttpServer.Shutdown(ctx)
+	}()
+
+	forced := cg.sessions.drain(ctx)
+	if forced > 0 {
+		logger.Warningf("%d sessions forcibly closed\n", forced)
+	}
+
+	err := <-chErr
+	if errors.Is(err, context.DeadlineExceeded) {
+		// Requests that are still active after the grace period are forcibly closed
+		logger.Warningf("grace period exceeded, closing remaining connections\n")
+		_ = cg.frontendHttpServer.Close()
+		err = nil
+	}
+
+	for _, pool := range cg.backendPools {
+		pool.close()
+	}
 
 	logger.Infof("exit\n")
 	return err
@@ -229,38 +521,71 @@ func (cg *Server) setIsRunning(running bool) {
 	}
 }
 
-func (cg *Server) validateRequest(req *http.Request) bool {
+func (cg *Server) validateRequest(req *http.Request, rules []Rule) (*Rule, bool) {
 	p := cleanPath(req.URL.Path)
-	for _, rule := range cg.Rules {
+	for i, rule := range rules {
 		_, mOk := rule.Methods[req.Method]
-		if mOk && rule.Pattern.MatchString(p) {
-			return true
+		if mOk && rule.Options.matches(req) && rule.Pattern.MatchString(p) {
+			return &rules[i], true
 		}
 	}
-	return false
+	return nil, false
 }
 
-func (cg *Server) handleValidRequest(wri http.ResponseWriter, req *http.Request) error {
-	logger.Debugf("allowed request: %s %s\n", req.Method, req.URL.Path)
+func (cg *Server) handleValidRequest(wri http.ResponseWriter, req *http.Request, rule *Rule) error {
+	logger.Debugf("allowed request %s: %s %s\n", requestId(req), req.Method, req.URL.Path)
 
 	mWri := &middleware.ResponseWriter{ResponseWriter: wri}
 	if f, ok := wri.(http.Flusher); ok {
 		mWri.Flusher = f
 	}
 
-	newReq := req.Clone(req.Context())
-	if cg.backendTlsConfig != nil {
-		newReq.URL.Scheme = "https"
-	} else {
-		newReq.URL.Scheme = "http"
+	// The backend connection is needed to propagate half-closes on hijacked connections,
+	// because the upgraded response body does not expose it
+	var upConn net.Conn
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) { upConn = info.Conn },
 	}
-	if cg.backendProto == "unix" {
-		newReq.URL.Host = "localhost"
-	} else {
-		newReq.URL.Host = cg.backendHost
+
+	if !cg.applyPolicies(mWri, req) {
+		return nil
+	}
+
+	// Requests that could not reach a backend are retried on the next one,
+	// as long as they do not have a body that may have been partially consumed
+	backendName, pool := cg.routeRequest(req)
+	if backendName != DefaultBackendName {
+		logger.Debugf("routed request %s to backend %s\n", requestId(req), backendName)
+	}
+
+	// The number of hijacked connections is limited before the daemon starts the session, which exec start and
+	// attach requests do even without an Upgrade header, by streaming the response on the same connection
+	if req.Header.Get("Upgrade") != "" || isSessionRequest(req) {
+		if !cg.sessions.reserveHijacked(cg.MaxSessions) {
+			logger.Warningf("rejected request %s: maximum of %d hijacked connections reached\n", requestId(req), cg.MaxSessions)
+			writeTooManyRequests(mWri, time.Second)
+			return nil
+		}
+		defer cg.sessions.releaseHijacked()
 	}
 
-	res, err := cg.backendHttpClient.Transport.RoundTrip(newReq)
+	client := clientKey(req)
+	var res *http.Response
+	var err error
+	for _, bt := range pool.candidates(client) {
+		newReq := req.Clone(httptrace.WithClientTrace(req.Context(), trace))
+		bt.direct(newReq)
+
+		res, err = bt.httpClient.Transport.RoundTrip(newReq)
+		if err == nil {
+			pool.pin(client, bt)
+			break
+		}
+		if !isDialError(err) || (req.Body != nil && req.Body != http.NoBody) {
+			break
+		}
+		bt.setHealthy(false, err)
+	}
 	if err == io.EOF || err == io.ErrUnexpectedEOF || errors.Is(err, context.Canceled) || errors.Is(err, syscall.ECONNREFUSED) {
 		mWri.WriteHeader(http.StatusBadGateway)
 		return nil
@@ -273,8 +598,12 @@ func (cg *Server) handleValidRequest(wri http.ResponseWriter, req *http.Request)
 	}()
 
 	resMediaType := res.Header.Get("Content-Type")
+	resIsStream := resMediaType == mediaTypeRawStream || resMediaType == mediaTypeMultiplexedStream
 
-	if resMediaType == mediaTypeRawStream || resMediaType == mediaTypeMultiplexedStream {
+	maxLifetime := minTimeout(cg.SessionMaxLifetime, rule.Options.MaxLifetime)
+	idleTimeout := minTimeout(cg.SessionIdleTimeout, rule.Options.IdleTimeout)
+
+	if resIsStream {
 		logger.Debugf("stream response\n")
 
 		// If the response is a stream, we need to disable the write deadline to prevent the connection from being closed
@@ -300,20 +629,38 @@ func (cg *Server) handleValidRequest(wri http.ResponseWriter, req *http.Request)
 			upCloseOnce.Do(func() { _ = up.Close() })
 		}()
 
-		hj, ok := wri.(http.Hijacker)
-		if !ok {
-			mWri.WriteHeader(http.StatusInternalServerError)
-			return errors.New("unable to hijack connection")
+		ts := &trackedSession{}
+		if !cg.sessions.add(ts) {
+			mWri.WriteHeader(http.StatusServiceUnavailable)
+			return nil
 		}
+		defer cg.sessions.remove(ts)
 
-		down, downRw, err := hj.Hijack()
-		if err != nil {
+		// The response controller also reaches the connection through wrapped response writers
+		down, downRw, err := http.NewResponseController(wri).Hijack()
+		if errors.Is(err, http.ErrNotSupported) {
+			mWri.WriteHeader(http.StatusInternalServerError)
+			return errors.New("unable to hijack connection")
+		} else if err != nil {
 			return fmt.Errorf("error hijacking connection: %w", err)
 		}
 		defer func() {
 			downCloseOnce.Do(func() { _ = down.Close() })
 		}()
 
+		ts.closeWrite = func() {
+			if err := closeWrite(upConn); err != nil {
+				upCloseOnce.Do(func() { _ = up.Close() })
+			}
+			if err := closeWrite(down); err != nil {
+				downCloseOnce.Do(func() { _ = down.Close() })
+			}
+		}
+		ts.close = func() {
+			upCloseOnce.Do(func() { _ = up.Close() })
+			downCloseOnce.Do(func() { _ = down.Close() })
+		}
+
 		_, err = downRw.Write([]byte(res.Proto + " " + res.Status + "\r\n"))
 		if err != nil {
 			return fmt.Errorf("error writing response status: %w", err)
@@ -334,22 +681,104 @@ func (cg *Server) handleValidRequest(wri http.ResponseWriter, req *http.Request)
 			return fmt.Errorf("error flushing response headers: %w", err)
 		}
 
+		var upReader io.Reader = up
+		var upWriter io.Writer = up
+		var downReader io.Reader = down
+
+		var rec *sessionRecorder
+		if cg.RecordDir != "" {
+			rec, err = cg.recordSession(req)
+			if err != nil {
+				logger.Errorf("error starting session recording: %v\n", err)
+			} else if rec != nil {
+				defer func() {
+					_ = rec.Close()
+				}()
+				upReader = io.TeeReader(up, rec.outputWriter(resMediaType == mediaTypeMultiplexedStream))
+				downReader = io.TeeReader(down, rec.inputWriter())
+			}
+		}
+
+		// Data sent by the client along with the request must be forwarded before reading from the connection
+		if n := downRw.Reader.Buffered(); n > 0 {
+			buffered, _ := downRw.Reader.Peek(n)
+			if rec != nil {
+				_, _ = rec.inputWriter().Write(buffered)
+			}
+			_, err = up.Write(buffered)
+			if err != nil {
+				return fmt.Errorf("error forwarding buffered request data: %w", err)
+			}
+		}
+
+		// If nothing needs to see the data and both ends are raw sockets, it is moved within the kernel
+		spliced := rec == nil && netcopy.Spliceable(upConn) && netcopy.Spliceable(down)
+		if spliced {
+			logger.Debugf("splicing connection\n")
+			upWriter = upConn
+		}
+
+		var onData func(int64)
+		if maxLifetime > 0 || idleTimeout > 0 {
+			sm := newSessionMonitor(maxLifetime, idleTimeout, func() {
+				upCloseOnce.Do(func() { _ = up.Close() })
+				downCloseOnce.Do(func() { _ = down.Close() })
+			})
+			defer func() {
+				if reason := sm.stop(); reason != "" {
+					logger.Infof("terminated session %s: %s\n", requestId(req), reason)
+				}
+			}()
+			onData = func(int64) { sm.touch() }
+		}
+
 		var wg sync.WaitGroup
 		wg.Add(2)
 
+		// When the client stops sending data, the daemon connection is half-closed,
+		// so it can still send the remaining output, e.g. of a command that reads stdin until EOF
 		go func() {
 			defer wg.Done()
-			_, _ = io.Copy(up, down)
+			_, _ = netcopy.Copy(upWriter, downReader, onData)
+			if err := closeWrite(upConn); err != nil {
+				upCloseOnce.Do(func() { _ = up.Close() })
+			}
 		}()
 
+		// When the daemon stops sending data the session is over, the client connection is half-closed
+		// and the client is given a short time to close its side before the connection is closed
 		go func() {
 			defer wg.Done()
-			_, _ = io.Copy(down, up)
-			downCloseOnce.Do(func() { _ = down.Close() })
+			if spliced {
+				// The data already buffered by the transport must be forwarded before the connection is used directly
+				if err := drainUpgradedBody(down, up, onData); err == nil {
+					_, _ = netcopy.Copy(down, upConn, onData)
+				}
+			} else {
+				_, _ = netcopy.Copy(down, upReader, onData)
+			}
+			if err := closeWrite(down); err != nil {
+				downCloseOnce.Do(func() { _ = down.Close() })
+			} else {
+				_ = down.SetReadDeadline(time.Now().Add(hijackCloseDelay))
+			}
 		}()
 
 		wg.Wait()
 	} else {
+		var ts *trackedSession
+		if resIsStream {
+			ts = &trackedSession{}
+			ts.close = func() { _ = res.Body.Close() }
+			// Ending a stream response is already a clean close for the client
+			ts.closeWrite = ts.close
+			if !cg.sessions.add(ts) {
+				mWri.WriteHeader(http.StatusServiceUnavailable)
+				return nil
+			}
+			defer cg.sessions.remove(ts)
+		}
+
 		for k, vv := range res.Header {
 			for _, v := range vv {
 				mWri.Header().Add(k, v)
@@ -357,13 +786,54 @@ func (cg *Server) handleValidRequest(wri http.ResponseWriter, req *http.Request)
 		}
 		mWri.WriteHeader(res.StatusCode)
 
+		// Nobody waits for every chunk of a response with a known length or of an archive,
+		// so it is flushed in batches instead of after every write
+		if !resIsStream && (res.ContentLength >= 0 || resMediaType == mediaTypeTar) {
+			mWri.FlushInterval = batchedFlushInterval
+			defer mWri.Stop()
+		}
+
 		if res.StatusCode >= 200 && res.StatusCode != 204 && res.StatusCode != 304 {
-			_, err = io.Copy(mWri, res.Body)
+			var body io.Reader = res.Body
+
+			// Exec create responses are inspected to link the exec instance to this request
+			var execCreateBody *cappedBuffer
+			if cg.RecordDir != "" && res.StatusCode == http.StatusCreated && req.Method == http.MethodPost && execCreatePattern.MatchString(cleanPath(req.URL.Path)) {
+				execCreateBody = &cappedBuffer{max: 64 * 1024}
+				body = io.TeeReader(res.Body, execCreateBody)
+			}
+
+			var sm *sessionMonitor
+			if resIsStream && (maxLifetime > 0 || idleTimeout > 0) {
+				sm = newSessionMonitor(maxLifetime, idleTimeout, func() {
+					_ = res.Body.Close()
+				})
+				body = sm.reader(body)
+			}
+
+			_, err = netcopy.Copy(mWri, body, nil)
+			if sm != nil {
+				if reason := sm.stop(); reason != "" {
+					logger.Infof("terminated stream %s: %s\n", requestId(req), reason)
+					return nil
+				}
+			}
+			if ts != nil && ts.stopping.Load() {
+				logger.Infof("terminated stream %s: server shutting down\n", requestId(req))
+				return nil
+			}
 			if errors.Is(err, context.Canceled) || errors.Is(err, syscall.EPIPE) || errors.Is(err, syscall.ECONNRESET) {
 				return nil
 			} else if err != nil {
 				return fmt.Errorf("error copying response body: %w", err)
 			}
+
+			if execCreateBody != nil {
+				var execCreateRes struct{ Id string }
+				if err := json.Unmarshal(execCreateBody.Bytes(), &execCreateRes); err == nil && execCreateRes.Id != "" {
+					cg.execs.add(execCreateRes.Id, requestId(req))
+				}
+			}
 		}
 	}
 
@@ -371,84 +841,260 @@ func (cg *Server) handleValidRequest(wri http.ResponseWriter, req *http.Request)
 }
 
 func (cg *Server) handleInvalidRequest(wri http.ResponseWriter, req *http.Request) {
-	logger.Warningf("denied request: %s %s\n", req.Method, req.URL.Path)
+	logger.Warningf("denied request %s: %s %s\n", requestId(req), req.Method, req.URL.Path)
 
 	wri.WriteHeader(http.StatusForbidden)
 }
 
-func clientTlsConfig(cacertPath string, certPath string, keyPath string) (*tls.Config, error) {
+// Reports whether the request starts an exec or attach session
+func isSessionRequest(req *http.Request) bool {
+	p := cleanPath(req.URL.Path)
+	return execStartPattern.MatchString(p) || attachPattern.MatchString(p)
+}
+
+// Returns a nil recorder if the request does not start an exec or attach session
+func (cg *Server) recordSession(req *http.Request) (*sessionRecorder, error) {
+	rec := &sessionRecording{
+		RequestId:  requestId(req),
+		Method:     req.Method,
+		Path:       req.URL.Path,
+		RemoteAddr: req.RemoteAddr,
+	}
+
+	p := cleanPath(req.URL.Path)
+	if m := execStartPattern.FindStringSubmatch(p); m != nil {
+		rec.ExecId = m[1]
+		rec.ExecCreateRequestId = cg.execs.take(m[1])
+	} else if m := attachPattern.FindStringSubmatch(p); m != nil {
+		rec.Container = m[1]
+	} else {
+		return nil, nil
+	}
+
+	sr, err := newSessionRecorder(cg.RecordDir, rec)
+	if err != nil {
+		return nil, err
+	}
+
+	if rec.ExecId != "" {
+		logger.Infof("recording session %s of exec %s created by request %s to %s\n", rec.RequestId, rec.ExecId, rec.ExecCreateRequestId, sr.path)
+	} else {
+		logger.Infof("recording session %s of container %s to %s\n", rec.RequestId, rec.Container, sr.path)
+	}
+
+	return sr, nil
+}
+
+// Builds the TLS configuration used to connect to the backend and returns the files it depends on, if any
+func clientTlsConfig(backend *Backend) (*tls.Config, *tlsFiles, error) {
 	var tlsConfig *tls.Config
 
-	var cacertPool *x509.CertPool
-	if cacertPath != "" {
-		cacert, err := os.ReadFile(filepath.Clean(cacertPath))
+	var tf *tlsFiles
+	if backend.TlsCacert != "" || backend.TlsCert != "" || backend.TlsKey != "" {
+		var err error
+		tf, err = loadTlsFiles(backend.TlsCacert, backend.TlsCert, backend.TlsKey, nil)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
-		cacertPool = x509.NewCertPool()
-		if ok := cacertPool.AppendCertsFromPEM(cacert); !ok {
-			return nil, errors.New("error loading CA certificate")
+	}
+
+	pins, err := parseSpkiPins(backend.TlsPin)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	minVersion, err := parseTlsVersion(backend.TlsMinVersion)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cipherSuites, err := parseCipherSuites(backend.TlsCipherSuites)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if tf != nil || backend.TlsServerName != "" || len(pins) > 0 || backend.TlsMinVersion != "" || len(cipherSuites) > 0 {
+		tlsConfig = &tls.Config{
+			MinVersion:   minVersion,
+			CipherSuites: cipherSuites,
+			ServerName:   backend.TlsServerName,
+		}
+
+		if tf != nil && tf.certificate() != nil {
+			tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				return tf.certificate(), nil
+			}
+		}
+
+		var verifyFuncs []func(cs tls.ConnectionState) error
+		if tf != nil && tf.certPool() != nil {
+			// The chain is verified against the current CA bundle instead of a fixed one
+			/* #nosec G402 */
+			tlsConfig.InsecureSkipVerify = true
+			verifyFuncs = append(verifyFuncs, func(cs tls.ConnectionState) error {
+				return verifyServerChain(tf.certPool(), cs)
+			})
+		}
+		if len(pins) > 0 {
+			// Without a CA, the pinned keys are the only trust anchor, e.g. for self-signed certificates
+			/* #nosec G402 */
+			tlsConfig.InsecureSkipVerify = true
+			verifyFuncs = append(verifyFuncs, verifySpkiPins(pins))
+		}
+		if len(verifyFuncs) > 0 {
+			tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+				for _, verify := range verifyFuncs {
+					if err := verify(cs); err != nil {
+						return err
+					}
+				}
+				return nil
+			}
 		}
 	}
 
-	var certificates []tls.Certificate
-	if certPath != "" || keyPath != "" {
-		cert, err := tls.LoadX509KeyPair(certPath, keyPath)
-		if err != nil {
-			return nil, err
+	return tlsConfig, tf, nil
+}
+
+// Builds the TLS configuration of the frontend and returns the files it depends on, if any
+func serverTlsConfig(frontend *Frontend, optionalClientCert bool) (*tls.Config, *tlsFiles, error) {
+	if optionalClientCert && frontend.TlsCacert == "" {
+		return nil, nil, errors.New("anonymous rules require a CA certificate")
+	}
+
+	if frontend.TlsCacert == "" && frontend.TlsCert == "" && frontend.TlsKey == "" {
+		if len(frontend.TlsCrl) > 0 || len(frontend.TlsDeny) > 0 || len(frontend.TlsAllow) > 0 {
+			return nil, nil, errors.New("CRLs, deny-list and allow rules require a CA certificate")
 		}
-		certificates = []tls.Certificate{cert}
+		return nil, nil, nil
 	}
 
-	if cacertPool != nil || len(certificates) > 0 {
-		tlsConfig = &tls.Config{
-			MinVersion:   minTlsVersion,
-			RootCAs:      cacertPool,
-			Certificates: certificates,
+	tf, err := loadTlsFiles(frontend.TlsCacert, frontend.TlsCert, frontend.TlsKey, frontend.TlsCrl)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if (len(frontend.TlsDeny) > 0 || len(frontend.TlsAllow) > 0) && frontend.TlsCacert == "" {
+		return nil, nil, errors.New("CRLs, deny-list and allow rules require a CA certificate")
+	}
+	dl, err := parseDenyList(frontend.TlsDeny)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion: minTlsVersion,
+		ClientAuth: tls.NoClientCert,
+		// Same protocols that http.Server.ServeTLS would negotiate
+		NextProtos: []string{"h2", "http/1.1"},
+	}
+
+	if tf.certificate() != nil {
+		tlsConfig.GetCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return tf.certificate(), nil
 		}
 	}
 
-	return tlsConfig, nil
+	if tf.certPool() != nil {
+		// Each handshake uses the current CA bundle to verify the client
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		if optionalClientCert {
+			tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+		tlsConfig.VerifyConnection = verifyClientNotRevoked(tf, dl)
+		baseTlsConfig := tlsConfig.Clone()
+		tlsConfig.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			config := baseTlsConfig.Clone()
+			config.ClientCAs = tf.certPool()
+			return config, nil
+		}
+	}
+
+	return tlsConfig, tf, nil
 }
 
-func serverTlsConfig(cacertPath string, certPath string, keyPath string) (*tls.Config, error) {
-	var tlsConfig *tls.Config
+// Adds the verifications that depend on the listener to the frontend TLS configuration
+func listenerTlsConfig(tlsConfig *tls.Config, frontend *Frontend, listener string) *tls.Config {
+	verifyAllowed := verifyClientAllowed(frontend.TlsAllow, listener)
+	if verifyAllowed == nil || tlsConfig.GetConfigForClient == nil {
+		return tlsConfig
+	}
 
-	var clientAuth tls.ClientAuthType
-	var cacertPool *x509.CertPool
-	if cacertPath != "" {
-		cacert, err := os.ReadFile(filepath.Clean(cacertPath))
+	config := tlsConfig.Clone()
+	getConfigForClient := tlsConfig.GetConfigForClient
+	config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		c, err := getConfigForClient(hello)
 		if err != nil {
 			return nil, err
 		}
-		cacertPool = x509.NewCertPool()
-		if ok := cacertPool.AppendCertsFromPEM(cacert); !ok {
-			return nil, errors.New("error loading CA certificate")
+		verifyNotRevoked := c.VerifyConnection
+		c.VerifyConnection = func(cs tls.ConnectionState) error {
+			if err := verifyNotRevoked(cs); err != nil {
+				return err
+			}
+			return verifyAllowed(cs)
 		}
-		clientAuth = tls.RequireAndVerifyClientCert
-	} else {
-		clientAuth = tls.NoClientCert
+		return c, nil
 	}
+	return config
+}
 
-	var certificates []tls.Certificate
-	if certPath != "" || keyPath != "" {
-		cert, err := tls.LoadX509KeyPair(certPath, keyPath)
-		if err != nil {
-			return nil, err
+func parseTlsVersion(val string) (uint16, error) {
+	switch val {
+	case "", "1.2":
+		return minTlsVersion, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("unsupported TLS version: %s", val)
+	}
+}
+
+// Only secure TLS 1.2 cipher suites can be chosen, TLS 1.3 ones are not configurable
+func parseCipherSuites(names []string) ([]uint16, error) {
+	var ids []uint16
+	for _, name := range names {
+		idx := slices.IndexFunc(tls.CipherSuites(), func(cs *tls.CipherSuite) bool {
+			return cs.Name == name && slices.Contains(cs.SupportedVersions, tls.VersionTLS12)
+		})
+		if idx < 0 {
+			return nil, fmt.Errorf("unsupported TLS cipher suite: %s", name)
 		}
-		certificates = []tls.Certificate{cert}
+		ids = append(ids, tls.CipherSuites()[idx].ID)
 	}
+	return ids, nil
+}
 
-	if cacertPool != nil || len(certificates) > 0 {
-		tlsConfig = &tls.Config{
-			MinVersion:   minTlsVersion,
-			Certificates: certificates,
-			ClientAuth:   clientAuth,
-			ClientCAs:    cacertPool,
+func parseSpkiPins(vals []string) ([][]byte, error) {
+	var pins [][]byte
+	for _, val := range vals {
+		encoded, ok := strings.CutPrefix(val, "sha256//")
+		if !ok {
+			return nil, fmt.Errorf("invalid TLS pin format: %s", val)
 		}
+		pin, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(pin) != sha256.Size {
+			return nil, fmt.Errorf("invalid TLS pin format: %s", val)
+		}
+		pins = append(pins, pin)
 	}
+	return pins, nil
+}
 
-	return tlsConfig, nil
+// Rejects the connection unless the public key of the peer certificate matches one of the pins
+func verifySpkiPins(pins [][]byte) func(cs tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return errors.New("no peer certificate")
+		}
+		digest := sha256.Sum256(cs.PeerCertificates[0].RawSubjectPublicKeyInfo)
+		for _, pin := range pins {
+			if bytes.Equal(digest[:], pin) {
+				return nil
+			}
+		}
+		return fmt.Errorf("certificate public key does not match any pin: sha256//%s", base64.StdEncoding.EncodeToString(digest[:]))
+	}
 }
 
 func parseAddr(addr string) (string, string, error) {
@@ -471,6 +1117,17 @@ func parseAddr(addr string) (string, string, error) {
 	}
 }
 
+func newRequestId() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func requestId(req *http.Request) string {
+	id, _ := req.Context().Value(requestIdContextKey).(string)
+	return id
+}
+
 // Borrowed from net/http/server.go
 func cleanPath(p string) string {
 	if p == "" {
@@ -485,3 +1142,27 @@ func cleanPath(p string) string {
 	}
 	return np
 }
+
+// Forwards the data buffered by the transport for an upgraded response body, so that the underlying connection
+// can be used directly afterwards. The body returns only buffered data until the buffer is empty, and reads
+// from the connection after that, so a read shorter than the requested size means that nothing is left
+func drainUpgradedBody(dst io.Writer, body io.Reader, onData func(int64)) error {
+	buf := make([]byte, upgradeDrainSize)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				return werr
+			}
+			if onData != nil {
+				onData(int64(n))
+			}
+		}
+		if err != nil {
+			return err
+		}
+		if n < len(buf) {
+			return nil
+		}
+	}
+}
@@ -1,18 +1,28 @@
 package cetusguard
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"regexp"
 	"strings"
+	"sync"
 	"testing"
+	"testing/iotest"
 	"time"
 
 	"github.com/hectorm/cetusguard/cetusguard/testdata"
@@ -161,6 +171,227 @@ func TestCetusGuardPlainAllowedReq(t *testing.T) {
 	}
 }
 
+func TestCetusGuardPlainFailoverBackendReq(t *testing.T) {
+	tc := &testCase{
+		daemonListenerFunc: tcpDaemonListener,
+		daemonFunc:         plainDaemon,
+		backendFunc:        plainBackend,
+		frontendFunc:       plainFrontend,
+		clientFunc:         plainClient,
+	}
+
+	defer tc.setup(t)()
+	tc.daemon.Handler = http.HandlerFunc(func(wri http.ResponseWriter, req *http.Request) {
+		wri.WriteHeader(http.StatusOK)
+	})
+
+	// The first backend is unreachable, so requests must fail over to the second one
+	unreachable, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = unreachable.Close()
+	tc.server.Backend.FailoverAddr = []string{tc.server.Backend.Addr}
+	tc.server.Backend.Addr = "tcp://" + unreachable.Addr().String()
+
+	ready := make(chan any, 1)
+	go func() {
+		err := tc.server.Start(ready)
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+	<-ready
+
+	addrs, err := tc.server.Addrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for range 2 {
+		req, err := http.NewRequest("HEAD", fmt.Sprintf("http://%s/", addrs[0].String()), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res, err := tc.client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = res.Body.Close()
+
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("res.StatusCode = %d, want %d", res.StatusCode, http.StatusOK)
+		}
+	}
+
+	if tc.server.backendPools[DefaultBackendName].targets[0].healthy.Load() {
+		t.Errorf("backend healthy, want unhealthy")
+	}
+
+	err = tc.server.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCetusGuardSshBackendReq(t *testing.T) {
+	tc := &testCase{
+		daemonListenerFunc: tcpDaemonListener,
+		daemonFunc:         plainDaemon,
+		backendFunc:        plainBackend,
+		frontendFunc:       plainFrontend,
+		clientFunc:         plainClient,
+	}
+
+	defer tc.setup(t)()
+	tc.daemon.Handler = http.HandlerFunc(func(wri http.ResponseWriter, req *http.Request) {
+		wri.WriteHeader(http.StatusOK)
+	})
+
+	// The daemon is reached through the socket forwarded by an SSH server
+	t.Setenv("SSH_AUTH_SOCK", "")
+	ts := newTestSshServer(t, tc.daemonListener.Addr())
+	tc.server.Backend.Addr = ts.addr("identity-file=" + ts.clientKeyPath + "&known-hosts=" + ts.knownHostsPath)
+
+	ready := make(chan any, 1)
+	go func() {
+		err := tc.server.Start(ready)
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+	<-ready
+
+	addrs, err := tc.server.Addrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for range 2 {
+		req, err := http.NewRequest("HEAD", fmt.Sprintf("http://%s/", addrs[0].String()), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res, err := tc.client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = res.Body.Close()
+
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("res.StatusCode = %d, want %d", res.StatusCode, http.StatusOK)
+		}
+	}
+
+	if n := ts.connections.Load(); n != 1 {
+		t.Errorf("connections = %d, want %d", n, 1)
+	}
+
+	err = tc.server.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCetusGuardPlainRoutedReq(t *testing.T) {
+	tc := &testCase{
+		daemonListenerFunc: tcpDaemonListener,
+		daemonFunc:         plainDaemon,
+		backendFunc:        plainBackend,
+		frontendFunc:       plainFrontend,
+		clientFunc:         plainClient,
+	}
+
+	defer tc.setup(t)()
+	tc.daemon.Handler = http.HandlerFunc(func(wri http.ResponseWriter, req *http.Request) {
+		wri.WriteHeader(http.StatusOK)
+	})
+
+	podmanDaemon := httptest.NewServer(http.HandlerFunc(func(wri http.ResponseWriter, req *http.Request) {
+		wri.WriteHeader(http.StatusTeapot)
+	}))
+	defer podmanDaemon.Close()
+
+	tc.server.Backends = map[string]*Backend{
+		"podman": {Addr: "tcp://" + podmanDaemon.Listener.Addr().String()},
+	}
+	tc.server.Routes = []Route{{
+		Backend: "podman",
+		Pattern: regexp.MustCompile(`^/libpod/.*$`),
+	}}
+
+	ready := make(chan any, 1)
+	go func() {
+		err := tc.server.Start(ready)
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+	<-ready
+
+	addrs, err := tc.server.Addrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := map[string]int{
+		"/libpod/info": http.StatusTeapot,
+		"/info":        http.StatusOK,
+	}
+
+	for path, wanted := range testCases {
+		req, err := http.NewRequest("HEAD", fmt.Sprintf("http://%s%s", addrs[0].String(), path), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res, err := tc.client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = res.Body.Close()
+
+		if res.StatusCode != wanted {
+			t.Errorf("%s: res.StatusCode = %d, want %d", path, res.StatusCode, wanted)
+		}
+	}
+
+	err = tc.server.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCetusGuardUnknownRouteBackend(t *testing.T) {
+	tc := &testCase{
+		daemonListenerFunc: tcpDaemonListener,
+		daemonFunc:         plainDaemon,
+		backendFunc:        plainBackend,
+		frontendFunc:       plainFrontend,
+		clientFunc:         plainClient,
+	}
+
+	defer tc.setup(t)()
+	tc.daemon.Handler = http.HandlerFunc(httpDaemonHandler)
+	tc.server.Routes = []Route{{
+		Backend: "podman",
+		Pattern: regexp.MustCompile(`^/libpod/.*$`),
+	}}
+
+	ready := make(chan any, 1)
+	go func() {
+		err := tc.server.Start(ready)
+		if err == nil {
+			t.Errorf("server started, want an error")
+		}
+	}()
+	<-ready
+
+	_ = tc.server.Stop()
+}
+
 func TestCetusGuardPlainAllowedStreamReq(t *testing.T) {
 	tc := &testCase{
 		daemonListenerFunc: tcpDaemonListener,
@@ -905,18 +1136,21 @@ func TestCetusGuardUntrustedDaemonCertReq(t *testing.T) {
 	}
 }
 
-func TestCetusGuardUntrustedClientCertReq(t *testing.T) {
+func TestCetusGuardPinnedDaemonCertReq(t *testing.T) {
 	tc := &testCase{
 		daemonListenerFunc: tcpDaemonListener,
 		daemonFunc:         tlsDaemon,
-		backendFunc:        tlsBackend,
-		frontendFunc:       tlsAuthFrontend,
-		clientFunc:         altTlsAuthClient,
+		backendFunc:        plainBackend,
+		frontendFunc:       tlsFrontend,
+		clientFunc:         tlsClient,
 	}
 
 	defer tc.setup(t)()
 	tc.daemon.Handler = http.HandlerFunc(httpDaemonHandler)
 
+	// The pinned key is the only trust anchor, so no CA is needed
+	tc.server.Backend.TlsPin = []string{testSpkiPin(t, testdata.TestAltTlsServerCert), testSpkiPin(t, testdata.TestTlsServerCert)}
+
 	ready := make(chan any, 1)
 	go func() {
 		err := tc.server.Start(ready)
@@ -937,8 +1171,15 @@ func TestCetusGuardUntrustedClientCertReq(t *testing.T) {
 	}
 
 	res, err := tc.client.Do(req)
-	if err == nil || res != nil {
-		t.Fatalf("response returned, want an error")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = res.Body.Close()
+	}()
+
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("res.StatusCode = %d, want %d", res.StatusCode, http.StatusOK)
 	}
 
 	err = tc.server.Stop()
@@ -947,11 +1188,11 @@ func TestCetusGuardUntrustedClientCertReq(t *testing.T) {
 	}
 }
 
-func TestCetusGuardInvalidBackendCacert(t *testing.T) {
+func TestCetusGuardUnpinnedDaemonCertReq(t *testing.T) {
 	tc := &testCase{
 		daemonListenerFunc: tcpDaemonListener,
 		daemonFunc:         tlsDaemon,
-		backendFunc:        invalidCacertTlsBackend,
+		backendFunc:        tlsBackend,
 		frontendFunc:       tlsFrontend,
 		clientFunc:         tlsClient,
 	}
@@ -959,127 +1200,2897 @@ func TestCetusGuardInvalidBackendCacert(t *testing.T) {
 	defer tc.setup(t)()
 	tc.daemon.Handler = http.HandlerFunc(httpDaemonHandler)
 
+	// The daemon certificate is trusted by the CA, but its key is not pinned
+	tc.server.Backend.TlsPin = []string{testSpkiPin(t, testdata.TestAltTlsServerCert)}
+
 	ready := make(chan any, 1)
 	go func() {
 		err := tc.server.Start(ready)
-		if err == nil {
-			t.Errorf("server started, want an error")
+		if err != nil {
+			t.Error(err)
 		}
 	}()
 	<-ready
 
-	_ = tc.server.Stop()
-}
-
-func TestCetusGuardInvalidBackendCert(t *testing.T) {
-	tc := &testCase{
-		daemonListenerFunc: tcpDaemonListener,
-		daemonFunc:         tlsAuthDaemon,
-		backendFunc:        invalidCertTlsAuthBackend,
-		frontendFunc:       tlsFrontend,
-		clientFunc:         tlsClient,
+	addrs, err := tc.server.Addrs()
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	defer tc.setup(t)()
-	tc.daemon.Handler = http.HandlerFunc(httpDaemonHandler)
+	req, err := httpClientAllowedReq("https", addrs[0].String())
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	ready := make(chan any, 1)
-	go func() {
-		err := tc.server.Start(ready)
-		if err == nil {
-			t.Errorf("server started, want an error")
-		}
+	res, err := tc.client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = res.Body.Close()
 	}()
-	<-ready
 
-	_ = tc.server.Stop()
+	if res.StatusCode != http.StatusBadGateway {
+		t.Fatalf("res.StatusCode = %d, want %d", res.StatusCode, http.StatusBadGateway)
+	}
+
+	err = tc.server.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
 }
 
-func TestCetusGuardInvalidFrontendCacert(t *testing.T) {
+func TestCetusGuardDaemonServerNameReq(t *testing.T) {
 	tc := &testCase{
 		daemonListenerFunc: tcpDaemonListener,
 		daemonFunc:         tlsDaemon,
 		backendFunc:        tlsBackend,
-		frontendFunc:       invalidCacertTlsAuthFrontend,
-		clientFunc:         tlsAuthClient,
+		frontendFunc:       tlsFrontend,
+		clientFunc:         tlsClient,
 	}
 
 	defer tc.setup(t)()
 	tc.daemon.Handler = http.HandlerFunc(httpDaemonHandler)
 
+	tc.server.Backend.TlsServerName = "localhost"
+
 	ready := make(chan any, 1)
 	go func() {
 		err := tc.server.Start(ready)
-		if err == nil {
-			t.Errorf("server started, want an error")
+		if err != nil {
+			t.Error(err)
 		}
 	}()
 	<-ready
 
-	_ = tc.server.Stop()
-}
-
-func TestCetusGuardInvalidFrontendCert(t *testing.T) {
-	tc := &testCase{
+	addrs, err := tc.server.Addrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := httpClientAllowedReq("https", addrs[0].String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := tc.client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = res.Body.Close()
+	}()
+
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("res.StatusCode = %d, want %d", res.StatusCode, http.StatusOK)
+	}
+
+	err = tc.server.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCetusGuardMismatchedDaemonServerNameReq(t *testing.T) {
+	tc := &testCase{
 		daemonListenerFunc: tcpDaemonListener,
 		daemonFunc:         tlsDaemon,
 		backendFunc:        tlsBackend,
-		frontendFunc:       invalidCertTlsFrontend,
+		frontendFunc:       tlsFrontend,
 		clientFunc:         tlsClient,
 	}
 
 	defer tc.setup(t)()
 	tc.daemon.Handler = http.HandlerFunc(httpDaemonHandler)
 
+	tc.server.Backend.TlsServerName = "daemon.example.com"
+
 	ready := make(chan any, 1)
 	go func() {
 		err := tc.server.Start(ready)
-		if err == nil {
-			t.Errorf("server started, want an error")
+		if err != nil {
+			t.Error(err)
 		}
 	}()
 	<-ready
 
-	_ = tc.server.Stop()
+	addrs, err := tc.server.Addrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := httpClientAllowedReq("https", addrs[0].String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := tc.client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = res.Body.Close()
+	}()
+
+	if res.StatusCode != http.StatusBadGateway {
+		t.Fatalf("res.StatusCode = %d, want %d", res.StatusCode, http.StatusBadGateway)
+	}
+
+	err = tc.server.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
 }
 
-func TestCetusGuardInvalidBackendAddr(t *testing.T) {
+func TestCetusGuardDaemonCipherSuitesReq(t *testing.T) {
+	tc := &testCase{
+		daemonListenerFunc: tcpDaemonListener,
+		daemonFunc:         tls12Daemon,
+		backendFunc:        tlsBackend,
+		frontendFunc:       tlsFrontend,
+		clientFunc:         tlsClient,
+	}
+
+	defer tc.setup(t)()
+	tc.daemon.Handler = http.HandlerFunc(httpDaemonHandler)
+
+	tc.server.Backend.TlsCipherSuites = []string{"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"}
+
+	ready := make(chan any, 1)
+	go func() {
+		err := tc.server.Start(ready)
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+	<-ready
+
+	addrs, err := tc.server.Addrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := httpClientAllowedReq("https", addrs[0].String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := tc.client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = res.Body.Close()
+	}()
+
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("res.StatusCode = %d, want %d", res.StatusCode, http.StatusOK)
+	}
+
+	err = tc.server.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCetusGuardDaemonMinVersionReq(t *testing.T) {
+	tc := &testCase{
+		daemonListenerFunc: tcpDaemonListener,
+		daemonFunc:         tls12Daemon,
+		backendFunc:        tlsBackend,
+		frontendFunc:       tlsFrontend,
+		clientFunc:         tlsClient,
+	}
+
+	defer tc.setup(t)()
+	tc.daemon.Handler = http.HandlerFunc(httpDaemonHandler)
+
+	tc.server.Backend.TlsMinVersion = "1.3"
+
+	ready := make(chan any, 1)
+	go func() {
+		err := tc.server.Start(ready)
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+	<-ready
+
+	addrs, err := tc.server.Addrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := httpClientAllowedReq("https", addrs[0].String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := tc.client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = res.Body.Close()
+	}()
+
+	if res.StatusCode != http.StatusBadGateway {
+		t.Fatalf("res.StatusCode = %d, want %d", res.StatusCode, http.StatusBadGateway)
+	}
+
+	err = tc.server.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCetusGuardInvalidBackendTlsOptions(t *testing.T) {
+	invalidBackends := []Backend{
+		{TlsPin: []string{"AAAA"}},
+		{TlsPin: []string{"sha256//AAAA"}},
+		{TlsMinVersion: "1.1"},
+		{TlsCipherSuites: []string{"TLS_RSA_WITH_RC4_128_SHA"}},
+		{TlsCipherSuites: []string{"TLS_AES_128_GCM_SHA256"}},
+		{TlsCipherSuites: []string{"FOO"}},
+	}
+
+	for _, invalidBackend := range invalidBackends {
+		tc := &testCase{
+			daemonListenerFunc: tcpDaemonListener,
+			daemonFunc:         tlsDaemon,
+			backendFunc:        tlsBackend,
+			frontendFunc:       tlsFrontend,
+			clientFunc:         tlsClient,
+		}
+
+		cleanup := tc.setup(t)
+		tc.daemon.Handler = http.HandlerFunc(httpDaemonHandler)
+		tc.server.Backend.TlsPin = invalidBackend.TlsPin
+		tc.server.Backend.TlsMinVersion = invalidBackend.TlsMinVersion
+		tc.server.Backend.TlsCipherSuites = invalidBackend.TlsCipherSuites
+
+		ready := make(chan any, 1)
+		go func() {
+			err := tc.server.Start(ready)
+			if err == nil {
+				t.Errorf("%+v: server started, want an error", invalidBackend)
+			}
+		}()
+		<-ready
+
+		_ = tc.server.Stop()
+		cleanup()
+	}
+}
+
+func TestCetusGuardFrontendCertReload(t *testing.T) {
 	tc := &testCase{
 		daemonListenerFunc: tcpDaemonListener,
 		daemonFunc:         plainDaemon,
 		backendFunc:        plainBackend,
-		frontendFunc:       plainFrontend,
-		clientFunc:         plainClient,
+		frontendFunc:       tlsFrontend,
+		clientFunc:         tlsClient,
 	}
 
 	defer tc.setup(t)()
 	tc.daemon.Handler = http.HandlerFunc(httpDaemonHandler)
-	tc.server.Backend.Addr = "invalid"
 
-	ready := make(chan any, 1)
+	ready := make(chan any, 1)
+	go func() {
+		err := tc.server.Start(ready)
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+	<-ready
+
+	addrs, err := tc.server.Addrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, wantedCn := range []string{"daemon:", "alt-daemon:"} {
+		if i > 0 {
+			// The certificate is replaced and the files are checked without waiting for the next interval
+			modTime := time.Now().Add(time.Minute)
+			for path, data := range map[string][]byte{tc.frontend.TlsCert: testdata.TestAltTlsServerCert, tc.frontend.TlsKey: testdata.TestAltTlsServerKey} {
+				if err := os.WriteFile(path, data, 0600); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Chtimes(path, modTime, modTime); err != nil {
+					t.Fatal(err)
+				}
+			}
+			tc.server.tlsWatcher.checkAll()
+		}
+
+		req, err := httpClientAllowedReq("https", addrs[0].String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Each request needs a new handshake
+		req.Close = true
+
+		res, err := tc.client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = res.Body.Close()
+
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("res.StatusCode = %d, want %d", res.StatusCode, http.StatusOK)
+		}
+		if cn := res.TLS.PeerCertificates[0].Subject.CommonName; !strings.HasPrefix(cn, wantedCn) {
+			t.Errorf("cn = %s, want prefix %s", cn, wantedCn)
+		}
+	}
+
+	err = tc.server.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCetusGuardBackendCacertReload(t *testing.T) {
+	tc := &testCase{
+		daemonListenerFunc: tcpDaemonListener,
+		daemonFunc:         tlsDaemon,
+		backendFunc:        invalidCacertTlsBackend,
+		frontendFunc:       tlsFrontend,
+		clientFunc:         tlsClient,
+	}
+
+	defer tc.setup(t)()
+	tc.daemon.Handler = http.HandlerFunc(httpDaemonHandler)
+
+	// The daemon certificate is not trusted until the CA bundle is replaced
+	if err := os.WriteFile(tc.backend.TlsCacert, testdata.TestAltTlsCacert, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ready := make(chan any, 1)
+	go func() {
+		err := tc.server.Start(ready)
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+	<-ready
+
+	addrs, err := tc.server.Addrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, wantedStatus := range []int{http.StatusBadGateway, http.StatusOK} {
+		if i > 0 {
+			modTime := time.Now().Add(time.Minute)
+			if err := os.WriteFile(tc.backend.TlsCacert, testdata.TestTlsCacert, 0600); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chtimes(tc.backend.TlsCacert, modTime, modTime); err != nil {
+				t.Fatal(err)
+			}
+			tc.server.tlsWatcher.checkAll()
+		}
+
+		req, err := httpClientAllowedReq("https", addrs[0].String())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res, err := tc.client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = res.Body.Close()
+
+		if res.StatusCode != wantedStatus {
+			t.Fatalf("res.StatusCode = %d, want %d", res.StatusCode, wantedStatus)
+		}
+	}
+
+	err = tc.server.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCetusGuardMetrics(t *testing.T) {
+	tc := &testCase{
+		daemonListenerFunc: tcpDaemonListener,
+		daemonFunc:         tlsDaemon,
+		backendFunc:        tlsBackend,
+		frontendFunc:       tlsFrontend,
+		clientFunc:         tlsClient,
+	}
+
+	defer tc.setup(t)()
+	tc.daemon.Handler = http.HandlerFunc(httpDaemonHandler)
+	tc.server.MetricsAddr = "tcp://127.0.0.1:0"
+
+	ready := make(chan any, 1)
+	go func() {
+		err := tc.server.Start(ready)
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+	<-ready
+
+	res, err := http.Get(fmt.Sprintf("http://%s/metrics", tc.server.metricsListener.Addr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = res.Body.Close()
+	}()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("res.StatusCode = %d, want %d", res.StatusCode, http.StatusOK)
+	}
+	for _, path := range []string{tc.frontend.TlsCert, tc.backend.TlsCacert} {
+		wanted := fmt.Sprintf(`cetusguard_tls_certificate_expiry_timestamp_seconds{path="%s"} `, path)
+		if !strings.Contains(string(body), wanted) {
+			t.Errorf("body = %q, want %q", body, wanted)
+		}
+	}
+
+	err = tc.server.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCetusGuardUntrustedClientCertReq(t *testing.T) {
+	tc := &testCase{
+		daemonListenerFunc: tcpDaemonListener,
+		daemonFunc:         tlsDaemon,
+		backendFunc:        tlsBackend,
+		frontendFunc:       tlsAuthFrontend,
+		clientFunc:         altTlsAuthClient,
+	}
+
+	defer tc.setup(t)()
+	tc.daemon.Handler = http.HandlerFunc(httpDaemonHandler)
+
+	ready := make(chan any, 1)
+	go func() {
+		err := tc.server.Start(ready)
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+	<-ready
+
+	addrs, err := tc.server.Addrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := httpClientAllowedReq("https", addrs[0].String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := tc.client.Do(req)
+	if err == nil || res != nil {
+		t.Fatalf("response returned, want an error")
+	}
+
+	err = tc.server.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCetusGuardDeniedClientCertReq(t *testing.T) {
+	tc := &testCase{
+		daemonListenerFunc: tcpDaemonListener,
+		daemonFunc:         tlsDaemon,
+		backendFunc:        tlsBackend,
+		frontendFunc:       tlsAuthFrontend,
+		clientFunc:         tlsAuthClient,
+	}
+
+	defer tc.setup(t)()
+	tc.daemon.Handler = http.HandlerFunc(httpDaemonHandler)
+
+	fingerprint := sha256.Sum256(parseTestCert(t, testdata.TestTlsClientCert).Raw)
+	tc.server.Frontend.TlsDeny = []string{"sha256:" + hex.EncodeToString(fingerprint[:])}
+
+	ready := make(chan any, 1)
+	go func() {
+		err := tc.server.Start(ready)
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+	<-ready
+
+	addrs, err := tc.server.Addrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := httpClientAllowedReq("https", addrs[0].String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := tc.client.Do(req)
+	if err == nil || res != nil {
+		t.Fatalf("response returned, want an error")
+	}
+
+	err = tc.server.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCetusGuardRevokedClientCertReq(t *testing.T) {
+	tc := &testCase{
+		daemonListenerFunc: tcpDaemonListener,
+		daemonFunc:         tlsDaemon,
+		backendFunc:        tlsBackend,
+		frontendFunc:       tlsAuthFrontend,
+		clientFunc:         tlsClient,
+	}
+
+	defer tc.setup(t)()
+	tc.daemon.Handler = http.HandlerFunc(httpDaemonHandler)
+
+	pki := newTestPki(t, "ca")
+	tmpdir := t.TempDir()
+
+	if err := os.WriteFile(tc.server.Frontend.TlsCacert, pki.cacertPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	crlPath := filepath.Join(tmpdir, "crl.pem")
+	if err := os.WriteFile(crlPath, pki.crl(t, time.Now().Add(time.Hour), 2), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tc.server.Frontend.TlsCrl = []string{crlPath}
+
+	certPem, keyPem := pki.issue(t, "client", 2)
+	cert, err := tls.X509KeyPair(certPem, keyPem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc.client.Transport.(*http.Transport).TLSClientConfig.Certificates = []tls.Certificate{cert}
+
+	ready := make(chan any, 1)
+	go func() {
+		err := tc.server.Start(ready)
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+	<-ready
+
+	addrs, err := tc.server.Addrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, wantRevoked := range []bool{true, false} {
+		if i > 0 {
+			// The certificate is accepted once the CRL no longer includes it
+			modTime := time.Now().Add(time.Minute)
+			if err := os.WriteFile(crlPath, pki.crl(t, time.Now().Add(time.Hour)), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chtimes(crlPath, modTime, modTime); err != nil {
+				t.Fatal(err)
+			}
+			tc.server.tlsWatcher.checkAll()
+		}
+
+		req, err := httpClientAllowedReq("https", addrs[0].String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Close = true
+
+		res, err := tc.client.Do(req)
+		if wantRevoked {
+			if err == nil || res != nil {
+				t.Fatalf("response returned, want an error")
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = res.Body.Close()
+
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("res.StatusCode = %d, want %d", res.StatusCode, http.StatusOK)
+		}
+	}
+
+	err = tc.server.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCetusGuardDenyListWithoutCacert(t *testing.T) {
+	tc := &testCase{
+		daemonListenerFunc: tcpDaemonListener,
+		daemonFunc:         tlsDaemon,
+		backendFunc:        tlsBackend,
+		frontendFunc:       tlsFrontend,
+		clientFunc:         tlsClient,
+	}
+
+	defer tc.setup(t)()
+	tc.daemon.Handler = http.HandlerFunc(httpDaemonHandler)
+	tc.server.Frontend.TlsDeny = []string{"serial:01"}
+
+	ready := make(chan any, 1)
+	go func() {
+		err := tc.server.Start(ready)
+		if err == nil {
+			t.Errorf("server started, want an error")
+		}
+	}()
+	<-ready
+
+	_ = tc.server.Stop()
+}
+
+func TestCetusGuardAllowedClientCertReq(t *testing.T) {
+	tc := &testCase{
+		daemonListenerFunc: tcpDaemonListener,
+		daemonFunc:         tlsDaemon,
+		backendFunc:        tlsBackend,
+		frontendFunc:       tlsAuthFrontend,
+		clientFunc:         tlsClient,
+	}
+
+	defer tc.setup(t)()
+	tc.daemon.Handler = http.HandlerFunc(httpDaemonHandler)
+
+	pki := newTestPki(t, "ca")
+	if err := os.WriteFile(tc.server.Frontend.TlsCacert, pki.cacertPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	tc.server.Frontend.Addr = []string{"tcp://127.0.0.1:0", "tcp://localhost:0"}
+	tc.server.Frontend.TlsAllow = []TlsAllowRule{{Listener: "tcp://127.0.0.1:0", Cn: "ci-*"}}
+
+	ready := make(chan any, 1)
+	go func() {
+		err := tc.server.Start(ready)
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+	<-ready
+
+	addrs, err := tc.server.Addrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		cn      string
+		addr    net.Addr
+		allowed bool
+	}{
+		{"ci-runner", addrs[0], true},
+		{"dev", addrs[0], false},
+		// The rule only applies to the first listener
+		{"dev", addrs[1], true},
+	}
+
+	for i, c := range testCases {
+		certPem, keyPem := pki.issue(t, c.cn, int64(i+2))
+		cert, err := tls.X509KeyPair(certPem, keyPem)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tc.client.Transport.(*http.Transport).TLSClientConfig.Certificates = []tls.Certificate{cert}
+
+		req, err := httpClientAllowedReq("https", c.addr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Close = true
+
+		res, err := tc.client.Do(req)
+		if !c.allowed {
+			if err == nil || res != nil {
+				t.Errorf("%s on %s: response returned, want an error", c.cn, c.addr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s on %s: %v", c.cn, c.addr, err)
+		}
+		_ = res.Body.Close()
+
+		if res.StatusCode != http.StatusOK {
+			t.Errorf("%s on %s: res.StatusCode = %d, want %d", c.cn, c.addr, res.StatusCode, http.StatusOK)
+		}
+	}
+
+	err = tc.server.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCetusGuardTlsAuthListenerRoutedReq(t *testing.T) {
+	tc := &testCase{
+		daemonListenerFunc: tcpDaemonListener,
+		daemonFunc:         plainDaemon,
+		backendFunc:        plainBackend,
+		frontendFunc:       tlsAuthFrontend,
+		clientFunc:         tlsAuthClient,
+	}
+
+	defer tc.setup(t)()
+	tc.daemon.Handler = http.HandlerFunc(func(wri http.ResponseWriter, req *http.Request) {
+		wri.WriteHeader(http.StatusOK)
+	})
+
+	podmanDaemon := httptest.NewServer(http.HandlerFunc(func(wri http.ResponseWriter, req *http.Request) {
+		wri.WriteHeader(http.StatusTeapot)
+	}))
+	defer podmanDaemon.Close()
+
+	tc.server.Frontend.Addr = []string{"tcp://127.0.0.1:0", "tcp://localhost:0"}
+	tc.server.Backends = map[string]*Backend{
+		"podman": {Addr: "tcp://" + podmanDaemon.Listener.Addr().String()},
+	}
+	tc.server.Routes = []Route{{
+		Backend: "podman",
+		Pattern: regexp.MustCompile(`^.*$`),
+		Options: RouteOptions{Listener: "tcp://localhost:0"},
+	}}
+
+	ready := make(chan any, 1)
+	go func() {
+		err := tc.server.Start(ready)
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+	<-ready
+
+	addrs, err := tc.server.Addrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, wanted := range []int{http.StatusOK, http.StatusTeapot} {
+		req, err := http.NewRequest("HEAD", fmt.Sprintf("https://%s/info", addrs[i].String()), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res, err := tc.client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = res.Body.Close()
+
+		if res.StatusCode != wanted {
+			t.Errorf("%s: res.StatusCode = %d, want %d", addrs[i], res.StatusCode, wanted)
+		}
+	}
+
+	err = tc.server.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCetusGuardAllowRulesWithoutCacert(t *testing.T) {
+	tc := &testCase{
+		daemonListenerFunc: tcpDaemonListener,
+		daemonFunc:         tlsDaemon,
+		backendFunc:        tlsBackend,
+		frontendFunc:       tlsFrontend,
+		clientFunc:         tlsClient,
+	}
+
+	defer tc.setup(t)()
+	tc.daemon.Handler = http.HandlerFunc(httpDaemonHandler)
+	tc.server.Frontend.TlsAllow = []TlsAllowRule{{Cn: "ci-*"}}
+
+	ready := make(chan any, 1)
+	go func() {
+		err := tc.server.Start(ready)
+		if err == nil {
+			t.Errorf("server started, want an error")
+		}
+	}()
+	<-ready
+
+	_ = tc.server.Stop()
+}
+
+func TestCetusGuardAnonymousReq(t *testing.T) {
+	tc := &testCase{
+		daemonListenerFunc: tcpDaemonListener,
+		daemonFunc:         tlsDaemon,
+		backendFunc:        tlsBackend,
+		frontendFunc:       tlsAuthFrontend,
+		clientFunc:         tlsClient,
+	}
+
+	defer tc.setup(t)()
+	tc.daemon.Handler = http.HandlerFunc(func(wri http.ResponseWriter, req *http.Request) {
+		wri.WriteHeader(http.StatusOK)
+	})
+
+	anonymousRules, err := BuildRules("GET,HEAD %API_PREFIX_PING%")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc.server.AnonymousRules = anonymousRules
+
+	ready := make(chan any, 1)
+	go func() {
+		err := tc.server.Start(ready)
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+	<-ready
+
+	addrs, err := tc.server.Addrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authClient, err := tlsAuthClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name   string
+		client *http.Client
+		path   string
+		wanted int
+	}{
+		{"anonymous", tc.client, "/_ping", http.StatusOK},
+		{"anonymous", tc.client, "/v1.41/_ping", http.StatusOK},
+		{"anonymous", tc.client, "/info", http.StatusForbidden},
+		// Clients with a certificate get the regular rules
+		{"authenticated", authClient, "/_ping", http.StatusOK},
+		{"authenticated", authClient, "/info", http.StatusOK},
+	}
+
+	for _, c := range testCases {
+		req, err := http.NewRequest("HEAD", fmt.Sprintf("https://%s%s", addrs[0].String(), c.path), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res, err := c.client.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", c.name, c.path, err)
+		}
+		_ = res.Body.Close()
+
+		if res.StatusCode != c.wanted {
+			t.Errorf("%s %s: res.StatusCode = %d, want %d", c.name, c.path, res.StatusCode, c.wanted)
+		}
+	}
+
+	// A certificate that is presented must still be signed by the CA
+	altClient, err := tlsClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	altCert, err := tls.X509KeyPair(testdata.TestAltTlsClientCert, testdata.TestAltTlsClientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	altClient.Transport.(*http.Transport).TLSClientConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		return &altCert, nil
+	}
+	req, err := http.NewRequest("HEAD", fmt.Sprintf("https://%s/_ping", addrs[0].String()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := altClient.Do(req)
+	if err == nil || res != nil {
+		t.Errorf("response returned, want an error")
+	}
+
+	err = tc.server.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCetusGuardAnonymousRulesWithoutCacert(t *testing.T) {
+	tc := &testCase{
+		daemonListenerFunc: tcpDaemonListener,
+		daemonFunc:         tlsDaemon,
+		backendFunc:        tlsBackend,
+		frontendFunc:       tlsFrontend,
+		clientFunc:         tlsClient,
+	}
+
+	defer tc.setup(t)()
+	tc.daemon.Handler = http.HandlerFunc(httpDaemonHandler)
+	tc.server.AnonymousRules = []Rule{{
+		Methods: map[string]struct{}{"GET": {}},
+		Pattern: regexp.MustCompile(`^/_ping$`),
+	}}
+
+	ready := make(chan any, 1)
+	go func() {
+		err := tc.server.Start(ready)
+		if err == nil {
+			t.Errorf("server started, want an error")
+		}
+	}()
+	<-ready
+
+	_ = tc.server.Stop()
+}
+
+func TestCetusGuardAuthReq(t *testing.T) {
+	tc := &testCase{
+		daemonListenerFunc: tcpDaemonListener,
+		daemonFunc:         plainDaemon,
+		backendFunc:        plainBackend,
+		frontendFunc:       plainFrontend,
+		clientFunc:         plainClient,
+	}
+
+	defer tc.setup(t)()
+	tc.daemon.Handler = http.HandlerFunc(func(wri http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "" {
+			wri.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		wri.WriteHeader(http.StatusOK)
+	})
+
+	tokensPath := filepath.Join(t.TempDir(), "tokens")
+	if err := os.WriteFile(tokensPath, []byte("admin:admin-token\nmonitor:monitor-token:readonly\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tc.frontend.AuthTokens = tokensPath
+	tc.server.RuleSets = map[string][]Rule{
+		"readonly": {{
+			Methods: map[string]struct{}{"HEAD": {}},
+			Pattern: regexp.MustCompile(`^/_ping$`),
+		}},
+	}
+
+	ready := make(chan any, 1)
+	go func() {
+		err := tc.server.Start(ready)
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+	<-ready
+
+	addrs, err := tc.server.Addrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		token  string
+		path   string
+		wanted int
+	}{
+		{"", "/_ping", http.StatusUnauthorized},
+		{"admin-token", "/_ping", http.StatusOK},
+		{"admin-token", "/info", http.StatusOK},
+		// Credentials mapped to a rule set only get its rules
+		{"monitor-token", "/_ping", http.StatusOK},
+		{"monitor-token", "/info", http.StatusForbidden},
+		{"wrong-token", "/_ping", http.StatusUnauthorized},
+	}
+
+	for _, c := range testCases {
+		req, err := http.NewRequest("HEAD", fmt.Sprintf("http://%s%s", addrs[0].String(), c.path), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.token != "" {
+			req.Header.Set("Authorization", "Bearer "+c.token)
+		}
+
+		res, err := tc.client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = res.Body.Close()
+
+		if res.StatusCode != c.wanted {
+			t.Errorf("%q %s: res.StatusCode = %d, want %d", c.token, c.path, res.StatusCode, c.wanted)
+		}
+		if c.wanted == http.StatusUnauthorized && res.Header.Get("WWW-Authenticate") == "" {
+			t.Errorf("%q %s: missing WWW-Authenticate header", c.token, c.path)
+		}
+	}
+
+	// Too many failed attempts block further authenticated requests from the same client
+	for i := 0; i < authMaxFailures; i++ {
+		req, err := http.NewRequest("HEAD", fmt.Sprintf("http://%s/_ping", addrs[0].String()), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer wrong-token")
+		res, err := tc.client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = res.Body.Close()
+	}
+	req, err := http.NewRequest("HEAD", fmt.Sprintf("http://%s/_ping", addrs[0].String()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer admin-token")
+	res, err := tc.client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = res.Body.Close()
+	if res.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("res.StatusCode = %d, want %d", res.StatusCode, http.StatusTooManyRequests)
+	}
+
+	err = tc.server.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCetusGuardAuthUnknownRuleSet(t *testing.T) {
+	tc := &testCase{
+		daemonListenerFunc: tcpDaemonListener,
+		daemonFunc:         plainDaemon,
+		backendFunc:        plainBackend,
+		frontendFunc:       plainFrontend,
+		clientFunc:         plainClient,
+	}
+
+	defer tc.setup(t)()
+	tc.daemon.Handler = http.HandlerFunc(httpDaemonHandler)
+
+	tokensPath := filepath.Join(t.TempDir(), "tokens")
+	if err := os.WriteFile(tokensPath, []byte("monitor:monitor-token:readonly\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tc.frontend.AuthTokens = tokensPath
+
+	ready := make(chan any, 1)
+	go func() {
+		err := tc.server.Start(ready)
+		if err == nil {
+			t.Errorf("server started, want an error")
+		}
+	}()
+	<-ready
+
+	_ = tc.server.Stop()
+}
+
+func TestCetusGuardProxyProtocolReq(t *testing.T) {
+	tc := &testCase{
+		daemonListenerFunc: tcpDaemonListener,
+		daemonFunc:         plainDaemon,
+		backendFunc:        plainBackend,
+		frontendFunc:       plainFrontend,
+		clientFunc:         plainClient,
+	}
+
+	defer tc.setup(t)()
+	tc.daemon.Handler = http.HandlerFunc(func(wri http.ResponseWriter, req *http.Request) {
+		wri.WriteHeader(http.StatusOK)
+	})
+
+	acl, err := BuildAclRules("deny 192.0.2.99\nallow 192.0.2.0/24\nallow 127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc.frontend.Acl = acl
+	tc.frontend.ProxyProtocol = tc.frontend.Addr
+	tc.frontend.ProxyTrusted = []*net.IPNet{{IP: net.IPv4(127, 0, 0, 1), Mask: net.CIDRMask(32, 32)}}
+	tc.server.Rules, err = BuildRules("HEAD;client-addr=192.0.2.1 %API_PREFIX_INFO%\nHEAD %API_PREFIX_PING%")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ready := make(chan any, 1)
+	go func() {
+		err := tc.server.Start(ready)
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+	<-ready
+
+	addrs, err := tc.server.Addrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		header string
+		path   string
+		wanted int
+	}{
+		{"PROXY TCP4 192.0.2.1 127.0.0.1 12345 2375\r\n", "/_ping", http.StatusOK},
+		{"PROXY TCP4 192.0.2.1 127.0.0.1 12345 2375\r\n", "/info", http.StatusOK},
+		{"PROXY TCP4 192.0.2.2 127.0.0.1 12345 2375\r\n", "/info", http.StatusForbidden},
+		// Connections of the proxy on its own behalf use its address
+		{"PROXY UNKNOWN\r\n", "/_ping", http.StatusOK},
+		// Connections that are not allowed are closed without a response
+		{"PROXY TCP4 192.0.2.99 127.0.0.1 12345 2375\r\n", "/_ping", 0},
+		{"PROXY TCP4 198.51.100.1 127.0.0.1 12345 2375\r\n", "/_ping", 0},
+		{"", "/_ping", 0},
+	}
+
+	for _, c := range testCases {
+		conn, err := net.Dial("tcp", addrs[0].String())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = fmt.Fprintf(conn, "%sHEAD %s HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n", c.header, c.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		_ = conn.Close()
+		if c.wanted == 0 {
+			if err == nil {
+				t.Errorf("%q %s: res.StatusCode = %d, want an error", c.header, c.path, res.StatusCode)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q %s: %v", c.header, c.path, err)
+			continue
+		}
+		if res.StatusCode != c.wanted {
+			t.Errorf("%q %s: res.StatusCode = %d, want %d", c.header, c.path, res.StatusCode, c.wanted)
+		}
+	}
+
+	err = tc.server.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCetusGuardProxyProtocolUntrustedReq(t *testing.T) {
+	tc := &testCase{
+		daemonListenerFunc: tcpDaemonListener,
+		daemonFunc:         plainDaemon,
+		backendFunc:        plainBackend,
+		frontendFunc:       plainFrontend,
+		clientFunc:         plainClient,
+	}
+
+	defer tc.setup(t)()
+	tc.daemon.Handler = http.HandlerFunc(func(wri http.ResponseWriter, req *http.Request) {
+		wri.WriteHeader(http.StatusOK)
+	})
+
+	acl, err := BuildAclRules("allow 192.0.2.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc.frontend.Acl = acl
+	tc.frontend.ProxyProtocol = tc.frontend.Addr
+	tc.frontend.ProxyTrusted = []*net.IPNet{{IP: net.IPv4(198, 51, 100, 0), Mask: net.CIDRMask(24, 32)}}
+
+	ready := make(chan any, 1)
+	go func() {
+		err := tc.server.Start(ready)
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+	<-ready
+
+	addrs, err := tc.server.Addrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A client that is not a trusted proxy cannot spoof an allowed address with the header
+	conn, err := net.Dial("tcp", addrs[0].String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fmt.Fprintf(conn, "PROXY TCP4 192.0.2.1 127.0.0.1 12345 2375\r\nHEAD /_ping HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	_ = conn.Close()
+	if err == nil {
+		t.Errorf("res.StatusCode = %d, want an error", res.StatusCode)
+	}
+
+	err = tc.server.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCetusGuardProxyProtocolWithoutTrusted(t *testing.T) {
+	tc := &testCase{
+		daemonListenerFunc: tcpDaemonListener,
+		daemonFunc:         plainDaemon,
+		backendFunc:        plainBackend,
+		frontendFunc:       plainFrontend,
+		clientFunc:         plainClient,
+	}
+
+	defer tc.setup(t)()
+	tc.daemon.Handler = http.HandlerFunc(httpDaemonHandler)
+	tc.frontend.ProxyProtocol = tc.frontend.Addr
+
+	ready := make(chan any, 1)
+	go func() {
+		err := tc.server.Start(ready)
+		if err == nil {
+			t.Errorf("server started, want an error")
+		}
+	}()
+	<-ready
+
+	_ = tc.server.Stop()
+}
+
+func TestCetusGuardAclReq(t *testing.T) {
+	tc := &testCase{
+		daemonListenerFunc: tcpDaemonListener,
+		daemonFunc:         plainDaemon,
+		backendFunc:        plainBackend,
+		frontendFunc:       plainFrontend,
+		clientFunc:         plainClient,
+	}
+
+	defer tc.setup(t)()
+	tc.daemon.Handler = http.HandlerFunc(httpDaemonHandler)
+
+	acl, err := BuildAclRules("allow 192.0.2.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc.frontend.Acl = acl
+
+	ready := make(chan any, 1)
+	go func() {
+		err := tc.server.Start(ready)
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+	<-ready
+
+	addrs, err := tc.server.Addrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := httpClientAllowedReq("http", addrs[0].String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := tc.client.Do(req)
+	if err == nil || res != nil {
+		t.Errorf("response returned, want an error")
+	}
+
+	err = tc.server.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCetusGuardProxyProtocolUnknownListener(t *testing.T) {
+	tc := &testCase{
+		daemonListenerFunc: tcpDaemonListener,
+		daemonFunc:         plainDaemon,
+		backendFunc:        plainBackend,
+		frontendFunc:       plainFrontend,
+		clientFunc:         plainClient,
+	}
+
+	defer tc.setup(t)()
+	tc.daemon.Handler = http.HandlerFunc(httpDaemonHandler)
+	tc.frontend.ProxyProtocol = []string{"tcp://127.0.0.1:2375"}
+	tc.frontend.ProxyTrusted = []*net.IPNet{{IP: net.IPv4(127, 0, 0, 1), Mask: net.CIDRMask(32, 32)}}
+
+	ready := make(chan any, 1)
+	go func() {
+		err := tc.server.Start(ready)
+		if err == nil {
+			t.Errorf("server started, want an error")
+		}
+	}()
+	<-ready
+
+	_ = tc.server.Stop()
+}
+
+func TestCetusGuardRateLimitedReq(t *testing.T) {
+	tc := &testCase{
+		daemonListenerFunc: tcpDaemonListener,
+		daemonFunc:         plainDaemon,
+		backendFunc:        plainBackend,
+		frontendFunc:       plainFrontend,
+		clientFunc:         plainClient,
+	}
+
+	defer tc.setup(t)()
+	tc.daemon.Handler = http.HandlerFunc(func(wri http.ResponseWriter, req *http.Request) {
+		wri.WriteHeader(http.StatusOK)
+	})
+
+	var err error
+	tc.server.Rules, err = BuildRules("HEAD;rate-limit=1/h;burst=2 %API_PREFIX_INFO%\nHEAD %API_PREFIX_PING%")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc.server.RateLimit = Rate{1, time.Hour}
+	tc.server.RateLimitBurst = 4
+
+	ready := make(chan any, 1)
+	go func() {
+		err := tc.server.Start(ready)
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+	<-ready
+
+	addrs, err := tc.server.Addrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		path   string
+		wanted int
+	}{
+		{"/info", http.StatusOK},
+		{"/info", http.StatusOK},
+		// The rule limit is exceeded
+		{"/info", http.StatusTooManyRequests},
+		{"/_ping", http.StatusOK},
+		// The global limit is exceeded, the rejected request also counts
+		{"/_ping", http.StatusTooManyRequests},
+	}
+
+	for _, c := range testCases {
+		req, err := http.NewRequest("HEAD", fmt.Sprintf("http://%s%s", addrs[0].String(), c.path), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res, err := tc.client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = res.Body.Close()
+
+		if res.StatusCode != c.wanted {
+			t.Errorf("%s: res.StatusCode = %d, want %d", c.path, res.StatusCode, c.wanted)
+		}
+		if c.wanted == http.StatusTooManyRequests && res.Header.Get("Retry-After") == "" {
+			t.Errorf("%s: missing Retry-After header", c.path)
+		}
+	}
+
+	err = tc.server.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCetusGuardMaxSessionsReq(t *testing.T) {
+	tc := &testCase{
+		daemonListenerFunc: tcpDaemonListener,
+		daemonFunc:         plainDaemon,
+		backendFunc:        plainBackend,
+		frontendFunc:       plainFrontend,
+		clientFunc:         plainClient,
+	}
+
+	defer tc.setup(t)()
+	tc.daemon.Handler = http.HandlerFunc(httpDaemonHandler)
+	tc.server.MaxSessions = 1
+
+	ready := make(chan any, 1)
+	go func() {
+		err := tc.server.Start(ready)
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+	<-ready
+
+	addrs, err := tc.server.Addrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upgrade := func() (net.Conn, *http.Response) {
+		conn, err := net.Dial("tcp", addrs[0].String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := httpClientAllowedReq("http", addrs[0].String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", "tcp")
+		if err := req.Write(conn); err != nil {
+			t.Fatal(err)
+		}
+		res, err := http.ReadResponse(bufio.NewReader(conn), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn, res
+	}
+
+	conn, res := upgrade()
+	defer func() {
+		_ = conn.Close()
+	}()
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("res.StatusCode = %d, want %d", res.StatusCode, http.StatusSwitchingProtocols)
+	}
+
+	otherConn, otherRes := upgrade()
+	_ = otherConn.Close()
+	if otherRes.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("res.StatusCode = %d, want %d", otherRes.StatusCode, http.StatusTooManyRequests)
+	}
+
+	_ = conn.Close()
+	err = tc.server.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCetusGuardMaxSessionsAttachReq(t *testing.T) {
+	tc := &testCase{
+		daemonListenerFunc: tcpDaemonListener,
+		daemonFunc:         plainDaemon,
+		backendFunc:        plainBackend,
+		frontendFunc:       plainFrontend,
+		clientFunc:         plainClient,
+	}
+
+	defer tc.setup(t)()
+	release := make(chan struct{})
+	tc.daemon.Handler = http.HandlerFunc(func(wri http.ResponseWriter, req *http.Request) {
+		wri.Header().Set("Content-Type", mediaTypeRawStream)
+		wri.WriteHeader(http.StatusOK)
+		wri.(http.Flusher).Flush()
+		select {
+		case <-release:
+		case <-req.Context().Done():
+		}
+	})
+	tc.server.MaxSessions = 1
+
+	var err error
+	tc.server.Rules, err = BuildRules("POST %API_PREFIX_CONTAINERS%/%CONTAINER_ID_OR_NAME%/attach(\\?.*)?")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ready := make(chan any, 1)
+	go func() {
+		err := tc.server.Start(ready)
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+	<-ready
+
+	addrs, err := tc.server.Addrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Attach requests without an Upgrade header stream the session on the response and count towards the limit
+	attach := func() *http.Response {
+		req, err := http.NewRequest("POST", "http://"+addrs[0].String()+"/containers/test/attach?stream=1&stdout=1", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := tc.client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	res := attach()
+	defer func() {
+		_ = res.Body.Close()
+	}()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("res.StatusCode = %d, want %d", res.StatusCode, http.StatusOK)
+	}
+
+	otherRes := attach()
+	_ = otherRes.Body.Close()
+	if otherRes.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("res.StatusCode = %d, want %d", otherRes.StatusCode, http.StatusTooManyRequests)
+	}
+
+	close(release)
+	_ = res.Body.Close()
+	err = tc.server.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCetusGuardHardeningReq(t *testing.T) {
+	tc := &testCase{
+		daemonListenerFunc: tcpDaemonListener,
+		daemonFunc:         plainDaemon,
+		backendFunc:        plainBackend,
+		frontendFunc:       plainFrontend,
+		clientFunc:         plainClient,
+	}
+
+	defer tc.setup(t)()
+
+	received := make(chan map[string]any, 1)
+	tc.daemon.Handler = http.HandlerFunc(func(wri http.ResponseWriter, req *http.Request) {
+		data, err := io.ReadAll(req.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		if req.ContentLength != int64(len(data)) {
+			t.Errorf("req.ContentLength = %d, want %d", req.ContentLength, len(data))
+		}
+		var body map[string]any
+		if err := json.Unmarshal(data, &body); err != nil {
+			t.Error(err)
+		}
+		received <- body
+		wri.WriteHeader(http.StatusCreated)
+	})
+
+	var err error
+	tc.server.Rules, err = BuildRules("POST %API_PREFIX_CONTAINERS%/create(\\?.*)?")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc.server.Hardening = &Hardening{
+		NoNewPrivileges:  true,
+		DropCapabilities: true,
+		CapAllowlist:     []string{"chown", "CAP_NET_ADMIN"},
+		ReadonlyRootfs:   true,
+		DefaultPidsLimit: 100,
+	}
+
+	ready := make(chan any, 1)
+	go func() {
+		err := tc.server.Start(ready)
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+	<-ready
+
+	addrs, err := tc.server.Addrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	url := fmt.Sprintf("http://%s/v1.41/containers/create?name=foo", addrs[0].String())
+	res, err := tc.client.Post(url, "application/json", strings.NewReader(`{"Image":"alpine","HostConfig":{"CapAdd":["NET_ADMIN","SYS_ADMIN"],"PidsLimit":-1}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = res.Body.Close()
+
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("res.StatusCode = %d, want %d", res.StatusCode, http.StatusCreated)
+	}
+
+	hc := (<-received)["HostConfig"].(map[string]any)
+	wanted := map[string]any{
+		"SecurityOpt":    []any{"no-new-privileges:true"},
+		"CapAdd":         []any{"CHOWN", "NET_ADMIN"},
+		"CapDrop":        []any{"ALL"},
+		"ReadonlyRootfs": true,
+		"PidsLimit":      float64(100),
+	}
+	for k, v := range wanted {
+		if fmt.Sprint(hc[k]) != fmt.Sprint(v) {
+			t.Errorf("HostConfig.%s = %v, want %v", k, hc[k], v)
+		}
+	}
+
+	// A HostConfig field whose name differs in case is hardened as well
+	res, err = tc.client.Post(url, "application/json", strings.NewReader(`{"Image":"alpine","hostconfig":{"Privileged":true,"CapAdd":["ALL"]}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = res.Body.Close()
+
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("res.StatusCode = %d, want %d", res.StatusCode, http.StatusCreated)
+	}
+
+	body := <-received
+	if _, ok := body["hostconfig"]; ok {
+		t.Errorf("hostconfig forwarded: %v", body)
+	}
+	hc = body["HostConfig"].(map[string]any)
+	if hc["Privileged"] != false || fmt.Sprint(hc["CapAdd"]) != "[CHOWN NET_ADMIN]" {
+		t.Errorf("HostConfig = %v, want it hardened", hc)
+	}
+
+	// Bodies that cannot be rewritten are not forwarded, including those where a HostConfig field
+	// whose name differs in case would undo the hardening
+	for _, data := range []string{
+		`{"Image":`,
+		`{"Image":"alpine","HostConfig":{},"hostconfig":{"Privileged":true,"CapAdd":["ALL"]}}`,
+	} {
+		res, err = tc.client.Post(url, "application/json", strings.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = res.Body.Close()
+
+		if res.StatusCode != http.StatusForbidden {
+			t.Errorf("%s: res.StatusCode = %d, want %d", data, res.StatusCode, http.StatusForbidden)
+		}
+	}
+
+	err = tc.server.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCetusGuardExecPolicyReq(t *testing.T) {
+	tc := &testCase{
+		daemonListenerFunc: tcpDaemonListener,
+		daemonFunc:         plainDaemon,
+		backendFunc:        plainBackend,
+		frontendFunc:       plainFrontend,
+		clientFunc:         plainClient,
+	}
+
+	defer tc.setup(t)()
+
+	received := make(chan map[string]any, 1)
+	tc.daemon.Handler = http.HandlerFunc(func(wri http.ResponseWriter, req *http.Request) {
+		var body map[string]any
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			t.Error(err)
+		}
+		received <- body
+		wri.WriteHeader(http.StatusCreated)
+	})
+
+	var err error
+	tc.server.Rules, err = BuildRules("POST %API_PREFIX_CONTAINERS%/%CONTAINER_ID_OR_NAME%/exec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	execRules, err := BuildExecRules("allow ps aux")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc.server.ExecPolicy = &ExecPolicy{Rules: execRules, DefaultUser: "65534"}
+
+	ready := make(chan any, 1)
+	go func() {
+		err := tc.server.Start(ready)
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+	<-ready
+
+	addrs, err := tc.server.Addrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		body   string
+		wanted int
+	}{
+		{`{"Cmd":["ps","aux"]}`, http.StatusCreated},
+		{`{"Cmd":["sh"]}`, http.StatusForbidden},
+		{`{"Cmd":["ps","aux"],"User":"root"}`, http.StatusForbidden},
+	}
+
+	for _, c := range testCases {
+		res, err := tc.client.Post(fmt.Sprintf("http://%s/v1.41/containers/foo/exec", addrs[0].String()), "application/json", strings.NewReader(c.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = res.Body.Close()
+
+		if res.StatusCode != c.wanted {
+			t.Errorf("%s: res.StatusCode = %d, want %d", c.body, res.StatusCode, c.wanted)
+		}
+		if res.StatusCode == http.StatusCreated {
+			if user := (<-received)["User"]; user != "65534" {
+				t.Errorf("%s: User = %v, want 65534", c.body, user)
+			}
+		}
+	}
+
+	err = tc.server.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCetusGuardImagePolicyReq(t *testing.T) {
+	tc := &testCase{
+		daemonListenerFunc: tcpDaemonListener,
+		daemonFunc:         plainDaemon,
+		backendFunc:        plainBackend,
+		frontendFunc:       plainFrontend,
+		clientFunc:         plainClient,
+	}
+
+	defer tc.setup(t)()
+	tc.daemon.Handler = http.HandlerFunc(func(wri http.ResponseWriter, req *http.Request) {
+		// Request bodies that are not inspected are forwarded as they are
+		data, err := io.ReadAll(req.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		_, _ = wri.Write(data)
+	})
+
+	var err error
+	tc.server.Rules, err = BuildRules("POST %API_PREFIX_IMAGES%/create\nPOST %API_PREFIX_BUILD%")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc.server.ImagePolicy = &ImagePolicy{Repositories: []string{"docker.io/library/*"}}
+
+	ready := make(chan any, 1)
+	go func() {
+		err := tc.server.Start(ready)
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+	<-ready
+
+	addrs, err := tc.server.Addrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		path   string
+		body   string
+		wanted int
+	}{
+		{"/v1.41/images/create?fromImage=alpine&tag=3.19", "", http.StatusOK},
+		{"/v1.41/images/create?fromImage=hectorm/cetusguard&tag=latest", "", http.StatusForbidden},
+		{"/v1.41/images/create?fromSrc=-&repo=alpine", "", http.StatusForbidden},
+		{"/v1.41/build?t=foo&cachefrom=%5B%22alpine%22%5D", "FROM alpine", http.StatusOK},
+		{"/v1.41/build?t=foo&cachefrom=%5B%22hectorm%2Fcetusguard%22%5D", "FROM alpine", http.StatusForbidden},
+	}
+
+	for _, c := range testCases {
+		res, err := tc.client.Post(fmt.Sprintf("http://%s%s", addrs[0].String(), c.path), mediaTypeTar, strings.NewReader(c.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(res.Body)
+		_ = res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if res.StatusCode != c.wanted {
+			t.Errorf("%s: res.StatusCode = %d, want %d", c.path, res.StatusCode, c.wanted)
+		}
+		if res.StatusCode == http.StatusOK && string(data) != c.body {
+			t.Errorf("%s: body = %q, want %q", c.path, data, c.body)
+		}
+	}
+
+	err = tc.server.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCetusGuardOwnerRulesReq(t *testing.T) {
+	tc := &testCase{
+		daemonListenerFunc: tcpDaemonListener,
+		daemonFunc:         plainDaemon,
+		backendFunc:        plainBackend,
+		frontendFunc:       plainFrontend,
+		clientFunc:         plainClient,
+	}
+
+	defer tc.setup(t)()
+
+	containers := map[string]string{
+		"mine":  `{"Id":"aaaa","Config":{"Labels":{"project":"ci-123"}}}`,
+		"other": `{"Id":"bbbb","Config":{"Labels":{"project":"ci-124"}}}`,
+		"aa":    `{"Id":"aaaa","Config":{"Labels":{"project":"ci-123"}}}`,
+	}
+	var containersMu sync.Mutex
+	events := make(chan string)
+	watching := make(chan any, 1)
+	inspections := make(chan string, 16)
+	forwarded := make(chan *http.Request, 1)
+	forwardedBody := make(chan string, 1)
+	tc.daemon.Handler = http.HandlerFunc(func(wri http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/events" {
+			wri.WriteHeader(http.StatusOK)
+			wri.(http.Flusher).Flush()
+			watching <- nil
+			for {
+				select {
+				case event := <-events:
+					_, _ = wri.Write([]byte(event + "\n"))
+					wri.(http.Flusher).Flush()
+				case <-req.Context().Done():
+					return
+				}
+			}
+		}
+		if m := regexp.MustCompile(`^/containers/([^/]+)/json$`).FindStringSubmatch(req.URL.Path); m != nil && !strings.HasPrefix(req.URL.Path, "/v") {
+			inspections <- m[1]
+			containersMu.Lock()
+			container, ok := containers[m[1]]
+			containersMu.Unlock()
+			if ok {
+				_, _ = wri.Write([]byte(container))
+			} else {
+				wri.WriteHeader(http.StatusNotFound)
+			}
+			return
+		}
+		body, _ := io.ReadAll(req.Body)
+		forwarded <- req
+		forwardedBody <- string(body)
+		wri.WriteHeader(http.StatusOK)
+	})
+
+	var err error
+	tc.server.Rules, err = BuildRules("GET,POST %API_PREFIX_CONTAINERS%/.+")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc.server.OwnerRules, err = BuildOwnerRules("label=project=ci-123")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ready := make(chan any, 1)
+	go func() {
+		err := tc.server.Start(ready)
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+	<-ready
+	<-watching
+
+	// Objects are cached once the proxy has received the headers of the event stream
+	for _, oc := range tc.server.owners {
+		for _, targetCache := range oc.targets {
+			for i := 0; ; i++ {
+				targetCache.mu.Lock()
+				watching := targetCache.watching
+				targetCache.mu.Unlock()
+				if watching {
+					break
+				}
+				if i == 100 {
+					t.Fatal("backend events are not being watched")
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		}
+	}
+
+	addrs, err := tc.server.Addrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	do := func(method string, path string, body string) int {
+		req, err := http.NewRequest(method, fmt.Sprintf("http://%s%s", addrs[0].String(), path), strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := tc.client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = res.Body.Close()
+		return res.StatusCode
+	}
+
+	testCases := []struct {
+		method string
+		path   string
+		body   string
+		wanted int
+	}{
+		{http.MethodGet, "/v1.41/containers/mine/json", "", http.StatusOK},
+		{http.MethodPost, "/v1.41/containers/mine/start", "", http.StatusOK},
+		{http.MethodGet, "/v1.41/containers/other/json", "", http.StatusForbidden},
+		{http.MethodPost, "/v1.41/containers/other/exec", `{"Cmd":["sh"]}`, http.StatusForbidden},
+		{http.MethodPost, "/v1.41/containers/missing/start", "", http.StatusOK},
+		{http.MethodPost, "/v1.41/containers/create", `{"Image":"alpine","HostConfig":{"VolumesFrom":["other"]}}`, http.StatusForbidden},
+		{http.MethodPost, "/v1.41/containers/create", `{"Image":"alpine","Labels":{"project":"ci-124"}}`, http.StatusForbidden},
+		// Fields whose names differ in case are matched by the daemon
+		{http.MethodPost, "/v1.41/containers/create", `{"Image":"alpine","hostconfig":{"VolumesFrom":["other"],"NetworkMode":"container:other"}}`, http.StatusForbidden},
+		{http.MethodPost, "/v1.41/containers/create", `{"Image":"alpine","labels":{"project":"ci-124"}}`, http.StatusForbidden},
+		{http.MethodPost, "/v1.41/containers/create", `{"Image":"alpine","Labels":{"project":"ci-123"},"labels":{"project":"ci-124"}}`, http.StatusForbidden},
+	}
+
+	for _, c := range testCases {
+		if status := do(c.method, c.path, c.body); status != c.wanted {
+			t.Errorf("%s %s: res.StatusCode = %d, want %d", c.method, c.path, status, c.wanted)
+		}
+		if c.wanted == http.StatusOK {
+			<-forwarded
+			<-forwardedBody
+		}
+	}
+
+	if status := do(http.MethodPost, "/v1.41/containers/create", `{"Image":"alpine","HostConfig":{"VolumesFrom":["mine"]}}`); status != http.StatusOK {
+		t.Errorf("res.StatusCode = %d, want %d", status, http.StatusOK)
+	}
+	<-forwarded
+	if body := <-forwardedBody; body != `{"HostConfig":{"VolumesFrom":["mine"]},"Image":"alpine","Labels":{"project":"ci-123"}}` {
+		t.Errorf("body = %s, want the label", body)
+	}
+
+	if status := do(http.MethodGet, "/v1.41/containers/json?all=1", ""); status != http.StatusOK {
+		t.Errorf("res.StatusCode = %d, want %d", status, http.StatusOK)
+	}
+	if filters := (<-forwarded).URL.Query().Get("filters"); filters != `{"label":["project=ci-123"]}` {
+		t.Errorf("filters = %s, want the label", filters)
+	}
+	<-forwardedBody
+
+	// The owned container was inspected once, and is inspected again once it is destroyed
+	countInspections := func(name string) int {
+		n := 0
+		for {
+			select {
+			case i := <-inspections:
+				if i == name {
+					n++
+				}
+			default:
+				return n
+			}
+		}
+	}
+	if n := countInspections("mine"); n != 1 {
+		t.Errorf("inspections = %d, want 1", n)
+	}
+
+	events <- `{"Type":"container","Action":"destroy","Actor":{"ID":"aaaa"}}`
+	for i := 0; ; i++ {
+		if status := do(http.MethodGet, "/v1.41/containers/mine/json", ""); status != http.StatusOK {
+			t.Errorf("res.StatusCode = %d, want %d", status, http.StatusOK)
+		}
+		<-forwarded
+		<-forwardedBody
+		if countInspections("mine") > 0 {
+			break
+		}
+		if i == 100 {
+			t.Fatal("container was not inspected again after being destroyed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// A container created with a name equal to a cached ID prefix is the one the prefix refers to afterwards
+	if status := do(http.MethodGet, "/v1.41/containers/aa/json", ""); status != http.StatusOK {
+		t.Errorf("res.StatusCode = %d, want %d", status, http.StatusOK)
+	}
+	<-forwarded
+	<-forwardedBody
+	containersMu.Lock()
+	containers["aa"] = `{"Id":"cccc","Config":{"Labels":{"project":"ci-124"}}}`
+	containersMu.Unlock()
+	events <- `{"Type":"container","Action":"create","Actor":{"ID":"cccc"}}`
+	for i := 0; ; i++ {
+		status := do(http.MethodGet, "/v1.41/containers/aa/json", "")
+		if status == http.StatusForbidden {
+			break
+		}
+		<-forwarded
+		<-forwardedBody
+		if i == 100 {
+			t.Fatal("container name shadowing a cached ID prefix was not inspected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	err = tc.server.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCetusGuardMountPolicyReq(t *testing.T) {
+	tc := &testCase{
+		daemonListenerFunc: tcpDaemonListener,
+		daemonFunc:         plainDaemon,
+		backendFunc:        plainBackend,
+		frontendFunc:       plainFrontend,
+		clientFunc:         plainClient,
+	}
+
+	defer tc.setup(t)()
+	tc.daemon.Handler = http.HandlerFunc(func(wri http.ResponseWriter, req *http.Request) {
+		// The daemon receives the body that was checked, with the names of the fields it matched
+		data, err := io.ReadAll(req.Body)
+		if err != nil || bytes.Contains(data, []byte(`"hostconfig"`)) {
+			wri.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		wri.WriteHeader(http.StatusCreated)
+	})
+
+	var err error
+	tc.server.Rules, err = BuildRules("POST %API_PREFIX_CONTAINERS%/create\nPOST %API_PREFIX_VOLUMES%/create\nPOST %API_PREFIX_LIBPOD_VOLUMES%/create")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc.server.MountPolicy = &MountPolicy{
+		AllowedPaths:  []string{"/builds"},
+		VolumeOptions: []string{"type", "o", "device"},
+	}
+
+	ready := make(chan any, 1)
+	go func() {
+		err := tc.server.Start(ready)
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+	<-ready
+
+	addrs, err := tc.server.Addrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		path   string
+		body   string
+		wanted int
+	}{
+		{"/v1.41/volumes/create", `{"Name":"data","DriverOpts":{"type":"none","o":"bind","device":"/builds/job"}}`, http.StatusCreated},
+		{"/v1.41/volumes/create", `{"Name":"data","DriverOpts":{"type":"none","o":"bind","device":"/"}}`, http.StatusForbidden},
+		{"/v1.41/volumes/create", `{"Name":"data","Driver":"nfs"}`, http.StatusForbidden},
+		{"/v4.0.0/libpod/volumes/create", `{"Name":"data","Options":{"type":"none","o":"bind","device":"/etc"}}`, http.StatusForbidden},
+		{"/v1.41/volumes/create", `{"Name":"data","driveropts":{"type":"none","o":"bind","device":"/"}}`, http.StatusForbidden},
+		{"/v1.41/containers/create", `{"Image":"alpine","hostconfig":{"Binds":["/builds/job:/src"]}}`, http.StatusCreated},
+		{"/v1.41/containers/create", `{"Image":"alpine","hostconfig":{"Binds":["/:/host"]}}`, http.StatusForbidden},
+		{"/v1.41/containers/create", `{"Image":"alpine","HostConfig":{"Binds":["/:/host"]},"HostConfig":{}}`, http.StatusForbidden},
+		{"/v1.41/containers/create", `{"Image":"alpine","Labels":{"Foo":"a","foo":"b"}}`, http.StatusCreated},
+	}
+
+	for _, c := range testCases {
+		res, err := tc.client.Post(fmt.Sprintf("http://%s%s", addrs[0].String(), c.path), "application/json", strings.NewReader(c.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = res.Body.Close()
+
+		if res.StatusCode != c.wanted {
+			t.Errorf("%s: res.StatusCode = %d, want %d", c.body, res.StatusCode, c.wanted)
+		}
+	}
+
+	err = tc.server.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCetusGuardPortPolicyReq(t *testing.T) {
+	tc := &testCase{
+		daemonListenerFunc: tcpDaemonListener,
+		daemonFunc:         plainDaemon,
+		backendFunc:        plainBackend,
+		frontendFunc:       plainFrontend,
+		clientFunc:         plainClient,
+	}
+
+	defer tc.setup(t)()
+	tc.daemon.Handler = http.HandlerFunc(func(wri http.ResponseWriter, req *http.Request) {
+		// The daemon receives the port bindings that were allowed
+		data, err := io.ReadAll(req.Body)
+		if err != nil || !bytes.Contains(data, []byte(`"PortBindings"`)) {
+			wri.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		wri.WriteHeader(http.StatusCreated)
+	})
+
+	var err error
+	tc.server.Rules, err = BuildRules("POST %API_PREFIX_CONTAINERS%/create")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc.server.PortPolicy = &PortPolicy{
+		HostIps:   []string{"127.0.0.1"},
+		HostPorts: []string{"20000-29999"},
+	}
+
+	ready := make(chan any, 1)
+	go func() {
+		err := tc.server.Start(ready)
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+	<-ready
+
+	addrs, err := tc.server.Addrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		body   string
+		wanted int
+	}{
+		{`{"Image":"alpine","HostConfig":{"PortBindings":{"80/tcp":[{"HostIp":"127.0.0.1","HostPort":"20080"}]}}}`, http.StatusCreated},
+		{`{"Image":"alpine","HostConfig":{"PortBindings":{"80/tcp":[{"HostIp":"0.0.0.0","HostPort":"80"}]}}}`, http.StatusForbidden},
+		{`{"Image":"alpine","HostConfig":{"PortBindings":{},"NetworkMode":"host"}}`, http.StatusForbidden},
+	}
+
+	for _, c := range testCases {
+		res, err := tc.client.Post(fmt.Sprintf("http://%s/v1.41/containers/create", addrs[0].String()), "application/json", strings.NewReader(c.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = res.Body.Close()
+
+		if res.StatusCode != c.wanted {
+			t.Errorf("%s: res.StatusCode = %d, want %d", c.body, res.StatusCode, c.wanted)
+		}
+	}
+
+	err = tc.server.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCetusGuardTlsBootstrapReq(t *testing.T) {
+	tc := &testCase{
+		daemonListenerFunc: tcpDaemonListener,
+		daemonFunc:         tlsDaemon,
+		backendFunc:        tlsBackend,
+		frontendFunc:       plainFrontend,
+		clientFunc:         plainClient,
+	}
+
+	defer tc.setup(t)()
+	tc.daemon.Handler = http.HandlerFunc(httpDaemonHandler)
+
+	bootstrapDir := filepath.Join(t.TempDir(), "certs")
+	tc.server.Frontend.TlsBootstrapDir = bootstrapDir
+
+	ready := make(chan any, 1)
+	go func() {
+		err := tc.server.Start(ready)
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+	<-ready
+
+	addrs, err := tc.server.Addrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The client bundle is enough to verify the server and authenticate against it
+	clientDir := filepath.Join(bootstrapDir, "client")
+	cert, err := tls.LoadX509KeyPair(filepath.Join(clientDir, "cert.pem"), filepath.Join(clientDir, "key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cacertPool, _, err := loadCacerts(filepath.Join(clientDir, "ca.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc.client.Transport.(*http.Transport).TLSClientConfig = &tls.Config{
+		MinVersion:   minTlsVersion,
+		RootCAs:      cacertPool,
+		Certificates: []tls.Certificate{cert},
+	}
+
+	req, err := httpClientAllowedReq("https", addrs[0].String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := tc.client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("res.StatusCode = %d, want %d", res.StatusCode, http.StatusOK)
+	}
+
+	// A client without a certificate is rejected
+	noCertClient, err := plainClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	noCertClient.Transport.(*http.Transport).TLSClientConfig = &tls.Config{
+		MinVersion: minTlsVersion,
+		RootCAs:    cacertPool,
+	}
+
+	req, err = httpClientAllowedReq("https", addrs[0].String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err = noCertClient.Do(req)
+	if err == nil || res != nil {
+		t.Fatalf("response returned, want an error")
+	}
+
+	err = tc.server.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCetusGuardInvalidBackendCacert(t *testing.T) {
+	tc := &testCase{
+		daemonListenerFunc: tcpDaemonListener,
+		daemonFunc:         tlsDaemon,
+		backendFunc:        invalidCacertTlsBackend,
+		frontendFunc:       tlsFrontend,
+		clientFunc:         tlsClient,
+	}
+
+	defer tc.setup(t)()
+	tc.daemon.Handler = http.HandlerFunc(httpDaemonHandler)
+
+	ready := make(chan any, 1)
+	go func() {
+		err := tc.server.Start(ready)
+		if err == nil {
+			t.Errorf("server started, want an error")
+		}
+	}()
+	<-ready
+
+	_ = tc.server.Stop()
+}
+
+func TestCetusGuardInvalidBackendCert(t *testing.T) {
+	tc := &testCase{
+		daemonListenerFunc: tcpDaemonListener,
+		daemonFunc:         tlsAuthDaemon,
+		backendFunc:        invalidCertTlsAuthBackend,
+		frontendFunc:       tlsFrontend,
+		clientFunc:         tlsClient,
+	}
+
+	defer tc.setup(t)()
+	tc.daemon.Handler = http.HandlerFunc(httpDaemonHandler)
+
+	ready := make(chan any, 1)
+	go func() {
+		err := tc.server.Start(ready)
+		if err == nil {
+			t.Errorf("server started, want an error")
+		}
+	}()
+	<-ready
+
+	_ = tc.server.Stop()
+}
+
+func TestCetusGuardInvalidFrontendCacert(t *testing.T) {
+	tc := &testCase{
+		daemonListenerFunc: tcpDaemonListener,
+		daemonFunc:         tlsDaemon,
+		backendFunc:        tlsBackend,
+		frontendFunc:       invalidCacertTlsAuthFrontend,
+		clientFunc:         tlsAuthClient,
+	}
+
+	defer tc.setup(t)()
+	tc.daemon.Handler = http.HandlerFunc(httpDaemonHandler)
+
+	ready := make(chan any, 1)
+	go func() {
+		err := tc.server.Start(ready)
+		if err == nil {
+			t.Errorf("server started, want an error")
+		}
+	}()
+	<-ready
+
+	_ = tc.server.Stop()
+}
+
+func TestCetusGuardInvalidFrontendCert(t *testing.T) {
+	tc := &testCase{
+		daemonListenerFunc: tcpDaemonListener,
+		daemonFunc:         tlsDaemon,
+		backendFunc:        tlsBackend,
+		frontendFunc:       invalidCertTlsFrontend,
+		clientFunc:         tlsClient,
+	}
+
+	defer tc.setup(t)()
+	tc.daemon.Handler = http.HandlerFunc(httpDaemonHandler)
+
+	ready := make(chan any, 1)
+	go func() {
+		err := tc.server.Start(ready)
+		if err == nil {
+			t.Errorf("server started, want an error")
+		}
+	}()
+	<-ready
+
+	_ = tc.server.Stop()
+}
+
+func TestCetusGuardInvalidBackendAddr(t *testing.T) {
+	tc := &testCase{
+		daemonListenerFunc: tcpDaemonListener,
+		daemonFunc:         plainDaemon,
+		backendFunc:        plainBackend,
+		frontendFunc:       plainFrontend,
+		clientFunc:         plainClient,
+	}
+
+	defer tc.setup(t)()
+	tc.daemon.Handler = http.HandlerFunc(httpDaemonHandler)
+	tc.server.Backend.Addr = "invalid"
+
+	ready := make(chan any, 1)
+	go func() {
+		err := tc.server.Start(ready)
+		if err == nil {
+			t.Errorf("server started, want an error")
+		}
+	}()
+	<-ready
+
+	tc.server.Backend.Addr = "invalid://127.0.0.1:0"
+
+	ready = make(chan any, 1)
+	go func() {
+		err := tc.server.Start(ready)
+		if err == nil {
+			t.Errorf("server started, want an error")
+		}
+	}()
+	<-ready
+
+	_ = tc.server.Stop()
+}
+
+func TestCetusGuardInvalidFrontendAddr(t *testing.T) {
+	tc := &testCase{
+		daemonListenerFunc: tcpDaemonListener,
+		daemonFunc:         plainDaemon,
+		backendFunc:        plainBackend,
+		frontendFunc:       plainFrontend,
+		clientFunc:         plainClient,
+	}
+
+	defer tc.setup(t)()
+	tc.daemon.Handler = http.HandlerFunc(httpDaemonHandler)
+	tc.server.Frontend.Addr = []string{"tcp://127.0.0.1:0", "invalid"}
+
+	ready := make(chan any, 1)
+	go func() {
+		err := tc.server.Start(ready)
+		if err == nil {
+			t.Errorf("server started, want an error")
+		}
+	}()
+	<-ready
+
+	tc.server.Frontend.Addr = []string{"tcp://127.0.0.1:0", "invalid://127.0.0.1:0"}
+
+	ready = make(chan any, 1)
+	go func() {
+		err := tc.server.Start(ready)
+		if err == nil {
+			t.Errorf("server started, want an error")
+		}
+	}()
+	<-ready
+
+	_ = tc.server.Stop()
+}
+
+func TestCetusGuardFrontendListenMultiple(t *testing.T) {
+	tc := &testCase{
+		daemonListenerFunc: tcpDaemonListener,
+		daemonFunc:         plainDaemon,
+		backendFunc:        plainBackend,
+		frontendFunc:       plainFrontend,
+		clientFunc:         plainClient,
+	}
+
+	defer tc.setup(t)()
+	tc.daemon.Handler = http.HandlerFunc(httpDaemonHandler)
+	tc.server.Frontend.Addr = []string{"tcp://127.0.0.1:0", "tcp://127.0.0.1:0", "tcp://127.0.0.1:0", "tcp://127.0.0.1:0"}
+
+	ready := make(chan any, 1)
+	go func() {
+		err := tc.server.Start(ready)
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+	<-ready
+
+	addrs, err := tc.server.Addrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != len(tc.server.Frontend.Addr) {
+		t.Fatalf("len(addrs) = %d, want %d", len(addrs), len(tc.server.Frontend.Addr))
+	}
+
+	for _, addr := range addrs {
+		req, err := httpClientAllowedReq("http", addr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res, err := tc.client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("res.StatusCode = %d, want %d", res.StatusCode, http.StatusOK)
+		}
+
+		msg, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = res.Body.Close()
+
+		if string(msg) != "PONG" {
+			t.Fatalf(`msg = "%s", want "%s"`, msg, "PONG")
+		}
+	}
+
+	err = tc.server.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCetusGuardPlainRecordedExecReq(t *testing.T) {
+	tc := &testCase{
+		daemonListenerFunc: tcpDaemonListener,
+		daemonFunc:         plainDaemon,
+		backendFunc:        plainBackend,
+		frontendFunc:       plainFrontend,
+		clientFunc:         plainClient,
+	}
+
+	defer tc.setup(t)()
+	tc.daemon.Handler = http.HandlerFunc(httpExecDaemonHandler)
+	tc.server.RecordDir = t.TempDir()
+	tc.server.Rules = []Rule{{
+		Methods: map[string]struct{}{"POST": {}},
+		Pattern: regexp.MustCompile(`^.*$`),
+	}}
+
+	ready := make(chan any, 1)
+	go func() {
+		err := tc.server.Start(ready)
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+	<-ready
+
+	addrs, err := tc.server.Addrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := tc.client.Post("http://"+addrs[0].String()+"/v1.51/containers/foo/exec", "application/json", strings.NewReader(`{"Cmd":["cat"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := io.ReadAll(res.Body)
+	_ = res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("res.StatusCode = %d, want %d", res.StatusCode, http.StatusCreated)
+	}
+
+	var execCreateRes struct{ Id string }
+	if err := json.Unmarshal(msg, &execCreateRes); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial("tcp", addrs[0].String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	_, err = fmt.Fprintf(conn, "POST /v1.51/exec/%s/start HTTP/1.1\r\n"+
+		"Host: localhost\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Upgrade: tcp\r\n"+
+		"Content-Length: 0\r\n"+
+		"\r\n", execCreateRes.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	br := bufio.NewReader(conn)
+	res, err = http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("res.StatusCode = %d, want %d", res.StatusCode, http.StatusSwitchingProtocols)
+	}
+
+	_, err = conn.Write([]byte("PING\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err = io.ReadAll(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasSuffix(string(msg), "BYE\n") {
+		t.Fatalf(`msg = "%s", want suffix "%s"`, msg, "BYE\n")
+	}
+
+	err = tc.server.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := os.ReadDir(tc.server.RecordDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("len(entries) = %d, want %d", len(entries), 1)
+	}
+
+	recording, err := os.ReadFile(filepath.Join(tc.server.RecordDir, entries[0].Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(recording)), "\n")
+
+	var header asciicastHeader
+	if err := json.Unmarshal([]byte(lines[0]), &header); err != nil {
+		t.Fatal(err)
+	}
+	if header.Version != 2 {
+		t.Errorf("header.Version = %d, want %d", header.Version, 2)
+	}
+	if header.CetusGuard == nil || header.CetusGuard.ExecId != execCreateRes.Id || header.CetusGuard.ExecCreateRequestId == "" {
+		t.Errorf("header.CetusGuard = %+v, want a reference to the exec create request", header.CetusGuard)
+	}
+
+	events := map[string]string{}
+	for _, line := range lines[1:] {
+		var event []any
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			t.Fatal(err)
+		}
+		events[event[1].(string)] += event[2].(string)
+	}
+	if events["i"] != "PING\n" {
+		t.Errorf(`events["i"] = "%s", want "%s"`, events["i"], "PING\n")
+	}
+	if events["o"] != "PONG\nBYE\n" {
+		t.Errorf(`events["o"] = "%s", want "%s"`, events["o"], "PONG\nBYE\n")
+	}
+}
+
+func TestCetusGuardPlainIdleTimeoutHijackReq(t *testing.T) {
+	tc := &testCase{
+		daemonListenerFunc: tcpDaemonListener,
+		daemonFunc:         plainDaemon,
+		backendFunc:        plainBackend,
+		frontendFunc:       plainFrontend,
+		clientFunc:         plainClient,
+	}
+
+	defer tc.setup(t)()
+	tc.daemon.Handler = http.HandlerFunc(httpEndlessDaemonHandler)
+	tc.server.SessionIdleTimeout = 200 * time.Millisecond
+
+	ready := make(chan any, 1)
+	go func() {
+		err := tc.server.Start(ready)
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+	<-ready
+
+	addrs, err := tc.server.Addrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := httpClientAllowedReq("http", addrs[0].String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Upgrade", "tcp")
+	req.Header.Set("Connection", "Upgrade")
+
+	res, err := tc.client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = res.Body.Close()
+	}()
+
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("res.StatusCode = %d, want %d", res.StatusCode, http.StatusSwitchingProtocols)
+	}
+
+	// The daemon never closes the connection, so the read only ends when the session is terminated
+	msg, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(msg) != "PONG" {
+		t.Fatalf(`msg = "%s", want "%s"`, msg, "PONG")
+	}
+
+	err = tc.server.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCetusGuardPlainMaxLifetimeStreamReq(t *testing.T) {
+	tc := &testCase{
+		daemonListenerFunc: tcpDaemonListener,
+		daemonFunc:         plainDaemon,
+		backendFunc:        plainBackend,
+		frontendFunc:       plainFrontend,
+		clientFunc:         plainClient,
+	}
+
+	defer tc.setup(t)()
+	tc.daemon.Handler = http.HandlerFunc(httpEndlessDaemonHandler)
+	tc.server.SessionIdleTimeout = time.Hour
+	tc.server.Rules = []Rule{{
+		Methods: map[string]struct{}{"POST": {}},
+		Pattern: regexp.MustCompile(`^.*$`),
+		Options: RuleOptions{MaxLifetime: 200 * time.Millisecond},
+	}}
+
+	ready := make(chan any, 1)
+	go func() {
+		err := tc.server.Start(ready)
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+	<-ready
+
+	addrs, err := tc.server.Addrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := httpClientAllowedReq("http", addrs[0].String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	res, err := tc.client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = res.Body.Close()
+	}()
+
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("res.StatusCode = %d, want %d", res.StatusCode, http.StatusOK)
+	}
+
+	// The daemon never ends the stream and keeps it active, so the read only ends when the lifetime is exceeded
+	msg, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(string(msg), "PONG") {
+		t.Fatalf(`msg = "%s", want prefix "%s"`, msg, "PONG")
+	}
+
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Fatalf("elapsed = %s, want at least %s", elapsed, 200*time.Millisecond)
+	}
+
+	err = tc.server.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCetusGuardPlainGracefulShutdownHijackReq(t *testing.T) {
+	tc := &testCase{
+		daemonListenerFunc: tcpDaemonListener,
+		daemonFunc:         plainDaemon,
+		backendFunc:        plainBackend,
+		frontendFunc:       plainFrontend,
+		clientFunc:         plainClient,
+	}
+
+	defer tc.setup(t)()
+	tc.daemon.Handler = http.HandlerFunc(httpEndlessDaemonHandler)
+	tc.server.ShutdownGracePeriod = 100 * time.Millisecond
+
+	ready := make(chan any, 1)
+	go func() {
+		err := tc.server.Start(ready)
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+	<-ready
+
+	addrs, err := tc.server.Addrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := httpClientAllowedReq("http", addrs[0].String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Upgrade", "tcp")
+	req.Header.Set("Connection", "Upgrade")
+
+	res, err := tc.client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = res.Body.Close()
+	}()
+
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("res.StatusCode = %d, want %d", res.StatusCode, http.StatusSwitchingProtocols)
+	}
+
+	msg := make([]byte, 4)
+	_, err = io.ReadFull(res.Body, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(msg) != "PONG" {
+		t.Fatalf(`msg = "%s", want "%s"`, msg, "PONG")
+	}
+
+	chErr := make(chan error, 1)
 	go func() {
-		err := tc.server.Start(ready)
-		if err == nil {
-			t.Errorf("server started, want an error")
-		}
+		chErr <- tc.server.Stop()
 	}()
-	<-ready
 
-	tc.server.Backend.Addr = "invalid://127.0.0.1:0"
+	// The session is kept open by the daemon, so the read only ends when the server notifies the client
+	rest, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	ready = make(chan any, 1)
-	go func() {
-		err := tc.server.Start(ready)
-		if err == nil {
-			t.Errorf("server started, want an error")
-		}
-	}()
-	<-ready
+	if len(rest) != 0 {
+		t.Fatalf(`rest = "%s", want ""`, rest)
+	}
 
-	_ = tc.server.Stop()
+	_ = res.Body.Close()
+
+	select {
+	case err := <-chErr:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("server still stopping, want stopped")
+	}
 }
 
-func TestCetusGuardInvalidFrontendAddr(t *testing.T) {
+func TestCetusGuardPlainHalfCloseHijackReq(t *testing.T) {
 	tc := &testCase{
 		daemonListenerFunc: tcpDaemonListener,
 		daemonFunc:         plainDaemon,
@@ -1089,44 +4100,72 @@ func TestCetusGuardInvalidFrontendAddr(t *testing.T) {
 	}
 
 	defer tc.setup(t)()
-	tc.daemon.Handler = http.HandlerFunc(httpDaemonHandler)
-	tc.server.Frontend.Addr = []string{"tcp://127.0.0.1:0", "invalid"}
+	tc.daemon.Handler = http.HandlerFunc(httpEchoDaemonHandler)
 
 	ready := make(chan any, 1)
 	go func() {
 		err := tc.server.Start(ready)
-		if err == nil {
-			t.Errorf("server started, want an error")
+		if err != nil {
+			t.Error(err)
 		}
 	}()
 	<-ready
 
-	tc.server.Frontend.Addr = []string{"tcp://127.0.0.1:0", "invalid://127.0.0.1:0"}
+	addrs, err := tc.server.Addrs()
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	ready = make(chan any, 1)
-	go func() {
-		err := tc.server.Start(ready)
-		if err == nil {
-			t.Errorf("server started, want an error")
-		}
+	conn, err := net.Dial("tcp", addrs[0].String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = conn.Close()
 	}()
-	<-ready
 
-	_ = tc.server.Stop()
+	br, err := httpClientHijackReq(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = conn.Write([]byte("PING"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The daemon only replies after reading EOF, so the half-close must be propagated
+	err = conn.(*net.TCPConn).CloseWrite()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := io.ReadAll(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(msg) != "PING" {
+		t.Fatalf(`msg = "%s", want "%s"`, msg, "PING")
+	}
+
+	err = tc.server.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
 }
 
-func TestCetusGuardFrontendListenMultiple(t *testing.T) {
+func TestCetusGuardTlsAuthHalfCloseHijackReq(t *testing.T) {
 	tc := &testCase{
 		daemonListenerFunc: tcpDaemonListener,
-		daemonFunc:         plainDaemon,
-		backendFunc:        plainBackend,
-		frontendFunc:       plainFrontend,
-		clientFunc:         plainClient,
+		daemonFunc:         tlsAuthDaemon,
+		backendFunc:        tlsAuthBackend,
+		frontendFunc:       tlsAuthFrontend,
+		clientFunc:         tlsAuthClient,
 	}
 
 	defer tc.setup(t)()
-	tc.daemon.Handler = http.HandlerFunc(httpDaemonHandler)
-	tc.server.Frontend.Addr = []string{"tcp://127.0.0.1:0", "tcp://127.0.0.1:0", "tcp://127.0.0.1:0", "tcp://127.0.0.1:0"}
+	tc.daemon.Handler = http.HandlerFunc(httpEchoDaemonHandler)
 
 	ready := make(chan any, 1)
 	go func() {
@@ -1141,34 +4180,38 @@ func TestCetusGuardFrontendListenMultiple(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	if len(addrs) != len(tc.server.Frontend.Addr) {
-		t.Fatalf("len(addrs) = %d, want %d", len(addrs), len(tc.server.Frontend.Addr))
+
+	conn, err := tls.Dial("tcp", addrs[0].String(), tc.client.Transport.(*http.Transport).TLSClientConfig)
+	if err != nil {
+		t.Fatal(err)
 	}
+	defer func() {
+		_ = conn.Close()
+	}()
 
-	for _, addr := range addrs {
-		req, err := httpClientAllowedReq("http", addr.String())
-		if err != nil {
-			t.Fatal(err)
-		}
+	br, err := httpClientHijackReq(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
 
-		res, err := tc.client.Do(req)
-		if err != nil {
-			t.Fatal(err)
-		}
+	_, err = conn.Write([]byte("PING"))
+	if err != nil {
+		t.Fatal(err)
+	}
 
-		if res.StatusCode != http.StatusOK {
-			t.Fatalf("res.StatusCode = %d, want %d", res.StatusCode, http.StatusOK)
-		}
+	// The daemon only replies after reading EOF, so the half-close must be propagated
+	err = conn.CloseWrite()
+	if err != nil {
+		t.Fatal(err)
+	}
 
-		msg, err := io.ReadAll(res.Body)
-		if err != nil {
-			t.Fatal(err)
-		}
-		_ = res.Body.Close()
+	msg, err := io.ReadAll(br)
+	if err != nil {
+		t.Fatal(err)
+	}
 
-		if string(msg) != "PONG" {
-			t.Fatalf(`msg = "%s", want "%s"`, msg, "PONG")
-		}
+	if string(msg) != "PING" {
+		t.Fatalf(`msg = "%s", want "%s"`, msg, "PING")
 	}
 
 	err = tc.server.Stop()
@@ -1225,6 +4268,30 @@ func httpClientDeniedPatternReq(scheme string, addr string) (*http.Request, erro
 	return req, nil
 }
 
+func httpClientHijackReq(conn net.Conn) (*bufio.Reader, error) {
+	_, err := conn.Write([]byte("POST /~foo+bar+%F0%9F%90%B3 HTTP/1.1\r\n" +
+		"Host: test.cetusguard.localhost\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Upgrade: tcp\r\n" +
+		"Content-Length: 0\r\n" +
+		"\r\n"))
+	if err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("res.StatusCode = %d, want %d", res.StatusCode, http.StatusSwitchingProtocols)
+	}
+
+	return br, nil
+}
+
 func httpDaemonHandler(wri http.ResponseWriter, req *http.Request) {
 	b, err := io.ReadAll(req.Body)
 	if err != nil {
@@ -1278,6 +4345,154 @@ func httpDaemonHandler(wri http.ResponseWriter, req *http.Request) {
 	}
 }
 
+func httpExecDaemonHandler(wri http.ResponseWriter, req *http.Request) {
+	if strings.HasSuffix(req.URL.Path, "/exec") {
+		wri.Header().Set("Content-Type", "application/json")
+		wri.WriteHeader(http.StatusCreated)
+		_, _ = fmt.Fprintf(wri, `{"Id":"0123456789abcdef"}`)
+		return
+	}
+
+	hj, ok := wri.(http.Hijacker)
+	if !ok {
+		wri.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		return
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	_, err = brw.Write([]byte("HTTP/1.1 101 UPGRADED\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Upgrade: tcp\r\n" +
+		"Content-Type: application/vnd.docker.multiplexed-stream\r\n" +
+		"\r\n"))
+	if err != nil {
+		return
+	}
+
+	err = brw.Flush()
+	if err != nil {
+		return
+	}
+
+	b := make([]byte, 5)
+	_, err = io.ReadFull(brw, b)
+	if err != nil || string(b) != "PING\n" {
+		return
+	}
+
+	_, err = brw.Write([]byte("\x01\x00\x00\x00\x00\x00\x00\x05PONG\n\x02\x00\x00\x00\x00\x00\x00\x04BYE\n"))
+	if err != nil {
+		return
+	}
+
+	_ = brw.Flush()
+}
+
+func httpEndlessDaemonHandler(wri http.ResponseWriter, req *http.Request) {
+	if req.Header.Get("Upgrade") == "tcp" {
+		hj, ok := wri.(http.Hijacker)
+		if !ok {
+			wri.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		conn, brw, err := hj.Hijack()
+		if err != nil {
+			return
+		}
+		defer func() {
+			_ = conn.Close()
+		}()
+
+		_, err = brw.Write([]byte("HTTP/1.1 101 UPGRADED\r\n" +
+			"Connection: Upgrade\r\n" +
+			"Upgrade: tcp\r\n" +
+			"Content-Type: application/vnd.docker.raw-stream\r\n" +
+			"\r\n" +
+			"PONG"))
+		if err != nil {
+			return
+		}
+
+		err = brw.Flush()
+		if err != nil {
+			return
+		}
+
+		_, _ = io.Copy(io.Discard, conn)
+	} else {
+		wri.Header().Set("Content-Type", "application/vnd.docker.raw-stream")
+		wri.WriteHeader(http.StatusOK)
+
+		rc := http.NewResponseController(wri)
+		for {
+			_, err := fmt.Fprintf(wri, "PONG")
+			if err != nil {
+				return
+			}
+			err = rc.Flush()
+			if err != nil {
+				return
+			}
+
+			select {
+			case <-req.Context().Done():
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}
+}
+
+func httpEchoDaemonHandler(wri http.ResponseWriter, req *http.Request) {
+	hj, ok := wri.(http.Hijacker)
+	if !ok {
+		wri.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		return
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	_, err = brw.Write([]byte("HTTP/1.1 101 UPGRADED\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Upgrade: tcp\r\n" +
+		"Content-Type: application/vnd.docker.raw-stream\r\n" +
+		"\r\n"))
+	if err != nil {
+		return
+	}
+
+	err = brw.Flush()
+	if err != nil {
+		return
+	}
+
+	b, err := io.ReadAll(brw)
+	if err != nil {
+		return
+	}
+
+	_, err = brw.Write(b)
+	if err != nil {
+		return
+	}
+
+	_ = brw.Flush()
+}
+
 func tcpDaemonListener(_ string) (net.Listener, error) {
 	listener, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
@@ -1352,6 +4567,17 @@ func altTlsDaemon() (*http.Server, error) {
 	return server, nil
 }
 
+func tls12Daemon() (*http.Server, error) {
+	server, err := tlsDaemon()
+	if err != nil {
+		return nil, err
+	}
+
+	server.TLSConfig.MaxVersion = tls.VersionTLS12
+
+	return server, nil
+}
+
 func tlsAuthDaemon() (*http.Server, error) {
 	server, err := tlsDaemon()
 	if err != nil {
@@ -1368,6 +4594,22 @@ func tlsAuthDaemon() (*http.Server, error) {
 	return server, nil
 }
 
+func testSpkiPin(t *testing.T, certPem []byte) string {
+	t.Helper()
+
+	block, _ := pem.Decode(certPem)
+	if block == nil {
+		t.Fatal("error decoding certificate")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+
+	return "sha256//" + base64.StdEncoding.EncodeToString(digest[:])
+}
+
 func plainBackend(listener net.Listener, _ string) (*Backend, error) {
 	backend := &Backend{
 		Addr: fmt.Sprintf(
@@ -1683,7 +4925,7 @@ func (tc *testCase) setup(t *testing.T) func() {
 
 	go func() {
 		var err error
-		if tc.backend.TlsCacert != "" {
+		if tc.daemon.TLSConfig != nil {
 			err = tc.daemon.ServeTLS(tc.daemonListener, "", "")
 		} else {
 			err = tc.daemon.Serve(tc.daemonListener)
@@ -1700,3 +4942,24 @@ func (tc *testCase) setup(t *testing.T) func() {
 		}
 	}
 }
+
+func TestDrainUpgradedBody(t *testing.T) {
+	buffered := strings.Repeat("x", 2*upgradeDrainSize+100)
+	errConnRead := errors.New("read from connection")
+
+	// The connection must not be read once the buffered data has been forwarded
+	body := io.MultiReader(strings.NewReader(buffered), iotest.ErrReader(errConnRead))
+
+	var dst strings.Builder
+	var forwarded int64
+	err := drainUpgradedBody(&dst, body, func(n int64) { forwarded += n })
+	if err != nil {
+		t.Fatalf("error = %v, want nil", err)
+	}
+	if dst.String() != buffered {
+		t.Errorf("forwarded %d bytes, want %d", dst.Len(), len(buffered))
+	}
+	if forwarded != int64(len(buffered)) {
+		t.Errorf("onData reported %d bytes, want %d", forwarded, len(buffered))
+	}
+}
@@ -131,6 +131,71 @@ func TestCetusGuardSocketAllowedStreamReq(t *testing.T) {
 	}
 }
 
+func TestCetusGuardSocketHalfCloseHijackReq(t *testing.T) {
+	tc := &testCase{
+		daemonListenerFunc: socketDaemonListener,
+		daemonFunc:         socketDaemon,
+		backendFunc:        socketBackend,
+		frontendFunc:       socketFrontend,
+		clientFunc:         socketClient,
+	}
+
+	defer tc.setup(t)()
+	tc.daemon.Handler = http.HandlerFunc(httpEchoDaemonHandler)
+
+	ready := make(chan any, 1)
+	go func() {
+		err := tc.server.Start(ready)
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+	<-ready
+
+	addrs, err := tc.server.Addrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial("unix", addrs[0].String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	br, err := httpClientHijackReq(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = conn.Write([]byte("PING"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The daemon only replies after reading EOF, so the half-close must be propagated
+	err = conn.(*net.UnixConn).CloseWrite()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := io.ReadAll(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(msg) != "PING" {
+		t.Fatalf(`msg = "%s", want "%s"`, msg, "PING")
+	}
+
+	err = tc.server.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestCetusGuardSocketDeniedMethodReq(t *testing.T) {
 	tc := &testCase{
 		daemonListenerFunc: socketDaemonListener,
@@ -345,6 +410,97 @@ func TestCetusGuardTlsAuthSocketBackendReq(t *testing.T) {
 	}
 }
 
+func TestCetusGuardTlsAuthSocketFrontendReq(t *testing.T) {
+	tc := &testCase{
+		daemonListenerFunc: tcpDaemonListener,
+		daemonFunc:         plainDaemon,
+		backendFunc:        plainBackend,
+		frontendFunc:       tlsAuthSocketFrontend,
+		clientFunc:         tlsAuthSocketClient,
+	}
+
+	defer tc.setup(t)()
+	tc.daemon.Handler = http.HandlerFunc(httpDaemonHandler)
+
+	ready := make(chan any, 1)
+	go func() {
+		err := tc.server.Start(ready)
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+	<-ready
+
+	addrs, err := tc.server.Addrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := httpClientAllowedReq("https", addrs[0].String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := tc.client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("res.StatusCode = %d, want %d", res.StatusCode, http.StatusOK)
+	}
+
+	// Plain HTTP is no longer accepted on the socket
+	plainSocketClient, err := socketClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err = httpClientAllowedReq("http", addrs[0].String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err = plainSocketClient.Do(req)
+	if err == nil {
+		_ = res.Body.Close()
+		if res.StatusCode == http.StatusOK {
+			t.Fatalf("res.StatusCode = %d, want an error", res.StatusCode)
+		}
+	}
+
+	err = tc.server.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCetusGuardTlsUnixWithoutCert(t *testing.T) {
+	tc := &testCase{
+		daemonListenerFunc: tcpDaemonListener,
+		daemonFunc:         plainDaemon,
+		backendFunc:        plainBackend,
+		frontendFunc:       socketFrontend,
+		clientFunc:         socketClient,
+	}
+
+	defer tc.setup(t)()
+	tc.daemon.Handler = http.HandlerFunc(httpDaemonHandler)
+	tc.server.Frontend.TlsUnix = true
+
+	ready := make(chan any, 1)
+	go func() {
+		err := tc.server.Start(ready)
+		if err == nil {
+			t.Errorf("server started, want an error")
+		}
+	}()
+	<-ready
+
+	_ = tc.server.Stop()
+}
+
 func socketDaemonListener(tmpdir string) (net.Listener, error) {
 	listener, err := net.Listen("unix", filepath.Join(tmpdir, "d"))
 	if err != nil {
@@ -400,3 +556,33 @@ func socketClient() (*http.Client, error) {
 
 	return client, nil
 }
+
+func tlsAuthSocketFrontend(tmpdir string) (*Frontend, error) {
+	frontend, err := tlsAuthFrontend(tmpdir)
+	if err != nil {
+		return nil, err
+	}
+
+	frontend.Addr = []string{"unix://" + filepath.Join(tmpdir, "c")}
+	frontend.TlsUnix = true
+
+	return frontend, nil
+}
+
+func tlsAuthSocketClient() (*http.Client, error) {
+	client, err := tlsAuthClient()
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 90 * time.Second,
+	}
+	transport := client.Transport.(*http.Transport)
+	transport.DialContext = func(ctx context.Context, _ string, addr string) (net.Conn, error) {
+		return dialer.DialContext(ctx, "unix", addr[:strings.LastIndex(addr, ":")])
+	}
+
+	return client, nil
+}
@@ -0,0 +1,205 @@
+package cetusguard
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/hectorm/cetusguard/internal/logger"
+)
+
+var (
+	execRuleLineRegex   = regexp.MustCompile(`^[\t ]*(allow|deny)((?:;[a-z0-9-]+=[^\t ;]*)*)[\t ]+(.+?)[\t ]*$`)
+	fieldSeparatorRegex = regexp.MustCompile(`[\t ]+`)
+)
+
+// Allows or denies the commands of exec instances, either by their exact arguments or by a pattern
+// matched against the arguments joined by spaces. The first rule that matches the command is used,
+// and if none matches, commands are denied if any of them allows a command
+type ExecRule struct {
+	Allow bool
+	// Arguments the command must have, if Pattern is nil
+	Argv    []string
+	Pattern *regexp.Regexp
+
+	regex bool
+}
+
+func (rule ExecRule) String() string {
+	action := "deny"
+	if rule.Allow {
+		action = "allow"
+	}
+	if rule.Pattern != nil {
+		return fmt.Sprintf("%s;match=regex %s", action, strings.TrimSuffix(strings.TrimPrefix(rule.Pattern.String(), "^(?:"), ")$"))
+	}
+	return fmt.Sprintf("%s %s", action, strings.Join(rule.Argv, " "))
+}
+
+var execRuleOptionParsers = map[string]func(rule *ExecRule, val string) error{
+	"match": func(rule *ExecRule, val string) error {
+		switch val {
+		case "exact":
+			rule.regex = false
+		case "regex":
+			rule.regex = true
+		default:
+			return fmt.Errorf("unknown match type: %s", val)
+		}
+		return nil
+	},
+}
+
+func BuildExecRules(str string) ([]ExecRule, error) {
+	var rules []ExecRule
+
+	lines := newLineRegex.Split(str, -1)
+	for _, line := range lines {
+		if commentLineRegex.MatchString(line) {
+			continue
+		}
+
+		matches := execRuleLineRegex.FindStringSubmatch(line)
+		if len(matches) != 4 {
+			return nil, fmt.Errorf("invalid exec rule line: %s", line)
+		}
+		actionFrag := matches[1]
+		optionsFrag := matches[2]
+		commandFrag := matches[3]
+
+		rule := ExecRule{Allow: actionFrag == "allow"}
+		if optionsFrag != "" {
+			for _, option := range strings.Split(optionsFrag[1:], ";") {
+				k, v, _ := strings.Cut(option, "=")
+				parse, ok := execRuleOptionParsers[k]
+				if !ok {
+					return nil, fmt.Errorf("unknown exec rule option: %s", k)
+				}
+				if err := parse(&rule, v); err != nil {
+					return nil, fmt.Errorf("invalid exec rule option: %s: %w", option, err)
+				}
+			}
+		}
+
+		if rule.regex {
+			var err error
+			rule.Pattern, err = regexp.Compile("^(?:" + commandFrag + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("invalid exec rule pattern: %s: %w", commandFrag, err)
+			}
+		} else {
+			rule.Argv = fieldSeparatorRegex.Split(commandFrag, -1)
+		}
+
+		rules = append(rules, rule)
+
+		logger.Debugf("loaded exec rule: %s\n", rule)
+	}
+
+	return rules, nil
+}
+
+func (rule ExecRule) matches(argv []string) bool {
+	if rule.Pattern != nil {
+		return rule.Pattern.MatchString(strings.Join(argv, " "))
+	}
+	return slices.Equal(rule.Argv, argv)
+}
+
+// Restricts the commands, users and environment of exec instances, by inspecting the body of the exec create requests
+type ExecPolicy struct {
+	// Rules for the commands that can be run, any if empty
+	Rules []ExecRule
+	// Allow privileged exec instances
+	AllowPrivileged bool
+	// Allow running commands as root, including as the default user of the container if no user is set.
+	// Otherwise the user must have a numeric ID other than 0, since any user name may map to the ID 0
+	AllowRoot bool
+	// User set on exec instances that do not set one, which must have a numeric ID other than 0 unless AllowRoot is set
+	DefaultUser string
+	// Shell patterns the names of the environment variables must match, any if empty
+	AllowedEnv []string
+}
+
+// Checks the default user and the environment variable patterns
+func (ep *ExecPolicy) load() error {
+	if ep == nil {
+		return nil
+	}
+
+	if !ep.AllowRoot && ep.DefaultUser != "" && !hasNonRootUid(ep.DefaultUser) {
+		return fmt.Errorf("default exec user must have a numeric ID other than 0: %s", ep.DefaultUser)
+	}
+
+	for _, env := range ep.AllowedEnv {
+		if _, err := parsePattern(env); err != nil {
+			return fmt.Errorf("invalid environment variable pattern: %s: %w", env, err)
+		}
+	}
+
+	return nil
+}
+
+func (ep *ExecPolicy) commandAllowed(argv []string) bool {
+	for _, rule := range ep.Rules {
+		if rule.matches(argv) {
+			return rule.Allow
+		}
+	}
+	return !slices.ContainsFunc(ep.Rules, func(rule ExecRule) bool { return rule.Allow })
+}
+
+// Reports whether a user in USER[:GROUP] format has a numeric ID other than 0. IDs are parsed as the runtime
+// does, so that forms such as "00" or "+0" are also 0, and names are not accepted because the passwd file
+// of the container may map any of them to the ID 0
+func hasNonRootUid(user string) bool {
+	name, _, _ := strings.Cut(user, ":")
+	uid, err := strconv.Atoi(name)
+	return err == nil && uid > 0
+}
+
+// Checks the body of an exec create request, which has the same format in the Docker and the libpod API
+func (ep *ExecPolicy) checkExec(body map[string]any, _ bool) ([]string, error) {
+	var changes []string
+
+	argv := stringsField(body, "Cmd")
+	if !ep.commandAllowed(argv) {
+		return nil, policyErrorf("command not allowed: %s", strings.Join(argv, " "))
+	}
+
+	if !ep.AllowPrivileged && boolField(body, "Privileged") {
+		return nil, policyErrorf("privileged exec not allowed")
+	}
+
+	user, _ := field(body, "User").(string)
+	if user == "" && ep.DefaultUser != "" {
+		user = ep.DefaultUser
+		setField(body, "User", user)
+		changes = append(changes, "set exec user "+user)
+	}
+	if !ep.AllowRoot {
+		if user == "" {
+			return nil, policyErrorf("exec without user not allowed")
+		}
+		if !hasNonRootUid(user) {
+			return nil, policyErrorf("exec as a user without a numeric ID other than 0 not allowed: %s", user)
+		}
+	}
+
+	if len(ep.AllowedEnv) > 0 {
+		for _, env := range stringsField(body, "Env") {
+			name, _, _ := strings.Cut(env, "=")
+			if !slices.ContainsFunc(ep.AllowedEnv, func(pattern string) bool {
+				ok, _ := path.Match(pattern, name)
+				return ok
+			}) {
+				return nil, policyErrorf("environment variable not allowed: %s", name)
+			}
+		}
+	}
+
+	return changes, nil
+}
@@ -0,0 +1,166 @@
+package cetusguard
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBuildExecRules(t *testing.T) {
+	rules, err := BuildExecRules("! Diagnostics\n" +
+		"allow \t ps \t aux \n" +
+		"allow;match=exact df -h\n" +
+		"deny;match=regex (/bin/)?sh( .*)?")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wanted := []string{
+		"allow ps aux",
+		"allow df -h",
+		"deny;match=regex (/bin/)?sh( .*)?",
+	}
+	if len(rules) != len(wanted) {
+		t.Fatalf("rules = %v, want %v", rules, wanted)
+	}
+	for i, rule := range rules {
+		if rule.String() != wanted[i] {
+			t.Errorf("rule = %s, want %s", rule, wanted[i])
+		}
+	}
+}
+
+func TestBuildInvalidExecRules(t *testing.T) {
+	lines := []string{
+		"allow",
+		"permit ps",
+		"allow;match=glob ps*",
+		"allow;foo=bar ps",
+		"allow;match=regex ps(",
+	}
+
+	for _, line := range lines {
+		rules, err := BuildExecRules(line)
+		if err == nil || rules != nil {
+			t.Errorf("%q: rules = %v, want an error", line, rules)
+		}
+	}
+}
+
+func TestExecPolicyCommandAllowed(t *testing.T) {
+	rules, err := BuildExecRules("deny;match=regex .* --force( .*)?\n" +
+		"allow;match=regex cat /var/log/app/[a-z]+\\.log\n" +
+		"allow ps aux")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ep := &ExecPolicy{Rules: rules}
+
+	testCases := []struct {
+		argv   []string
+		wanted bool
+	}{
+		{[]string{"ps", "aux"}, true},
+		{[]string{"ps", "aux", "-e"}, false},
+		{[]string{"ps aux"}, false},
+		{[]string{"cat", "/var/log/app/error.log"}, true},
+		{[]string{"cat", "/var/log/app/../../../etc/shadow"}, false},
+		{[]string{"cat", "/var/log/app/error.log", "--force"}, false},
+		{[]string{"sh"}, false},
+		{nil, false},
+	}
+
+	for _, c := range testCases {
+		if allowed := ep.commandAllowed(c.argv); allowed != c.wanted {
+			t.Errorf("%q: allowed = %t, want %t", c.argv, allowed, c.wanted)
+		}
+	}
+
+	// Rules that only deny commands allow any other
+	denyRules, err := BuildExecRules("deny;match=regex (/bin/)?sh( .*)?")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !(&ExecPolicy{Rules: denyRules}).commandAllowed([]string{"ps", "aux"}) {
+		t.Errorf("command denied, want allowed")
+	}
+}
+
+func TestExecPolicyCheckExec(t *testing.T) {
+	ep := &ExecPolicy{AllowedEnv: []string{"LANG", "LC_*"}}
+	if err := ep.load(); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		body   string
+		wanted bool
+	}{
+		{`{"Cmd":["ps"],"User":"65534"}`, true},
+		{`{"Cmd":["ps"],"User":"1000:0","Env":["LANG=C","LC_ALL=C"]}`, true},
+		{`{"Cmd":["ps"]}`, false},
+		{`{"Cmd":["ps"],"User":"root"}`, false},
+		{`{"Cmd":["ps"],"User":"0:0"}`, false},
+		{`{"Cmd":["ps"],"User":"00"}`, false},
+		{`{"Cmd":["ps"],"User":"+0:1000"}`, false},
+		{`{"Cmd":["ps"],"User":"-0"}`, false},
+		{`{"Cmd":["ps"],"User":"100"}`, true},
+		{`{"Cmd":["ps"],"User":"nobody"}`, false},
+		{`{"Cmd":["ps"],"User":"toor:1000"}`, false},
+		{`{"Cmd":["ps"],"user":"0"}`, false},
+		{`{"cmd":["ps"],"USER":"root"}`, false},
+		{`{"Cmd":["ps"],"User":"65534","Privileged":true}`, false},
+		{`{"Cmd":["ps"],"User":"65534","Env":["LD_PRELOAD=/tmp/x.so"]}`, false},
+	}
+
+	for _, c := range testCases {
+		_, err := ep.checkExec(decodeTestBody(t, c.body), false)
+		var pErr *policyError
+		if err != nil && !errors.As(err, &pErr) {
+			t.Errorf("%s: err = %v, want a policy error", c.body, err)
+		}
+		if allowed := err == nil; allowed != c.wanted {
+			t.Errorf("%s: allowed = %t, want %t (%v)", c.body, allowed, c.wanted, err)
+		}
+	}
+
+	// The daemon would use the last command and user, which are not the ones that are allowed
+	cg := &Server{ExecPolicy: &ExecPolicy{Rules: []ExecRule{{Allow: true, Argv: []string{"id"}}}}}
+	cg.policies = cg.requestPolicies()
+	for _, body := range []string{
+		`{"Cmd":["id"],"cmd":["sh"],"User":"65534"}`,
+		`{"Cmd":["id"],"User":"65534","user":"0"}`,
+	} {
+		req := httptest.NewRequest("POST", "/v1.41/containers/test/exec", strings.NewReader(body))
+		rec := httptest.NewRecorder()
+		if cg.applyPolicies(rec, req) || rec.Code != http.StatusForbidden {
+			t.Errorf("%s: status = %d, want %d", body, rec.Code, http.StatusForbidden)
+		}
+	}
+
+	ep.DefaultUser = "65534"
+	body := decodeTestBody(t, `{"Cmd":["ps"]}`)
+	changes, err := ep.checkExec(body, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body["User"] != "65534" || len(changes) != 1 {
+		t.Errorf("User = %v, changes = %v, want 65534 and 1 change", body["User"], changes)
+	}
+
+	ep.AllowRoot = true
+	if _, err := ep.checkExec(decodeTestBody(t, `{"Cmd":["ps"],"User":"root"}`), false); err != nil {
+		t.Error(err)
+	}
+
+	for _, user := range []string{"root", "0", "nobody"} {
+		if err := (&ExecPolicy{DefaultUser: user}).load(); err == nil {
+			t.Errorf("%s default user, want an error", user)
+		}
+	}
+	if err := (&ExecPolicy{DefaultUser: "nobody", AllowRoot: true}).load(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,314 @@
+package cetusguard
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	// CPU CFS period used to express the default CPU limit of libpod containers
+	cpuPeriod = 100000
+	// Minimum CPU CFS quota accepted by the kernel
+	minCpuQuota = 1000
+)
+
+var (
+	sizeRegex = regexp.MustCompile(`^([0-9]+)([bkmg]?)$`)
+)
+
+var sizeUnits = map[string]int64{
+	"":  1,
+	"b": 1,
+	"k": 1024,
+	"m": 1024 * 1024,
+	"g": 1024 * 1024 * 1024,
+}
+
+// Capabilities granted by default to the containers of the Docker daemon
+var defaultCapabilities = []string{
+	"AUDIT_WRITE",
+	"CHOWN",
+	"DAC_OVERRIDE",
+	"FOWNER",
+	"FSETID",
+	"KILL",
+	"MKNOD",
+	"NET_BIND_SERVICE",
+	"NET_RAW",
+	"SETFCAP",
+	"SETGID",
+	"SETPCAP",
+	"SETUID",
+	"SYS_CHROOT",
+}
+
+// Security defaults that are enforced on the containers created through the proxy
+// by rewriting the body of the create requests
+type Hardening struct {
+	// Prevent container processes from gaining additional privileges
+	NoNewPrivileges bool
+	// Drop all capabilities except those in CapAllowlist, and disable privileged mode
+	DropCapabilities bool
+	// Capabilities containers may keep or add when DropCapabilities is enabled, without the CAP_ prefix
+	CapAllowlist []string
+	// Mount the root filesystem of containers as read only
+	ReadonlyRootfs bool
+	// Memory limit in bytes for containers that do not set one, none if zero
+	DefaultMemory int64
+	// CPU limit in units of 10^-9 CPUs for containers that do not set one, none if zero
+	DefaultNanoCpus int64
+	// PIDs limit for containers that do not set one or are unlimited, none if zero
+	DefaultPidsLimit int64
+	// Path to a seccomp profile for containers that do not set one
+	DefaultSeccompProfile string
+	// Name of an AppArmor profile loaded on the daemon host for containers that do not set one
+	DefaultApparmorProfile string
+
+	// Compacted content of the seccomp profile, which the Docker API expects instead of a path
+	seccompProfile string
+}
+
+// Parses a size in bytes with an optional b, k, m or g suffix
+func ParseSize(val string) (int64, error) {
+	matches := sizeRegex.FindStringSubmatch(strings.ToLower(val))
+	if len(matches) != 3 {
+		return 0, fmt.Errorf("invalid size: %s", val)
+	}
+	n, err := strconv.ParseInt(matches[1], 10, 64)
+	unit := sizeUnits[matches[2]]
+	if err != nil || n > math.MaxInt64/unit {
+		return 0, fmt.Errorf("size out of range: %s", val)
+	}
+	return n * unit, nil
+}
+
+// Parses a number of CPUs, which may be fractional, in units of 10^-9 CPUs
+func ParseCpus(val string) (int64, error) {
+	cpus, err := strconv.ParseFloat(val, 64)
+	if err != nil || math.IsNaN(cpus) || cpus < 0 || cpus > math.MaxInt64/1e9 {
+		return 0, fmt.Errorf("invalid number of CPUs: %s", val)
+	}
+	return int64(math.Round(cpus * 1e9)), nil
+}
+
+func (h *Hardening) enabled() bool {
+	return h != nil && (h.NoNewPrivileges || h.DropCapabilities || h.ReadonlyRootfs ||
+		h.DefaultMemory > 0 || h.DefaultNanoCpus > 0 || h.DefaultPidsLimit > 0 ||
+		h.DefaultSeccompProfile != "" || h.DefaultApparmorProfile != "")
+}
+
+// Normalizes the capability allowlist and reads the default seccomp profile
+func (h *Hardening) load() error {
+	if h == nil {
+		return nil
+	}
+
+	for i, c := range h.CapAllowlist {
+		h.CapAllowlist[i] = normalizeCapability(c)
+	}
+
+	h.seccompProfile = ""
+	if h.DefaultSeccompProfile != "" {
+		data, err := os.ReadFile(h.DefaultSeccompProfile)
+		if err != nil {
+			return fmt.Errorf("error reading seccomp profile: %w", err)
+		}
+		var buf bytes.Buffer
+		if err := json.Compact(&buf, data); err != nil {
+			return fmt.Errorf("invalid seccomp profile: %s: %w", h.DefaultSeccompProfile, err)
+		}
+		h.seccompProfile = buf.String()
+	}
+
+	return nil
+}
+
+func normalizeCapability(c string) string {
+	return strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(c)), "CAP_")
+}
+
+// Returns the capabilities a container is granted in addition to the dropped ones,
+// which are those it would have without the allowlist that are also in the allowlist
+func (h *Hardening) allowedCapabilities(capAdd []string, capDrop []string) []string {
+	normalize := func(caps []string) []string {
+		n := make([]string, len(caps))
+		for i, c := range caps {
+			n[i] = normalizeCapability(c)
+		}
+		return n
+	}
+	capAdd, capDrop = normalize(capAdd), normalize(capDrop)
+
+	var caps []string
+	if !slices.Contains(capDrop, "ALL") {
+		caps = append(caps, defaultCapabilities...)
+	}
+	if slices.Contains(capAdd, "ALL") {
+		caps = append(caps, h.CapAllowlist...)
+	} else {
+		caps = append(caps, capAdd...)
+	}
+
+	allowed := []string{}
+	for _, c := range caps {
+		if slices.Contains(h.CapAllowlist, c) && !slices.Contains(capDrop, c) && !slices.Contains(allowed, c) {
+			allowed = append(allowed, c)
+		}
+	}
+	slices.Sort(allowed)
+	return allowed
+}
+
+// Rewrites the body of a container create request, in the Docker or the libpod format,
+// and returns a description of each change
+func (h *Hardening) apply(body map[string]any, libpod bool) []string {
+	if libpod {
+		return h.applyLibpod(body)
+	}
+	return h.applyDocker(body)
+}
+
+func (h *Hardening) applyDocker(body map[string]any) []string {
+	var changes []string
+	hc := objectField(body, "HostConfig")
+
+	securityOpt := stringsField(hc, "SecurityOpt")
+	hasSecurityOpt := func(name string) bool {
+		return slices.ContainsFunc(securityOpt, func(opt string) bool {
+			return strings.HasPrefix(opt, name+"=") || strings.HasPrefix(opt, name+":")
+		})
+	}
+	securityOptChanged := false
+	// The daemon uses the last no-new-privileges option, so any other one is removed
+	if h.NoNewPrivileges {
+		hardened := slices.DeleteFunc(slices.Clone(securityOpt), func(opt string) bool {
+			return strings.HasPrefix(opt, "no-new-privileges")
+		})
+		hardened = append(hardened, "no-new-privileges:true")
+		if !slices.Equal(hardened, securityOpt) {
+			securityOpt = hardened
+			securityOptChanged = true
+			changes = append(changes, "set no-new-privileges")
+		}
+	}
+	if h.seccompProfile != "" && !hasSecurityOpt("seccomp") {
+		securityOpt = append(securityOpt, "seccomp="+h.seccompProfile)
+		securityOptChanged = true
+		changes = append(changes, "set seccomp profile "+h.DefaultSeccompProfile)
+	}
+	if h.DefaultApparmorProfile != "" && !hasSecurityOpt("apparmor") {
+		securityOpt = append(securityOpt, "apparmor="+h.DefaultApparmorProfile)
+		securityOptChanged = true
+		changes = append(changes, "set AppArmor profile "+h.DefaultApparmorProfile)
+	}
+	if securityOptChanged {
+		setField(hc, "SecurityOpt", securityOpt)
+	}
+
+	if h.DropCapabilities {
+		if boolField(hc, "Privileged") {
+			setField(hc, "Privileged", false)
+			changes = append(changes, "disabled privileged mode")
+		}
+		capAdd, capDrop := stringsField(hc, "CapAdd"), stringsField(hc, "CapDrop")
+		allowed := h.allowedCapabilities(capAdd, capDrop)
+		if !slices.Equal(capDrop, []string{"ALL"}) || !slices.Equal(capAdd, allowed) {
+			setField(hc, "CapDrop", []string{"ALL"})
+			setField(hc, "CapAdd", allowed)
+			changes = append(changes, fmt.Sprintf("set capabilities [%s]", strings.Join(allowed, " ")))
+		}
+	}
+
+	if h.ReadonlyRootfs && !boolField(hc, "ReadonlyRootfs") {
+		setField(hc, "ReadonlyRootfs", true)
+		changes = append(changes, "set read-only root filesystem")
+	}
+
+	if h.DefaultMemory > 0 && intField(hc, "Memory") <= 0 {
+		setField(hc, "Memory", h.DefaultMemory)
+		changes = append(changes, fmt.Sprintf("set memory limit %d", h.DefaultMemory))
+	}
+	// The daemon rejects NanoCpus together with a CFS quota or period
+	if h.DefaultNanoCpus > 0 && intField(hc, "NanoCpus") <= 0 && intField(hc, "CpuQuota") <= 0 && intField(hc, "CpuPeriod") <= 0 {
+		setField(hc, "NanoCpus", h.DefaultNanoCpus)
+		changes = append(changes, fmt.Sprintf("set CPU limit %d", h.DefaultNanoCpus))
+	}
+	if h.DefaultPidsLimit > 0 && intField(hc, "PidsLimit") <= 0 {
+		setField(hc, "PidsLimit", h.DefaultPidsLimit)
+		changes = append(changes, fmt.Sprintf("set PIDs limit %d", h.DefaultPidsLimit))
+	}
+
+	return changes
+}
+
+func (h *Hardening) applyLibpod(body map[string]any) []string {
+	var changes []string
+
+	if h.NoNewPrivileges && !boolField(body, "no_new_privileges") {
+		setField(body, "no_new_privileges", true)
+		changes = append(changes, "set no-new-privileges")
+	}
+	// Libpod reads the seccomp profile from the daemon host
+	if h.DefaultSeccompProfile != "" && field(body, "seccomp_profile_path") == nil {
+		setField(body, "seccomp_profile_path", h.DefaultSeccompProfile)
+		changes = append(changes, "set seccomp profile "+h.DefaultSeccompProfile)
+	}
+	if h.DefaultApparmorProfile != "" && field(body, "apparmor_profile") == nil {
+		setField(body, "apparmor_profile", h.DefaultApparmorProfile)
+		changes = append(changes, "set AppArmor profile "+h.DefaultApparmorProfile)
+	}
+
+	if h.DropCapabilities {
+		if boolField(body, "privileged") {
+			setField(body, "privileged", false)
+			changes = append(changes, "disabled privileged mode")
+		}
+		capAdd, capDrop := stringsField(body, "cap_add"), stringsField(body, "cap_drop")
+		allowed := h.allowedCapabilities(capAdd, capDrop)
+		if !slices.Equal(capDrop, []string{"ALL"}) || !slices.Equal(capAdd, allowed) {
+			setField(body, "cap_drop", []string{"ALL"})
+			setField(body, "cap_add", allowed)
+			changes = append(changes, fmt.Sprintf("set capabilities [%s]", strings.Join(allowed, " ")))
+		}
+	}
+
+	if h.ReadonlyRootfs && !boolField(body, "read_only_filesystem") {
+		setField(body, "read_only_filesystem", true)
+		changes = append(changes, "set read-only root filesystem")
+	}
+
+	if h.DefaultMemory > 0 || h.DefaultNanoCpus > 0 || h.DefaultPidsLimit > 0 {
+		resources := objectField(body, "resource_limits")
+		if h.DefaultMemory > 0 {
+			memory := objectField(resources, "memory")
+			if intField(memory, "limit") <= 0 {
+				setField(memory, "limit", h.DefaultMemory)
+				changes = append(changes, fmt.Sprintf("set memory limit %d", h.DefaultMemory))
+			}
+		}
+		if h.DefaultNanoCpus > 0 {
+			cpu := objectField(resources, "cpu")
+			if intField(cpu, "quota") <= 0 {
+				setField(cpu, "quota", max(h.DefaultNanoCpus*cpuPeriod/1e9, minCpuQuota))
+				setField(cpu, "period", cpuPeriod)
+				changes = append(changes, fmt.Sprintf("set CPU limit %d", h.DefaultNanoCpus))
+			}
+		}
+		if h.DefaultPidsLimit > 0 {
+			pids := objectField(resources, "pids")
+			if intField(pids, "limit") <= 0 {
+				setField(pids, "limit", h.DefaultPidsLimit)
+				changes = append(changes, fmt.Sprintf("set PIDs limit %d", h.DefaultPidsLimit))
+			}
+		}
+	}
+
+	return changes
+}
@@ -0,0 +1,192 @@
+package cetusguard
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseSize(t *testing.T) {
+	testCases := map[string]int64{
+		"0":    0,
+		"512":  512,
+		"512b": 512,
+		"64k":  64 * 1024,
+		"256m": 256 * 1024 * 1024,
+		"2G":   2 * 1024 * 1024 * 1024,
+	}
+	for val, wanted := range testCases {
+		size, err := ParseSize(val)
+		if err != nil {
+			t.Errorf("%s: %v", val, err)
+			continue
+		}
+		if size != wanted {
+			t.Errorf("%s: size = %d, want %d", val, size, wanted)
+		}
+	}
+
+	for _, val := range []string{"", "m", "-1m", "1.5g", "1t", "99999999999999999999g"} {
+		if size, err := ParseSize(val); err == nil {
+			t.Errorf("%q: size = %d, want an error", val, size)
+		}
+	}
+}
+
+func TestParseCpus(t *testing.T) {
+	testCases := map[string]int64{
+		"1":    1000000000,
+		"0.5":  500000000,
+		"2.25": 2250000000,
+	}
+	for val, wanted := range testCases {
+		nanoCpus, err := ParseCpus(val)
+		if err != nil {
+			t.Errorf("%s: %v", val, err)
+			continue
+		}
+		if nanoCpus != wanted {
+			t.Errorf("%s: nanoCpus = %d, want %d", val, nanoCpus, wanted)
+		}
+	}
+
+	for _, val := range []string{"", "one", "-1", "NaN", "1e100"} {
+		if nanoCpus, err := ParseCpus(val); err == nil {
+			t.Errorf("%q: nanoCpus = %d, want an error", val, nanoCpus)
+		}
+	}
+}
+
+func TestHardeningAllowedCapabilities(t *testing.T) {
+	h := &Hardening{CapAllowlist: []string{"CHOWN", "KILL", "NET_ADMIN"}}
+
+	testCases := []struct {
+		capAdd  []string
+		capDrop []string
+		wanted  []string
+	}{
+		{nil, nil, []string{"CHOWN", "KILL"}},
+		{[]string{"net_admin", "SYS_ADMIN"}, nil, []string{"CHOWN", "KILL", "NET_ADMIN"}},
+		{nil, []string{"CAP_KILL"}, []string{"CHOWN"}},
+		{[]string{"KILL"}, []string{"ALL"}, []string{"KILL"}},
+		{[]string{"ALL"}, []string{"ALL"}, []string{"CHOWN", "KILL", "NET_ADMIN"}},
+		{nil, []string{"ALL"}, []string{}},
+	}
+
+	for _, c := range testCases {
+		allowed := h.allowedCapabilities(c.capAdd, c.capDrop)
+		if strings.Join(allowed, ",") != strings.Join(c.wanted, ",") {
+			t.Errorf("add %v, drop %v: allowed = %v, want %v", c.capAdd, c.capDrop, allowed, c.wanted)
+		}
+	}
+}
+
+func TestHardeningApply(t *testing.T) {
+	tmpDir := t.TempDir()
+	seccompPath := filepath.Join(tmpDir, "seccomp.json")
+	if err := os.WriteFile(seccompPath, []byte("{\n  \"defaultAction\": \"SCMP_ACT_ERRNO\"\n}\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	h := &Hardening{
+		NoNewPrivileges:        true,
+		DropCapabilities:       true,
+		CapAllowlist:           []string{"cap_chown"},
+		ReadonlyRootfs:         true,
+		DefaultMemory:          256 * 1024 * 1024,
+		DefaultNanoCpus:        500000000,
+		DefaultPidsLimit:       100,
+		DefaultSeccompProfile:  seccompPath,
+		DefaultApparmorProfile: "cetusguard",
+	}
+	if err := h.load(); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		libpod  bool
+		body    string
+		wanted  string
+		changes int
+	}{
+		{
+			libpod: false,
+			body:   `{"Image":"alpine","HostConfig":{"Privileged":true,"SecurityOpt":["no-new-privileges:false","apparmor=unconfined"],"CpuQuota":50000}}`,
+			wanted: `{"HostConfig":{"CapAdd":["CHOWN"],"CapDrop":["ALL"],"CpuQuota":50000,"Memory":268435456,"PidsLimit":100,"Privileged":false,"ReadonlyRootfs":true,` +
+				`"SecurityOpt":["apparmor=unconfined","no-new-privileges:true","seccomp={\"defaultAction\":\"SCMP_ACT_ERRNO\"}"]},"Image":"alpine"}`,
+			changes: 7,
+		},
+		{
+			libpod: false,
+			body: `{"HostConfig":{"CapAdd":["CHOWN"],"CapDrop":["ALL"],"Memory":1024,"NanoCpus":1,"PidsLimit":10,"ReadonlyRootfs":true,` +
+				`"SecurityOpt":["seccomp=unconfined","apparmor:docker-default","no-new-privileges:true"]}}`,
+			wanted: `{"HostConfig":{"CapAdd":["CHOWN"],"CapDrop":["ALL"],"Memory":1024,"NanoCpus":1,"PidsLimit":10,"ReadonlyRootfs":true,` +
+				`"SecurityOpt":["seccomp=unconfined","apparmor:docker-default","no-new-privileges:true"]}}`,
+			changes: 0,
+		},
+		{
+			// The daemon uses the last no-new-privileges option, so the others are removed even if they enable it
+			libpod: false,
+			body: `{"HostConfig":{"CapAdd":["CHOWN"],"CapDrop":["ALL"],"Memory":1024,"NanoCpus":1,"PidsLimit":10,"ReadonlyRootfs":true,` +
+				`"SecurityOpt":["no-new-privileges:true","no-new-privileges=false","seccomp=unconfined","apparmor:docker-default"]}}`,
+			wanted: `{"HostConfig":{"CapAdd":["CHOWN"],"CapDrop":["ALL"],"Memory":1024,"NanoCpus":1,"PidsLimit":10,"ReadonlyRootfs":true,` +
+				`"SecurityOpt":["seccomp=unconfined","apparmor:docker-default","no-new-privileges:true"]}}`,
+			changes: 1,
+		},
+		{
+			// Fields whose names only differ in case are replaced, since the daemon would use them
+			libpod: false,
+			body:   `{"Image":"alpine","hostconfig":{"privileged":true,"capadd":["ALL"],"readonlyrootfs":false}}`,
+			wanted: `{"HostConfig":{"CapAdd":["CHOWN"],"CapDrop":["ALL"],"Memory":268435456,"NanoCpus":500000000,"PidsLimit":100,"Privileged":false,"ReadonlyRootfs":true,` +
+				`"SecurityOpt":["no-new-privileges:true","seccomp={\"defaultAction\":\"SCMP_ACT_ERRNO\"}","apparmor=cetusguard"]},"Image":"alpine"}`,
+			changes: 9,
+		},
+		{
+			libpod: true,
+			body:   `{"image":"alpine","Privileged":true,"CAP_ADD":["SYS_ADMIN"]}`,
+			wanted: `{"apparmor_profile":"cetusguard","cap_add":["CHOWN"],"cap_drop":["ALL"],"image":"alpine","no_new_privileges":true,"privileged":false,"read_only_filesystem":true,` +
+				`"resource_limits":{"cpu":{"period":100000,"quota":50000},"memory":{"limit":268435456},"pids":{"limit":100}},"seccomp_profile_path":"` + seccompPath + `"}`,
+			changes: 9,
+		},
+		{
+			libpod: true,
+			body:   `{"image":"alpine","cap_add":["SYS_ADMIN"],"resource_limits":{"memory":{"limit":1024}}}`,
+			wanted: `{"apparmor_profile":"cetusguard","cap_add":["CHOWN"],"cap_drop":["ALL"],"image":"alpine","no_new_privileges":true,"read_only_filesystem":true,` +
+				`"resource_limits":{"cpu":{"period":100000,"quota":50000},"memory":{"limit":1024},"pids":{"limit":100}},"seccomp_profile_path":"` + seccompPath + `"}`,
+			changes: 7,
+		},
+	}
+
+	for _, c := range testCases {
+		body := decodeTestBody(t, c.body)
+		changes := h.apply(body, c.libpod)
+		if len(changes) != c.changes {
+			t.Errorf("%s: changes = %v, want %d changes", c.body, changes, c.changes)
+		}
+
+		data, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != c.wanted {
+			t.Errorf("body = %s, want %s", data, c.wanted)
+		}
+	}
+}
+
+func TestHardeningInvalidSeccompProfile(t *testing.T) {
+	tmpDir := t.TempDir()
+	seccompPath := filepath.Join(tmpDir, "seccomp.json")
+	if err := os.WriteFile(seccompPath, []byte("{"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range []string{seccompPath, filepath.Join(tmpDir, "missing.json")} {
+		h := &Hardening{DefaultSeccompProfile: p}
+		if err := h.load(); err == nil {
+			t.Errorf("%s: want an error", p)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package cetusguard
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+const (
+	defaultImageRegistry = "docker.io"
+	defaultImageTag      = "latest"
+)
+
+var (
+	imageReferencePattern = mustBuildPattern(`(%IMAGE_NAME%)(?::(%IMAGE_TAG%))?(?:@(%IMAGE_DIGEST%))?`)
+	// The daemon looks up references that are not found as a name as a prefix of an image ID
+	imageIdRegex = regexp.MustCompile(`^(?:sha256:)?[a-fA-F0-9]+$`)
+
+	imagePullPattern        = mustBuildPattern(`%API_PREFIX_IMAGES%/create`)
+	libpodImagePullPattern  = mustBuildPattern(`%API_PREFIX_LIBPOD_IMAGES%/pull`)
+	imageBuildPattern       = mustBuildPattern(`%API_PREFIX_BUILD%`)
+	libpodImageBuildPattern = mustBuildPattern(`%API_PREFIX_LIBPOD_BUILD%`)
+	pluginPullPattern       = mustBuildPattern(`%API_PREFIX_PLUGINS%/pull`)
+)
+
+// Image reference with the default registry, repository namespace and tag of Docker Hub applied
+type imageReference struct {
+	registry   string
+	repository string
+	tag        string
+	digest     string
+}
+
+func (ref imageReference) name() string {
+	return ref.registry + "/" + ref.repository
+}
+
+func (ref imageReference) String() string {
+	str := ref.name()
+	if ref.tag != "" {
+		str += ":" + ref.tag
+	}
+	if ref.digest != "" {
+		str += "@" + ref.digest
+	}
+	return str
+}
+
+// Parses an image reference, the first component of the name is the registry
+// if it contains a dot or a port, or if it is localhost
+func parseImageReference(val string) (imageReference, error) {
+	matches := imageReferencePattern.FindStringSubmatch(val)
+	if len(matches) != 4 {
+		return imageReference{}, fmt.Errorf("invalid image reference: %s", val)
+	}
+	ref := imageReference{registry: defaultImageRegistry, repository: matches[1], tag: matches[2], digest: matches[3]}
+
+	if first, rest, ok := strings.Cut(ref.repository, "/"); ok && (strings.ContainsAny(first, ".:") || first == "localhost") {
+		ref.registry, ref.repository = normalizeImageRegistry(first), rest
+	}
+	if ref.registry == defaultImageRegistry && !strings.Contains(ref.repository, "/") {
+		ref.repository = "library/" + ref.repository
+	}
+	if ref.tag == "" && ref.digest == "" {
+		ref.tag = defaultImageTag
+	}
+
+	return ref, nil
+}
+
+func normalizeImageRegistry(registry string) string {
+	registry = strings.ToLower(registry)
+	if registry == "index.docker.io" || registry == "registry-1.docker.io" {
+		return defaultImageRegistry
+	}
+	return registry
+}
+
+// Restricts the images that can be pulled and run, by inspecting the references in image and plugin pull,
+// image build and container create requests
+type ImagePolicy struct {
+	// Registries images may come from, such as docker.io, any if empty
+	Registries []string
+	// Shell patterns the registry and repository of images must match, such as docker.io/library/*, any if empty
+	Repositories []string
+	// Require images to be referenced by digest
+	RequireDigest bool
+}
+
+// Normalizes the registries and checks the repository patterns
+func (ip *ImagePolicy) load() error {
+	if ip == nil {
+		return nil
+	}
+
+	for i, registry := range ip.Registries {
+		ip.Registries[i] = normalizeImageRegistry(registry)
+	}
+	for _, repository := range ip.Repositories {
+		if _, err := parsePattern(repository); err != nil {
+			return fmt.Errorf("invalid image repository pattern: %s: %w", repository, err)
+		}
+	}
+
+	return nil
+}
+
+// Checks an image reference, references that only have hexadecimal digits are denied as image IDs
+func (ip *ImagePolicy) checkReference(val string) error {
+	if imageIdRegex.MatchString(val) {
+		return policyErrorf("image referenced by ID not allowed: %s", val)
+	}
+	ref, err := parseImageReference(val)
+	if err != nil {
+		return policyErrorf("%v", err)
+	}
+	if len(ip.Registries) > 0 && !slices.Contains(ip.Registries, ref.registry) {
+		return policyErrorf("image registry not allowed: %s", ref)
+	}
+	if len(ip.Repositories) > 0 && !slices.ContainsFunc(ip.Repositories, func(pattern string) bool {
+		ok, _ := path.Match(pattern, ref.name())
+		return ok
+	}) {
+		return policyErrorf("image repository not allowed: %s", ref)
+	}
+	if ip.RequireDigest && ref.digest == "" {
+		return policyErrorf("image not referenced by digest: %s", ref)
+	}
+	return nil
+}
+
+// Returns the policies that check the image references of each endpoint
+func (ip *ImagePolicy) policies() []requestPolicy {
+	return []requestPolicy{
+		{pattern: imagePullPattern, libpodPattern: libpodImagePullPattern, checkQuery: ip.checkPullQuery},
+		{pattern: imageBuildPattern, libpodPattern: libpodImageBuildPattern, checkQuery: ip.checkBuildQuery},
+		{pattern: pluginPullPattern, checkQuery: ip.checkPluginPullQuery},
+		{pattern: containerCreatePattern, libpodPattern: libpodContainerCreatePattern, apply: ip.checkContainer},
+	}
+}
+
+// Checks the image of a pull request, the Docker endpoint also imports images
+// from a URL or the body, which are denied because their source cannot be checked
+func (ip *ImagePolicy) checkPullQuery(query url.Values, libpod bool) error {
+	if libpod {
+		return ip.checkReference(query.Get("reference"))
+	}
+
+	if query.Has("fromSrc") {
+		return policyErrorf("image import not allowed")
+	}
+	ref := query.Get("fromImage")
+	if tag := query.Get("tag"); tag != "" {
+		if strings.Contains(tag, ":") {
+			ref += "@" + tag
+		} else {
+			ref += ":" + tag
+		}
+	}
+	return ip.checkReference(ref)
+}
+
+// Checks the images used as cache sources of a build request, which are a JSON array or a single reference.
+// The images in the FROM instructions are in the build context and are not checked
+func (ip *ImagePolicy) checkBuildQuery(query url.Values, _ bool) error {
+	cacheFrom := query.Get("cachefrom")
+	if cacheFrom == "" {
+		return nil
+	}
+	var refs []string
+	if err := json.Unmarshal([]byte(cacheFrom), &refs); err != nil {
+		refs = []string{cacheFrom}
+	}
+	for _, ref := range refs {
+		if err := ip.checkReference(ref); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ip *ImagePolicy) checkPluginPullQuery(query url.Values, _ bool) error {
+	return ip.checkReference(query.Get("remote"))
+}
+
+// Checks the image of a container create request, in the Docker or the libpod format
+func (ip *ImagePolicy) checkContainer(body map[string]any, libpod bool) ([]string, error) {
+	key := "Image"
+	if libpod {
+		key = "image"
+	}
+	// Libpod containers may use a root filesystem from the daemon host instead of an image
+	if rootfs, _ := field(body, "rootfs").(string); libpod && rootfs != "" {
+		return nil, policyErrorf("container root filesystem not allowed: %s", rootfs)
+	}
+	image, _ := field(body, key).(string)
+	return nil, ip.checkReference(image)
+}
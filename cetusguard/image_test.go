@@ -0,0 +1,165 @@
+package cetusguard
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestParseImageReference(t *testing.T) {
+	digest := "sha256:" + "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+	testCases := map[string]string{
+		"alpine":                                "docker.io/library/alpine:latest",
+		"alpine:3.19":                           "docker.io/library/alpine:3.19",
+		"library/alpine@" + digest:              "docker.io/library/alpine@" + digest,
+		"alpine:3.19@" + digest:                 "docker.io/library/alpine:3.19@" + digest,
+		"hectorm/cetusguard":                    "docker.io/hectorm/cetusguard:latest",
+		"docker.io/alpine":                      "docker.io/library/alpine:latest",
+		"index.docker.io/hectorm/cetusguard:v1": "docker.io/hectorm/cetusguard:v1",
+		"ghcr.io/hectorm/cetusguard:v1":         "ghcr.io/hectorm/cetusguard:v1",
+		"localhost/foo/bar":                     "localhost/foo/bar:latest",
+		"localhost:5000/foo:1.0":                "localhost:5000/foo:1.0",
+		"registry:5000/foo":                     "registry:5000/foo:latest",
+	}
+	for val, wanted := range testCases {
+		ref, err := parseImageReference(val)
+		if err != nil {
+			t.Errorf("%s: %v", val, err)
+			continue
+		}
+		if ref.String() != wanted {
+			t.Errorf("%s: ref = %s, want %s", val, ref, wanted)
+		}
+	}
+
+	for _, val := range []string{"", "alpine:", "-alpine", "alpine@sha256:abc", "ghcr.io/", "alpine 3.19"} {
+		if ref, err := parseImageReference(val); err == nil {
+			t.Errorf("%q: ref = %s, want an error", val, ref)
+		}
+	}
+}
+
+func TestImagePolicyCheckReference(t *testing.T) {
+	digest := "sha256:" + "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+	ip := &ImagePolicy{
+		Registries:   []string{"index.docker.io", "ghcr.io"},
+		Repositories: []string{"docker.io/library/*", "ghcr.io/hectorm/*"},
+	}
+	if err := ip.load(); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := map[string]bool{
+		"alpine":                     true,
+		"docker.io/library/alpine":   true,
+		"ghcr.io/hectorm/cetusguard": true,
+		"hectorm/cetusguard":         false,
+		"ghcr.io/example/cetusguard": false,
+		"quay.io/library/alpine":     false,
+		"ghcr.io/hectorm/foo/bar":    false,
+		digest:                       false,
+		"a1b2c3d4e5f6":               false,
+		"sha256:a1b2c3d4e5f6":        false,
+		"a1b2c3d4e5f6:latest":        true,
+	}
+	for val, wanted := range testCases {
+		if allowed := ip.checkReference(val) == nil; allowed != wanted {
+			t.Errorf("%s: allowed = %t, want %t", val, allowed, wanted)
+		}
+	}
+
+	ip.RequireDigest = true
+	if err := ip.checkReference("alpine:3.19"); err == nil {
+		t.Errorf("reference without digest allowed, want denied")
+	}
+	if err := ip.checkReference("alpine:3.19@" + digest); err != nil {
+		t.Error(err)
+	}
+
+	if err := (&ImagePolicy{Repositories: []string{"docker.io/["}}).load(); err == nil {
+		t.Errorf("invalid pattern, want an error")
+	}
+}
+
+func TestImagePolicyCheckQuery(t *testing.T) {
+	digest := "sha256:" + "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+	ip := &ImagePolicy{Repositories: []string{"docker.io/library/*"}}
+	if err := ip.load(); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		check  func(query url.Values, libpod bool) error
+		libpod bool
+		query  string
+		wanted bool
+	}{
+		{ip.checkPullQuery, false, "fromImage=alpine&tag=3.19", true},
+		{ip.checkPullQuery, false, "fromImage=alpine&tag=" + digest, true},
+		{ip.checkPullQuery, false, "fromImage=hectorm/cetusguard&tag=latest", false},
+		{ip.checkPullQuery, false, "fromSrc=-&repo=alpine", false},
+		{ip.checkPullQuery, false, "", false},
+		{ip.checkPullQuery, true, "reference=docker.io/library/alpine:3.19", true},
+		{ip.checkPullQuery, true, "reference=quay.io/podman/stable", false},
+		{ip.checkBuildQuery, false, "t=foo", true},
+		{ip.checkBuildQuery, false, "cachefrom=" + url.QueryEscape(`["alpine","debian"]`), true},
+		{ip.checkBuildQuery, false, "cachefrom=" + url.QueryEscape(`["alpine","hectorm/cetusguard"]`), false},
+		{ip.checkBuildQuery, true, "cachefrom=hectorm/cetusguard", false},
+		{ip.checkPluginPullQuery, false, "remote=vieux/sshfs", false},
+	}
+
+	for _, c := range testCases {
+		query, err := url.ParseQuery(c.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if allowed := c.check(query, c.libpod) == nil; allowed != c.wanted {
+			t.Errorf("%s: allowed = %t, want %t", c.query, allowed, c.wanted)
+		}
+	}
+}
+
+func TestImagePolicyCheckContainer(t *testing.T) {
+	ip := &ImagePolicy{Repositories: []string{"docker.io/library/*"}}
+	if err := ip.load(); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		libpod bool
+		body   string
+		wanted bool
+	}{
+		{false, `{"Image":"alpine"}`, true},
+		{false, `{"Image":"hectorm/cetusguard"}`, false},
+		{false, `{"image":"hectorm/cetusguard"}`, false},
+		{false, `{"Image":"a1b2c3d4e5f6"}`, false},
+		{false, `{}`, false},
+		{true, `{"image":"alpine"}`, true},
+		{true, `{"Image":"hectorm/cetusguard"}`, false},
+		{true, `{"rootfs":"/"}`, false},
+		{true, `{"image":"alpine","rootfs":"/srv/rootfs"}`, false},
+	}
+
+	for _, c := range testCases {
+		_, err := ip.checkContainer(decodeTestBody(t, c.body), c.libpod)
+		if allowed := err == nil; allowed != c.wanted {
+			t.Errorf("%s: allowed = %t, want %t (%v)", c.body, allowed, c.wanted, err)
+		}
+	}
+
+	// The daemon would use the last image, which is not the one that is allowed
+	cg := &Server{ImagePolicy: ip}
+	cg.policies = cg.requestPolicies()
+	body := `{"Image":"alpine","image":"hectorm/cetusguard"}`
+	req := httptest.NewRequest("POST", "/v1.41/containers/create", strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	if cg.applyPolicies(rec, req) || rec.Code != http.StatusForbidden {
+		t.Errorf("%s: status = %d, want %d", body, rec.Code, http.StatusForbidden)
+	}
+}
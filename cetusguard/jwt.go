@@ -0,0 +1,517 @@
+package cetusguard
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hectorm/cetusguard/internal/logger"
+)
+
+const (
+	// Minimum time between reloads of the JWKS triggered by tokens signed with an unknown key
+	jwksReloadInterval = time.Minute
+	// Maximum time to fetch a JWKS from a URL
+	jwksFetchTimeout = 10 * time.Second
+	// Maximum size of a JWKS
+	jwksMaxSize = 1024 * 1024
+	// Tolerated clock difference with the token issuer
+	jwtLeeway = time.Minute
+)
+
+var (
+	jwtClaimLineRegex = regexp.MustCompile(`^[\t ]*([a-z0-9-]+=[^\t ;]*(?:;[a-z0-9-]+=[^\t ;]*)*)[\t ]*$`)
+	ruleSetNameRegex  = regexp.MustCompile(`^[a-z0-9-]+$`)
+)
+
+// Verified tokens that are accepted and the rule set they are mapped to, a token is accepted by the first rule
+// whose conditions are all met by its claims. Claims are matched with shell patterns as in path.Match, and every
+// rule must restrict the issuer or the audience, since a JWKS is often shared by tokens issued for other services
+type JwtClaimRule struct {
+	// Name of the rule set for the tokens, the regular rules if empty
+	RuleSet string
+	// Pattern for the issuer of the token
+	Iss string
+	// Pattern for the subject of the token
+	Sub string
+	// Pattern for one of the audiences of the token
+	Aud string
+	// Pattern for the repository the token was issued for, as in CI workload identity tokens
+	Repository string
+}
+
+func (rule JwtClaimRule) String() string {
+	var opts []string
+	if rule.RuleSet != "" {
+		opts = append(opts, "rule-set="+rule.RuleSet)
+	}
+	if rule.Iss != "" {
+		opts = append(opts, "iss="+rule.Iss)
+	}
+	if rule.Sub != "" {
+		opts = append(opts, "sub="+rule.Sub)
+	}
+	if rule.Aud != "" {
+		opts = append(opts, "aud="+rule.Aud)
+	}
+	if rule.Repository != "" {
+		opts = append(opts, "repository="+rule.Repository)
+	}
+	return strings.Join(opts, ";")
+}
+
+var jwtClaimOptionParsers = map[string]func(rule *JwtClaimRule, val string) error{
+	"rule-set": func(rule *JwtClaimRule, val string) error {
+		if !ruleSetNameRegex.MatchString(val) {
+			return fmt.Errorf("invalid rule set name: %s", val)
+		}
+		rule.RuleSet = val
+		return nil
+	},
+	"iss": func(rule *JwtClaimRule, val string) (err error) {
+		rule.Iss, err = parsePattern(val)
+		return err
+	},
+	"sub": func(rule *JwtClaimRule, val string) (err error) {
+		rule.Sub, err = parsePattern(val)
+		return err
+	},
+	"aud": func(rule *JwtClaimRule, val string) (err error) {
+		rule.Aud, err = parsePattern(val)
+		return err
+	},
+	"repository": func(rule *JwtClaimRule, val string) (err error) {
+		rule.Repository, err = parsePattern(val)
+		return err
+	},
+}
+
+// Builds claim rules from lines with conditions in the KEY=VALUE format separated by semicolons
+func BuildJwtClaimRules(str string) ([]JwtClaimRule, error) {
+	var rules []JwtClaimRule
+
+	lines := newLineRegex.Split(str, -1)
+	for _, line := range lines {
+		if commentLineRegex.MatchString(line) {
+			continue
+		}
+
+		matches := jwtClaimLineRegex.FindStringSubmatch(line)
+		if len(matches) != 2 {
+			return nil, fmt.Errorf("invalid JWT claim rule line: %s", line)
+		}
+
+		var rule JwtClaimRule
+		for _, option := range strings.Split(matches[1], ";") {
+			k, v, _ := strings.Cut(option, "=")
+			parse, ok := jwtClaimOptionParsers[k]
+			if !ok {
+				return nil, fmt.Errorf("unknown JWT claim rule option: %s", k)
+			}
+			if err := parse(&rule, v); err != nil {
+				return nil, fmt.Errorf("invalid JWT claim rule option: %s: %w", option, err)
+			}
+		}
+		if rule.Iss == "" && rule.Aud == "" {
+			return nil, fmt.Errorf("JWT claim rule without iss or aud option: %s", line)
+		}
+
+		rules = append(rules, rule)
+
+		logger.Debugf("loaded JWT claim rule: %s\n", rule)
+	}
+
+	return rules, nil
+}
+
+// Registered and CI specific claims of a token, the audience can be a single string or a list of them
+type jwtClaims struct {
+	Iss        string          `json:"iss"`
+	Sub        string          `json:"sub"`
+	Aud        json.RawMessage `json:"aud"`
+	Exp        *json.Number    `json:"exp"`
+	Nbf        *json.Number    `json:"nbf"`
+	Repository string          `json:"repository"`
+}
+
+func (claims *jwtClaims) audiences() []string {
+	var aud string
+	if err := json.Unmarshal(claims.Aud, &aud); err == nil {
+		return []string{aud}
+	}
+	var auds []string
+	_ = json.Unmarshal(claims.Aud, &auds)
+	return auds
+}
+
+func (rule JwtClaimRule) matches(claims *jwtClaims) bool {
+	if rule.Iss != "" && !matchesAny(rule.Iss, []string{claims.Iss}) {
+		return false
+	}
+	if rule.Sub != "" && !matchesAny(rule.Sub, []string{claims.Sub}) {
+		return false
+	}
+	if rule.Aud != "" && !matchesAny(rule.Aud, claims.audiences()) {
+		return false
+	}
+	if rule.Repository != "" && !matchesAny(rule.Repository, []string{claims.Repository}) {
+		return false
+	}
+	return true
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type jwtKey struct {
+	kid string
+	alg string
+	pub crypto.PublicKey
+}
+
+var jwkCurves = map[string]elliptic.Curve{
+	"P-256": elliptic.P256(),
+	"P-384": elliptic.P384(),
+	"P-521": elliptic.P521(),
+}
+
+// Curves that must be used with each ECDSA algorithm
+var jwtEcdsaCurves = map[string]elliptic.Curve{
+	"ES256": elliptic.P256(),
+	"ES384": elliptic.P384(),
+	"ES512": elliptic.P521(),
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		pub := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		if pub.N.BitLen() < 2048 {
+			return nil, errors.New("RSA keys must be at least 2048 bits")
+		}
+		return pub, nil
+	case "EC":
+		curve, ok := jwkCurves[k.Crv]
+		if !ok {
+			return nil, fmt.Errorf("unsupported curve: %s", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		size := (curve.Params().BitSize + 7) / 8
+		if len(x) != size || len(y) != size {
+			return nil, errors.New("invalid EC point")
+		}
+		return ecdsa.ParseUncompressedPublicKey(curve, append(append([]byte{4}, x...), y...))
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve: %s", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, fmt.Errorf("unsupported key type: %s", k.Kty)
+	}
+}
+
+// Verifies tokens signed with the keys of a JWKS read from a file or fetched from a URL, which is loaded
+// again when a token is signed with an unknown key, so that keys can be rotated without a restart
+type jwtVerifier struct {
+	jwks  string
+	rules []JwtClaimRule
+
+	keys     []jwtKey
+	loadedAt time.Time
+	mu       sync.Mutex
+}
+
+func newJwtVerifier(jwks string, rules []JwtClaimRule) (*jwtVerifier, error) {
+	if len(rules) == 0 {
+		return nil, errors.New("a JWKS requires JWT claim rules")
+	}
+	v := &jwtVerifier{jwks: jwks, rules: rules}
+	keys, err := v.load()
+	if err != nil {
+		return nil, err
+	}
+	v.keys, v.loadedAt = keys, time.Now()
+	return v, nil
+}
+
+func (v *jwtVerifier) readJwks() ([]byte, error) {
+	if !strings.HasPrefix(v.jwks, "http://") && !strings.HasPrefix(v.jwks, "https://") {
+		return os.ReadFile(filepath.Clean(v.jwks))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), jwksFetchTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", v.jwks, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = res.Body.Close()
+	}()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status fetching JWKS: %s", res.Status)
+	}
+	return io.ReadAll(io.LimitReader(res.Body, jwksMaxSize))
+}
+
+// Reads and parses the JWKS, it must be called without the lock held since it can take a while to fetch it
+func (v *jwtVerifier) load() ([]jwtKey, error) {
+	data, err := v.readJwks()
+	if err != nil {
+		return nil, fmt.Errorf("cannot load JWKS %s: %w", v.jwks, err)
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("invalid JWKS %s: %w", v.jwks, err)
+	}
+
+	var keys []jwtKey
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pub, err := k.publicKey()
+		if err != nil {
+			logger.Warningf("ignored key %q of JWKS %s: %v\n", k.Kid, v.jwks, err)
+			continue
+		}
+		keys = append(keys, jwtKey{kid: k.Kid, alg: k.Alg, pub: pub})
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("JWKS %s does not have any usable key", v.jwks)
+	}
+
+	logger.Debugf("loaded %d keys from JWKS %s\n", len(keys), v.jwks)
+	return keys, nil
+}
+
+func (v *jwtVerifier) candidateKeys(kid string, alg string) []jwtKey {
+	var keys []jwtKey
+	for _, k := range v.keys {
+		if (kid == "" || k.kid == kid) && (k.alg == "" || k.alg == alg) {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+func (v *jwtVerifier) keysFor(kid string, alg string, now time.Time) []jwtKey {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	keys := v.candidateKeys(kid, alg)
+	if len(keys) > 0 || now.Sub(v.loadedAt) < jwksReloadInterval {
+		return keys
+	}
+
+	// The reload time is updated before the JWKS is fetched, so that only one request fetches it and
+	// the others are not blocked in the meantime
+	v.loadedAt = now
+	v.mu.Unlock()
+	loaded, err := v.load()
+	v.mu.Lock()
+	if err != nil {
+		logger.Error(err)
+		return nil
+	}
+	v.keys = loaded
+	return v.candidateKeys(kid, alg)
+}
+
+func jwtHash(alg string) (crypto.Hash, bool) {
+	switch alg[2:] {
+	case "256":
+		return crypto.SHA256, true
+	case "384":
+		return crypto.SHA384, true
+	case "512":
+		return crypto.SHA512, true
+	}
+	return 0, false
+}
+
+func verifyJwtSignature(alg string, pub crypto.PublicKey, signed []byte, sig []byte) bool {
+	if alg == "EdDSA" {
+		key, ok := pub.(ed25519.PublicKey)
+		return ok && ed25519.Verify(key, signed, sig)
+	}
+	if len(alg) != 5 {
+		return false
+	}
+	hash, ok := jwtHash(alg)
+	if !ok {
+		return false
+	}
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	switch alg[:2] {
+	case "RS":
+		key, ok := pub.(*rsa.PublicKey)
+		return ok && rsa.VerifyPKCS1v15(key, hash, digest, sig) == nil
+	case "PS":
+		key, ok := pub.(*rsa.PublicKey)
+		return ok && rsa.VerifyPSS(key, hash, digest, sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}) == nil
+	case "ES":
+		key, ok := pub.(*ecdsa.PublicKey)
+		if !ok || key.Curve != jwtEcdsaCurves[alg] {
+			return false
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return false
+		}
+		r, s := new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])
+		return ecdsa.Verify(key, digest, r, s)
+	}
+	return false
+}
+
+func numericDate(n *json.Number) (time.Time, error) {
+	f, err := n.Float64()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(int64(f), 0), nil
+}
+
+// Returns the credential of a token with a valid signature, that is not expired and that is accepted by a claim rule
+func (v *jwtVerifier) verify(token string, now time.Time) (*credential, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	rawHeader, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errors.New("malformed token header")
+	}
+	var header struct {
+		Alg  string   `json:"alg"`
+		Kid  string   `json:"kid"`
+		Crit []string `json:"crit"`
+	}
+	if err := json.Unmarshal(rawHeader, &header); err != nil {
+		return nil, errors.New("malformed token header")
+	}
+	if len(header.Crit) > 0 {
+		return nil, fmt.Errorf("unsupported critical token header parameters: %s", strings.Join(header.Crit, ","))
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed token signature")
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+
+	verified := false
+	for _, k := range v.keysFor(header.Kid, header.Alg, now) {
+		if verifyJwtSignature(header.Alg, k.pub, signed, sig) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, fmt.Errorf("invalid token signature with algorithm %q and key %q", header.Alg, header.Kid)
+	}
+
+	rawClaims, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errors.New("malformed token claims")
+	}
+	var claims jwtClaims
+	dec := json.NewDecoder(bytes.NewReader(rawClaims))
+	dec.UseNumber()
+	if err := dec.Decode(&claims); err != nil {
+		return nil, errors.New("malformed token claims")
+	}
+
+	if claims.Exp == nil {
+		return nil, errors.New("token without expiration")
+	}
+	exp, err := numericDate(claims.Exp)
+	if err != nil {
+		return nil, errors.New("malformed token expiration")
+	}
+	if !now.Before(exp.Add(jwtLeeway)) {
+		return nil, fmt.Errorf("expired token for %s", claims.Sub)
+	}
+	if claims.Nbf != nil {
+		nbf, err := numericDate(claims.Nbf)
+		if err != nil {
+			return nil, errors.New("malformed token not before date")
+		}
+		if now.Add(jwtLeeway).Before(nbf) {
+			return nil, fmt.Errorf("token for %s not valid yet", claims.Sub)
+		}
+	}
+
+	cred := &credential{name: claims.Sub}
+	for _, rule := range v.rules {
+		if rule.matches(&claims) {
+			cred.ruleSet = rule.RuleSet
+			return cred, nil
+		}
+	}
+	return nil, fmt.Errorf("token for %s not accepted by any claim rule", claims.Sub)
+}
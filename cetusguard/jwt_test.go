@@ -0,0 +1,314 @@
+package cetusguard
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func signJwt(t *testing.T, alg string, kid string, key crypto.Signer, claims map[string]any) string {
+	t.Helper()
+
+	header, err := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := b64(header) + "." + b64(payload)
+
+	var sig []byte
+	switch k := key.(type) {
+	case ed25519.PrivateKey:
+		sig = ed25519.Sign(k, []byte(signed))
+	case *ecdsa.PrivateKey:
+		digest := sha256.Sum256([]byte(signed))
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	case *rsa.PrivateKey:
+		digest := sha256.Sum256([]byte(signed))
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return signed + "." + b64(sig)
+}
+
+func writeJwks(t *testing.T, path string, keys ...map[string]string) {
+	t.Helper()
+
+	data, err := json.Marshal(map[string]any{"keys": keys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBuildJwtClaimRules(t *testing.T) {
+	rules, err := BuildJwtClaimRules("! CI jobs\n" +
+		"iss=https://token.actions.githubusercontent.com;aud=cetusguard;repository=example/*;rule-set=ci\n" +
+		" \t aud=cetusguard;sub=admin \t \n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wanted := []JwtClaimRule{
+		{RuleSet: "ci", Iss: "https://token.actions.githubusercontent.com", Aud: "cetusguard", Repository: "example/*"},
+		{Sub: "admin", Aud: "cetusguard"},
+	}
+	if !reflect.DeepEqual(rules, wanted) {
+		t.Errorf("rules = %v, want %v", rules, wanted)
+	}
+}
+
+func TestBuildInvalidJwtClaimRules(t *testing.T) {
+	lines := []string{
+		"sub",
+		"sub=",
+		"sub=[",
+		"email=admin@example.com",
+		"rule-set=Read_Only",
+		"sub=admin sub=other",
+		"sub=admin",
+		"repository=example/*;rule-set=ci",
+	}
+
+	for _, line := range lines {
+		rules, err := BuildJwtClaimRules(line)
+		if err == nil || rules != nil {
+			t.Errorf("%q: rules = %v, want an error", line, rules)
+		}
+	}
+}
+
+func TestJwtVerify(t *testing.T) {
+	edPub, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecPub, err := ecKey.PublicKey.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, otherKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	writeJwks(t, path,
+		map[string]string{"kty": "OKP", "crv": "Ed25519", "kid": "ed", "x": b64(edPub)},
+		map[string]string{"kty": "EC", "crv": "P-256", "kid": "ec", "x": b64(ecPub[1:33]), "y": b64(ecPub[33:])},
+		map[string]string{"kty": "RSA", "kid": "rsa", "alg": "RS256", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+		map[string]string{"kty": "oct", "kid": "hmac", "k": b64([]byte("secret"))},
+	)
+
+	rules, err := BuildJwtClaimRules("aud=cetusguard;repository=example/*;rule-set=ci\naud=cetusguard;sub=admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := newJwtVerifier(path, rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	exp := now.Add(time.Hour).Unix()
+	ciClaims := map[string]any{"sub": "repo:example/app", "aud": []string{"other", "cetusguard"}, "repository": "example/app", "exp": exp}
+	adminClaims := map[string]any{"sub": "admin", "aud": "cetusguard", "exp": exp}
+
+	testCases := []struct {
+		name    string
+		token   string
+		sub     string
+		ruleSet string
+	}{
+		{"EdDSA", signJwt(t, "EdDSA", "ed", edKey, ciClaims), "repo:example/app", "ci"},
+		{"ES256", signJwt(t, "ES256", "ec", ecKey, ciClaims), "repo:example/app", "ci"},
+		{"RS256", signJwt(t, "RS256", "rsa", rsaKey, adminClaims), "admin", ""},
+		{"without kid", signJwt(t, "EdDSA", "", edKey, adminClaims), "admin", ""},
+		{"unknown key", signJwt(t, "EdDSA", "ed", otherKey, adminClaims), "", ""},
+		{"mismatched algorithm", signJwt(t, "ES384", "ec", ecKey, adminClaims), "", ""},
+		{"expired", signJwt(t, "EdDSA", "ed", edKey, map[string]any{"sub": "admin", "aud": "cetusguard", "exp": now.Add(-time.Hour).Unix()}), "", ""},
+		{"not valid yet", signJwt(t, "EdDSA", "ed", edKey, map[string]any{"sub": "admin", "aud": "cetusguard", "exp": exp, "nbf": now.Add(time.Hour).Unix()}), "", ""},
+		{"without expiration", signJwt(t, "EdDSA", "ed", edKey, map[string]any{"sub": "admin", "aud": "cetusguard"}), "", ""},
+		{"wrong audience", signJwt(t, "EdDSA", "ed", edKey, map[string]any{"sub": "admin", "aud": "other", "exp": exp}), "", ""},
+		{"unsigned", b64([]byte(`{"alg":"none"}`)) + "." + b64([]byte(`{"sub":"admin","aud":"cetusguard"}`)) + ".", "", ""},
+		{"malformed", "a.b.c", "", ""},
+	}
+
+	for _, c := range testCases {
+		cred, err := v.verify(c.token, now)
+		if c.sub == "" {
+			if err == nil {
+				t.Errorf("%s: verified as %v, want an error", c.name, cred)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if cred.name != c.sub || cred.ruleSet != c.ruleSet {
+			t.Errorf("%s: cred = %v, want {%s %s}", c.name, cred, c.sub, c.ruleSet)
+		}
+	}
+}
+
+func TestJwtVerifierReload(t *testing.T) {
+	oldPub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newPub, newKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var jwks atomic.Pointer[map[string]string]
+	jwks.Store(&map[string]string{"kty": "OKP", "crv": "Ed25519", "kid": "old", "x": b64(oldPub)})
+	server := httptest.NewServer(http.HandlerFunc(func(wri http.ResponseWriter, req *http.Request) {
+		_ = json.NewEncoder(wri).Encode(map[string]any{"keys": []map[string]string{*jwks.Load()}})
+	}))
+	defer server.Close()
+
+	v, err := newJwtVerifier(server.URL, []JwtClaimRule{{Aud: "cetusguard"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jwks.Store(&map[string]string{"kty": "OKP", "crv": "Ed25519", "kid": "new", "x": b64(newPub)})
+	now := time.Now()
+	token := signJwt(t, "EdDSA", "new", newKey, map[string]any{"sub": "ci", "aud": "cetusguard", "exp": now.Add(time.Hour).Unix()})
+
+	// The JWKS is not loaded again until the reload interval has passed
+	if _, err := v.verify(token, now); err == nil {
+		t.Errorf("token verified before reload, want an error")
+	}
+	if _, err := v.verify(token, now.Add(jwksReloadInterval)); err != nil {
+		t.Errorf("token not verified after reload: %v", err)
+	}
+}
+
+func TestJwtVerifierReloadNotBlocking(t *testing.T) {
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var slow atomic.Bool
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(wri http.ResponseWriter, req *http.Request) {
+		if slow.Load() {
+			<-release
+		}
+		_ = json.NewEncoder(wri).Encode(map[string]any{"keys": []map[string]string{{"kty": "OKP", "crv": "Ed25519", "kid": "key", "x": b64(pub)}}})
+	}))
+	defer server.Close()
+	defer close(release)
+
+	v, err := newJwtVerifier(server.URL, []JwtClaimRule{{Aud: "cetusguard"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	slow.Store(true)
+	now := time.Now().Add(jwksReloadInterval)
+	claims := map[string]any{"sub": "ci", "aud": "cetusguard", "exp": now.Add(time.Hour).Unix()}
+	unknown := signJwt(t, "EdDSA", "unknown", key, claims)
+	known := signJwt(t, "EdDSA", "key", key, claims)
+	go func() {
+		_, _ = v.verify(unknown, now)
+	}()
+
+	// Tokens signed with a known key are verified while the JWKS is being fetched
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		v.mu.Lock()
+		reloading := v.loadedAt.Equal(now)
+		v.mu.Unlock()
+		if reloading {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("JWKS not reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := v.verify(known, now)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("token not verified: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("token verification blocked by the JWKS fetch")
+	}
+}
+
+func TestInvalidJwks(t *testing.T) {
+	tmpdir := t.TempDir()
+	rules := []JwtClaimRule{{Aud: "cetusguard"}}
+
+	path := filepath.Join(tmpdir, "jwks.json")
+	writeJwks(t, path, map[string]string{"kty": "OKP", "crv": "Ed25519", "kid": "key", "x": b64(make([]byte, ed25519.PublicKeySize))})
+	if _, err := newJwtVerifier(path, nil); err == nil {
+		t.Errorf("verifier created without claim rules, want an error")
+	}
+
+	writeJwks(t, path, map[string]string{"kty": "RSA", "kid": "short", "n": b64(big.NewInt(65537).Bytes()), "e": "AQAB"})
+	if _, err := newJwtVerifier(path, rules); err == nil {
+		t.Errorf("verifier created without usable keys, want an error")
+	}
+
+	if err := os.WriteFile(path, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newJwtVerifier(path, rules); err == nil {
+		t.Errorf("verifier created from an invalid JWKS, want an error")
+	}
+
+	if _, err := newJwtVerifier(filepath.Join(tmpdir, "missing.json"), rules); err == nil {
+		t.Errorf("verifier created from a missing JWKS, want an error")
+	}
+}
@@ -0,0 +1,263 @@
+package cetusguard
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hectorm/cetusguard/internal/logger"
+)
+
+const (
+	// Minimum time between removals of the token buckets that are full again
+	rateLimitSweepInterval = time.Minute
+)
+
+var (
+	rateRegex = regexp.MustCompile(`^([0-9]+)/([smh])$`)
+)
+
+var rateIntervals = map[string]time.Duration{
+	"s": time.Second,
+	"m": time.Minute,
+	"h": time.Hour,
+}
+
+// Number of requests allowed in an interval of one second, minute or hour
+type Rate struct {
+	Requests int
+	Interval time.Duration
+}
+
+// Parses a rate in the N/s, N/m or N/h format
+func ParseRate(val string) (Rate, error) {
+	matches := rateRegex.FindStringSubmatch(val)
+	if len(matches) != 3 {
+		return Rate{}, fmt.Errorf("invalid rate: %s", val)
+	}
+	n, err := strconv.Atoi(matches[1])
+	if err != nil || n <= 0 {
+		return Rate{}, fmt.Errorf("rate must be positive: %s", val)
+	}
+	return Rate{Requests: n, Interval: rateIntervals[matches[2]]}, nil
+}
+
+func (rate Rate) String() string {
+	if rate.Requests <= 0 {
+		return ""
+	}
+	for unit, interval := range rateIntervals {
+		if interval == rate.Interval {
+			return fmt.Sprintf("%d/%s", rate.Requests, unit)
+		}
+	}
+	return fmt.Sprintf("%d/%s", rate.Requests, rate.Interval)
+}
+
+type contextUidKey struct{}
+
+// Stores the user ID of the peer of Unix socket connections in the connection context
+func connContext(ctx context.Context, conn net.Conn) context.Context {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	if uid, ok := peerUid(conn); ok {
+		return context.WithValue(ctx, contextUidKey{}, uid)
+	}
+	return ctx
+}
+
+// Identifies the client for rate limiting purposes, by the common name of its verified certificate,
+// the user ID of the peer of a Unix socket connection or its address, in that order
+func clientIdentity(req *http.Request) string {
+	if cn := clientCommonName(req); cn != "" {
+		return "cn:" + cn
+	}
+	if uid, ok := req.Context().Value(contextUidKey{}).(int); ok {
+		return "uid:" + strconv.Itoa(uid)
+	}
+	return "addr:" + clientKey(req)
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Limits the requests of each client with a token bucket that is refilled at the given rate
+type rateLimiter struct {
+	perSecond float64
+	burst     float64
+
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+	mu        sync.Mutex
+}
+
+func newRateLimiter(rate Rate, burst int) *rateLimiter {
+	if burst <= 0 {
+		burst = rate.Requests
+	}
+	return &rateLimiter{
+		perSecond: float64(rate.Requests) / rate.Interval.Seconds(),
+		burst:     float64(burst),
+		buckets:   make(map[string]*tokenBucket),
+	}
+}
+
+// Takes a token from the bucket of the client, or returns the time until one is available
+func (rl *rateLimiter) allow(client string, now time.Time) (bool, time.Duration) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if now.Sub(rl.lastSweep) >= rateLimitSweepInterval {
+		for k, b := range rl.buckets {
+			if b.tokens+now.Sub(b.last).Seconds()*rl.perSecond >= rl.burst {
+				delete(rl.buckets, k)
+			}
+		}
+		rl.lastSweep = now
+	}
+
+	b, ok := rl.buckets[client]
+	if !ok {
+		b = &tokenBucket{tokens: rl.burst, last: now}
+		rl.buckets[client] = b
+	}
+	b.tokens = math.Min(rl.burst, b.tokens+now.Sub(b.last).Seconds()*rl.perSecond)
+	b.last = now
+
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / rl.perSecond * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// Limits the requests of each client that are being handled at the same time
+type inFlightLimiter struct {
+	max int
+
+	counts map[string]int
+	mu     sync.Mutex
+}
+
+func newInFlightLimiter(limit int) *inFlightLimiter {
+	return &inFlightLimiter{max: limit, counts: make(map[string]int)}
+}
+
+func (il *inFlightLimiter) acquire(client string) bool {
+	il.mu.Lock()
+	defer il.mu.Unlock()
+
+	if il.counts[client] >= il.max {
+		return false
+	}
+	il.counts[client]++
+	return true
+}
+
+func (il *inFlightLimiter) release(client string) {
+	il.mu.Lock()
+	defer il.mu.Unlock()
+
+	if il.counts[client]--; il.counts[client] <= 0 {
+		delete(il.counts, client)
+	}
+}
+
+// Rate and in-flight limits that apply to the same requests, either all of them or those allowed by a rule
+type requestLimiter struct {
+	rate     *rateLimiter
+	inFlight *inFlightLimiter
+}
+
+func newRequestLimiter(rate Rate, burst int, maxInFlight int) *requestLimiter {
+	if rate.Requests <= 0 && maxInFlight <= 0 {
+		return nil
+	}
+	rl := &requestLimiter{}
+	if rate.Requests > 0 {
+		rl.rate = newRateLimiter(rate, burst)
+	}
+	if maxInFlight > 0 {
+		rl.inFlight = newInFlightLimiter(maxInFlight)
+	}
+	return rl
+}
+
+// Returns a function that must be called when the request is done, or false and the time
+// after which the client may try again if the request exceeds any of the limits
+func (rl *requestLimiter) acquire(client string, now time.Time) (func(), bool, time.Duration) {
+	if rl == nil {
+		return func() {}, true, 0
+	}
+	if rl.rate != nil {
+		if ok, retryAfter := rl.rate.allow(client, now); !ok {
+			return nil, false, retryAfter
+		}
+	}
+	if rl.inFlight != nil {
+		if !rl.inFlight.acquire(client) {
+			return nil, false, time.Second
+		}
+		return func() { rl.inFlight.release(client) }, true, 0
+	}
+	return func() {}, true, 0
+}
+
+// Creates the global limiter and the limiters of the rules with limit options,
+// which apply to each client separately for every rule
+func (cg *Server) buildLimiters() {
+	cg.limiter = newRequestLimiter(cg.RateLimit, cg.RateLimitBurst, cg.MaxInFlight)
+
+	cg.ruleLimiters = make(map[*Rule]*requestLimiter)
+	ruleLists := [][]Rule{cg.Rules, cg.AnonymousRules}
+	for _, rules := range cg.RuleSets {
+		ruleLists = append(ruleLists, rules)
+	}
+	for _, rules := range ruleLists {
+		for i := range rules {
+			opts := rules[i].Options
+			if rl := newRequestLimiter(opts.RateLimit, opts.Burst, opts.MaxInFlight); rl != nil {
+				cg.ruleLimiters[&rules[i]] = rl
+			}
+		}
+	}
+}
+
+// Applies the global limits and those of the rule to the request, and writes a response with
+// the 429 status if any of them is exceeded. Returns a function that must be called when the request is done
+func (cg *Server) limitRequest(wri http.ResponseWriter, req *http.Request, rule *Rule) (func(), bool) {
+	client := clientIdentity(req)
+	now := time.Now()
+
+	releaseGlobal, ok, retryAfter := cg.limiter.acquire(client, now)
+	if ok {
+		releaseRule, ruleOk, ruleRetryAfter := cg.ruleLimiters[rule].acquire(client, now)
+		if ruleOk {
+			return func() {
+				releaseRule()
+				releaseGlobal()
+			}, true
+		}
+		releaseGlobal()
+		retryAfter = ruleRetryAfter
+	}
+
+	logger.Warningf("rate limited request %s from %s: %s %s\n", requestId(req), client, req.Method, req.URL.Path)
+	writeTooManyRequests(wri, retryAfter)
+	return nil, false
+}
+
+func writeTooManyRequests(wri http.ResponseWriter, retryAfter time.Duration) {
+	wri.Header().Set("Retry-After", strconv.Itoa(max(1, int(math.Ceil(retryAfter.Seconds())))))
+	wri.WriteHeader(http.StatusTooManyRequests)
+}
@@ -0,0 +1,128 @@
+package cetusguard
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRate(t *testing.T) {
+	testCases := map[string]Rate{
+		"10/s": {10, time.Second},
+		"30/m": {30, time.Minute},
+		"1/h":  {1, time.Hour},
+	}
+	for val, wanted := range testCases {
+		rate, err := ParseRate(val)
+		if err != nil {
+			t.Errorf("%s: %v", val, err)
+			continue
+		}
+		if rate != wanted {
+			t.Errorf("%s: rate = %v, want %v", val, rate, wanted)
+		}
+		if rate.String() != val {
+			t.Errorf("rate.String() = %s, want %s", rate, val)
+		}
+	}
+
+	for _, val := range []string{"", "10", "0/s", "-1/s", "10/d", "1.5/s", "10/ms"} {
+		if rate, err := ParseRate(val); err == nil {
+			t.Errorf("%q: rate = %v, want an error", val, rate)
+		}
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	rl := newRateLimiter(Rate{2, time.Second}, 3)
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := rl.allow("a", now); !ok {
+			t.Fatalf("request %d denied, want allowed", i)
+		}
+	}
+	ok, retryAfter := rl.allow("a", now)
+	if ok {
+		t.Fatalf("request allowed after the burst, want denied")
+	}
+	if retryAfter != 500*time.Millisecond {
+		t.Errorf("retryAfter = %s, want %s", retryAfter, 500*time.Millisecond)
+	}
+
+	// Other clients have their own bucket
+	if ok, _ := rl.allow("b", now); !ok {
+		t.Errorf("other client denied, want allowed")
+	}
+
+	if ok, _ := rl.allow("a", now.Add(500*time.Millisecond)); !ok {
+		t.Errorf("request denied after a token was refilled, want allowed")
+	}
+	if ok, _ := rl.allow("a", now.Add(500*time.Millisecond)); ok {
+		t.Errorf("request allowed without tokens, want denied")
+	}
+
+	// Buckets that are full again are removed
+	rl.allow("c", now.Add(rateLimitSweepInterval))
+	if _, ok := rl.buckets["a"]; ok {
+		t.Errorf("full bucket not removed")
+	}
+}
+
+func TestRequestLimiter(t *testing.T) {
+	if rl := newRequestLimiter(Rate{}, 0, 0); rl != nil {
+		t.Fatalf("limiter without limits, want nil")
+	}
+
+	var rl *requestLimiter
+	if release, ok, _ := rl.acquire("a", time.Now()); !ok {
+		t.Errorf("request denied by a nil limiter, want allowed")
+	} else {
+		release()
+	}
+
+	rl = newRequestLimiter(Rate{}, 0, 2)
+	now := time.Now()
+	release1, ok1, _ := rl.acquire("a", now)
+	release2, ok2, _ := rl.acquire("a", now)
+	if !ok1 || !ok2 {
+		t.Fatalf("requests denied below the in-flight limit, want allowed")
+	}
+	if _, ok, retryAfter := rl.acquire("a", now); ok || retryAfter <= 0 {
+		t.Errorf("request allowed above the in-flight limit, want denied")
+	}
+	if release, ok, _ := rl.acquire("b", now); !ok {
+		t.Errorf("other client denied, want allowed")
+	} else {
+		release()
+	}
+
+	release1()
+	if release, ok, _ := rl.acquire("a", now); !ok {
+		t.Errorf("request denied after another one finished, want allowed")
+	} else {
+		release()
+	}
+	release2()
+
+	if len(rl.inFlight.counts) != 0 {
+		t.Errorf("counts = %v, want empty", rl.inFlight.counts)
+	}
+}
+
+func TestSessionRegistryReserveHijacked(t *testing.T) {
+	sr := &sessionRegistry{}
+
+	if !sr.reserveHijacked(1) {
+		t.Fatalf("session denied below the limit, want allowed")
+	}
+	if sr.reserveHijacked(1) {
+		t.Errorf("session allowed above the limit, want denied")
+	}
+	sr.releaseHijacked()
+	if !sr.reserveHijacked(1) {
+		t.Errorf("session denied after another one finished, want allowed")
+	}
+	if !sr.reserveHijacked(0) {
+		t.Errorf("session denied without a limit, want allowed")
+	}
+}
@@ -0,0 +1,249 @@
+package cetusguard
+
+import (
+	"fmt"
+	"maps"
+	"path"
+	"slices"
+	"strings"
+)
+
+const (
+	defaultVolumeDriver = "local"
+)
+
+// Restricts the host paths and volumes that containers can mount,
+// by inspecting the body of the container and volume create requests
+type MountPolicy struct {
+	// Host path prefixes bind mounts may use, bind mounts are denied if empty
+	AllowedPaths []string
+	// Make bind mounts read only
+	ReadOnly bool
+	// Drivers volumes may use, only the local driver if empty
+	VolumeDrivers []string
+	// Names of the driver options volumes may set, none if empty
+	VolumeOptions []string
+}
+
+// Checks and cleans the allowed path prefixes
+func (mp *MountPolicy) load() error {
+	if mp == nil {
+		return nil
+	}
+
+	for i, p := range mp.AllowedPaths {
+		if !path.IsAbs(p) {
+			return fmt.Errorf("mount path prefix is not absolute: %s", p)
+		}
+		mp.AllowedPaths[i] = path.Clean(p)
+	}
+
+	return nil
+}
+
+// Reports whether a host path is under any of the allowed prefixes, once its ".." elements are resolved
+func (mp *MountPolicy) pathAllowed(p string) bool {
+	if !path.IsAbs(p) {
+		return false
+	}
+	p = path.Clean(p)
+	for _, prefix := range mp.AllowedPaths {
+		if p == prefix || prefix == "/" || strings.HasPrefix(p, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func (mp *MountPolicy) checkBindSource(src string) error {
+	if !mp.pathAllowed(src) {
+		return policyErrorf("bind mount of host path not allowed: %s", src)
+	}
+	return nil
+}
+
+func (mp *MountPolicy) checkVolumeDriver(driver string) error {
+	if driver == "" {
+		driver = defaultVolumeDriver
+	}
+	drivers := mp.VolumeDrivers
+	if len(drivers) == 0 {
+		drivers = []string{defaultVolumeDriver}
+	}
+	if !slices.Contains(drivers, driver) {
+		return policyErrorf("volume driver not allowed: %s", driver)
+	}
+	return nil
+}
+
+// Checks the driver options of a volume, the local driver can also mount
+// a host path with the bind option, which must be allowed as a bind mount
+func (mp *MountPolicy) checkVolumeOptions(driver string, opts map[string]any) error {
+	for _, k := range slices.Sorted(maps.Keys(opts)) {
+		if !slices.Contains(mp.VolumeOptions, k) {
+			return policyErrorf("volume driver option not allowed: %s", k)
+		}
+	}
+	if driver == "" || driver == defaultVolumeDriver {
+		o, _ := opts["o"].(string)
+		mountOpts := strings.Split(o, ",")
+		if slices.Contains(mountOpts, "bind") || slices.Contains(mountOpts, "rbind") {
+			device, _ := opts["device"].(string)
+			return mp.checkBindSource(device)
+		}
+	}
+	return nil
+}
+
+// Returns the mount options with "ro" instead of "rw", and whether they changed
+func readOnlyOptions(opts []string) ([]string, bool) {
+	if slices.Contains(opts, "ro") && !slices.Contains(opts, "rw") {
+		return opts, false
+	}
+	opts = slices.DeleteFunc(slices.Clone(opts), func(opt string) bool { return opt == "rw" || opt == "ro" || opt == "" })
+	return append(opts, "ro"), true
+}
+
+// Checks the mounts of a container create request, in the Docker or the libpod format
+func (mp *MountPolicy) checkContainer(body map[string]any, libpod bool) ([]string, error) {
+	if libpod {
+		return mp.checkLibpodContainer(body)
+	}
+
+	hc, ok := field(body, "HostConfig").(map[string]any)
+	if !ok {
+		return nil, nil
+	}
+
+	var changes []string
+
+	volumeDriver, _ := field(hc, "VolumeDriver").(string)
+	if volumeDriver != "" {
+		if err := mp.checkVolumeDriver(volumeDriver); err != nil {
+			return nil, err
+		}
+	}
+
+	// Binds are in SOURCE:TARGET[:OPTIONS] format, where the source is a volume name if it is not a path
+	binds := stringsField(hc, "Binds")
+	bindsChanged := false
+	for i, bind := range binds {
+		src, rest, _ := strings.Cut(bind, ":")
+		if !strings.HasPrefix(src, "/") {
+			continue
+		}
+		if err := mp.checkBindSource(src); err != nil {
+			return nil, err
+		}
+		if mp.ReadOnly {
+			target, optsFrag, _ := strings.Cut(rest, ":")
+			if opts, changed := readOnlyOptions(strings.Split(optsFrag, ",")); changed {
+				binds[i] = src + ":" + target + ":" + strings.Join(opts, ",")
+				bindsChanged = true
+				changes = append(changes, "made bind mount read only: "+target)
+			}
+		}
+	}
+	if bindsChanged {
+		setField(hc, "Binds", binds)
+	}
+
+	mounts, _ := field(hc, "Mounts").([]any)
+	for _, m := range mounts {
+		mount, ok := m.(map[string]any)
+		if !ok {
+			continue
+		}
+		target, _ := field(mount, "Target").(string)
+		switch field(mount, "Type") {
+		case "bind":
+			src, _ := field(mount, "Source").(string)
+			if err := mp.checkBindSource(src); err != nil {
+				return nil, err
+			}
+			if mp.ReadOnly && !boolField(mount, "ReadOnly") {
+				setField(mount, "ReadOnly", true)
+				changes = append(changes, "made bind mount read only: "+target)
+			}
+		case "volume":
+			driver := volumeDriver
+			var opts map[string]any
+			if volumeOptions, ok := field(mount, "VolumeOptions").(map[string]any); ok {
+				if driverConfig, ok := field(volumeOptions, "DriverConfig").(map[string]any); ok {
+					if name, _ := field(driverConfig, "Name").(string); name != "" {
+						driver = name
+					}
+					opts, _ = field(driverConfig, "Options").(map[string]any)
+				}
+			}
+			if err := mp.checkVolumeDriver(driver); err != nil {
+				return nil, err
+			}
+			if err := mp.checkVolumeOptions(driver, opts); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return changes, nil
+}
+
+func (mp *MountPolicy) checkLibpodContainer(body map[string]any) ([]string, error) {
+	var changes []string
+
+	mounts, _ := field(body, "mounts").([]any)
+	for _, m := range mounts {
+		mount, ok := m.(map[string]any)
+		if !ok {
+			continue
+		}
+		opts := stringsField(mount, "options")
+		if field(mount, "type") != "bind" && !slices.Contains(opts, "bind") && !slices.Contains(opts, "rbind") {
+			continue
+		}
+		src, _ := field(mount, "source").(string)
+		if err := mp.checkBindSource(src); err != nil {
+			return nil, err
+		}
+		if mp.ReadOnly {
+			if opts, changed := readOnlyOptions(opts); changed {
+				setField(mount, "options", opts)
+				target, _ := field(mount, "destination").(string)
+				changes = append(changes, "made bind mount read only: "+target)
+			}
+		}
+	}
+
+	// Overlay volumes mount a host path as the lower layer of an overlay filesystem
+	overlayVolumes, _ := field(body, "overlay_volumes").([]any)
+	for _, v := range overlayVolumes {
+		volume, ok := v.(map[string]any)
+		if !ok {
+			continue
+		}
+		src, _ := field(volume, "source").(string)
+		if err := mp.checkBindSource(src); err != nil {
+			return nil, err
+		}
+	}
+
+	return changes, nil
+}
+
+// Checks the driver and the driver options of a volume create request, in the Docker or the libpod format
+func (mp *MountPolicy) checkVolume(body map[string]any, libpod bool) ([]string, error) {
+	driver, _ := field(body, "Driver").(string)
+	optsKey := "DriverOpts"
+	if libpod {
+		optsKey = "Options"
+	}
+	opts, _ := field(body, optsKey).(map[string]any)
+
+	if err := mp.checkVolumeDriver(driver); err != nil {
+		return nil, err
+	}
+	if err := mp.checkVolumeOptions(driver, opts); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
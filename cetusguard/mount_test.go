@@ -0,0 +1,151 @@
+package cetusguard
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestMountPolicyPathAllowed(t *testing.T) {
+	mp := &MountPolicy{AllowedPaths: []string{"/builds/", "/srv/data"}}
+	if err := mp.load(); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := map[string]bool{
+		"/builds":                true,
+		"/builds/job/1":          true,
+		"/srv/data/./cache":      true,
+		"/builds/../etc":         false,
+		"/builds/job/../../":     false,
+		"/srv/database":          false,
+		"/":                      false,
+		"builds/job":             false,
+		"/builds/job/../../srv/": false,
+	}
+	for p, wanted := range testCases {
+		if allowed := mp.pathAllowed(p); allowed != wanted {
+			t.Errorf("%s: allowed = %t, want %t", p, allowed, wanted)
+		}
+	}
+
+	if err := (&MountPolicy{AllowedPaths: []string{"builds"}}).load(); err == nil {
+		t.Errorf("relative prefix, want an error")
+	}
+}
+
+func TestMountPolicyCheckContainer(t *testing.T) {
+	mp := &MountPolicy{
+		AllowedPaths:  []string{"/builds"},
+		ReadOnly:      true,
+		VolumeOptions: []string{"type", "o", "device"},
+	}
+	if err := mp.load(); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		libpod bool
+		body   string
+		wanted string
+	}{
+		{
+			libpod: false,
+			body:   `{"Image":"alpine"}`,
+			wanted: `{"Image":"alpine"}`,
+		},
+		{
+			libpod: false,
+			body: `{"HostConfig":{"Binds":["/builds/job:/src","/builds/cache:/cache:rw,z","data:/data"],` +
+				`"Mounts":[{"Type":"bind","Source":"/builds/job/out","Target":"/out"},{"Type":"volume","Source":"logs","Target":"/logs"},{"Type":"tmpfs","Target":"/tmp"}]}}`,
+			wanted: `{"HostConfig":{"Binds":["/builds/job:/src:ro","/builds/cache:/cache:z,ro","data:/data"],` +
+				`"Mounts":[{"ReadOnly":true,"Source":"/builds/job/out","Target":"/out","Type":"bind"},{"Source":"logs","Target":"/logs","Type":"volume"},{"Target":"/tmp","Type":"tmpfs"}]}}`,
+		},
+		{
+			libpod: true,
+			body:   `{"mounts":[{"destination":"/src","type":"bind","source":"/builds/job","options":["rbind","rw"]},{"destination":"/tmp","type":"tmpfs","source":"tmpfs"}]}`,
+			wanted: `{"mounts":[{"destination":"/src","options":["rbind","ro"],"source":"/builds/job","type":"bind"},{"destination":"/tmp","source":"tmpfs","type":"tmpfs"}]}`,
+		},
+	}
+
+	for _, c := range testCases {
+		body := decodeTestBody(t, c.body)
+		if _, err := mp.checkContainer(body, c.libpod); err != nil {
+			t.Errorf("%s: %v", c.body, err)
+			continue
+		}
+		data, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != c.wanted {
+			t.Errorf("body = %s, want %s", data, c.wanted)
+		}
+	}
+}
+
+func TestMountPolicyDeniedContainer(t *testing.T) {
+	mp := &MountPolicy{AllowedPaths: []string{"/builds"}}
+	if err := mp.load(); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		libpod bool
+		body   string
+	}{
+		{false, `{"HostConfig":{"Binds":["/:/host"]}}`},
+		{false, `{"hostconfig":{"Binds":["/:/host"]}}`},
+		{false, `{"HostConfig":{"mounts":[{"type":"bind","source":"/etc","target":"/etc"}]}}`},
+		{false, `{"HostConfig":{"Binds":["/builds/../var/run/docker.sock:/var/run/docker.sock"]}}`},
+		{false, `{"HostConfig":{"Mounts":[{"Type":"bind","Source":"/etc","Target":"/etc"}]}}`},
+		{false, `{"HostConfig":{"VolumeDriver":"nfs"}}`},
+		{false, `{"HostConfig":{"Mounts":[{"Type":"volume","Target":"/data","VolumeOptions":{"DriverConfig":{"Name":"nfs"}}}]}}`},
+		{false, `{"HostConfig":{"Mounts":[{"Type":"volume","Target":"/data","VolumeOptions":{"DriverConfig":{"Options":{"device":"/"}}}}]}}`},
+		{true, `{"mounts":[{"destination":"/host","type":"bind","source":"/"}]}`},
+		{true, `{"mounts":[{"destination":"/host","options":["rbind"],"source":"/"}]}`},
+		{true, `{"overlay_volumes":[{"destination":"/host","source":"/etc"}]}`},
+	}
+
+	for _, c := range testCases {
+		_, err := mp.checkContainer(decodeTestBody(t, c.body), c.libpod)
+		var pErr *policyError
+		if !errors.As(err, &pErr) {
+			t.Errorf("%s: err = %v, want a policy error", c.body, err)
+		}
+	}
+}
+
+func TestMountPolicyCheckVolume(t *testing.T) {
+	mp := &MountPolicy{
+		AllowedPaths:  []string{"/builds"},
+		VolumeDrivers: []string{"local", "tmpfs-plugin"},
+		VolumeOptions: []string{"type", "o", "device"},
+	}
+	if err := mp.load(); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		libpod bool
+		body   string
+		wanted bool
+	}{
+		{false, `{"Name":"data"}`, true},
+		{false, `{"Name":"data","Driver":"tmpfs-plugin"}`, true},
+		{false, `{"Name":"data","DriverOpts":{"type":"tmpfs","device":"tmpfs","o":"size=100m"}}`, true},
+		{false, `{"Name":"data","DriverOpts":{"type":"none","device":"/builds/job","o":"bind"}}`, true},
+		{false, `{"Name":"data","Driver":"nfs"}`, false},
+		{false, `{"Name":"data","DriverOpts":{"type":"none","device":"/","o":"bind"}}`, false},
+		{false, `{"Name":"data","DriverOpts":{"uid":"0"}}`, false},
+		{true, `{"Name":"data","Options":{"type":"none","device":"/builds","o":"rbind"}}`, true},
+		{true, `{"Name":"data","Options":{"type":"none","device":"/etc","o":"rbind"}}`, false},
+	}
+
+	for _, c := range testCases {
+		_, err := mp.checkVolume(decodeTestBody(t, c.body), c.libpod)
+		if allowed := err == nil; allowed != c.wanted {
+			t.Errorf("%s: allowed = %t, want %t (%v)", c.body, allowed, c.wanted, err)
+		}
+	}
+}
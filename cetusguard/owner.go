@@ -0,0 +1,632 @@
+package cetusguard
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hectorm/cetusguard/internal/logger"
+)
+
+const (
+	// Maximum number of inspected objects kept in the cache of each backend
+	maxOwnerCacheEntries = 4096
+	// Time to wait before watching the events of a backend again after the stream ends
+	ownerEventsRetryInterval = 5 * time.Second
+)
+
+const (
+	ownedContainer = "container"
+	ownedVolume    = "volume"
+	ownedNetwork   = "network"
+	ownedExec      = "exec"
+)
+
+var (
+	ownerRuleLineRegex = regexp.MustCompile(`^[\t ]*([a-z0-9-]+=[^\t ;]*(?:;[a-z0-9-]+=[^\t ;]*)*)[\t ]*$`)
+
+	networkCreatePattern        = mustBuildPattern(`%API_PREFIX_NETWORKS%/create`)
+	libpodNetworkCreatePattern  = mustBuildPattern(`%API_PREFIX_LIBPOD_NETWORKS%/create`)
+	networkConnectPattern       = mustBuildPattern(`%API_PREFIX_NETWORKS%/[^/]+/(?:connect|disconnect)`)
+	libpodNetworkConnectPattern = mustBuildPattern(`%API_PREFIX_LIBPOD_NETWORKS%/[^/]+/(?:connect|disconnect)`)
+	commitPattern               = mustBuildPattern(`(?:%API_PREFIX_COMMIT%|%API_PREFIX_LIBPOD_COMMIT%)`)
+
+	// Endpoints that list or prune objects, or stream their events, which are filtered by the label
+	ownerFilterPattern = mustBuildPattern(`(?:%API_PREFIX_CONTAINERS%/(?:json|prune)|%API_PREFIX_LIBPOD_CONTAINERS%/(?:json|prune)|` +
+		`%API_PREFIX_VOLUMES%(?:/prune)?|%API_PREFIX_LIBPOD_VOLUMES%/(?:json|prune)|` +
+		`%API_PREFIX_NETWORKS%(?:/prune)?|%API_PREFIX_LIBPOD_NETWORKS%/(?:json|prune)|` +
+		`%API_PREFIX_EVENTS%|%API_PREFIX_LIBPOD_EVENTS%)/?`)
+	// Endpoints that show or act on the objects of every client and cannot be filtered by the label, such as the
+	// disk usage, the stats and mounts of all containers, pods, or the kube files that create unlabeled objects
+	ownerDeniedPattern = mustBuildPattern(`(?:%API_PREFIX_SYSTEM%/df|%API_PREFIX_LIBPOD_SYSTEM%/df|` +
+		`%API_PREFIX_LIBPOD_CONTAINERS%/(?:stats|showmounts)|%API_PREFIX_LIBPOD_PODS%(?:/.*)?|` +
+		`%API_PREFIX_LIBPOD_GENERATE%(?:/.*)?|%API_PREFIX_LIBPOD_PLAY%(?:/.*)?)/?`)
+)
+
+// Paths that refer to an object by its ID or name, followed by the names that refer to other endpoints instead
+var ownedObjectPaths = []struct {
+	kind     string
+	pattern  *regexp.Regexp
+	reserved []string
+}{
+	{ownedContainer, mustBuildPattern(`%API_PREFIX_CONTAINERS%/([^/]+)(/.*)?`), []string{"json", "create", "prune"}},
+	{ownedContainer, mustBuildPattern(`%API_PREFIX_LIBPOD_CONTAINERS%/([^/]+)(/.*)?`), []string{"json", "create", "prune", "stats", "showmounts"}},
+	{ownedVolume, mustBuildPattern(`%API_PREFIX_VOLUMES%/([^/]+)(/.*)?`), []string{"create", "prune"}},
+	{ownedVolume, mustBuildPattern(`%API_PREFIX_LIBPOD_VOLUMES%/([^/]+)(/.*)?`), []string{"json", "create", "prune"}},
+	{ownedNetwork, mustBuildPattern(`%API_PREFIX_NETWORKS%/([^/]+)(/.*)?`), []string{"create", "prune"}},
+	{ownedNetwork, mustBuildPattern(`%API_PREFIX_LIBPOD_NETWORKS%/([^/]+)(/.*)?`), []string{"json", "create", "prune"}},
+	{ownedExec, mustBuildPattern(`(?:%API_PREFIX_EXEC%|%API_PREFIX_LIBPOD_EXEC%)/([^/]+)(/.*)?`), nil},
+}
+
+// Networks that exist in every daemon and have no labels
+var builtinNetworks = []string{"default", "bridge", "host", "none", "podman"}
+
+// Returned when the owner of an object cannot be looked up on the backend
+var errOwnerLookup = errors.New("error looking up object owner")
+
+// Restricts the clients that meet the conditions of the options to the containers, volumes and networks
+// that have the label, which is added to the objects they create. The first rule that matches the client is used
+type OwnerRule struct {
+	Label   string
+	Value   string
+	Options RouteOptions
+}
+
+func (rule OwnerRule) String() string {
+	return fmt.Sprintf("label=%s=%s%s", rule.Label, rule.Value, rule.Options.String())
+}
+
+func BuildOwnerRules(str string) ([]OwnerRule, error) {
+	var rules []OwnerRule
+
+	lines := newLineRegex.Split(str, -1)
+	for _, line := range lines {
+		if commentLineRegex.MatchString(line) {
+			continue
+		}
+
+		matches := ownerRuleLineRegex.FindStringSubmatch(line)
+		if len(matches) != 2 {
+			return nil, fmt.Errorf("invalid owner rule line: %s", line)
+		}
+
+		var rule OwnerRule
+		for _, option := range strings.Split(matches[1], ";") {
+			k, v, _ := strings.Cut(option, "=")
+			if k == "label" {
+				var ok bool
+				rule.Label, rule.Value, ok = strings.Cut(v, "=")
+				if !ok || rule.Label == "" {
+					return nil, fmt.Errorf("invalid owner rule option: %s: not in KEY=VALUE format", option)
+				}
+				continue
+			}
+			parse, ok := routeOptionParsers[k]
+			if !ok {
+				return nil, fmt.Errorf("unknown owner rule option: %s", k)
+			}
+			if err := parse(&rule.Options, v); err != nil {
+				return nil, fmt.Errorf("invalid owner rule option: %s: %w", option, err)
+			}
+		}
+		if rule.Label == "" {
+			return nil, fmt.Errorf("owner rule without label: %s", line)
+		}
+
+		rules = append(rules, rule)
+
+		logger.Debugf("loaded owner rule: %s\n", rule)
+	}
+
+	return rules, nil
+}
+
+// Labels and identity of an inspected object, or the container of an exec instance
+type ownerEntry struct {
+	id        string
+	labels    map[string]string
+	container string
+}
+
+// Caches the objects inspected on each backend of a pool, since the requests of a client may be forwarded to any of them
+type ownerCache struct {
+	pool     *backendPool
+	targets  map[*backendTarget]*ownerTargetCache
+	stopCh   chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+// Caches the objects inspected on a backend, the entries of an object are removed when it is destroyed or renamed,
+// and the entries of the objects referenced by a name or an ID prefix are removed when another object of the same
+// kind is created or renamed, as the reference may then resolve to it. Objects are only cached while the events
+// of the backend are being watched, as otherwise they could be stale
+type ownerTargetCache struct {
+	target     *backendTarget
+	entries    map[string]ownerEntry
+	watching   bool
+	generation uint64
+	mu         sync.Mutex
+}
+
+func newOwnerCache(pool *backendPool) *ownerCache {
+	oc := &ownerCache{
+		pool:    pool,
+		targets: make(map[*backendTarget]*ownerTargetCache),
+		stopCh:  make(chan struct{}),
+	}
+	for _, bt := range pool.targets {
+		oc.targets[bt] = &ownerTargetCache{
+			target:  bt,
+			entries: make(map[string]ownerEntry),
+		}
+	}
+	return oc
+}
+
+// Watches the events of every backend until the cache is stopped, reconnecting when a stream ends
+func (oc *ownerCache) start() {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	for _, tc := range oc.targets {
+		oc.wg.Add(1)
+		go func() {
+			defer oc.wg.Done()
+
+			for {
+				err := tc.watchEvents(ctx)
+				tc.setWatching(false)
+				select {
+				case <-oc.stopCh:
+					return
+				default:
+				}
+				logger.Warningf("error watching backend %s events, object owners will not be cached: %v\n", tc.target.addr, err)
+				select {
+				case <-oc.stopCh:
+					return
+				case <-time.After(ownerEventsRetryInterval):
+				}
+			}
+		}()
+	}
+
+	go func() {
+		<-oc.stopCh
+		cancel()
+	}()
+}
+
+func (oc *ownerCache) stop() {
+	oc.stopOnce.Do(func() { close(oc.stopCh) })
+	oc.wg.Wait()
+}
+
+// Returns the entry of an object from the first backend that can be reached, in the order requests are forwarded,
+// reports false if it does not exist
+func (oc *ownerCache) lookup(ctx context.Context, client string, kind string, ref string) (ownerEntry, bool, error) {
+	var entry ownerEntry
+	var found bool
+	var err error
+	for _, bt := range oc.pool.candidates(client) {
+		entry, found, err = oc.targets[bt].lookup(ctx, kind, ref)
+		if err == nil || !isDialError(err) {
+			break
+		}
+	}
+	return entry, found, err
+}
+
+func (tc *ownerTargetCache) setWatching(watching bool) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	tc.watching = watching
+	tc.generation++
+	clear(tc.entries)
+}
+
+func (tc *ownerTargetCache) invalidate(kind string, action string, id string) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	tc.generation++
+	for k, entry := range tc.entries {
+		if entry.id == id || entry.container == id {
+			delete(tc.entries, k)
+			continue
+		}
+		if action == "create" || action == "rename" {
+			if entryKind, ref, _ := strings.Cut(k, ":"); entryKind == kind && ref != entry.id {
+				delete(tc.entries, k)
+			}
+		}
+	}
+}
+
+func (tc *ownerTargetCache) watchEvents(ctx context.Context) error {
+	filters := `{"type":["container","volume","network"],"event":["create","destroy","rename"]}`
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "/events?filters="+url.QueryEscape(filters), nil)
+	if err != nil {
+		return err
+	}
+	tc.target.direct(req)
+
+	// The client of the backend has a timeout that would end the stream
+	res, err := tc.target.httpClient.Transport.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = res.Body.Close()
+	}()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code: %d", res.StatusCode)
+	}
+	tc.setWatching(true)
+	logger.Debugf("watching backend %s events to invalidate object owners\n", tc.target.addr)
+
+	dec := json.NewDecoder(res.Body)
+	for {
+		var event struct {
+			Type   string
+			Action string
+			Actor  struct{ ID string }
+		}
+		if err := dec.Decode(&event); err != nil {
+			return err
+		}
+		if event.Actor.ID != "" {
+			tc.invalidate(event.Type, event.Action, event.Actor.ID)
+		}
+	}
+}
+
+// Returns the cached entry of an object or inspects it on the backend, reports false if it does not exist
+func (tc *ownerTargetCache) lookup(ctx context.Context, kind string, ref string) (ownerEntry, bool, error) {
+	key := kind + ":" + ref
+
+	tc.mu.Lock()
+	entry, ok := tc.entries[key]
+	generation := tc.generation
+	tc.mu.Unlock()
+	if ok {
+		return entry, true, nil
+	}
+
+	entry, found, err := tc.inspect(ctx, kind, ref)
+	if err != nil || !found {
+		return entry, found, err
+	}
+
+	// The entry is not cached if an event was received during the inspection, as it may refer to this object
+	tc.mu.Lock()
+	if tc.watching && tc.generation == generation {
+		if len(tc.entries) >= maxOwnerCacheEntries {
+			clear(tc.entries)
+		}
+		tc.entries[key] = entry
+	}
+	tc.mu.Unlock()
+
+	return entry, true, nil
+}
+
+func (tc *ownerTargetCache) inspect(ctx context.Context, kind string, ref string) (ownerEntry, bool, error) {
+	var p string
+	switch kind {
+	case ownedContainer:
+		p = "/containers/" + url.PathEscape(ref) + "/json"
+	case ownedVolume:
+		p = "/volumes/" + url.PathEscape(ref)
+	case ownedNetwork:
+		p = "/networks/" + url.PathEscape(ref)
+	case ownedExec:
+		p = "/exec/" + url.PathEscape(ref) + "/json"
+	default:
+		return ownerEntry{}, false, fmt.Errorf("unknown object kind: %s", kind)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p, nil)
+	if err != nil {
+		return ownerEntry{}, false, err
+	}
+	tc.target.direct(req)
+
+	res, err := tc.target.httpClient.Do(req)
+	if err != nil {
+		return ownerEntry{}, false, err
+	}
+	defer func() {
+		_ = res.Body.Close()
+	}()
+
+	if res.StatusCode == http.StatusNotFound {
+		_, _ = io.Copy(io.Discard, res.Body)
+		return ownerEntry{}, false, nil
+	}
+	if res.StatusCode != http.StatusOK {
+		_, _ = io.Copy(io.Discard, res.Body)
+		return ownerEntry{}, false, fmt.Errorf("unexpected status code inspecting %s %s: %d", kind, ref, res.StatusCode)
+	}
+
+	var obj struct {
+		Id          string
+		Name        string
+		ContainerID string
+		Labels      map[string]string
+		Config      struct{ Labels map[string]string }
+	}
+	if err := json.NewDecoder(io.LimitReader(res.Body, maxPolicyBodySize)).Decode(&obj); err != nil {
+		return ownerEntry{}, false, fmt.Errorf("error decoding %s %s: %w", kind, ref, err)
+	}
+
+	switch kind {
+	case ownedContainer:
+		return ownerEntry{id: obj.Id, labels: obj.Config.Labels}, true, nil
+	case ownedVolume:
+		return ownerEntry{id: obj.Name, labels: obj.Labels}, true, nil
+	case ownedNetwork:
+		return ownerEntry{id: obj.Id, labels: obj.Labels}, true, nil
+	default:
+		return ownerEntry{id: ref, container: obj.ContainerID}, true, nil
+	}
+}
+
+// Returns the owner rule that applies to the request, or nil if the client is not restricted
+func (cg *Server) ownerRule(req *http.Request) *OwnerRule {
+	for i, rule := range cg.OwnerRules {
+		if rule.Options.matches(req) {
+			return &cg.OwnerRules[i]
+		}
+	}
+	return nil
+}
+
+// Checks the objects of a request restricted to the objects with a label
+type ownerCheck struct {
+	rule   *OwnerRule
+	cache  *ownerCache
+	ctx    context.Context
+	client string
+}
+
+func (cg *Server) newOwnerCheck(req *http.Request, rule *OwnerRule) *ownerCheck {
+	backendName, _ := cg.routeRequest(req)
+	return &ownerCheck{
+		rule:   rule,
+		cache:  cg.owners[backendName],
+		ctx:    req.Context(),
+		client: clientKey(req),
+	}
+}
+
+// Denies the use of an object without the label, objects that do not exist are left for the daemon to report
+func (check *ownerCheck) object(kind string, ref string) error {
+	if ref == "" {
+		return nil
+	}
+	entry, found, err := check.cache.lookup(check.ctx, check.client, kind, ref)
+	if err != nil {
+		return fmt.Errorf("%w: %s %s: %w", errOwnerLookup, kind, ref, err)
+	}
+	if !found {
+		return nil
+	}
+	if kind == ownedExec {
+		err := check.object(ownedContainer, entry.container)
+		var pErr *policyError
+		if entry.container == "" || errors.As(err, &pErr) {
+			return policyErrorf("exec of a container not owned by the client: %s", ref)
+		}
+		return err
+	}
+	if val, ok := entry.labels[check.rule.Label]; !ok || val != check.rule.Value {
+		return policyErrorf("%s not owned by the client: %s", kind, ref)
+	}
+	return nil
+}
+
+// Checks the object in the path of a request and restricts the objects that are listed, pruned or whose
+// events are streamed, the endpoints that cannot be restricted are denied
+func (check *ownerCheck) request(req *http.Request) error {
+	p := cleanPath(req.URL.Path)
+
+	if ownerDeniedPattern.MatchString(p) {
+		return policyErrorf("endpoint not allowed to clients restricted by an owner rule: %s", p)
+	}
+
+	if ownerFilterPattern.MatchString(p) {
+		query := req.URL.Query()
+		if err := addLabelFilter(query, check.rule.Label+"="+check.rule.Value); err != nil {
+			return err
+		}
+		req.URL.RawQuery = query.Encode()
+		return nil
+	}
+
+	if req.Method == http.MethodPost && commitPattern.MatchString(p) {
+		return check.object(ownedContainer, req.URL.Query().Get("container"))
+	}
+
+	for _, op := range ownedObjectPaths {
+		if m := op.pattern.FindStringSubmatch(p); m != nil {
+			if m[2] == "" && slices.Contains(op.reserved, m[1]) {
+				return nil
+			}
+			return check.object(op.kind, m[1])
+		}
+	}
+
+	return nil
+}
+
+// Adds a label filter to the JSON filters of a query, which may have the legacy format of an object
+func addLabelFilter(query url.Values, label string) error {
+	filters := make(map[string]any)
+	if val := query.Get("filters"); val != "" {
+		if err := json.Unmarshal([]byte(val), &filters); err != nil {
+			return policyErrorf("invalid filters: %v", err)
+		}
+	}
+	switch labels := filters["label"].(type) {
+	case map[string]any:
+		labels[label] = true
+	case []any:
+		filters["label"] = append(labels, label)
+	default:
+		filters["label"] = []string{label}
+	}
+	data, err := json.Marshal(filters)
+	if err != nil {
+		return err
+	}
+	query.Set("filters", string(data))
+	return nil
+}
+
+// Returns the policies that add the label to the objects created by the client
+// and check the objects referenced in the body of the requests
+func (check *ownerCheck) policies() []requestPolicy {
+	return []requestPolicy{
+		{pattern: containerCreatePattern, libpodPattern: libpodContainerCreatePattern, apply: check.container},
+		{pattern: volumeCreatePattern, libpodPattern: libpodVolumeCreatePattern, apply: func(body map[string]any, _ bool) ([]string, error) {
+			return check.label(body, "Labels")
+		}},
+		{pattern: networkCreatePattern, libpodPattern: libpodNetworkCreatePattern, apply: func(body map[string]any, libpod bool) ([]string, error) {
+			if libpod {
+				return check.label(body, "labels")
+			}
+			return check.label(body, "Labels")
+		}},
+		{pattern: networkConnectPattern, libpodPattern: libpodNetworkConnectPattern, apply: func(body map[string]any, libpod bool) ([]string, error) {
+			key := "Container"
+			if libpod {
+				key = "container"
+			}
+			ref, _ := field(body, key).(string)
+			return nil, check.object(ownedContainer, ref)
+		}},
+	}
+}
+
+// Sets the label in a labels field, a different value set by the client is denied
+func (check *ownerCheck) label(body map[string]any, key string) ([]string, error) {
+	labels := objectField(body, key)
+	if val, ok := labels[check.rule.Label]; ok {
+		if val != check.rule.Value {
+			return nil, policyErrorf("label %s not allowed: %v", check.rule.Label, val)
+		}
+		return nil, nil
+	}
+	labels[check.rule.Label] = check.rule.Value
+	return []string{fmt.Sprintf("set label %s=%s", check.rule.Label, check.rule.Value)}, nil
+}
+
+// Checks the containers, volumes and networks a container create request refers to,
+// in the Docker or the libpod format, and sets the label of the container
+func (check *ownerCheck) container(body map[string]any, libpod bool) ([]string, error) {
+	var refs [][2]string
+	if libpod {
+		refs = libpodContainerRefs(body)
+	} else {
+		refs = containerRefs(body)
+	}
+	for _, ref := range refs {
+		if err := check.object(ref[0], ref[1]); err != nil {
+			return nil, err
+		}
+	}
+
+	if libpod {
+		return check.label(body, "labels")
+	}
+	return check.label(body, "Labels")
+}
+
+func containerRefs(body map[string]any) [][2]string {
+	var refs [][2]string
+
+	hc, _ := field(body, "HostConfig").(map[string]any)
+	if hc != nil {
+		// Binds with a source that is not an absolute path refer to named volumes
+		for _, bind := range stringsField(hc, "Binds") {
+			if src, _, _ := strings.Cut(bind, ":"); src != "" && !strings.HasPrefix(src, "/") {
+				refs = append(refs, [2]string{ownedVolume, src})
+			}
+		}
+		mounts, _ := field(hc, "Mounts").([]any)
+		for _, m := range mounts {
+			if mount, ok := m.(map[string]any); ok && field(mount, "Type") == "volume" {
+				if src, _ := field(mount, "Source").(string); src != "" {
+					refs = append(refs, [2]string{ownedVolume, src})
+				}
+			}
+		}
+		for _, from := range stringsField(hc, "VolumesFrom") {
+			name, _, _ := strings.Cut(from, ":")
+			refs = append(refs, [2]string{ownedContainer, name})
+		}
+		for _, key := range []string{"NetworkMode", "PidMode", "IpcMode"} {
+			mode, _ := field(hc, key).(string)
+			if name, ok := strings.CutPrefix(mode, "container:"); ok {
+				refs = append(refs, [2]string{ownedContainer, name})
+			} else if key == "NetworkMode" && mode != "" && !slices.Contains(builtinNetworks, mode) {
+				refs = append(refs, [2]string{ownedNetwork, mode})
+			}
+		}
+	}
+
+	if nc, ok := field(body, "NetworkingConfig").(map[string]any); ok {
+		endpoints, _ := field(nc, "EndpointsConfig").(map[string]any)
+		for _, name := range slices.Sorted(maps.Keys(endpoints)) {
+			if !slices.Contains(builtinNetworks, name) {
+				refs = append(refs, [2]string{ownedNetwork, name})
+			}
+		}
+	}
+
+	return refs
+}
+
+func libpodContainerRefs(body map[string]any) [][2]string {
+	var refs [][2]string
+
+	volumes, _ := field(body, "volumes").([]any)
+	for _, v := range volumes {
+		if volume, ok := v.(map[string]any); ok {
+			if name, _ := field(volume, "Name").(string); name != "" {
+				refs = append(refs, [2]string{ownedVolume, name})
+			}
+		}
+	}
+	for _, from := range stringsField(body, "volumes_from") {
+		name, _, _ := strings.Cut(from, ":")
+		refs = append(refs, [2]string{ownedContainer, name})
+	}
+	for _, key := range []string{"netns", "pidns", "ipcns"} {
+		if ns, ok := field(body, key).(map[string]any); ok && field(ns, "nsmode") == "container" {
+			if name, _ := field(ns, "value").(string); name != "" {
+				refs = append(refs, [2]string{ownedContainer, name})
+			}
+		}
+	}
+	networks, _ := field(body, "networks").(map[string]any)
+	for _, name := range slices.Sorted(maps.Keys(networks)) {
+		if !slices.Contains(builtinNetworks, name) {
+			refs = append(refs, [2]string{ownedNetwork, name})
+		}
+	}
+
+	return refs
+}
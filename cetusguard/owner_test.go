@@ -0,0 +1,271 @@
+package cetusguard
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestBuildOwnerRules(t *testing.T) {
+	rules, err := BuildOwnerRules("! CI runners\n" +
+		"label=com.docker.compose.project=ci-123;client-cn=ci-123\n" +
+		" \t label=owner=;listener=tcp://0.0.0.0:2376;client-addr=10.0.0.0/8 \t ")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wanted := []string{
+		"label=com.docker.compose.project=ci-123;client-cn=ci-123",
+		"label=owner=;listener=tcp://0.0.0.0:2376;client-addr=10.0.0.0/8",
+	}
+	if len(rules) != len(wanted) {
+		t.Fatalf("rules = %v, want %v", rules, wanted)
+	}
+	for i, rule := range rules {
+		if rule.String() != wanted[i] {
+			t.Errorf("rule = %s, want %s", rule, wanted[i])
+		}
+	}
+}
+
+func TestBuildInvalidOwnerRules(t *testing.T) {
+	lines := []string{
+		"project=ci-123",
+		"label=project",
+		"label==ci-123",
+		"client-cn=ci-123",
+		"label=project=ci-123;foo=bar",
+		"label=project=ci-123;client-addr=foo",
+		"label=project=ci 123",
+	}
+
+	for _, line := range lines {
+		rules, err := BuildOwnerRules(line)
+		if err == nil || rules != nil {
+			t.Errorf("%q: rules = %v, want an error", line, rules)
+		}
+	}
+}
+
+func TestAddLabelFilter(t *testing.T) {
+	testCases := map[string]string{
+		``:                                `{"label":["project=ci-123"]}`,
+		`{"status":["running"]}`:          `{"label":["project=ci-123"],"status":["running"]}`,
+		`{"label":["tier=web"]}`:          `{"label":["tier=web","project=ci-123"]}`,
+		`{"label":{"tier=web":true}}`:     `{"label":{"project=ci-123":true,"tier=web":true}}`,
+		`{"label":["project=ci-124"]}`:    `{"label":["project=ci-124","project=ci-123"]}`,
+		`{"dangling":["true"],"label":1}`: `{"dangling":["true"],"label":["project=ci-123"]}`,
+	}
+
+	for filters, wanted := range testCases {
+		query := url.Values{}
+		if filters != "" {
+			query.Set("filters", filters)
+		}
+		if err := addLabelFilter(query, "project=ci-123"); err != nil {
+			t.Errorf("%s: %v", filters, err)
+			continue
+		}
+		if query.Get("filters") != wanted {
+			t.Errorf("%s: filters = %s, want %s", filters, query.Get("filters"), wanted)
+		}
+	}
+
+	if err := addLabelFilter(url.Values{"filters": {"{"}}, "project=ci-123"); err == nil {
+		t.Errorf("invalid filters, want an error")
+	}
+}
+
+func TestOwnerCheckRequest(t *testing.T) {
+	check := &ownerCheck{rule: &OwnerRule{Label: "project", Value: "ci-123"}}
+
+	testCases := []struct {
+		method  string
+		path    string
+		allowed bool
+		filters string
+	}{
+		{http.MethodGet, "/v1.41/containers/json", true, `{"label":["project=ci-123"]}`},
+		{http.MethodGet, "/v1.41/events?since=1", true, `{"label":["project=ci-123"]}`},
+		{http.MethodGet, "/v4.0.0/libpod/events", true, `{"label":["project=ci-123"]}`},
+		{http.MethodGet, "/v1.41/system/df", false, ""},
+		{http.MethodGet, "/v4.0.0/libpod/system/df", false, ""},
+		{http.MethodGet, "/v4.0.0/libpod/containers/stats", false, ""},
+		{http.MethodGet, "/v4.0.0/libpod/pods/json", false, ""},
+		{http.MethodPost, "/v4.0.0/libpod/pods/other/kill", false, ""},
+		{http.MethodDelete, "/v4.0.0/libpod/pods/other", false, ""},
+		{http.MethodPost, "/v4.0.0/libpod/play/kube", false, ""},
+		{http.MethodGet, "/v4.0.0/libpod/generate/other/systemd", false, ""},
+		{http.MethodGet, "/v1.41/images/json", true, ""},
+	}
+
+	for _, c := range testCases {
+		req := httptest.NewRequest(c.method, c.path, nil)
+		err := check.request(req)
+		var pErr *policyError
+		if allowed := err == nil; allowed != c.allowed || (err != nil && !errors.As(err, &pErr)) {
+			t.Errorf("%s %s: err = %v, want allowed %t", c.method, c.path, err, c.allowed)
+			continue
+		}
+		if filters := req.URL.Query().Get("filters"); err == nil && filters != c.filters {
+			t.Errorf("%s %s: filters = %s, want %s", c.method, c.path, filters, c.filters)
+		}
+	}
+}
+
+func TestOwnerCheckLabel(t *testing.T) {
+	check := &ownerCheck{rule: &OwnerRule{Label: "project", Value: "ci-123"}}
+
+	// A labels field whose name differs in case is used by the daemon, so it is the one that is checked
+	if _, err := check.label(decodeTestBody(t, `{"labels":{"project":"ci-124"}}`), "Labels"); err == nil {
+		t.Errorf("label of another client allowed, want an error")
+	}
+
+	body := decodeTestBody(t, `{"labels":{"tier":"web"}}`)
+	if _, err := check.label(body, "Labels"); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(body) != "map[Labels:map[project:ci-123 tier:web]]" {
+		t.Errorf("body = %v, want the label in Labels", body)
+	}
+}
+
+func TestOwnerCacheTargets(t *testing.T) {
+	newDaemon := func(owner string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(wri http.ResponseWriter, req *http.Request) {
+			_, _ = wri.Write([]byte(`{"Id":"aaaa","Config":{"Labels":{"project":"` + owner + `"}}}`))
+		}))
+	}
+	primary, failover := newDaemon("ci-123"), newDaemon("ci-124")
+	defer primary.Close()
+	defer failover.Close()
+
+	toAddr := func(url string) string { return strings.Replace(url, "http://", "tcp://", 1) }
+	bp, err := newBackendPool(&Backend{Addr: toAddr(primary.URL), FailoverAddr: []string{toAddr(failover.URL)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bp.close()
+
+	oc := newOwnerCache(bp)
+	for _, tc := range oc.targets {
+		tc.setWatching(true)
+	}
+
+	entry, _, err := oc.lookup(context.Background(), "client", ownedContainer, "mine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.labels["project"] != "ci-123" {
+		t.Errorf("labels = %v, want the ones of the primary backend", entry.labels)
+	}
+
+	// The entry cached for the primary backend is not used for the failover backend
+	bp.targets[0].healthy.Store(false)
+	entry, _, err = oc.lookup(context.Background(), "client", ownedContainer, "mine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.labels["project"] != "ci-124" {
+		t.Errorf("labels = %v, want the ones of the failover backend", entry.labels)
+	}
+}
+
+func TestOwnerTargetCacheInvalidate(t *testing.T) {
+	newCache := func() *ownerTargetCache {
+		return &ownerTargetCache{entries: map[string]ownerEntry{
+			"container:aaaa1111": {id: "aaaa1111"},
+			"container:aa":       {id: "aaaa1111"},
+			"container:mine":     {id: "aaaa1111"},
+			"network:eeee5555":   {id: "eeee5555"},
+			"network:net":        {id: "bbbb2222"},
+			"exec:cccc3333":      {id: "cccc3333", container: "aaaa1111"},
+		}}
+	}
+	keys := func(tc *ownerTargetCache) string {
+		var keys []string
+		for k := range tc.entries {
+			keys = append(keys, k)
+		}
+		slices.Sort(keys)
+		return strings.Join(keys, " ")
+	}
+
+	testCases := []struct {
+		kind   string
+		action string
+		id     string
+		wanted string
+	}{
+		// A created container may have a name that shadows a cached ID prefix or name
+		{"container", "create", "dddd4444", "container:aaaa1111 exec:cccc3333 network:eeee5555 network:net"},
+		{"network", "create", "dddd4444", "container:aa container:aaaa1111 container:mine exec:cccc3333 network:eeee5555"},
+		{"container", "destroy", "dddd4444", "container:aa container:aaaa1111 container:mine exec:cccc3333 network:eeee5555 network:net"},
+		{"container", "destroy", "aaaa1111", "network:eeee5555 network:net"},
+		{"network", "rename", "bbbb2222", "container:aa container:aaaa1111 container:mine exec:cccc3333 network:eeee5555"},
+	}
+
+	for _, c := range testCases {
+		tc := newCache()
+		tc.invalidate(c.kind, c.action, c.id)
+		if got := keys(tc); got != c.wanted {
+			t.Errorf("%s %s %s: entries = %s, want %s", c.kind, c.action, c.id, got, c.wanted)
+		}
+	}
+}
+
+func TestContainerRefs(t *testing.T) {
+	testCases := []struct {
+		libpod bool
+		body   string
+		wanted string
+	}{
+		{
+			libpod: false,
+			body:   `{"Image":"alpine","HostConfig":{"NetworkMode":"bridge"}}`,
+			wanted: `[]`,
+		},
+		{
+			libpod: false,
+			body: `{"HostConfig":{"Binds":["/builds:/src","data:/data:ro"],"Mounts":[{"Type":"volume","Source":"cache"},{"Type":"bind","Source":"/tmp"}],` +
+				`"VolumesFrom":["app:ro"],"NetworkMode":"container:db","PidMode":"container:app","IpcMode":"shareable"},` +
+				`"NetworkingConfig":{"EndpointsConfig":{"front":{},"back":{},"host":{}}}}`,
+			wanted: `[[volume data] [volume cache] [container app] [container db] [container app] [network back] [network front]]`,
+		},
+		{
+			libpod: false,
+			body:   `{"HostConfig":{"NetworkMode":"ci-net"}}`,
+			wanted: `[[network ci-net]]`,
+		},
+		{
+			libpod: false,
+			body:   `{"hostconfig":{"volumesfrom":["victim"],"networkmode":"container:victim"},"networkingconfig":{"endpointsconfig":{"back":{}}}}`,
+			wanted: `[[container victim] [container victim] [network back]]`,
+		},
+		{
+			libpod: true,
+			body: `{"volumes":[{"Name":"data","Dest":"/data"}],"volumes_from":["app:ro"],"netns":{"nsmode":"container","value":"db"},` +
+				`"pidns":{"nsmode":"host"},"networks":{"podman":{},"front":{}}}`,
+			wanted: `[[volume data] [container app] [container db] [network front]]`,
+		},
+	}
+
+	for _, c := range testCases {
+		body := decodeTestBody(t, c.body)
+		var refs [][2]string
+		if c.libpod {
+			refs = libpodContainerRefs(body)
+		} else {
+			refs = containerRefs(body)
+		}
+		if fmt.Sprint(refs) != c.wanted {
+			t.Errorf("%s: refs = %v, want %s", c.body, refs, c.wanted)
+		}
+	}
+}
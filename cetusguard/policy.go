@@ -0,0 +1,370 @@
+package cetusguard
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/hectorm/cetusguard/internal/logger"
+)
+
+const (
+	// Maximum size of the request bodies that are inspected
+	maxPolicyBodySize = 16 * 1024 * 1024
+)
+
+var (
+	containerCreatePattern       = mustBuildPattern(`%API_PREFIX_CONTAINERS%/create`)
+	libpodContainerCreatePattern = mustBuildPattern(`%API_PREFIX_LIBPOD_CONTAINERS%/create`)
+	volumeCreatePattern          = mustBuildPattern(`%API_PREFIX_VOLUMES%/create`)
+	libpodVolumeCreatePattern    = mustBuildPattern(`%API_PREFIX_LIBPOD_VOLUMES%/create`)
+)
+
+// Fields of the request bodies whose value is an object with arbitrary names, such as labels or driver options,
+// where names that only differ in case are different entries
+var jsonMapFields = []string{
+	"Annotations", "Config", "DriverOpts", "EndpointsConfig", "Env", "Expose", "ExposedPorts", "Labels",
+	"Network_Options", "Networks", "Options", "PortBindings", "Secret_Env", "StorageOpt", "Storage_Opts",
+	"Sysctl", "Sysctls", "Tmpfs", "Unified", "Volumes",
+}
+
+// Returned when a request body is rejected by a policy
+type policyError struct {
+	reason string
+}
+
+func (err *policyError) Error() string {
+	return err.reason
+}
+
+func policyErrorf(format string, a ...any) error {
+	return &policyError{fmt.Sprintf(format, a...)}
+}
+
+// Reads the JSON object in the body of a request, numbers are kept as they are. Objects with names that only
+// differ in case are rejected, because the daemon matches names case-insensitively and uses the last one
+func readJsonBody(req *http.Request) (map[string]any, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return make(map[string]any), nil
+	}
+
+	data, err := io.ReadAll(io.LimitReader(req.Body, maxPolicyBodySize+1))
+	_ = req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxPolicyBodySize {
+		return nil, policyErrorf("request body larger than %d bytes", maxPolicyBodySize)
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return make(map[string]any), nil
+	}
+
+	var body map[string]any
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&body); err != nil {
+		return nil, policyErrorf("invalid request body: %v", err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, policyErrorf("invalid request body: unexpected data after JSON object")
+	}
+	if err := checkJsonNames(data); err != nil {
+		return nil, err
+	}
+	if body == nil {
+		body = make(map[string]any)
+	}
+	return body, nil
+}
+
+// Rejects the objects at any level with duplicate names. Names that only differ in case are also duplicates,
+// except in the objects with arbitrary names of the fields listed in jsonMapFields
+func checkJsonNames(data []byte) error {
+	type object struct {
+		names    map[string]struct{}
+		name     string
+		wantName bool
+		isMap    bool
+	}
+	// Objects and arrays being decoded, arrays are nil
+	var stack []*object
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return policyErrorf("invalid request body: %v", err)
+		}
+
+		var top *object
+		if len(stack) > 0 {
+			top = stack[len(stack)-1]
+		}
+		if name, ok := tok.(string); ok && top != nil && top.wantName {
+			key := name
+			if !top.isMap {
+				key = foldName(name)
+			}
+			if _, ok := top.names[key]; ok {
+				return policyErrorf("invalid request body: duplicate name %q", name)
+			}
+			top.names[key] = struct{}{}
+			top.name = name
+			top.wantName = false
+			continue
+		}
+
+		switch tok {
+		case json.Delim('{'):
+			// Only the object of a listed field has arbitrary names, not the objects in its entries
+			isMap := top != nil && !top.isMap && slices.ContainsFunc(jsonMapFields, func(f string) bool {
+				return strings.EqualFold(f, top.name)
+			})
+			stack = append(stack, &object{names: make(map[string]struct{}), wantName: true, isMap: isMap})
+			continue
+		case json.Delim('['):
+			stack = append(stack, nil)
+			continue
+		case json.Delim('}'), json.Delim(']'):
+			stack = stack[:len(stack)-1]
+		}
+		// A value was decoded, so the object it belongs to expects a name next
+		if len(stack) > 0 && stack[len(stack)-1] != nil {
+			stack[len(stack)-1].wantName = true
+		}
+	}
+}
+
+// Folds the case of a name as strings.EqualFold does, so that names are equal if they match case-insensitively
+func foldName(name string) string {
+	return strings.Map(func(r rune) rune {
+		folded := r
+		for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+			folded = min(folded, f)
+		}
+		return folded
+	}, name)
+}
+
+func writeJsonBody(req *http.Request, body map[string]any) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	setBody(req, data)
+	return nil
+}
+
+func setBody(req *http.Request, data []byte) {
+	req.Body = io.NopCloser(bytes.NewReader(data))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}
+	req.ContentLength = int64(len(data))
+	req.TransferEncoding = nil
+	req.Header.Set("Content-Length", strconv.Itoa(len(data)))
+}
+
+// Returns the value of a field, or nil if it does not exist. A field whose name only differs in case is renamed,
+// since the daemon would use it as well, so that it can be checked and replaced by the policies
+func field(obj map[string]any, key string) any {
+	if v, ok := obj[key]; ok {
+		return v
+	}
+	for k, v := range obj {
+		if strings.EqualFold(k, key) {
+			delete(obj, k)
+			obj[key] = v
+			return v
+		}
+	}
+	return nil
+}
+
+// Sets the value of a field, replacing any field whose name only differs in case
+func setField(obj map[string]any, key string, v any) {
+	for k := range obj {
+		if k != key && strings.EqualFold(k, key) {
+			delete(obj, k)
+		}
+	}
+	obj[key] = v
+}
+
+// Returns the object in a field, which is created if it does not exist or is null
+func objectField(obj map[string]any, key string) map[string]any {
+	if v, ok := field(obj, key).(map[string]any); ok {
+		return v
+	}
+	v := make(map[string]any)
+	setField(obj, key, v)
+	return v
+}
+
+// Returns the strings in a field, ignoring the elements that are not strings
+func stringsField(obj map[string]any, key string) []string {
+	arr, _ := field(obj, key).([]any)
+	vals := make([]string, 0, len(arr))
+	for _, v := range arr {
+		if s, ok := v.(string); ok {
+			vals = append(vals, s)
+		}
+	}
+	return vals
+}
+
+// Returns the value of a numeric field, or 0 if it does not exist or is not a number
+func intField(obj map[string]any, key string) int64 {
+	n, ok := field(obj, key).(json.Number)
+	if !ok {
+		return 0
+	}
+	i, err := n.Int64()
+	if err != nil {
+		return 0
+	}
+	return i
+}
+
+func boolField(obj map[string]any, key string) bool {
+	b, _ := field(obj, key).(bool)
+	return b
+}
+
+// Inspects the requests to the endpoints it applies to, by their query or their JSON body, which may be rewritten.
+// Returns a description of each change or a policy error if the request must be denied
+type requestPolicy struct {
+	pattern       *regexp.Regexp
+	libpodPattern *regexp.Regexp
+	checkQuery    func(query url.Values, libpod bool) error
+	apply         func(body map[string]any, libpod bool) ([]string, error)
+}
+
+func (policy requestPolicy) matches(p string) (matched bool, libpod bool) {
+	if policy.libpodPattern != nil && policy.libpodPattern.MatchString(p) {
+		return true, true
+	}
+	if policy.pattern != nil && policy.pattern.MatchString(p) {
+		return true, false
+	}
+	return false, false
+}
+
+// Returns the policies that are enabled, those that only check the request go before those that rewrite it
+func (cg *Server) requestPolicies() []requestPolicy {
+	var policies []requestPolicy
+	if cg.ImagePolicy != nil {
+		policies = append(policies, cg.ImagePolicy.policies()...)
+	}
+	if cg.ExecPolicy != nil {
+		policies = append(policies,
+			requestPolicy{pattern: execCreatePattern, apply: cg.ExecPolicy.checkExec},
+		)
+	}
+	if cg.MountPolicy != nil {
+		policies = append(policies,
+			requestPolicy{pattern: containerCreatePattern, libpodPattern: libpodContainerCreatePattern, apply: cg.MountPolicy.checkContainer},
+			requestPolicy{pattern: volumeCreatePattern, libpodPattern: libpodVolumeCreatePattern, apply: cg.MountPolicy.checkVolume},
+		)
+	}
+	if cg.PortPolicy != nil {
+		policies = append(policies,
+			requestPolicy{pattern: containerCreatePattern, libpodPattern: libpodContainerCreatePattern, apply: cg.PortPolicy.checkContainer},
+		)
+	}
+	if cg.Hardening.enabled() {
+		policies = append(policies,
+			requestPolicy{pattern: containerCreatePattern, libpodPattern: libpodContainerCreatePattern, apply: func(body map[string]any, libpod bool) ([]string, error) {
+				return cg.Hardening.apply(body, libpod), nil
+			}},
+		)
+	}
+	return policies
+}
+
+// Applies the policies to the requests they inspect before they are forwarded, along with the owner rule
+// of the client, writes an error response and returns false if a request is rejected
+func (cg *Server) applyPolicies(wri http.ResponseWriter, req *http.Request) bool {
+	policies := cg.policies
+	if rule := cg.ownerRule(req); rule != nil {
+		check := cg.newOwnerCheck(req, rule)
+		if err := check.request(req); err != nil {
+			writePolicyError(wri, req, err)
+			return false
+		}
+		policies = append(slices.Clip(policies), check.policies()...)
+	}
+
+	if req.Method != http.MethodPost || len(policies) == 0 {
+		return true
+	}
+
+	p := cleanPath(req.URL.Path)
+	var body map[string]any
+	var changes []string
+	var err error
+	for _, policy := range policies {
+		matched, libpod := policy.matches(p)
+		if !matched {
+			continue
+		}
+		if policy.checkQuery != nil {
+			if err = policy.checkQuery(req.URL.Query(), libpod); err != nil {
+				break
+			}
+		}
+		if policy.apply == nil {
+			continue
+		}
+		if body == nil {
+			if body, err = readJsonBody(req); err != nil {
+				break
+			}
+		}
+		var policyChanges []string
+		if policyChanges, err = policy.apply(body, libpod); err != nil {
+			break
+		}
+		changes = append(changes, policyChanges...)
+	}
+	// The body is always encoded again, so that the daemon receives the same fields that were checked
+	if err == nil && body != nil {
+		err = writeJsonBody(req, body)
+		if len(changes) > 0 {
+			logger.Infof("rewrote request %s: %s\n", requestId(req), strings.Join(changes, ", "))
+		}
+	}
+
+	if err != nil {
+		writePolicyError(wri, req, err)
+		return false
+	}
+	return true
+}
+
+func writePolicyError(wri http.ResponseWriter, req *http.Request, err error) {
+	var pErr *policyError
+	if errors.As(err, &pErr) {
+		logger.Warningf("denied request %s: %s %s: %v\n", requestId(req), req.Method, req.URL.Path, err)
+		http.Error(wri, err.Error(), http.StatusForbidden)
+	} else if errors.Is(err, errOwnerLookup) {
+		logger.Errorf("error inspecting request %s: %v\n", requestId(req), err)
+		wri.WriteHeader(http.StatusBadGateway)
+	} else {
+		logger.Errorf("error inspecting request %s: %v\n", requestId(req), err)
+		wri.WriteHeader(http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,129 @@
+package cetusguard
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func decodeTestBody(t *testing.T, str string) map[string]any {
+	t.Helper()
+	var body map[string]any
+	dec := json.NewDecoder(strings.NewReader(str))
+	dec.UseNumber()
+	if err := dec.Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+func TestReadJsonBody(t *testing.T) {
+	raw := `{"Image":"alpine","HostConfig":{"Memory":9007199254740993}}`
+	req, err := http.NewRequest("POST", "http://localhost/containers/create", strings.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := readJsonBody(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body["Image"] = "busybox"
+	if err := writeJsonBody(req, body); err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(req.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Numbers are not converted to floating point
+	wanted := `{"HostConfig":{"Memory":9007199254740993},"Image":"busybox"}`
+	if string(data) != wanted {
+		t.Errorf("req.Body = %s, want %s", data, wanted)
+	}
+	if req.ContentLength != int64(len(wanted)) || req.Header.Get("Content-Length") != strconv.Itoa(len(wanted)) {
+		t.Errorf("req.ContentLength = %d, Content-Length = %s, want %d", req.ContentLength, req.Header.Get("Content-Length"), len(wanted))
+	}
+}
+
+func TestReadInvalidJsonBody(t *testing.T) {
+	bodies := []string{
+		`{"Image":`,
+		`["alpine"]`,
+		`{"Image":"alpine"}{}`,
+		`{"Image":"` + strings.Repeat("a", maxPolicyBodySize) + `"}`,
+		// Names that the daemon would match case-insensitively, where the last one wins
+		`{"HostConfig":{"Binds":["/:/host"]},"HostConfig":{}}`,
+		`{"Image":"alpine","image":"busybox"}`,
+		`{"HostConfig":{"Binds":[],"binds":["/:/host"]}}`,
+		`{"HostConfig":{"Mounts":[{"Type":"bind","type":"volume"}]}}`,
+		"{\"Kind\":\"a\",\"\u212aind\":\"b\"}",
+		// Objects with arbitrary names can still not repeat a name, nor can the objects in their entries
+		`{"Labels":{"foo":"a","foo":"b"}}`,
+		`{"NetworkingConfig":{"EndpointsConfig":{"net":{"Aliases":["a"],"aliases":["b"]}}}}`,
+	}
+
+	for _, raw := range bodies {
+		req, err := http.NewRequest("POST", "http://localhost/containers/create", strings.NewReader(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = readJsonBody(req)
+		var pErr *policyError
+		if !errors.As(err, &pErr) {
+			t.Errorf("%.32s: err = %v, want a policy error", raw, err)
+		}
+	}
+}
+
+func TestReadJsonBodyNames(t *testing.T) {
+	bodies := []string{
+		// The same name can be used in different objects
+		`{"Mounts":[{"Type":"bind"},{"Type":"volume"}],"Labels":{"Type":"a"},"Type":"b"}`,
+		// Names that only differ in case are different entries of the objects with arbitrary names
+		`{"Labels":{"Foo":"a","foo":"b"},"HostConfig":{"Tmpfs":{"/Run":"","/run":""},"Sysctls":{"a.B":"1","a.b":"2"}}}`,
+		`{"ExposedPorts":{"80/tcp":{},"80/TCP":{}},"Volumes":{"/Data":{},"/data":{}}}`,
+		`{"NetworkingConfig":{"EndpointsConfig":{"Net":{"DriverOpts":{"Opt":"a","opt":"b"}},"net":{}}}}`,
+		`{"Name":"data","DriverOpts":{"Type":"a","type":"b"}}`,
+		`{"labels":{"Foo":"a","foo":"b"},"env":{"PATH":"/bin","path":"/usr/bin"}}`,
+	}
+
+	for _, raw := range bodies {
+		req, err := http.NewRequest("POST", "http://localhost/containers/create", strings.NewReader(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readJsonBody(req); err != nil {
+			t.Errorf("%s: %v", raw, err)
+		}
+	}
+}
+
+func TestField(t *testing.T) {
+	body := decodeTestBody(t, `{"hostconfig":{"binds":["/:/host"]},"Image":"alpine"}`)
+
+	// Fields whose names only differ in case are renamed when they are read or replaced
+	hc := objectField(body, "HostConfig")
+	if binds := stringsField(hc, "Binds"); !slices.Equal(binds, []string{"/:/host"}) {
+		t.Errorf("Binds = %v, want [/:/host]", binds)
+	}
+	setField(body, "image", "busybox")
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wanted := `{"HostConfig":{"Binds":["/:/host"]},"image":"busybox"}`
+	if string(data) != wanted {
+		t.Errorf("body = %s, want %s", data, wanted)
+	}
+	if field(body, "Memory") != nil {
+		t.Errorf("missing field is not nil")
+	}
+}
@@ -0,0 +1,192 @@
+package cetusguard
+
+import (
+	"fmt"
+	"maps"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Restricts the host IPs and ports that containers can publish ports on and the use of the host network,
+// by inspecting the body of the container create requests
+type PortPolicy struct {
+	// Host IPs or networks in CIDR notation ports may be published on, any if empty
+	HostIps []string
+	// Host ports or ranges in START-END format that may be published, any if empty
+	HostPorts []string
+	// Allow publishing all exposed ports on random host ports
+	AllowPublishAll bool
+	// Allow the host network mode and joining the network namespace of another container or of a path,
+	// which may be the one of the host
+	AllowHostNetwork bool
+
+	hostNetworks []*net.IPNet
+	hostPorts    []portRange
+}
+
+type portRange struct {
+	start int
+	end   int
+}
+
+// Parses a port or a range of ports in START-END format
+func parsePortRange(val string) (portRange, error) {
+	startFrag, endFrag, isRange := strings.Cut(val, "-")
+	if !isRange {
+		endFrag = startFrag
+	}
+	start, err := strconv.Atoi(startFrag)
+	if err != nil || start < 1 || start > 65535 {
+		return portRange{}, fmt.Errorf("invalid port: %s", val)
+	}
+	end, err := strconv.Atoi(endFrag)
+	if err != nil || end < start || end > 65535 {
+		return portRange{}, fmt.Errorf("invalid port range: %s", val)
+	}
+	return portRange{start, end}, nil
+}
+
+// Parses the allowed host IPs and ports
+func (pp *PortPolicy) load() error {
+	if pp == nil {
+		return nil
+	}
+
+	pp.hostNetworks = nil
+	for _, ip := range pp.HostIps {
+		network, err := parseCidr(ip)
+		if err != nil {
+			return fmt.Errorf("invalid host IP in port policy: %s: %w", ip, err)
+		}
+		pp.hostNetworks = append(pp.hostNetworks, network)
+	}
+
+	pp.hostPorts = nil
+	for _, port := range pp.HostPorts {
+		r, err := parsePortRange(port)
+		if err != nil {
+			return fmt.Errorf("invalid host port in port policy: %w", err)
+		}
+		pp.hostPorts = append(pp.hostPorts, r)
+	}
+
+	return nil
+}
+
+// Checks the host IP of a port binding, where an empty one means all the interfaces
+func (pp *PortPolicy) checkHostIp(hostIp string) error {
+	if len(pp.hostNetworks) == 0 {
+		return nil
+	}
+	if hostIp == "" {
+		hostIp = "0.0.0.0"
+	}
+	ip := net.ParseIP(hostIp)
+	if ip == nil || !slices.ContainsFunc(pp.hostNetworks, func(network *net.IPNet) bool { return network.Contains(ip) }) {
+		return policyErrorf("publishing ports on host IP not allowed: %s", hostIp)
+	}
+	return nil
+}
+
+// Checks the host ports of a port binding, where zero ports means a random one
+func (pp *PortPolicy) checkHostPorts(start int, count int) error {
+	if len(pp.hostPorts) == 0 {
+		return nil
+	}
+	if start <= 0 {
+		return policyErrorf("publishing ports on a random host port not allowed")
+	}
+	end := start + max(count, 1) - 1
+	if !slices.ContainsFunc(pp.hostPorts, func(r portRange) bool { return start >= r.start && end <= r.end }) {
+		if end != start {
+			return policyErrorf("publishing host ports not allowed: %d-%d", start, end)
+		}
+		return policyErrorf("publishing host port not allowed: %d", start)
+	}
+	return nil
+}
+
+// Checks the published ports and the network mode of a container create request, in the Docker or the libpod format
+func (pp *PortPolicy) checkContainer(body map[string]any, libpod bool) ([]string, error) {
+	if libpod {
+		return nil, pp.checkLibpodContainer(body)
+	}
+
+	hc, ok := field(body, "HostConfig").(map[string]any)
+	if !ok {
+		return nil, nil
+	}
+
+	if !pp.AllowPublishAll && boolField(hc, "PublishAllPorts") {
+		return nil, policyErrorf("publishing all exposed ports not allowed")
+	}
+	if networkMode, _ := field(hc, "NetworkMode").(string); !pp.AllowHostNetwork {
+		if networkMode == "host" {
+			return nil, policyErrorf("host network mode not allowed")
+		} else if strings.HasPrefix(networkMode, "container:") {
+			return nil, policyErrorf("container network mode not allowed")
+		}
+	}
+
+	// Port bindings are keyed by container port, and their host port may be a range in START-END format
+	portBindings, _ := field(hc, "PortBindings").(map[string]any)
+	for _, containerPort := range slices.Sorted(maps.Keys(portBindings)) {
+		bindings, _ := portBindings[containerPort].([]any)
+		for _, b := range bindings {
+			binding, ok := b.(map[string]any)
+			if !ok {
+				continue
+			}
+			hostIp, _ := field(binding, "HostIp").(string)
+			if err := pp.checkHostIp(hostIp); err != nil {
+				return nil, err
+			}
+			hostPort, _ := field(binding, "HostPort").(string)
+			start, count := 0, 1
+			if hostPort != "" && hostPort != "0" {
+				r, err := parsePortRange(hostPort)
+				if err != nil {
+					return nil, policyErrorf("invalid host port: %s", hostPort)
+				}
+				start, count = r.start, r.end-r.start+1
+			}
+			if err := pp.checkHostPorts(start, count); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return nil, nil
+}
+
+func (pp *PortPolicy) checkLibpodContainer(body map[string]any) error {
+	if !pp.AllowPublishAll && boolField(body, "publish_image_ports") {
+		return policyErrorf("publishing all exposed ports not allowed")
+	}
+	if netns, ok := field(body, "netns").(map[string]any); ok && !pp.AllowHostNetwork {
+		switch nsmode, _ := field(netns, "nsmode").(string); nsmode {
+		case "host", "container", "path", "ns":
+			return policyErrorf("%s network mode not allowed", nsmode)
+		}
+	}
+
+	// Port mappings publish a range of ports when their range is greater than one
+	portMappings, _ := field(body, "portmappings").([]any)
+	for _, m := range portMappings {
+		mapping, ok := m.(map[string]any)
+		if !ok {
+			continue
+		}
+		hostIp, _ := field(mapping, "host_ip").(string)
+		if err := pp.checkHostIp(hostIp); err != nil {
+			return err
+		}
+		if err := pp.checkHostPorts(int(intField(mapping, "host_port")), int(intField(mapping, "range"))); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
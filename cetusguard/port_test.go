@@ -0,0 +1,116 @@
+package cetusguard
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPortPolicyLoad(t *testing.T) {
+	pp := &PortPolicy{HostIps: []string{"127.0.0.1", "10.0.0.0/8"}, HostPorts: []string{"8080", "20000-29999"}}
+	if err := pp.load(); err != nil {
+		t.Fatal(err)
+	}
+	if len(pp.hostNetworks) != 2 || len(pp.hostPorts) != 2 {
+		t.Errorf("hostNetworks = %v, hostPorts = %v, want 2 of each", pp.hostNetworks, pp.hostPorts)
+	}
+	if pp.hostPorts[1] != (portRange{20000, 29999}) {
+		t.Errorf("hostPorts[1] = %v, want %v", pp.hostPorts[1], portRange{20000, 29999})
+	}
+
+	invalid := []*PortPolicy{
+		{HostIps: []string{"localhost"}},
+		{HostIps: []string{"10.0.0.0/33"}},
+		{HostPorts: []string{"0"}},
+		{HostPorts: []string{"65536"}},
+		{HostPorts: []string{"30000-20000"}},
+		{HostPorts: []string{"20000-"}},
+	}
+	for _, pp := range invalid {
+		if err := pp.load(); err == nil {
+			t.Errorf("%v %v: want an error", pp.HostIps, pp.HostPorts)
+		}
+	}
+}
+
+func TestPortPolicyCheckContainer(t *testing.T) {
+	pp := &PortPolicy{HostIps: []string{"127.0.0.1", "::1"}, HostPorts: []string{"20000-29999"}}
+	if err := pp.load(); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		libpod bool
+		body   string
+		wanted bool
+	}{
+		{false, `{"Image":"alpine"}`, true},
+		{false, `{"HostConfig":{"PortBindings":{"80/tcp":[{"HostIp":"127.0.0.1","HostPort":"20080"}],"53/udp":[{"HostIp":"::1","HostPort":"20053"}]}}}`, true},
+		{false, `{"HostConfig":{"PortBindings":{"80/tcp":[{"HostIp":"127.0.0.1","HostPort":"20080-20089"}]}}}`, true},
+		{false, `{"HostConfig":{"PortBindings":{"80/tcp":[{"HostIp":"","HostPort":"20080"}]}}}`, false},
+		{false, `{"HostConfig":{"PortBindings":{"80/tcp":[{"HostIp":"0.0.0.0","HostPort":"20080"}]}}}`, false},
+		{false, `{"HostConfig":{"PortBindings":{"80/tcp":[{"HostIp":"127.0.0.1","HostPort":"80"}]}}}`, false},
+		{false, `{"HostConfig":{"PortBindings":{"80/tcp":[{"HostIp":"127.0.0.1","HostPort":"29990-30010"}]}}}`, false},
+		{false, `{"HostConfig":{"PortBindings":{"80/tcp":[{"HostIp":"127.0.0.1","HostPort":""}]}}}`, false},
+		{false, `{"HostConfig":{"PublishAllPorts":true}}`, false},
+		{false, `{"HostConfig":{"NetworkMode":"host"}}`, false},
+		{false, `{"hostconfig":{"NetworkMode":"host"}}`, false},
+		{false, `{"HostConfig":{"networkmode":"host"}}`, false},
+		{false, `{"HostConfig":{"NetworkMode":"container:0123456789ab"}}`, false},
+		{false, `{"HostConfig":{"NetworkMode":"bridge"}}`, true},
+		{false, `{"hostconfig":{"portbindings":{"80/tcp":[{"hostip":"0.0.0.0","hostport":"20080"}]}}}`, false},
+		{true, `{"portmappings":[{"container_port":80,"host_port":20080,"host_ip":"127.0.0.1","range":10}]}`, true},
+		{true, `{"portmappings":[{"container_port":80,"host_port":29999,"host_ip":"127.0.0.1","range":2}]}`, false},
+		{true, `{"portmappings":[{"container_port":80,"host_ip":"127.0.0.1"}]}`, false},
+		{true, `{"portmappings":[{"container_port":80,"host_port":20080}]}`, false},
+		{true, `{"publish_image_ports":true}`, false},
+		{true, `{"netns":{"nsmode":"host"}}`, false},
+		{true, `{"NetNS":{"NSMode":"host"}}`, false},
+		{true, `{"netns":{"nsmode":"container","value":"0123456789ab"}}`, false},
+		{true, `{"netns":{"nsmode":"path","value":"/proc/1/ns/net"}}`, false},
+		{true, `{"netns":{"nsmode":"ns","value":"/run/netns/host"}}`, false},
+		{true, `{"netns":{"nsmode":"bridge"}}`, true},
+	}
+
+	for _, c := range testCases {
+		_, err := pp.checkContainer(decodeTestBody(t, c.body), c.libpod)
+		if allowed := err == nil; allowed != c.wanted {
+			t.Errorf("%s: allowed = %t, want %t (%v)", c.body, allowed, c.wanted, err)
+		}
+	}
+
+	// Publishing all ports and the host network can be allowed
+	pp.AllowPublishAll = true
+	pp.AllowHostNetwork = true
+	if _, err := pp.checkContainer(decodeTestBody(t, `{"HostConfig":{"PublishAllPorts":true,"NetworkMode":"host"}}`), false); err != nil {
+		t.Error(err)
+	}
+	if _, err := pp.checkContainer(decodeTestBody(t, `{"HostConfig":{"NetworkMode":"container:0123456789ab"}}`), false); err != nil {
+		t.Error(err)
+	}
+	if _, err := pp.checkContainer(decodeTestBody(t, `{"netns":{"nsmode":"path","value":"/proc/1/ns/net"}}`), true); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPortPolicyDuplicateFields(t *testing.T) {
+	cg := &Server{PortPolicy: &PortPolicy{HostIps: []string{"127.0.0.1"}, HostPorts: []string{"20000-29999"}}}
+	if err := cg.PortPolicy.load(); err != nil {
+		t.Fatal(err)
+	}
+	cg.policies = cg.requestPolicies()
+
+	// The daemon would use the last HostConfig, which is not the one with the allowed bindings
+	bodies := []string{
+		`{"HostConfig":{"PortBindings":{"80/tcp":[{"HostIp":"127.0.0.1","HostPort":"20080"}]}},"HostConfig":{"PortBindings":{"80/tcp":[{"HostPort":"80"}]}}}`,
+		`{"HostConfig":{},"hostconfig":{"NetworkMode":"host"}}`,
+	}
+	for _, body := range bodies {
+		req := httptest.NewRequest("POST", "/v1.41/containers/create", strings.NewReader(body))
+		rec := httptest.NewRecorder()
+		if cg.applyPolicies(rec, req) || rec.Code != http.StatusForbidden {
+			t.Errorf("%s: status = %d, want %d", body, rec.Code, http.StatusForbidden)
+		}
+	}
+}
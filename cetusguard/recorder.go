@@ -0,0 +1,248 @@
+package cetusguard
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/hectorm/cetusguard/internal/logger"
+)
+
+const (
+	execRegistryTtl = 24 * time.Hour
+)
+
+var (
+	execCreatePattern = mustBuildPattern(`(?:%API_PREFIX_CONTAINERS%|%API_PREFIX_LIBPOD_CONTAINERS%)/%CONTAINER_ID_OR_NAME%/exec`)
+	execStartPattern  = mustBuildPattern(`(?:%API_PREFIX_EXEC%|%API_PREFIX_LIBPOD_EXEC%)/(%_OBJECT_ID%)/start`)
+	attachPattern     = mustBuildPattern(`(?:%API_PREFIX_CONTAINERS%|%API_PREFIX_LIBPOD_CONTAINERS%)/(%CONTAINER_ID_OR_NAME%)/attach`)
+)
+
+// Session recordings use the asciicast v2 format,
+// https://docs.asciinema.org/manual/asciicast/v2/
+type asciicastHeader struct {
+	Version    int               `json:"version"`
+	Width      int               `json:"width"`
+	Height     int               `json:"height"`
+	Timestamp  int64             `json:"timestamp"`
+	Title      string            `json:"title,omitempty"`
+	CetusGuard *sessionRecording `json:"cetusguard,omitempty"`
+}
+
+type sessionRecording struct {
+	RequestId           string `json:"request_id"`
+	Method              string `json:"method"`
+	Path                string `json:"path"`
+	RemoteAddr          string `json:"remote_addr"`
+	Container           string `json:"container,omitempty"`
+	ExecId              string `json:"exec_id,omitempty"`
+	ExecCreateRequestId string `json:"exec_create_request_id,omitempty"`
+}
+
+type sessionRecorder struct {
+	path  string
+	file  *os.File
+	start time.Time
+	err   error
+	mu    sync.Mutex
+}
+
+func newSessionRecorder(dir string, rec *sessionRecording) (*sessionRecorder, error) {
+	start := time.Now()
+
+	name := fmt.Sprintf("%s-%s.cast", start.UTC().Format("20060102T150405Z"), rec.RequestId)
+	path := filepath.Join(dir, name)
+
+	file, err := os.OpenFile(filepath.Clean(path), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	header, err := json.Marshal(&asciicastHeader{
+		Version:    2,
+		Width:      80,
+		Height:     24,
+		Timestamp:  start.Unix(),
+		Title:      fmt.Sprintf("%s %s", rec.Method, rec.Path),
+		CetusGuard: rec,
+	})
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	_, err = file.Write(append(header, '\n'))
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	return &sessionRecorder{path: path, file: file, start: start}, nil
+}
+
+func (sr *sessionRecorder) event(code string, data []byte) {
+	if len(data) == 0 {
+		return
+	}
+
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+
+	if sr.err != nil {
+		return
+	}
+
+	elapsed := time.Since(sr.start).Seconds()
+	line, err := json.Marshal([]any{elapsed, code, string(data)})
+	if err == nil {
+		_, err = sr.file.Write(append(line, '\n'))
+	}
+	if err != nil {
+		// A failing recording must never interrupt the session, so the error is only reported once
+		sr.err = err
+		logger.Errorf("error writing session recording %s: %v\n", sr.path, err)
+	}
+}
+
+// The returned writer records the data sent by the client
+func (sr *sessionRecorder) inputWriter() io.Writer {
+	return &asciicastEventWriter{recorder: sr, code: "i"}
+}
+
+// The returned writer records the data sent by the daemon,
+// if the stream is multiplexed the stdout and stderr frames are extracted from it
+func (sr *sessionRecorder) outputWriter(multiplexed bool) io.Writer {
+	var wri io.Writer = &asciicastEventWriter{recorder: sr, code: "o"}
+	if multiplexed {
+		wri = &demuxWriter{dst: wri}
+	}
+	return wri
+}
+
+func (sr *sessionRecorder) Close() error {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+
+	return sr.file.Close()
+}
+
+type asciicastEventWriter struct {
+	recorder *sessionRecorder
+	code     string
+	partial  []byte
+}
+
+func (ew *asciicastEventWriter) Write(p []byte) (int, error) {
+	data := append(ew.partial, p...)
+
+	// Hold back an incomplete UTF-8 sequence at the end of the chunk until the next write
+	end := len(data)
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				end = i
+			}
+			break
+		}
+	}
+
+	ew.recorder.event(ew.code, data[:end])
+	ew.partial = append([]byte(nil), data[end:]...)
+
+	return len(p), nil
+}
+
+// Decodes the stream format described in
+// https://docs.docker.com/reference/api/engine/version/v1.51/#tag/Container/operation/ContainerAttach
+type demuxWriter struct {
+	dst       io.Writer
+	header    [8]byte
+	headerLen int
+	remaining int
+	stream    byte
+}
+
+func (dw *demuxWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		if dw.remaining == 0 {
+			c := copy(dw.header[dw.headerLen:], p)
+			dw.headerLen += c
+			p = p[c:]
+			if dw.headerLen == len(dw.header) {
+				dw.stream = dw.header[0]
+				dw.remaining = int(binary.BigEndian.Uint32(dw.header[4:]))
+				dw.headerLen = 0
+			}
+			continue
+		}
+
+		c := min(dw.remaining, len(p))
+		if dw.stream == 1 || dw.stream == 2 {
+			_, _ = dw.dst.Write(p[:c])
+		}
+		dw.remaining -= c
+		p = p[c:]
+	}
+	return n, nil
+}
+
+// Writer that keeps at most max bytes and silently discards the rest
+type cappedBuffer struct {
+	bytes.Buffer
+	max int
+}
+
+func (cb *cappedBuffer) Write(p []byte) (int, error) {
+	if room := cb.max - cb.Len(); room > 0 {
+		_, _ = cb.Buffer.Write(p[:min(room, len(p))])
+	}
+	return len(p), nil
+}
+
+// Keeps track of the request that created each exec instance,
+// so the recording of a later exec start can be linked to it
+type execRegistry struct {
+	entries map[string]execRegistryEntry
+	mu      sync.Mutex
+}
+
+type execRegistryEntry struct {
+	requestId string
+	created   time.Time
+}
+
+func (er *execRegistry) add(execId string, requestId string) {
+	er.mu.Lock()
+	defer er.mu.Unlock()
+
+	now := time.Now()
+	if er.entries == nil {
+		er.entries = make(map[string]execRegistryEntry)
+	}
+	for k, v := range er.entries {
+		if now.Sub(v.created) > execRegistryTtl {
+			delete(er.entries, k)
+		}
+	}
+	er.entries[execId] = execRegistryEntry{requestId: requestId, created: now}
+}
+
+func (er *execRegistry) take(execId string) string {
+	er.mu.Lock()
+	defer er.mu.Unlock()
+
+	entry, ok := er.entries[execId]
+	if !ok {
+		return ""
+	}
+	delete(er.entries, execId)
+	return entry.requestId
+}
@@ -0,0 +1,103 @@
+package cetusguard
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestDemuxWriter(t *testing.T) {
+	stream := []byte("\x01\x00\x00\x00\x00\x00\x00\x03foo" +
+		"\x02\x00\x00\x00\x00\x00\x00\x03bar" +
+		"\x00\x00\x00\x00\x00\x00\x00\x03baz" +
+		"\x01\x00\x00\x00\x00\x00\x00\x00" +
+		"\x01\x00\x00\x00\x00\x00\x00\x03qux")
+
+	// Write the stream in chunks of every size to exercise frames split across writes
+	for size := 1; size <= len(stream); size++ {
+		var buf bytes.Buffer
+		dw := &demuxWriter{dst: &buf}
+		for i := 0; i < len(stream); i += size {
+			n, err := dw.Write(stream[i:min(i+size, len(stream))])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != min(size, len(stream)-i) {
+				t.Fatalf("n = %d, want %d", n, min(size, len(stream)-i))
+			}
+		}
+		if buf.String() != "foobarqux" {
+			t.Errorf(`chunk size %d: buf = "%s", want "%s"`, size, buf.String(), "foobarqux")
+		}
+	}
+}
+
+func TestSessionRecorder(t *testing.T) {
+	tmpdir := t.TempDir()
+
+	sr, err := newSessionRecorder(tmpdir, &sessionRecording{RequestId: "0123456789abcdef", Method: "POST", Path: "/exec/0123/start"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	in := sr.inputWriter()
+	out := sr.outputWriter(false)
+
+	// The whale emoji is split across writes and must not be recorded as invalid UTF-8
+	whale := []byte("\U0001F433")
+	_, _ = in.Write([]byte("ls\n"))
+	_, _ = out.Write(append([]byte("foo "), whale[:2]...))
+	_, _ = out.Write(whale[2:])
+
+	if err := sr.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	recording, err := os.ReadFile(sr.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(recording)), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("len(lines) = %d, want %d", len(lines), 4)
+	}
+
+	var header asciicastHeader
+	if err := json.Unmarshal([]byte(lines[0]), &header); err != nil {
+		t.Fatal(err)
+	}
+	if header.Version != 2 || header.Title != "POST /exec/0123/start" || header.CetusGuard.RequestId != "0123456789abcdef" {
+		t.Errorf("header = %+v, want a valid asciicast v2 header", header)
+	}
+
+	wantedEvents := [][2]string{{"i", "ls\n"}, {"o", "foo "}, {"o", "\U0001F433"}}
+	for i, line := range lines[1:] {
+		var event []any
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			t.Fatal(err)
+		}
+		if event[1] != wantedEvents[i][0] || event[2] != wantedEvents[i][1] {
+			t.Errorf("event = %v, want %v", event[1:], wantedEvents[i])
+		}
+	}
+}
+
+func TestExecRegistry(t *testing.T) {
+	var er execRegistry
+
+	er.add("0123", "req1")
+	er.add("4567", "req2")
+
+	if id := er.take("0123"); id != "req1" {
+		t.Errorf(`id = "%s", want "%s"`, id, "req1")
+	}
+	if id := er.take("0123"); id != "" {
+		t.Errorf(`id = "%s", want ""`, id)
+	}
+	if id := er.take("4567"); id != "req2" {
+		t.Errorf(`id = "%s", want "%s"`, id, "req2")
+	}
+}
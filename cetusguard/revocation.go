@@ -0,0 +1,137 @@
+package cetusguard
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hectorm/cetusguard/internal/logger"
+)
+
+// Certificates that are rejected even if they are signed by a trusted CA
+type denyList struct {
+	serials      map[string]struct{}
+	fingerprints map[[sha256.Size]byte]struct{}
+}
+
+// Parses deny-list entries in the "serial:HEX" and "sha256:HEX" formats,
+// colons between the hexadecimal digits are allowed, as printed by OpenSSL
+func parseDenyList(entries []string) (*denyList, error) {
+	dl := &denyList{
+		serials:      make(map[string]struct{}),
+		fingerprints: make(map[[sha256.Size]byte]struct{}),
+	}
+
+	for _, entry := range entries {
+		kind, val, _ := strings.Cut(entry, ":")
+		b, err := hex.DecodeString(strings.ReplaceAll(val, ":", ""))
+		if err != nil || len(b) == 0 {
+			return nil, fmt.Errorf("invalid deny-list entry: %s", entry)
+		}
+
+		switch strings.ToLower(kind) {
+		case "serial":
+			dl.serials[new(big.Int).SetBytes(b).String()] = struct{}{}
+		case "sha256":
+			if len(b) != sha256.Size {
+				return nil, fmt.Errorf("invalid deny-list entry: %s", entry)
+			}
+			dl.fingerprints[[sha256.Size]byte(b)] = struct{}{}
+		default:
+			return nil, fmt.Errorf("invalid deny-list entry: %s", entry)
+		}
+	}
+
+	return dl, nil
+}
+
+func (dl *denyList) contains(cert *x509.Certificate) bool {
+	if _, ok := dl.serials[cert.SerialNumber.String()]; ok {
+		return true
+	}
+	if _, ok := dl.fingerprints[sha256.Sum256(cert.Raw)]; ok {
+		return true
+	}
+	return false
+}
+
+// Loads the serials revoked by the CRL files, the CRLs must be signed by one of the given CAs
+func loadCrls(paths []string, cacerts []*x509.Certificate) (map[string]struct{}, []*x509.RevocationList, error) {
+	revoked := make(map[string]struct{})
+	var crls []*x509.RevocationList
+
+	for _, path := range paths {
+		data, err := os.ReadFile(filepath.Clean(path))
+		if err != nil {
+			return nil, nil, err
+		}
+		if block, _ := pem.Decode(data); block != nil {
+			if block.Type != "X509 CRL" {
+				return nil, nil, fmt.Errorf("error loading CRL %s: unexpected PEM block type: %s", path, block.Type)
+			}
+			data = block.Bytes
+		}
+
+		crl, err := x509.ParseRevocationList(data)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error loading CRL %s: %w", path, err)
+		}
+
+		var issuer *x509.Certificate
+		for _, c := range cacerts {
+			if bytes.Equal(c.RawSubject, crl.RawIssuer) && crl.CheckSignatureFrom(c) == nil {
+				issuer = c
+				break
+			}
+		}
+		if issuer == nil {
+			return nil, nil, fmt.Errorf("error loading CRL %s: not signed by a trusted CA", path)
+		}
+
+		for _, entry := range crl.RevokedCertificateEntries {
+			revoked[revocationKey(crl.RawIssuer, entry.SerialNumber)] = struct{}{}
+		}
+		crls = append(crls, crl)
+	}
+
+	return revoked, crls, nil
+}
+
+// Serials are only unique for the same issuer
+func revocationKey(rawIssuer []byte, serial *big.Int) string {
+	return string(rawIssuer) + "\x00" + serial.String()
+}
+
+func (tf *tlsFiles) isRevoked(cert *x509.Certificate) bool {
+	tf.mu.RLock()
+	defer tf.mu.RUnlock()
+
+	_, ok := tf.revoked[revocationKey(cert.RawIssuer, cert.SerialNumber)]
+	return ok
+}
+
+// Rejects client certificates that have been revoked by a CRL or that are in the deny-list,
+// it runs after the chain has been verified, so every certificate of the chain is checked
+func verifyClientNotRevoked(tf *tlsFiles, dl *denyList) func(cs tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		if len(cs.VerifiedChains) == 0 {
+			return nil
+		}
+		for _, cert := range cs.VerifiedChains[0] {
+			if tf.isRevoked(cert) || dl.contains(cert) {
+				logger.Warningf("rejected revoked client certificate %s with serial %s\n", cert.Subject, cert.SerialNumber.Text(16))
+				return errors.New("certificate revoked")
+			}
+		}
+		return nil
+	}
+}
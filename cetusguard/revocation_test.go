@@ -0,0 +1,273 @@
+package cetusguard
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Throwaway CA that can issue certificates and CRLs
+type testPki struct {
+	cacert    *x509.Certificate
+	cacertPem []byte
+	key       *ecdsa.PrivateKey
+}
+
+func newTestPki(t *testing.T, cn string) *testPki {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cacert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testPki{
+		cacert:    cacert,
+		cacertPem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		key:       key,
+	}
+}
+
+// Issues a certificate valid for localhost that can be used by both clients and servers
+func (pki *testPki) issue(t *testing.T, cn string, serial int64) (certPem []byte, keyPem []byte) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, pki.cacert, &key.PublicKey, pki.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+}
+
+func (pki *testPki) crl(t *testing.T, nextUpdate time.Time, serials ...int64) []byte {
+	t.Helper()
+
+	template := &x509.RevocationList{
+		Number:     big.NewInt(time.Now().UnixNano()),
+		ThisUpdate: time.Now().Add(-time.Hour),
+		NextUpdate: nextUpdate,
+	}
+	for _, serial := range serials {
+		template.RevokedCertificateEntries = append(template.RevokedCertificateEntries, x509.RevocationListEntry{
+			SerialNumber:   big.NewInt(serial),
+			RevocationTime: time.Now(),
+		})
+	}
+
+	der, err := x509.CreateRevocationList(rand.Reader, template, pki.cacert, pki.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der})
+}
+
+func TestParseDenyList(t *testing.T) {
+	pki := newTestPki(t, "ca")
+	certPem, _ := pki.issue(t, "client", 0x1a2b)
+	cert := parseTestCert(t, certPem)
+	otherCertPem, _ := pki.issue(t, "other", 0x3c4d)
+	otherCert := parseTestCert(t, otherCertPem)
+
+	fingerprint := sha256.Sum256(cert.Raw)
+
+	lists := map[string][]string{
+		"serial":          {"serial:1a2b"},
+		"serialColons":    {"SERIAL:00:1A:2B"},
+		"fingerprint":     {"sha256:" + hex.EncodeToString(fingerprint[:])},
+		"fingerprintCaps": {"SHA256:" + formatColonHex(fingerprint[:])},
+	}
+
+	for name, entries := range lists {
+		dl, err := parseDenyList(entries)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !dl.contains(cert) {
+			t.Errorf("%s: certificate not denied, want denied", name)
+		}
+		if dl.contains(otherCert) {
+			t.Errorf("%s: other certificate denied, want not denied", name)
+		}
+	}
+}
+
+func TestParseInvalidDenyList(t *testing.T) {
+	entries := []string{
+		"1a2b",
+		"serial:",
+		"serial:zz",
+		"sha256:1a2b",
+		"md5:1a2b",
+	}
+
+	for _, entry := range entries {
+		if _, err := parseDenyList([]string{entry}); err == nil {
+			t.Errorf("%s: entry parsed, want an error", entry)
+		}
+	}
+}
+
+func TestLoadCrls(t *testing.T) {
+	tmpdir := t.TempDir()
+	pki := newTestPki(t, "ca")
+	otherPki := newTestPki(t, "other-ca")
+
+	revokedCertPem, _ := pki.issue(t, "revoked", 2)
+	validCertPem, _ := pki.issue(t, "valid", 3)
+	otherCertPem, _ := otherPki.issue(t, "other", 2)
+
+	crlPath := filepath.Join(tmpdir, "crl.pem")
+	if err := os.WriteFile(crlPath, pki.crl(t, time.Now().Add(time.Hour), 2), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	revoked, crls, err := loadCrls([]string{crlPath}, []*x509.Certificate{otherPki.cacert, pki.cacert})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(crls) != 1 {
+		t.Fatalf("len(crls) = %d, want %d", len(crls), 1)
+	}
+
+	tf := &tlsFiles{revoked: revoked}
+	if !tf.isRevoked(parseTestCert(t, revokedCertPem)) {
+		t.Errorf("certificate not revoked, want revoked")
+	}
+	if tf.isRevoked(parseTestCert(t, validCertPem)) {
+		t.Errorf("certificate revoked, want not revoked")
+	}
+	// Same serial, but from another issuer
+	if tf.isRevoked(parseTestCert(t, otherCertPem)) {
+		t.Errorf("certificate of another issuer revoked, want not revoked")
+	}
+}
+
+func TestLoadInvalidCrls(t *testing.T) {
+	tmpdir := t.TempDir()
+	pki := newTestPki(t, "ca")
+	otherPki := newTestPki(t, "other-ca")
+
+	crls := map[string][]byte{
+		"untrusted.pem": otherPki.crl(t, time.Now().Add(time.Hour), 2),
+		"invalid.pem":   []byte("invalid"),
+		"cert.pem":      pki.cacertPem,
+	}
+
+	for name, data := range crls {
+		path := filepath.Join(tmpdir, name)
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := loadCrls([]string{path}, []*x509.Certificate{pki.cacert}); err == nil {
+			t.Errorf("%s: CRL loaded, want an error", name)
+		}
+	}
+
+	if _, _, err := loadCrls([]string{filepath.Join(tmpdir, "nonexistent.pem")}, []*x509.Certificate{pki.cacert}); err == nil {
+		t.Errorf("CRL loaded, want an error")
+	}
+}
+
+func TestVerifyClientNotRevoked(t *testing.T) {
+	tmpdir := t.TempDir()
+	pki := newTestPki(t, "ca")
+
+	cacertPath := filepath.Join(tmpdir, "ca.pem")
+	if err := os.WriteFile(cacertPath, pki.cacertPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	crlPath := filepath.Join(tmpdir, "crl.pem")
+	if err := os.WriteFile(crlPath, pki.crl(t, time.Now().Add(time.Hour), 2), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tf, err := loadTlsFiles(cacertPath, "", "", []string{crlPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dl, err := parseDenyList([]string{"serial:04"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	verify := verifyClientNotRevoked(tf, dl)
+
+	for serial, wantRevoked := range map[int64]bool{2: true, 3: false, 4: true} {
+		certPem, _ := pki.issue(t, "client", serial)
+		cs := tls.ConnectionState{
+			VerifiedChains: [][]*x509.Certificate{{parseTestCert(t, certPem), pki.cacert}},
+		}
+		if err := verify(cs); (err != nil) != wantRevoked {
+			t.Errorf("serial %d: err = %v, want revoked %t", serial, err, wantRevoked)
+		}
+	}
+}
+
+func TestLoadTlsFilesCrlWithoutCacert(t *testing.T) {
+	if _, err := loadTlsFiles("", "", "", []string{"crl.pem"}); err == nil {
+		t.Errorf("files loaded, want an error")
+	}
+}
+
+func formatColonHex(b []byte) string {
+	s := hex.EncodeToString(b)
+	var out []byte
+	for i := 0; i < len(s); i += 2 {
+		if i > 0 {
+			out = append(out, ':')
+		}
+		out = append(out, s[i], s[i+1])
+	}
+	return string(out)
+}
@@ -0,0 +1,315 @@
+package cetusguard
+
+import (
+	"bufio"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/hectorm/cetusguard/internal/logger"
+)
+
+const (
+	// Name that routes use to refer to the backend specified by Server.Backend
+	DefaultBackendName = "default"
+)
+
+var (
+	routeLineRegex  = regexp.MustCompile(`^[\t ]*([a-z0-9-]+)((?:;[a-z0-9-]+=[^\t ;]*)*)[\t ]+(.+?)[\t ]*$`)
+	backendDefRegex = regexp.MustCompile(`^([a-z0-9-]+)=(.+)$`)
+)
+
+// Query parameters accepted in the address of a named backend
+var backendOptions = []string{
+	"tls-cacert",
+	"tls-cert",
+	"tls-key",
+	"tls-server-name",
+	"tls-pin",
+	"tls-min-version",
+	"tls-cipher-suites",
+}
+
+// Sends the requests whose path matches the pattern and that meet all the conditions to the named backend
+type Route struct {
+	Backend string
+	Pattern *regexp.Regexp
+	Options RouteOptions
+}
+
+func (route Route) String() string {
+	return fmt.Sprintf("%s%s %s",
+		route.Backend,
+		route.Options.String(),
+		route.Pattern.String(),
+	)
+}
+
+type RouteOptions struct {
+	// Frontend address, as specified in the configuration, that the request was received on
+	Listener string
+	// Common name of the verified client certificate
+	ClientCn string
+	// Network the client address belongs to
+	ClientAddr *net.IPNet
+}
+
+var routeOptionParsers = map[string]func(options *RouteOptions, val string) error{
+	"listener": func(options *RouteOptions, val string) error {
+		if _, _, err := parseAddr(val); err != nil {
+			return err
+		}
+		options.Listener = val
+		return nil
+	},
+	"client-cn": func(options *RouteOptions, val string) error {
+		if val == "" {
+			return fmt.Errorf("empty common name")
+		}
+		options.ClientCn = val
+		return nil
+	},
+	"client-addr": func(options *RouteOptions, val string) (err error) {
+		options.ClientAddr, err = parseCidr(val)
+		return err
+	},
+}
+
+func (options RouteOptions) String() string {
+	var sb strings.Builder
+	if options.Listener != "" {
+		fmt.Fprintf(&sb, ";listener=%s", options.Listener)
+	}
+	if options.ClientCn != "" {
+		fmt.Fprintf(&sb, ";client-cn=%s", options.ClientCn)
+	}
+	if options.ClientAddr != nil {
+		fmt.Fprintf(&sb, ";client-addr=%s", options.ClientAddr)
+	}
+	return sb.String()
+}
+
+// Reports whether the request meets the conditions of the options
+func (options RouteOptions) matches(req *http.Request) bool {
+	if options.Listener != "" && options.Listener != listenerAddr(req) {
+		return false
+	}
+	if options.ClientCn != "" && options.ClientCn != clientCommonName(req) {
+		return false
+	}
+	if options.ClientAddr != nil {
+		ip := net.ParseIP(clientKey(req))
+		if ip == nil || !options.ClientAddr.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+func (route Route) matches(req *http.Request) bool {
+	return route.Options.matches(req) && route.Pattern.MatchString(cleanPath(req.URL.Path))
+}
+
+func BuildRoutes(str string) ([]Route, error) {
+	var routes []Route
+
+	lines := newLineRegex.Split(str, -1)
+	for _, line := range lines {
+		if commentLineRegex.MatchString(line) {
+			continue
+		}
+
+		matches := routeLineRegex.FindStringSubmatch(line)
+		if len(matches) != 4 {
+			return nil, fmt.Errorf("invalid route line: %s", line)
+		}
+		backendFrag := matches[1]
+		optionsFrag := matches[2]
+		patternFrag := matches[3]
+
+		var options RouteOptions
+		if optionsFrag != "" {
+			for _, option := range strings.Split(optionsFrag[1:], ";") {
+				k, v, _ := strings.Cut(option, "=")
+				parse, ok := routeOptionParsers[k]
+				if !ok {
+					return nil, fmt.Errorf("unknown route option: %s", k)
+				}
+				if err := parse(&options, v); err != nil {
+					return nil, fmt.Errorf("invalid route option: %s: %w", option, err)
+				}
+			}
+		}
+
+		pattern, err := buildPattern(patternFrag)
+		if err != nil {
+			return nil, fmt.Errorf("invalid route pattern: %s", str)
+		}
+
+		route := Route{backendFrag, pattern, options}
+		routes = append(routes, route)
+
+		logger.Debugf("loaded route: %s\n", route)
+	}
+
+	return routes, nil
+}
+
+func BuildRoutesFromFilePath(path string) ([]Route, error) {
+	var routes []Route
+
+	file, err := os.Open(filepath.Clean(path))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	if !fileInfo.Mode().IsRegular() {
+		return nil, fmt.Errorf("open %s: not a file", path)
+	}
+
+	scanner := bufio.NewScanner(file)
+	scanner.Split(bufio.ScanLines)
+	for scanner.Scan() {
+		r, err := BuildRoutes(scanner.Text())
+		if err != nil {
+			return nil, err
+		}
+
+		routes = append(routes, r...)
+	}
+
+	return routes, nil
+}
+
+// Builds the named backends from definitions in the NAME=ADDR format, the TLS settings of each backend
+// are specified with the "tls-*" query parameters of its address.
+// Definitions with the same name are merged into a single backend with failover
+func BuildBackends(defs []string) (map[string]*Backend, error) {
+	backends := make(map[string]*Backend)
+
+	for _, def := range defs {
+		matches := backendDefRegex.FindStringSubmatch(def)
+		if len(matches) != 3 {
+			return nil, fmt.Errorf("invalid backend definition: %s", def)
+		}
+		name := matches[1]
+		if name == DefaultBackendName {
+			return nil, fmt.Errorf("reserved backend name: %s", name)
+		}
+
+		addr, rawQuery, _ := strings.Cut(matches[2], "?")
+		query, err := url.ParseQuery(rawQuery)
+		if err != nil {
+			return nil, fmt.Errorf("invalid backend definition: %s: %w", def, err)
+		}
+		// The options of SSH addresses are kept in the address
+		sshQuery := url.Values{}
+		for k, v := range query {
+			if slices.Contains(backendOptions, k) {
+				continue
+			} else if isSshAddr(addr) && slices.Contains(sshOptions, k) {
+				sshQuery[k] = v
+			} else {
+				return nil, fmt.Errorf("unknown backend option: %s", k)
+			}
+		}
+		if len(sshQuery) > 0 {
+			addr += "?" + sshQuery.Encode()
+		}
+
+		backend := &Backend{
+			Addr:          addr,
+			TlsCacert:     query.Get("tls-cacert"),
+			TlsCert:       query.Get("tls-cert"),
+			TlsKey:        query.Get("tls-key"),
+			TlsServerName: query.Get("tls-server-name"),
+			TlsPin:        query["tls-pin"],
+			TlsMinVersion: query.Get("tls-min-version"),
+		}
+		if val := query.Get("tls-cipher-suites"); val != "" {
+			backend.TlsCipherSuites = strings.Split(val, ",")
+		}
+
+		if existing, ok := backends[name]; ok {
+			if !sameTlsSettings(existing, backend) {
+				return nil, fmt.Errorf("conflicting TLS settings for backend: %s", name)
+			}
+			existing.FailoverAddr = append(existing.FailoverAddr, addr)
+		} else {
+			backends[name] = backend
+		}
+	}
+
+	return backends, nil
+}
+
+func sameTlsSettings(a *Backend, b *Backend) bool {
+	return a.TlsCacert == b.TlsCacert &&
+		a.TlsCert == b.TlsCert &&
+		a.TlsKey == b.TlsKey &&
+		a.TlsServerName == b.TlsServerName &&
+		slices.Equal(a.TlsPin, b.TlsPin) &&
+		a.TlsMinVersion == b.TlsMinVersion &&
+		slices.Equal(a.TlsCipherSuites, b.TlsCipherSuites)
+}
+
+// Returns the backend the request must be forwarded to according to the first matching route
+func (cg *Server) routeRequest(req *http.Request) (string, *backendPool) {
+	for _, route := range cg.Routes {
+		if route.matches(req) {
+			return route.Backend, cg.backendPools[route.Backend]
+		}
+	}
+	return DefaultBackendName, cg.backendPools[DefaultBackendName]
+}
+
+func parseCidr(val string) (*net.IPNet, error) {
+	if !strings.Contains(val, "/") {
+		ip := net.ParseIP(val)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP address: %s", val)
+		}
+		bits := 8 * net.IPv4len
+		if ip.To4() == nil {
+			bits = 8 * net.IPv6len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, ipNet, err := net.ParseCIDR(val)
+	return ipNet, err
+}
+
+func listenerAddr(req *http.Request) string {
+	addr, _ := req.Context().Value(listenerContextKey).(string)
+	return addr
+}
+
+func clientCommonName(req *http.Request) string {
+	if cert := clientCertificate(req); cert != nil {
+		return cert.Subject.CommonName
+	}
+	return ""
+}
+
+// Returns the verified certificate presented by the client, if any
+func clientCertificate(req *http.Request) *x509.Certificate {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return req.TLS.VerifiedChains[0][0]
+}
@@ -0,0 +1,192 @@
+package cetusguard
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+func TestRouteString(t *testing.T) {
+	rawRoute := "podman;listener=unix:///run/cetusguard.sock;client-cn=ci;client-addr=10.0.0.0/8 ^/.+$"
+	_, clientAddr, _ := net.ParseCIDR("10.0.0.0/8")
+	route := Route{
+		Backend: "podman",
+		Pattern: regexp.MustCompile(`^/.+$`),
+		Options: RouteOptions{Listener: "unix:///run/cetusguard.sock", ClientCn: "ci", ClientAddr: clientAddr},
+	}
+	if route.String() != rawRoute {
+		t.Errorf("route = %v, want = %v", route, rawRoute)
+	}
+}
+
+func TestBuildValidRoutes(t *testing.T) {
+	_, clientAddr, _ := net.ParseCIDR("192.168.1.10/32")
+	rawRoutes := map[string]Route{
+		"! Comment\npodman %API_PREFIX_LIBPOD%/.*\n": {
+			Backend: "podman",
+			Pattern: regexp.MustCompile(`^(?:/v[0-9]+(?:\.[0-9]+)*)/libpod/.*$`),
+		},
+		" \t docker-2;listener=tcp://127.0.0.1:2375;client-cn=ci;client-addr=192.168.1.10 \t %API_PREFIX%/test02 \t ": {
+			Backend: "docker-2",
+			Pattern: regexp.MustCompile(`^(?:/v[0-9]+(?:\.[0-9]+)*)?/test02$`),
+			Options: RouteOptions{Listener: "tcp://127.0.0.1:2375", ClientCn: "ci", ClientAddr: &net.IPNet{IP: net.ParseIP("192.168.1.10"), Mask: clientAddr.Mask}},
+		},
+	}
+
+	for k, v := range rawRoutes {
+		builtRoutes, err := BuildRoutes(k)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		wantedRoutes := []Route{v}
+		if !reflect.DeepEqual(builtRoutes, wantedRoutes) {
+			t.Errorf("builtRoutes = %v, want = %v", builtRoutes, wantedRoutes)
+			continue
+		}
+	}
+}
+
+func TestBuildInvalidRoutes(t *testing.T) {
+	rawRoutes := []string{
+		"%API_PREFIX%/test01",
+		"Podman %API_PREFIX%/test02",
+		"podman %API_PREFIX%/[9-0]+/test03",
+		"podman;foo=bar %API_PREFIX%/test04",
+		"podman;listener=invalid %API_PREFIX%/test05",
+		"podman;client-cn= %API_PREFIX%/test06",
+		"podman;client-addr=10.0.0.0/33 %API_PREFIX%/test07",
+		"podman;client-addr=invalid %API_PREFIX%/test08",
+	}
+
+	for _, v := range rawRoutes {
+		builtRoutes, err := BuildRoutes(v)
+		if err == nil || builtRoutes != nil {
+			t.Errorf("builtRoutes = %v, want an error", builtRoutes)
+			continue
+		}
+	}
+}
+
+func TestBuildRoutesFromFilePath(t *testing.T) {
+	rawRoutes := []byte("\n! Comment\npodman /libpod/.+\r\ndocker /.+")
+
+	tmpdir := t.TempDir()
+	path := filepath.Join(tmpdir, "routes.list")
+	if err := os.WriteFile(path, rawRoutes, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	builtRoutes, err := BuildRoutesFromFilePath(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(builtRoutes) != 2 {
+		t.Errorf("len(builtRoutes) = %d, want = %d", len(builtRoutes), 2)
+	}
+}
+
+func TestRouteMatches(t *testing.T) {
+	routes, err := BuildRoutes("podman;listener=tcp://127.0.0.1:2375;client-cn=ci;client-addr=10.0.0.0/8 %API_PREFIX_LIBPOD%/.*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	route := routes[0]
+
+	newReq := func(listener string, cn string, remoteAddr string, path string) *http.Request {
+		req, _ := http.NewRequest("GET", path, nil)
+		req = req.WithContext(context.WithValue(req.Context(), listenerContextKey, listener))
+		req.RemoteAddr = remoteAddr
+		if cn != "" {
+			cert := &x509.Certificate{Subject: pkix.Name{CommonName: cn}}
+			req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+		}
+		return req
+	}
+
+	testCases := map[*http.Request]bool{
+		newReq("tcp://127.0.0.1:2375", "ci", "10.1.2.3:4567", "/v1.41/libpod/info"):     true,
+		newReq("tcp://127.0.0.1:2375", "ci", "10.1.2.3:4567", "/v1.41/info"):            false,
+		newReq("tcp://127.0.0.1:2376", "ci", "10.1.2.3:4567", "/v1.41/libpod/info"):     false,
+		newReq("tcp://127.0.0.1:2375", "dev", "10.1.2.3:4567", "/v1.41/libpod/info"):    false,
+		newReq("tcp://127.0.0.1:2375", "", "10.1.2.3:4567", "/v1.41/libpod/info"):       false,
+		newReq("tcp://127.0.0.1:2375", "ci", "192.168.1.1:4567", "/v1.41/libpod/info"):  false,
+		newReq("tcp://127.0.0.1:2375", "ci", "@", "/v1.41/libpod/info"):                 false,
+		newReq("tcp://127.0.0.1:2375", "ci", "10.1.2.3:4567", "/v1.41/libpod/../info"):  false,
+		newReq("tcp://127.0.0.1:2375", "ci", "10.1.2.3:4567", "/v1.41/info/../libpod/"): true,
+	}
+
+	for req, wanted := range testCases {
+		if result := route.matches(req); result != wanted {
+			t.Errorf("route.matches(%s %s %s) = %t, want %t", listenerAddr(req), req.RemoteAddr, req.URL.Path, result, wanted)
+		}
+	}
+}
+
+func TestBuildBackends(t *testing.T) {
+	backends, err := BuildBackends([]string{
+		"podman=unix:///run/podman/podman.sock",
+		"remote=tcp://10.0.0.1:2376?tls-cacert=/ca.pem&tls-cert=/cert.pem&tls-key=/key.pem",
+		"remote=tcp://10.0.0.2:2376?tls-cacert=/ca.pem&tls-cert=/cert.pem&tls-key=/key.pem",
+		"pinned=tcp://10.0.0.3:2376?tls-server-name=daemon&tls-pin=sha256//AAAA&tls-pin=sha256//BBBB&tls-min-version=1.3&tls-cipher-suites=A,B",
+		"ssh=ssh://docker@10.0.0.4?identity-file=/id_ed25519&tls-server-name=daemon",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantedBackends := map[string]*Backend{
+		"podman": {Addr: "unix:///run/podman/podman.sock"},
+		"remote": {
+			Addr:         "tcp://10.0.0.1:2376",
+			FailoverAddr: []string{"tcp://10.0.0.2:2376"},
+			TlsCacert:    "/ca.pem",
+			TlsCert:      "/cert.pem",
+			TlsKey:       "/key.pem",
+		},
+		"pinned": {
+			Addr:            "tcp://10.0.0.3:2376",
+			TlsServerName:   "daemon",
+			TlsPin:          []string{"sha256//AAAA", "sha256//BBBB"},
+			TlsMinVersion:   "1.3",
+			TlsCipherSuites: []string{"A", "B"},
+		},
+		"ssh": {
+			Addr:          "ssh://docker@10.0.0.4?identity-file=%2Fid_ed25519",
+			TlsServerName: "daemon",
+		},
+	}
+	if !reflect.DeepEqual(backends, wantedBackends) {
+		t.Errorf("backends = %v, want = %v", backends, wantedBackends)
+	}
+}
+
+func TestBuildInvalidBackends(t *testing.T) {
+	defs := [][]string{
+		{"unix:///run/podman/podman.sock"},
+		{"Podman=unix:///run/podman/podman.sock"},
+		{"default=unix:///run/podman/podman.sock"},
+		{"podman=unix:///run/podman/podman.sock?foo=bar"},
+		{"remote=tcp://10.0.0.1:2376?tls-cacert=%zz"},
+		{"remote=tcp://10.0.0.1:2376?tls-cacert=/ca.pem", "remote=tcp://10.0.0.2:2376"},
+		{"remote=tcp://10.0.0.1:2376?tls-pin=sha256//AAAA", "remote=tcp://10.0.0.2:2376?tls-pin=sha256//BBBB"},
+		{"remote=tcp://10.0.0.1:2376?identity-file=/id_ed25519"},
+	}
+
+	for _, v := range defs {
+		backends, err := BuildBackends(v)
+		if err == nil || backends != nil {
+			t.Errorf("backends = %v, want an error", backends)
+			continue
+		}
+	}
+}
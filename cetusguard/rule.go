@@ -3,11 +3,15 @@ package cetusguard
 import (
 	"bufio"
 	"fmt"
+	"net"
+	"net/http"
 	"os"
 	"path/filepath"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/hectorm/cetusguard/internal/logger"
 )
@@ -25,9 +29,10 @@ var RawBuiltinRules = []string{
 }
 
 var (
-	ruleLineRegex    = regexp.MustCompile(`^[\t ]*([A-Z]+(?:,[A-Z]+)*)[\t ]+(.+?)[\t ]*$`)
+	ruleLineRegex    = regexp.MustCompile(`^[\t ]*([A-Z]+(?:,[A-Z]+)*)((?:;[a-z0-9-]+=[^\t ;]*)*)[\t ]+(.+?)[\t ]*$`)
 	commentLineRegex = regexp.MustCompile(`^[\t ]*(?:!.*)?$`)
 	newLineRegex     = regexp.MustCompile(`\r?\n`)
+	ruleSetDefRegex  = regexp.MustCompile(`^([a-z0-9-]+)=(.+)$`)
 	ruleVars         = map[string]string{
 		"DOMAIN":       `(?:[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(?:\.[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*)`,
 		"IPV4":         `(?:[0-9]{1,3}(?:\.[0-9]{1,3}){3})`,
@@ -122,35 +127,38 @@ func BuildRules(str string) ([]Rule, error) {
 		}
 
 		matches := ruleLineRegex.FindStringSubmatch(line)
-		if len(matches) != 3 {
+		if len(matches) != 4 {
 			return nil, fmt.Errorf("invalid rule line: %s", line)
 		}
 		methodsFrag := matches[1]
-		patternFrag := matches[2]
+		optionsFrag := matches[2]
+		patternFrag := matches[3]
 
 		methods := make(map[string]struct{})
 		for _, method := range strings.Split(methodsFrag, ",") {
 			methods[method] = struct{}{}
 		}
 
-		for {
-			p := patternFrag
-			for k, v := range ruleVars {
-				if strings.Contains(p, "%"+k+"%") {
-					p = strings.ReplaceAll(p, "%"+k+"%", v)
+		var options RuleOptions
+		if optionsFrag != "" {
+			for _, option := range strings.Split(optionsFrag[1:], ";") {
+				k, v, _ := strings.Cut(option, "=")
+				parse, ok := ruleOptionParsers[k]
+				if !ok {
+					return nil, fmt.Errorf("unknown rule option: %s", k)
+				}
+				if err := parse(&options, v); err != nil {
+					return nil, fmt.Errorf("invalid rule option: %s: %w", option, err)
 				}
 			}
-			if p == patternFrag {
-				break
-			}
-			patternFrag = p
 		}
-		pattern, err := regexp.Compile("^" + patternFrag + "$")
+
+		pattern, err := buildPattern(patternFrag)
 		if err != nil {
 			return nil, fmt.Errorf("invalid rule pattern: %s", str)
 		}
 
-		rule := Rule{methods, pattern}
+		rule := Rule{methods, pattern, options}
 		rules = append(rules, rule)
 
 		logger.Debugf("loaded rule: %s\n", rule)
@@ -193,9 +201,55 @@ func BuildRulesFromFilePath(path string) ([]Rule, error) {
 	return rules, nil
 }
 
+// Builds named rule sets from definitions in the NAME=PATH format, where PATH is a filter rules file.
+// Definitions with the same name are merged into a single rule set
+func BuildRuleSets(defs []string) (map[string][]Rule, error) {
+	ruleSets := make(map[string][]Rule)
+
+	for _, def := range defs {
+		matches := ruleSetDefRegex.FindStringSubmatch(def)
+		if len(matches) != 3 {
+			return nil, fmt.Errorf("invalid rule set definition: %s", def)
+		}
+
+		rules, err := BuildRulesFromFilePath(matches[2])
+		if err != nil {
+			return nil, fmt.Errorf("rule set %s: %w", matches[1], err)
+		}
+		ruleSets[matches[1]] = append(ruleSets[matches[1]], rules...)
+	}
+
+	return ruleSets, nil
+}
+
+func buildPattern(patternFrag string) (*regexp.Regexp, error) {
+	for {
+		p := patternFrag
+		for k, v := range ruleVars {
+			if strings.Contains(p, "%"+k+"%") {
+				p = strings.ReplaceAll(p, "%"+k+"%", v)
+			}
+		}
+		if p == patternFrag {
+			break
+		}
+		patternFrag = p
+	}
+	return regexp.Compile("^" + patternFrag + "$")
+}
+
+func mustBuildPattern(patternFrag string) *regexp.Regexp {
+	pattern, err := buildPattern(patternFrag)
+	if err != nil {
+		panic(err)
+	}
+	return pattern
+}
+
 type Rule struct {
 	Methods map[string]struct{}
 	Pattern *regexp.Regexp
+	Options RuleOptions
 }
 
 func (rule Rule) String() string {
@@ -205,8 +259,123 @@ func (rule Rule) String() string {
 	}
 	sort.Strings(methods)
 
-	return fmt.Sprintf("%s %s",
+	return fmt.Sprintf("%s%s %s",
 		strings.Join(methods, ","),
+		rule.Options.String(),
 		rule.Pattern.String(),
 	)
 }
+
+type RuleOptions struct {
+	// Maximum duration of hijacked connections and stream responses
+	MaxLifetime time.Duration
+	// Maximum time without data in either direction for hijacked connections and stream responses
+	IdleTimeout time.Duration
+	// Frontend address, as specified in the configuration, that the request must be received on
+	Listener string
+	// Network the client address must belong to
+	ClientAddr *net.IPNet
+	// Requests allowed by the rule for each client
+	RateLimit Rate
+	// Requests a client can make in a burst above the rate limit
+	Burst int
+	// Requests allowed by the rule of each client handled at the same time
+	MaxInFlight int
+}
+
+var ruleOptionParsers = map[string]func(options *RuleOptions, val string) error{
+	"max-lifetime": func(options *RuleOptions, val string) (err error) {
+		options.MaxLifetime, err = parsePositiveDuration(val)
+		return err
+	},
+	"idle-timeout": func(options *RuleOptions, val string) (err error) {
+		options.IdleTimeout, err = parsePositiveDuration(val)
+		return err
+	},
+	"listener": func(options *RuleOptions, val string) error {
+		if _, _, err := parseAddr(val); err != nil {
+			return err
+		}
+		options.Listener = val
+		return nil
+	},
+	"client-addr": func(options *RuleOptions, val string) (err error) {
+		options.ClientAddr, err = parseCidr(val)
+		return err
+	},
+	"rate-limit": func(options *RuleOptions, val string) (err error) {
+		options.RateLimit, err = ParseRate(val)
+		return err
+	},
+	"burst": func(options *RuleOptions, val string) (err error) {
+		options.Burst, err = parsePositiveInt(val)
+		return err
+	},
+	"max-in-flight": func(options *RuleOptions, val string) (err error) {
+		options.MaxInFlight, err = parsePositiveInt(val)
+		return err
+	},
+}
+
+func (options RuleOptions) String() string {
+	var sb strings.Builder
+	if options.MaxLifetime > 0 {
+		fmt.Fprintf(&sb, ";max-lifetime=%s", options.MaxLifetime)
+	}
+	if options.IdleTimeout > 0 {
+		fmt.Fprintf(&sb, ";idle-timeout=%s", options.IdleTimeout)
+	}
+	if options.Listener != "" {
+		fmt.Fprintf(&sb, ";listener=%s", options.Listener)
+	}
+	if options.ClientAddr != nil {
+		fmt.Fprintf(&sb, ";client-addr=%s", options.ClientAddr)
+	}
+	if options.RateLimit.Requests > 0 {
+		fmt.Fprintf(&sb, ";rate-limit=%s", options.RateLimit)
+	}
+	if options.Burst > 0 {
+		fmt.Fprintf(&sb, ";burst=%d", options.Burst)
+	}
+	if options.MaxInFlight > 0 {
+		fmt.Fprintf(&sb, ";max-in-flight=%d", options.MaxInFlight)
+	}
+	return sb.String()
+}
+
+// Reports whether the request meets the conditions of the options, the client address
+// is the one received in the PROXY protocol header on listeners that have it enabled
+func (options RuleOptions) matches(req *http.Request) bool {
+	if options.Listener != "" && options.Listener != listenerAddr(req) {
+		return false
+	}
+	if options.ClientAddr != nil {
+		ip := net.ParseIP(clientKey(req))
+		if ip == nil || !options.ClientAddr.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+func parsePositiveInt(val string) (int, error) {
+	n, err := strconv.Atoi(val)
+	if err != nil {
+		return 0, err
+	}
+	if n <= 0 {
+		return 0, fmt.Errorf("number must be positive: %s", val)
+	}
+	return n, nil
+}
+
+func parsePositiveDuration(val string) (time.Duration, error) {
+	d, err := time.ParseDuration(val)
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("duration must be positive: %s", val)
+	}
+	return d, nil
+}
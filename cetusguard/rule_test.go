@@ -2,12 +2,14 @@ package cetusguard
 
 import (
 	"log"
+	"net"
 	"os"
 	"path/filepath"
 	"reflect"
 	"regexp"
 	"strings"
 	"testing"
+	"time"
 )
 
 func init() {
@@ -45,6 +47,18 @@ func TestRuleString(t *testing.T) {
 	}
 }
 
+func TestRuleWithOptionsString(t *testing.T) {
+	rawRule := "GET;max-lifetime=1h0m0s;idle-timeout=5m0s ^/.+$"
+	rule := Rule{
+		Methods: map[string]struct{}{"GET": {}},
+		Pattern: regexp.MustCompile(`^/.+$`),
+		Options: RuleOptions{MaxLifetime: time.Hour, IdleTimeout: 5 * time.Minute},
+	}
+	if rule.String() != rawRule {
+		t.Errorf("rule = %v, want = %v", rule, rawRule)
+	}
+}
+
 func TestBuildBuiltinRules(t *testing.T) {
 	_, err := BuildRules(strings.Join(RawBuiltinRules, "\n"))
 	if err != nil {
@@ -70,6 +84,21 @@ func TestBuildValidRules(t *testing.T) {
 			Methods: map[string]struct{}{"GET": {}, "HEAD": {}},
 			Pattern: regexp.MustCompile(`^(?:/v[0-9]+(?:\.[0-9]+)*)?/test04$`),
 		},
+		"GET;max-lifetime=1h;idle-timeout=90s %API_PREFIX%/test05": {
+			Methods: map[string]struct{}{"GET": {}},
+			Pattern: regexp.MustCompile(`^(?:/v[0-9]+(?:\.[0-9]+)*)?/test05$`),
+			Options: RuleOptions{MaxLifetime: time.Hour, IdleTimeout: 90 * time.Second},
+		},
+		"GET;listener=tcp://0.0.0.0:2375;client-addr=10.0.0.0/8 %API_PREFIX%/test06": {
+			Methods: map[string]struct{}{"GET": {}},
+			Pattern: regexp.MustCompile(`^(?:/v[0-9]+(?:\.[0-9]+)*)?/test06$`),
+			Options: RuleOptions{Listener: "tcp://0.0.0.0:2375", ClientAddr: &net.IPNet{IP: net.IPv4(10, 0, 0, 0).To4(), Mask: net.CIDRMask(8, 32)}},
+		},
+		"GET;rate-limit=30/m;burst=5;max-in-flight=2 %API_PREFIX%/test07": {
+			Methods: map[string]struct{}{"GET": {}},
+			Pattern: regexp.MustCompile(`^(?:/v[0-9]+(?:\.[0-9]+)*)?/test07$`),
+			Options: RuleOptions{RateLimit: Rate{30, time.Minute}, Burst: 5, MaxInFlight: 2},
+		},
 	}
 
 	for k, v := range rawRules {
@@ -96,6 +125,15 @@ func TestBuildInvalidRules(t *testing.T) {
 		"GET %API_PREFIX%/\x81/test06",
 		"GET\n%API_PREFIX%/test07",
 		"GET\r\n%API_PREFIX%/test08",
+		"GET; %API_PREFIX%/test09",
+		"GET;foo=bar %API_PREFIX%/test10",
+		"GET;max-lifetime=1x %API_PREFIX%/test11",
+		"GET;idle-timeout=-1s %API_PREFIX%/test12",
+		"GET;listener=0.0.0.0:2375 %API_PREFIX%/test13",
+		"GET;client-addr=10.0.0.0/33 %API_PREFIX%/test14",
+		"GET;rate-limit=30 %API_PREFIX%/test15",
+		"GET;burst=0 %API_PREFIX%/test16",
+		"GET;max-in-flight=-1 %API_PREFIX%/test17",
 	}
 
 	for _, v := range rawRules {
@@ -182,6 +220,33 @@ func TestBuildRulesFromNonexistentPath(t *testing.T) {
 	}
 }
 
+func TestBuildRuleSets(t *testing.T) {
+	tmpdir := t.TempDir()
+	path := filepath.Join(tmpdir, "rules.list")
+	if err := os.WriteFile(path, []byte("GET /.+\nHEAD /.+"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ruleSets, err := BuildRuleSets([]string{"readonly=" + path, "readonly=" + path, "other=" + path})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ruleSets) != 2 {
+		t.Errorf("len(ruleSets) = %d, want = %d", len(ruleSets), 2)
+	}
+	if len(ruleSets["readonly"]) != 4 {
+		t.Errorf("len(ruleSets[readonly]) = %d, want = %d", len(ruleSets["readonly"]), 4)
+	}
+
+	for _, def := range []string{"readonly", "=" + path, "Read-Only=" + path, "readonly=" + filepath.Join(tmpdir, "missing.list")} {
+		ruleSets, err := BuildRuleSets([]string{def})
+		if err == nil || ruleSets != nil {
+			t.Errorf("%s: ruleSets = %v, want an error", def, ruleSets)
+		}
+	}
+}
+
 func TestDomainRegex(t *testing.T) {
 	re := regexp.MustCompile("^" + ruleVars["DOMAIN"] + "$")
 
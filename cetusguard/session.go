@@ -0,0 +1,281 @@
+package cetusguard
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hectorm/cetusguard/internal/logger"
+)
+
+const (
+	defaultShutdownGracePeriod = 10 * time.Second
+	sessionCloseTimeout        = 2 * time.Second
+)
+
+// Terminates a hijacked connection or stream response when it exceeds its maximum lifetime
+// or when no data is transferred in either direction for longer than the idle timeout
+type sessionMonitor struct {
+	maxLifetime  time.Duration
+	idleTimeout  time.Duration
+	start        time.Time
+	lastActivity atomic.Int64
+	terminate    func()
+	reason       string
+	stopCh       chan struct{}
+	stopOnce     sync.Once
+	mu           sync.Mutex
+}
+
+func newSessionMonitor(maxLifetime time.Duration, idleTimeout time.Duration, terminate func()) *sessionMonitor {
+	sm := &sessionMonitor{
+		maxLifetime: maxLifetime,
+		idleTimeout: idleTimeout,
+		start:       time.Now(),
+		terminate:   terminate,
+		stopCh:      make(chan struct{}),
+	}
+	sm.lastActivity.Store(sm.start.UnixNano())
+
+	go sm.run()
+
+	return sm
+}
+
+func (sm *sessionMonitor) run() {
+	timer := time.NewTimer(sm.nextDeadline())
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-sm.stopCh:
+			return
+		case now := <-timer.C:
+			if sm.maxLifetime > 0 && now.Sub(sm.start) >= sm.maxLifetime {
+				sm.terminateWithReason("maximum lifetime of " + sm.maxLifetime.String() + " exceeded")
+				return
+			}
+			if sm.idleTimeout > 0 && now.Sub(time.Unix(0, sm.lastActivity.Load())) >= sm.idleTimeout {
+				sm.terminateWithReason("idle for more than " + sm.idleTimeout.String())
+				return
+			}
+			timer.Reset(sm.nextDeadline())
+		}
+	}
+}
+
+// Returns the time remaining until the earliest limit could be exceeded
+func (sm *sessionMonitor) nextDeadline() time.Duration {
+	now := time.Now()
+	next := time.Duration(-1)
+	if sm.maxLifetime > 0 {
+		next = sm.start.Add(sm.maxLifetime).Sub(now)
+	}
+	if sm.idleTimeout > 0 {
+		idle := time.Unix(0, sm.lastActivity.Load()).Add(sm.idleTimeout).Sub(now)
+		if next < 0 || idle < next {
+			next = idle
+		}
+	}
+	return max(next, 0)
+}
+
+func (sm *sessionMonitor) terminateWithReason(reason string) {
+	sm.mu.Lock()
+	sm.reason = reason
+	sm.mu.Unlock()
+
+	sm.terminate()
+}
+
+func (sm *sessionMonitor) touch() {
+	sm.lastActivity.Store(time.Now().UnixNano())
+}
+
+// Wraps a reader so that every successful read counts as activity
+func (sm *sessionMonitor) reader(r io.Reader) io.Reader {
+	return &activityReader{r: r, sm: sm}
+}
+
+// Stops the monitor and returns the reason why the session was terminated,
+// or an empty string if it was not terminated by the monitor
+func (sm *sessionMonitor) stop() string {
+	sm.stopOnce.Do(func() { close(sm.stopCh) })
+
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	return sm.reason
+}
+
+type activityReader struct {
+	r  io.Reader
+	sm *sessionMonitor
+}
+
+func (ar *activityReader) Read(p []byte) (int, error) {
+	n, err := ar.r.Read(p)
+	if n > 0 {
+		ar.sm.touch()
+	}
+	return n, err
+}
+
+// Returns the smallest non-zero duration
+func minTimeout(durations ...time.Duration) time.Duration {
+	var m time.Duration
+	for _, d := range durations {
+		if d > 0 && (m == 0 || d < m) {
+			m = d
+		}
+	}
+	return m
+}
+
+// Hijacked connections and stream responses are tracked separately
+// because they are not considered by http.Server.Shutdown or outlive it
+type sessionRegistry struct {
+	sessions map[*trackedSession]struct{}
+	hijacked int
+	draining bool
+	wg       sync.WaitGroup
+	mu       sync.Mutex
+}
+
+type trackedSession struct {
+	// Notifies the peers that the session is ending without discarding in-flight data
+	closeWrite func()
+	close      func()
+	stopping   atomic.Bool
+}
+
+// Returns false if the registry is draining and no new sessions are accepted
+func (sr *sessionRegistry) add(ts *trackedSession) bool {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+
+	if sr.draining {
+		return false
+	}
+	if sr.sessions == nil {
+		sr.sessions = make(map[*trackedSession]struct{})
+	}
+	sr.sessions[ts] = struct{}{}
+	sr.wg.Add(1)
+
+	return true
+}
+
+func (sr *sessionRegistry) remove(ts *trackedSession) {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+
+	if _, ok := sr.sessions[ts]; ok {
+		delete(sr.sessions, ts)
+		sr.wg.Done()
+	}
+}
+
+// Reserves one of the hijacked connections allowed at the same time, a limit of 0 means unlimited.
+// Reservations are made before the request is forwarded, so that the daemon does not start a session
+// that would be rejected afterwards
+func (sr *sessionRegistry) reserveHijacked(limit int) bool {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+
+	if limit > 0 && sr.hijacked >= limit {
+		return false
+	}
+	sr.hijacked++
+	return true
+}
+
+func (sr *sessionRegistry) releaseHijacked() {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+
+	sr.hijacked--
+}
+
+func (sr *sessionRegistry) snapshot() []*trackedSession {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+
+	sessions := make([]*trackedSession, 0, len(sr.sessions))
+	for ts := range sr.sessions {
+		sessions = append(sessions, ts)
+	}
+	return sessions
+}
+
+// Stops accepting new sessions and waits for the existing ones to finish until the context is done,
+// then the remaining sessions are half-closed and, if they still do not finish, forcibly closed.
+// When the context has a deadline, the half-close and close phases are reserved at its end so that
+// the whole drain fits in it. Returns the number of forcibly closed sessions
+func (sr *sessionRegistry) drain(ctx context.Context) int {
+	sr.mu.Lock()
+	sr.draining = true
+	n := len(sr.sessions)
+	sr.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		sr.wg.Wait()
+		close(done)
+	}()
+
+	if n > 0 {
+		logger.Infof("waiting for %d sessions to finish\n", n)
+	}
+
+	closePhase := sessionCloseTimeout
+	waitCtx := ctx
+	if deadline, ok := ctx.Deadline(); ok {
+		closePhase = min(closePhase, time.Until(deadline)/3)
+		var cancel context.CancelFunc
+		waitCtx, cancel = context.WithDeadline(ctx, deadline.Add(-2*closePhase))
+		defer cancel()
+	}
+
+	select {
+	case <-done:
+		return 0
+	case <-waitCtx.Done():
+	}
+
+	for _, ts := range sr.snapshot() {
+		ts.stopping.Store(true)
+		if ts.closeWrite != nil {
+			ts.closeWrite()
+		}
+	}
+
+	select {
+	case <-done:
+		return 0
+	case <-time.After(closePhase):
+	}
+
+	remaining := sr.snapshot()
+	for _, ts := range remaining {
+		ts.close()
+	}
+
+	select {
+	case <-done:
+	case <-time.After(closePhase):
+	}
+
+	return len(remaining)
+}
+
+// Shuts down the writing side of a connection if supported
+func closeWrite(conn any) error {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
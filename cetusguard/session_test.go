@@ -0,0 +1,135 @@
+package cetusguard
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSessionMonitorIdleTimeout(t *testing.T) {
+	terminated := make(chan any)
+	sm := newSessionMonitor(0, 100*time.Millisecond, func() { close(terminated) })
+
+	// Activity must postpone the termination
+	deadline := time.Now().Add(300 * time.Millisecond)
+	for time.Now().Before(deadline) {
+		sm.touch()
+		select {
+		case <-terminated:
+			t.Fatalf("session terminated, want active")
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+
+	select {
+	case <-terminated:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("session active, want terminated")
+	}
+
+	if reason := sm.stop(); !strings.HasPrefix(reason, "idle") {
+		t.Errorf(`reason = "%s", want an idle reason`, reason)
+	}
+}
+
+func TestSessionMonitorMaxLifetime(t *testing.T) {
+	terminated := make(chan any)
+	sm := newSessionMonitor(100*time.Millisecond, time.Hour, func() { close(terminated) })
+
+	select {
+	case <-terminated:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("session active, want terminated")
+	}
+
+	if reason := sm.stop(); !strings.HasPrefix(reason, "maximum lifetime") {
+		t.Errorf(`reason = "%s", want a maximum lifetime reason`, reason)
+	}
+}
+
+func TestSessionMonitorStop(t *testing.T) {
+	sm := newSessionMonitor(50*time.Millisecond, 0, func() { t.Errorf("session terminated, want stopped") })
+
+	if reason := sm.stop(); reason != "" {
+		t.Errorf(`reason = "%s", want ""`, reason)
+	}
+	if reason := sm.stop(); reason != "" {
+		t.Errorf(`reason = "%s", want ""`, reason)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+}
+
+func TestMinTimeout(t *testing.T) {
+	testCases := map[time.Duration][]time.Duration{
+		0:                {},
+		time.Second:      {0, time.Second},
+		time.Millisecond: {time.Minute, 0, time.Millisecond},
+	}
+
+	for wanted, input := range testCases {
+		if result := minTimeout(input...); result != wanted {
+			t.Errorf("minTimeout(%v) = %s, want = %s", input, result, wanted)
+		}
+	}
+}
+
+func TestSessionRegistryDrain(t *testing.T) {
+	sr := &sessionRegistry{}
+
+	finished := &trackedSession{close: func() { t.Errorf("session closed, want finished") }}
+	if !sr.add(finished) {
+		t.Fatalf("session rejected, want accepted")
+	}
+
+	// This session finishes when it is half-closed
+	halfClosed := &trackedSession{close: func() { t.Errorf("session closed, want half-closed") }}
+	halfClosed.closeWrite = func() { go sr.remove(halfClosed) }
+	if !sr.add(halfClosed) {
+		t.Fatalf("session rejected, want accepted")
+	}
+
+	// This session ignores the half-close and must be forcibly closed
+	stuck := &trackedSession{}
+	stuck.closeWrite = func() {}
+	stuck.close = func() { go sr.remove(stuck) }
+	if !sr.add(stuck) {
+		t.Fatalf("session rejected, want accepted")
+	}
+
+	sr.remove(finished)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if forced := sr.drain(ctx); forced != 1 {
+		t.Errorf("forced = %d, want %d", forced, 1)
+	}
+
+	if sr.add(&trackedSession{}) {
+		t.Errorf("session accepted, want rejected")
+	}
+}
+
+func TestSessionRegistryDrainDeadline(t *testing.T) {
+	sr := &sessionRegistry{}
+
+	// This session ignores both the half-close and the close
+	stuck := &trackedSession{closeWrite: func() {}, close: func() {}}
+	if !sr.add(stuck) {
+		t.Fatalf("session rejected, want accepted")
+	}
+
+	gracePeriod := 300 * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), gracePeriod)
+	defer cancel()
+
+	start := time.Now()
+	if forced := sr.drain(ctx); forced != 1 {
+		t.Errorf("forced = %d, want %d", forced, 1)
+	}
+	if elapsed := time.Since(start); elapsed > gracePeriod+100*time.Millisecond {
+		t.Errorf("drain took %s, want at most the grace period of %s", elapsed, gracePeriod)
+	}
+}
@@ -0,0 +1,369 @@
+package cetusguard
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"github.com/hectorm/cetusguard/internal/logger"
+)
+
+const (
+	defaultSshPort       = "22"
+	defaultSshSocketPath = "/var/run/docker.sock"
+	sshDialTimeout       = 30 * time.Second
+	sshKeepAliveInterval = 30 * time.Second
+)
+
+// Query parameters accepted in SSH addresses
+var sshOptions = []string{"identity-file", "known-hosts"}
+
+// Key files tried when no identity file is specified, in the same order as OpenSSH
+var defaultSshIdentityFiles = []string{"id_ed25519", "id_ecdsa", "id_rsa"}
+
+// Dials the daemon socket on a remote host through a single SSH connection that is shared by all
+// the backend connections and re-established when it is lost.
+//
+// The address has the ssh://[USER@]HOST[:PORT][/SOCKET_PATH] format, and the "identity-file" and "known-hosts"
+// query parameters can be used to override the default ~/.ssh/id_* and ~/.ssh/known_hosts files
+type sshDialer struct {
+	host       string
+	socketPath string
+	signers    []ssh.Signer
+	config     *ssh.ClientConfig
+	client     *ssh.Client
+	connecting *sshConnectAttempt
+	closed     bool
+	mu         sync.Mutex
+}
+
+// Connection to the SSH server in progress, done is closed once client or err is set
+type sshConnectAttempt struct {
+	done   chan struct{}
+	client *ssh.Client
+	err    error
+}
+
+func newSshDialer(addr string) (*sshDialer, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "ssh" || u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid address format: %s", addr)
+	}
+
+	query := u.Query()
+	for k := range query {
+		if !slices.Contains(sshOptions, k) {
+			return nil, fmt.Errorf("unknown backend option: %s", k)
+		}
+	}
+
+	port := u.Port()
+	if port == "" {
+		port = defaultSshPort
+	}
+	host := net.JoinHostPort(u.Hostname(), port)
+
+	socketPath := u.Path
+	if socketPath == "" || socketPath == "/" {
+		socketPath = defaultSshSocketPath
+	}
+
+	username := u.User.Username()
+	if username == "" {
+		username = os.Getenv("USER")
+	}
+	if username == "" {
+		return nil, fmt.Errorf("no SSH user specified: %s", addr)
+	}
+
+	home, _ := os.UserHomeDir()
+
+	knownHostsFiles := query["known-hosts"]
+	if len(knownHostsFiles) == 0 {
+		if home == "" {
+			return nil, errors.New("no known_hosts file found")
+		}
+		knownHostsFiles = []string{filepath.Join(home, ".ssh", "known_hosts")}
+	}
+	hostKeyCallback, err := knownhosts.New(knownHostsFiles...)
+	if err != nil {
+		return nil, err
+	}
+
+	identityFiles := query["identity-file"]
+	if len(identityFiles) == 0 && home != "" {
+		for _, name := range defaultSshIdentityFiles {
+			path := filepath.Join(home, ".ssh", name)
+			if _, err := os.Stat(path); err == nil {
+				identityFiles = append(identityFiles, path)
+			}
+		}
+	}
+	var signers []ssh.Signer
+	for _, path := range identityFiles {
+		key, err := os.ReadFile(filepath.Clean(path))
+		if err != nil {
+			return nil, err
+		}
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("error loading SSH key %s: %w", path, err)
+		}
+		signers = append(signers, signer)
+	}
+
+	sd := &sshDialer{
+		host:       host,
+		socketPath: socketPath,
+		signers:    signers,
+	}
+
+	sd.config = &ssh.ClientConfig{
+		User:              username,
+		HostKeyCallback:   hostKeyCallback,
+		HostKeyAlgorithms: knownHostKeyAlgorithms(hostKeyCallback, host),
+		Timeout:           sshDialTimeout,
+	}
+
+	return sd, nil
+}
+
+func (sd *sshDialer) DialContext(ctx context.Context) (net.Conn, error) {
+	client, err := sd.sshClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := client.DialContext(ctx, "unix", sd.socketPath)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		// The connection may have been lost without being noticed yet, so it is re-established once
+		sd.resetClient(client)
+		client, err = sd.sshClient(ctx)
+		if err != nil {
+			return nil, err
+		}
+		conn, err = client.DialContext(ctx, "unix", sd.socketPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return conn, nil
+}
+
+// Returns the shared SSH client, establishing it if there is none. The connection is established outside the lock,
+// and concurrent callers wait for the one that is already in progress instead of starting their own
+func (sd *sshDialer) sshClient(ctx context.Context) (*ssh.Client, error) {
+	sd.mu.Lock()
+	if sd.closed {
+		sd.mu.Unlock()
+		return nil, errors.New("SSH dialer closed")
+	}
+	if sd.client != nil {
+		client := sd.client
+		sd.mu.Unlock()
+		return client, nil
+	}
+	attempt := sd.connecting
+	if attempt == nil {
+		attempt = &sshConnectAttempt{done: make(chan struct{})}
+		sd.connecting = attempt
+		// The connection is shared, so it is not bound to the cancellation of the request that started it
+		go sd.connect(context.WithoutCancel(ctx), attempt)
+	}
+	sd.mu.Unlock()
+
+	select {
+	case <-attempt.done:
+		return attempt.client, attempt.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Establishes the SSH connection of an attempt and makes it the shared client, unless the dialer was closed meanwhile
+func (sd *sshDialer) connect(ctx context.Context, attempt *sshConnectAttempt) {
+	defer close(attempt.done)
+
+	client, err := sd.dial(ctx)
+
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	sd.connecting = nil
+	if err != nil {
+		attempt.err = err
+		return
+	}
+	if sd.closed {
+		_ = client.Close()
+		attempt.err = errors.New("SSH dialer closed")
+		return
+	}
+	sd.client = client
+	attempt.client = client
+	logger.Debugf("established SSH connection to %s\n", sd.host)
+
+	done := make(chan struct{})
+	go sd.keepAlive(client, done)
+	go func() {
+		_ = client.Wait()
+		close(done)
+		sd.resetClient(client)
+		logger.Debugf("closed SSH connection to %s\n", sd.host)
+	}()
+}
+
+func (sd *sshDialer) dial(ctx context.Context) (*ssh.Client, error) {
+	// The agent is queried on every connection because its keys may change
+	signers := sd.signers
+	agentSigners, agentConn := sshAgentSigners()
+	if agentConn != nil {
+		defer func() {
+			_ = agentConn.Close()
+		}()
+		signers = append(agentSigners, signers...)
+	}
+	if len(signers) == 0 {
+		return nil, errors.New("no SSH keys available")
+	}
+
+	config := *sd.config
+	config.Auth = []ssh.AuthMethod{ssh.PublicKeys(signers...)}
+
+	dialer := &net.Dialer{Timeout: sshDialTimeout, KeepAlive: 90 * time.Second}
+	conn, err := dialer.DialContext(ctx, "tcp", sd.host)
+	if err != nil {
+		return nil, err
+	}
+
+	// The handshake is bounded by the dial timeout in case the server never answers
+	_ = conn.SetDeadline(time.Now().Add(sshDialTimeout))
+	c, chans, reqs, err := ssh.NewClientConn(conn, sd.host, &config)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// Detects dead connections that would otherwise only be noticed when the next request fails,
+// until the connection is closed
+func (sd *sshDialer) keepAlive(client *ssh.Client, done <-chan struct{}) {
+	ticker := time.NewTicker(sshKeepAliveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		if _, _, err := client.SendRequest("keepalive@openssh.com", true, nil); err != nil {
+			_ = client.Close()
+			return
+		}
+	}
+}
+
+func (sd *sshDialer) resetClient(client *ssh.Client) {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	if sd.client == client {
+		sd.client = nil
+		_ = client.Close()
+	}
+}
+
+// Closes the shared connection, connections established afterwards are closed right away
+func (sd *sshDialer) Close() error {
+	sd.mu.Lock()
+	sd.closed = true
+	client := sd.client
+	sd.mu.Unlock()
+
+	if client != nil {
+		sd.resetClient(client)
+	}
+	return nil
+}
+
+// Returns the keys of the agent listening on SSH_AUTH_SOCK, if any,
+// the connection must remain open until the keys are no longer used
+func sshAgentSigners() ([]ssh.Signer, io.Closer) {
+	socket := os.Getenv("SSH_AUTH_SOCK")
+	if socket == "" {
+		return nil, nil
+	}
+
+	conn, err := net.DialTimeout("unix", socket, sshDialTimeout)
+	if err != nil {
+		logger.Warningf("error connecting to SSH agent: %v\n", err)
+		return nil, nil
+	}
+
+	signers, err := agent.NewClient(conn).Signers()
+	if err != nil {
+		logger.Warningf("error listing SSH agent keys: %v\n", err)
+		_ = conn.Close()
+		return nil, nil
+	}
+
+	return signers, conn
+}
+
+// Returns the host key algorithms of the keys known for the host, so that the server does not present
+// a key of another type that would be rejected, or nil to use the default algorithms if the host is unknown
+func knownHostKeyAlgorithms(hostKeyCallback ssh.HostKeyCallback, host string) []string {
+	placeholder, err := ssh.NewPublicKey(ed25519.PublicKey(make([]byte, ed25519.PublicKeySize)))
+	if err != nil {
+		return nil
+	}
+
+	var keyErr *knownhosts.KeyError
+	if err := hostKeyCallback(host, &net.TCPAddr{IP: net.IPv4zero}, placeholder); !errors.As(err, &keyErr) {
+		return nil
+	}
+
+	var algorithms []string
+	seen := make(map[string]bool)
+	for _, known := range keyErr.Want {
+		keyAlgorithms := []string{known.Key.Type()}
+		if known.Key.Type() == ssh.KeyAlgoRSA {
+			keyAlgorithms = []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}
+		}
+		for _, algorithm := range keyAlgorithms {
+			if !seen[algorithm] {
+				seen[algorithm] = true
+				algorithms = append(algorithms, algorithm)
+			}
+		}
+	}
+	return algorithms
+}
+
+func isSshAddr(addr string) bool {
+	return strings.HasPrefix(addr, "ssh://")
+}
@@ -0,0 +1,437 @@
+package cetusguard
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// In-process SSH server that forwards the connections to its socket path to the target address
+type testSshServer struct {
+	listener       net.Listener
+	socketPath     string
+	clientKey      ed25519.PrivateKey
+	clientKeyPath  string
+	knownHostsPath string
+	connections    atomic.Int32
+}
+
+func newTestSshServer(tb testing.TB, target net.Addr) *testSshServer {
+	tb.Helper()
+	tmpdir := tb.TempDir()
+
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	hostSigner, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	clientPub, clientKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	clientSshPub, err := ssh.NewPublicKey(clientPub)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() {
+		_ = listener.Close()
+	})
+
+	ts := &testSshServer{
+		listener:       listener,
+		socketPath:     "/var/run/docker.sock",
+		clientKey:      clientKey,
+		clientKeyPath:  filepath.Join(tmpdir, "id_ed25519"),
+		knownHostsPath: filepath.Join(tmpdir, "known_hosts"),
+	}
+
+	block, err := ssh.MarshalPrivateKey(clientKey, "")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if err := os.WriteFile(ts.clientKeyPath, pem.EncodeToMemory(block), 0600); err != nil {
+		tb.Fatal(err)
+	}
+
+	knownHostsLine := knownhosts.Line([]string{knownhosts.Normalize(listener.Addr().String())}, hostSigner.PublicKey())
+	if err := os.WriteFile(ts.knownHostsPath, []byte(knownHostsLine+"\n"), 0600); err != nil {
+		tb.Fatal(err)
+	}
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if string(key.Marshal()) != string(clientSshPub.Marshal()) {
+				return nil, errors.New("unknown public key")
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(hostSigner)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go ts.serve(conn, config, target)
+		}
+	}()
+
+	return ts
+}
+
+func (ts *testSshServer) serve(conn net.Conn, config *ssh.ServerConfig, target net.Addr) {
+	sconn, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+	defer func() {
+		_ = sconn.Close()
+	}()
+	ts.connections.Add(1)
+
+	go ssh.DiscardRequests(reqs)
+
+	for newChan := range chans {
+		var msg struct {
+			SocketPath string
+			Reserved0  string
+			Reserved1  uint32
+		}
+		if newChan.ChannelType() != "direct-streamlocal@openssh.com" {
+			_ = newChan.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		if err := ssh.Unmarshal(newChan.ExtraData(), &msg); err != nil || msg.SocketPath != ts.socketPath {
+			_ = newChan.Reject(ssh.ConnectionFailed, "unknown socket path")
+			continue
+		}
+
+		up, err := net.Dial(target.Network(), target.String())
+		if err != nil {
+			_ = newChan.Reject(ssh.ConnectionFailed, err.Error())
+			continue
+		}
+		ch, chReqs, err := newChan.Accept()
+		if err != nil {
+			_ = up.Close()
+			continue
+		}
+		go ssh.DiscardRequests(chReqs)
+
+		go func() {
+			_, _ = io.Copy(up, ch)
+			_ = closeWrite(up)
+		}()
+		go func() {
+			_, _ = io.Copy(ch, up)
+			_ = ch.CloseWrite()
+			_ = ch.Close()
+			_ = up.Close()
+		}()
+	}
+}
+
+func (ts *testSshServer) addr(query string) string {
+	return fmt.Sprintf("ssh://cetusguard@%s%s?%s", ts.listener.Addr(), ts.socketPath, query)
+}
+
+func newTestSshTarget(tb testing.TB) net.Addr {
+	tb.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() {
+		_ = listener.Close()
+	})
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(conn, conn)
+				_ = conn.Close()
+			}()
+		}
+	}()
+
+	return listener.Addr()
+}
+
+func testSshEcho(t *testing.T, sd *sshDialer) {
+	t.Helper()
+
+	conn, err := sd.DialContext(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	if _, err := conn.Write([]byte("PING")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "PING" {
+		t.Errorf(`buf = "%s", want "%s"`, buf, "PING")
+	}
+}
+
+func TestSshDialerReuse(t *testing.T) {
+	ts := newTestSshServer(t, newTestSshTarget(t))
+	t.Setenv("SSH_AUTH_SOCK", "")
+
+	sd, err := newSshDialer(ts.addr("identity-file=" + ts.clientKeyPath + "&known-hosts=" + ts.knownHostsPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = sd.Close()
+	}()
+
+	testSshEcho(t, sd)
+	testSshEcho(t, sd)
+	if n := ts.connections.Load(); n != 1 {
+		t.Errorf("connections = %d, want %d", n, 1)
+	}
+
+	// A lost connection must be re-established
+	sd.mu.Lock()
+	_ = sd.client.Close()
+	sd.mu.Unlock()
+
+	testSshEcho(t, sd)
+	if n := ts.connections.Load(); n != 2 {
+		t.Errorf("connections = %d, want %d", n, 2)
+	}
+}
+
+func TestSshDialerConcurrentDials(t *testing.T) {
+	ts := newTestSshServer(t, newTestSshTarget(t))
+	t.Setenv("SSH_AUTH_SOCK", "")
+
+	sd, err := newSshDialer(ts.addr("identity-file=" + ts.clientKeyPath + "&known-hosts=" + ts.knownHostsPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = sd.Close()
+	}()
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := sd.DialContext(context.Background())
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			_ = conn.Close()
+		}()
+	}
+	wg.Wait()
+
+	// Concurrent dials share the connection established by the first one
+	if n := ts.connections.Load(); n != 1 {
+		t.Errorf("connections = %d, want %d", n, 1)
+	}
+}
+
+func TestSshDialerSlowHandshake(t *testing.T) {
+	ts := newTestSshServer(t, newTestSshTarget(t))
+	t.Setenv("SSH_AUTH_SOCK", "")
+
+	// A server that accepts connections but never answers the handshake
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = listener.Close()
+	}()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer func() {
+				_ = conn.Close()
+			}()
+		}
+	}()
+
+	sd, err := newSshDialer(fmt.Sprintf("ssh://cetusguard@%s?identity-file=%s&known-hosts=%s", listener.Addr(), ts.clientKeyPath, ts.knownHostsPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := sd.DialContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("err = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("elapsed = %s, want the dial to return when its context is done", elapsed)
+	}
+
+	// The lock is not held while the handshake is in progress
+	closed := make(chan any)
+	go func() {
+		_ = sd.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Error("close blocked by the handshake in progress")
+	}
+}
+
+func TestSshDialerAgentAuth(t *testing.T) {
+	ts := newTestSshServer(t, newTestSshTarget(t))
+
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: ts.clientKey}); err != nil {
+		t.Fatal(err)
+	}
+
+	agentSocket := filepath.Join(t.TempDir(), "agent.sock")
+	agentListener, err := net.Listen("unix", agentSocket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = agentListener.Close()
+	}()
+	go func() {
+		for {
+			conn, err := agentListener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_ = agent.ServeAgent(keyring, conn)
+				_ = conn.Close()
+			}()
+		}
+	}()
+
+	// No key files are found in the home directory, so only the agent can be used
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("SSH_AUTH_SOCK", agentSocket)
+
+	sd, err := newSshDialer(ts.addr("known-hosts=" + ts.knownHostsPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = sd.Close()
+	}()
+
+	testSshEcho(t, sd)
+}
+
+func TestSshDialerUnknownHostKey(t *testing.T) {
+	ts := newTestSshServer(t, newTestSshTarget(t))
+	t.Setenv("SSH_AUTH_SOCK", "")
+
+	otherPub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherSshPub, err := ssh.NewPublicKey(otherPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	knownHostsLine := knownhosts.Line([]string{knownhosts.Normalize(ts.listener.Addr().String())}, otherSshPub)
+	if err := os.WriteFile(ts.knownHostsPath, []byte(knownHostsLine+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	sd, err := newSshDialer(ts.addr("identity-file=" + ts.clientKeyPath + "&known-hosts=" + ts.knownHostsPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var keyErr *knownhosts.KeyError
+	if _, err := sd.DialContext(context.Background()); !errors.As(err, &keyErr) {
+		t.Errorf("err = %v, want a host key error", err)
+	}
+	if n := ts.connections.Load(); n != 0 {
+		t.Errorf("connections = %d, want %d", n, 0)
+	}
+}
+
+func TestNewSshDialerInvalid(t *testing.T) {
+	ts := newTestSshServer(t, newTestSshTarget(t))
+
+	addrs := []string{
+		"ssh://",
+		"ssh://cetusguard@127.0.0.1?foo=bar",
+		"ssh://cetusguard@127.0.0.1?known-hosts=" + filepath.Join(t.TempDir(), "nonexistent"),
+		"ssh://cetusguard@127.0.0.1?known-hosts=" + ts.knownHostsPath + "&identity-file=" + ts.knownHostsPath,
+	}
+
+	for _, addr := range addrs {
+		if _, err := newSshDialer(addr); err == nil {
+			t.Errorf("%s: dialer created, want an error", addr)
+		}
+	}
+}
+
+func TestKnownHostKeyAlgorithms(t *testing.T) {
+	ts := newTestSshServer(t, newTestSshTarget(t))
+
+	hostKeyCallback, err := knownhosts.New(ts.knownHostsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wanted := []string{ssh.KeyAlgoED25519}
+	if algorithms := knownHostKeyAlgorithms(hostKeyCallback, ts.listener.Addr().String()); !reflect.DeepEqual(algorithms, wanted) {
+		t.Errorf("algorithms = %v, want %v", algorithms, wanted)
+	}
+	if algorithms := knownHostKeyAlgorithms(hostKeyCallback, "unknown:22"); algorithms != nil {
+		t.Errorf("algorithms = %v, want nil", algorithms)
+	}
+}
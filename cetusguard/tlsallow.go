@@ -0,0 +1,220 @@
+package cetusguard
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/hectorm/cetusguard/internal/logger"
+)
+
+var (
+	tlsAllowLineRegex = regexp.MustCompile(`^[\t ]*([a-z0-9-]+=[^\t ;]*(?:;[a-z0-9-]+=[^\t ;]*)*)[\t ]*$`)
+)
+
+// Extended key usages that can be required by an allow rule
+var extKeyUsageNames = map[string]x509.ExtKeyUsage{
+	"any":              x509.ExtKeyUsageAny,
+	"server-auth":      x509.ExtKeyUsageServerAuth,
+	"client-auth":      x509.ExtKeyUsageClientAuth,
+	"code-signing":     x509.ExtKeyUsageCodeSigning,
+	"email-protection": x509.ExtKeyUsageEmailProtection,
+	"time-stamping":    x509.ExtKeyUsageTimeStamping,
+	"ocsp-signing":     x509.ExtKeyUsageOCSPSigning,
+}
+
+// Verified client certificates that may connect, a certificate is allowed if it meets all the conditions of any
+// of the rules that apply to the listener. Names are matched with shell patterns as in path.Match
+type TlsAllowRule struct {
+	// Frontend address, as specified in the configuration, the rule applies to, all of them if empty
+	Listener string
+	// Pattern for the common name of the subject
+	Cn string
+	// Pattern for one of the organizational units of the subject
+	Ou string
+	// Pattern for one of the DNS names of the certificate
+	SanDns string
+	// Network one of the IP addresses of the certificate belongs to
+	SanIp *net.IPNet
+	// Pattern for one of the URIs of the certificate
+	SanUri string
+	// Extended key usage the certificate must have
+	Eku string
+}
+
+func (rule TlsAllowRule) String() string {
+	var opts []string
+	if rule.Listener != "" {
+		opts = append(opts, "listener="+rule.Listener)
+	}
+	if rule.Cn != "" {
+		opts = append(opts, "cn="+rule.Cn)
+	}
+	if rule.Ou != "" {
+		opts = append(opts, "ou="+rule.Ou)
+	}
+	if rule.SanDns != "" {
+		opts = append(opts, "san-dns="+rule.SanDns)
+	}
+	if rule.SanIp != nil {
+		opts = append(opts, "san-ip="+rule.SanIp.String())
+	}
+	if rule.SanUri != "" {
+		opts = append(opts, "san-uri="+rule.SanUri)
+	}
+	if rule.Eku != "" {
+		opts = append(opts, "eku="+rule.Eku)
+	}
+	return strings.Join(opts, ";")
+}
+
+func parsePattern(val string) (string, error) {
+	if val == "" {
+		return "", errors.New("empty pattern")
+	}
+	if _, err := path.Match(val, ""); err != nil {
+		return "", err
+	}
+	return val, nil
+}
+
+var tlsAllowOptionParsers = map[string]func(rule *TlsAllowRule, val string) error{
+	"listener": func(rule *TlsAllowRule, val string) error {
+		if _, _, err := parseAddr(val); err != nil {
+			return err
+		}
+		rule.Listener = val
+		return nil
+	},
+	"cn": func(rule *TlsAllowRule, val string) (err error) {
+		rule.Cn, err = parsePattern(val)
+		return err
+	},
+	"ou": func(rule *TlsAllowRule, val string) (err error) {
+		rule.Ou, err = parsePattern(val)
+		return err
+	},
+	"san-dns": func(rule *TlsAllowRule, val string) (err error) {
+		rule.SanDns, err = parsePattern(val)
+		return err
+	},
+	"san-ip": func(rule *TlsAllowRule, val string) (err error) {
+		rule.SanIp, err = parseCidr(val)
+		return err
+	},
+	"san-uri": func(rule *TlsAllowRule, val string) (err error) {
+		rule.SanUri, err = parsePattern(val)
+		return err
+	},
+	"eku": func(rule *TlsAllowRule, val string) error {
+		if _, ok := extKeyUsageNames[val]; !ok {
+			return fmt.Errorf("unknown extended key usage: %s", val)
+		}
+		rule.Eku = val
+		return nil
+	},
+}
+
+// Builds allow rules from lines with conditions in the KEY=VALUE format separated by semicolons
+func BuildTlsAllowRules(str string) ([]TlsAllowRule, error) {
+	var rules []TlsAllowRule
+
+	lines := newLineRegex.Split(str, -1)
+	for _, line := range lines {
+		if commentLineRegex.MatchString(line) {
+			continue
+		}
+
+		matches := tlsAllowLineRegex.FindStringSubmatch(line)
+		if len(matches) != 2 {
+			return nil, fmt.Errorf("invalid TLS allow rule line: %s", line)
+		}
+
+		var rule TlsAllowRule
+		for _, option := range strings.Split(matches[1], ";") {
+			k, v, _ := strings.Cut(option, "=")
+			parse, ok := tlsAllowOptionParsers[k]
+			if !ok {
+				return nil, fmt.Errorf("unknown TLS allow rule option: %s", k)
+			}
+			if err := parse(&rule, v); err != nil {
+				return nil, fmt.Errorf("invalid TLS allow rule option: %s: %w", option, err)
+			}
+		}
+
+		rules = append(rules, rule)
+
+		logger.Debugf("loaded TLS allow rule: %s\n", rule)
+	}
+
+	return rules, nil
+}
+
+func matchesAny(pattern string, vals []string) bool {
+	return slices.ContainsFunc(vals, func(val string) bool {
+		ok, _ := path.Match(pattern, val)
+		return ok
+	})
+}
+
+func (rule TlsAllowRule) matches(cert *x509.Certificate) bool {
+	if rule.Cn != "" && !matchesAny(rule.Cn, []string{cert.Subject.CommonName}) {
+		return false
+	}
+	if rule.Ou != "" && !matchesAny(rule.Ou, cert.Subject.OrganizationalUnit) {
+		return false
+	}
+	if rule.SanDns != "" && !matchesAny(rule.SanDns, cert.DNSNames) {
+		return false
+	}
+	if rule.SanIp != nil && !slices.ContainsFunc(cert.IPAddresses, rule.SanIp.Contains) {
+		return false
+	}
+	if rule.SanUri != "" {
+		uris := make([]string, 0, len(cert.URIs))
+		for _, uri := range cert.URIs {
+			uris = append(uris, uri.String())
+		}
+		if !matchesAny(rule.SanUri, uris) {
+			return false
+		}
+	}
+	if rule.Eku != "" && !slices.Contains(cert.ExtKeyUsage, extKeyUsageNames[rule.Eku]) {
+		return false
+	}
+	return true
+}
+
+// Rejects verified client certificates that do not match any of the rules that apply to the listener,
+// a listener without rules accepts any certificate signed by the CA
+func verifyClientAllowed(rules []TlsAllowRule, listener string) func(cs tls.ConnectionState) error {
+	var listenerRules []TlsAllowRule
+	for _, rule := range rules {
+		if rule.Listener == "" || rule.Listener == listener {
+			listenerRules = append(listenerRules, rule)
+		}
+	}
+	if len(listenerRules) == 0 {
+		return nil
+	}
+
+	return func(cs tls.ConnectionState) error {
+		if len(cs.VerifiedChains) == 0 {
+			return nil
+		}
+		cert := cs.VerifiedChains[0][0]
+		for _, rule := range listenerRules {
+			if rule.matches(cert) {
+				return nil
+			}
+		}
+		logger.Warningf("rejected client certificate %s with serial %s on %s: not allowed by any rule\n", cert.Subject, cert.SerialNumber.Text(16), listener)
+		return errors.New("certificate not allowed")
+	}
+}
@@ -0,0 +1,119 @@
+package cetusguard
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestBuildTlsAllowRules(t *testing.T) {
+	_, sanIp, _ := net.ParseCIDR("10.0.0.0/8")
+
+	rules, err := BuildTlsAllowRules("! CI runners\n" +
+		"listener=tcp://0.0.0.0:2376;cn=ci-*;ou=builds;eku=client-auth\n" +
+		" \t san-dns=*.example.com;san-ip=10.0.0.0/8;san-uri=spiffe://example.com/* \t \n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wanted := []TlsAllowRule{
+		{Listener: "tcp://0.0.0.0:2376", Cn: "ci-*", Ou: "builds", Eku: "client-auth"},
+		{SanDns: "*.example.com", SanIp: sanIp, SanUri: "spiffe://example.com/*"},
+	}
+	if !reflect.DeepEqual(rules, wanted) {
+		t.Errorf("rules = %v, want %v", rules, wanted)
+	}
+
+	for i, rule := range rules {
+		if rule.String() != wanted[i].String() {
+			t.Errorf("rule.String() = %s, want %s", rule.String(), wanted[i].String())
+		}
+	}
+}
+
+func TestBuildInvalidTlsAllowRules(t *testing.T) {
+	lines := []string{
+		"ci-runner",
+		"cn=",
+		"cn=[",
+		"cn=ci;",
+		"cn=ci ou=builds",
+		"name=ci",
+		"listener=invalid",
+		"san-ip=invalid",
+		"eku=invalid",
+	}
+
+	for _, line := range lines {
+		if _, err := BuildTlsAllowRules(line); err == nil {
+			t.Errorf("%s: rule built, want an error", line)
+		}
+	}
+}
+
+func TestTlsAllowRuleMatches(t *testing.T) {
+	cert := &x509.Certificate{
+		Subject: pkix.Name{
+			CommonName:         "ci-runner",
+			OrganizationalUnit: []string{"ops", "builds"},
+		},
+		DNSNames:    []string{"runner.example.com"},
+		IPAddresses: []net.IP{net.ParseIP("10.1.2.3")},
+		URIs:        []*url.URL{{Scheme: "spiffe", Host: "example.com", Path: "/runner"}},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	testCases := map[string]bool{
+		"cn=ci-*":                           true,
+		"cn=dev":                            false,
+		"ou=builds":                         true,
+		"ou=dev":                            false,
+		"san-dns=*.example.com":             true,
+		"san-dns=*.example.org":             false,
+		"san-ip=10.0.0.0/8":                 true,
+		"san-ip=192.168.0.0/16":             false,
+		"san-uri=spiffe://example.com/*":    true,
+		"san-uri=spiffe://example.org/*":    false,
+		"eku=client-auth":                   true,
+		"eku=server-auth":                   false,
+		"cn=ci-*;ou=builds;eku=client-auth": true,
+		"cn=ci-*;ou=dev":                    false,
+	}
+
+	for line, wanted := range testCases {
+		rules, err := BuildTlsAllowRules(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if matches := rules[0].matches(cert); matches != wanted {
+			t.Errorf("%s: matches = %t, want %t", line, matches, wanted)
+		}
+	}
+}
+
+func TestVerifyClientAllowed(t *testing.T) {
+	rules := []TlsAllowRule{
+		{Listener: "tcp://127.0.0.1:2376", Cn: "ci-*"},
+		{Listener: "tcp://127.0.0.1:2376", Cn: "admin"},
+		{Listener: "tcp://127.0.0.1:2377", Cn: "dev"},
+	}
+
+	if verify := verifyClientAllowed(rules, "unix:///run/cetusguard.sock"); verify != nil {
+		t.Errorf("verify != nil, want nil for a listener without rules")
+	}
+
+	verify := verifyClientAllowed(rules, "tcp://127.0.0.1:2376")
+	for cn, wantAllowed := range map[string]bool{"ci-runner": true, "admin": true, "dev": false} {
+		cs := tls.ConnectionState{
+			VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: cn}, SerialNumber: big.NewInt(1)}}},
+		}
+		if err := verify(cs); (err == nil) != wantAllowed {
+			t.Errorf("%s: err = %v, want allowed %t", cn, err, wantAllowed)
+		}
+	}
+}
@@ -0,0 +1,322 @@
+package cetusguard
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/hectorm/cetusguard/internal/logger"
+	"github.com/hectorm/cetusguard/internal/utils/metrics"
+)
+
+const (
+	// Interval between checks for changes in the certificate files and for certificates about to expire
+	tlsReloadInterval = 10 * time.Second
+	// Certificates are considered about to expire when less than this fraction of their lifetime remains
+	tlsExpiryWarningFraction = 3
+)
+
+// CA bundle, certificate, key and CRLs that are loaded again when their files change,
+// the previous ones are kept while the new files cannot be loaded, e.g. because only one of them was replaced
+type tlsFiles struct {
+	cacertPath string
+	certPath   string
+	keyPath    string
+	crlPaths   []string
+
+	cacertPool *x509.CertPool
+	cacerts    []*x509.Certificate
+	cert       *tls.Certificate
+	revoked    map[string]struct{}
+	crls       []*x509.RevocationList
+	stamps     []fileStamp
+	warned     map[string]bool
+	mu         sync.RWMutex
+}
+
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func loadTlsFiles(cacertPath string, certPath string, keyPath string, crlPaths []string) (*tlsFiles, error) {
+	if len(crlPaths) > 0 && cacertPath == "" {
+		return nil, errors.New("CRLs require a CA certificate")
+	}
+
+	tf := &tlsFiles{
+		cacertPath: cacertPath,
+		certPath:   certPath,
+		keyPath:    keyPath,
+		crlPaths:   crlPaths,
+	}
+	if _, err := tf.reload(); err != nil {
+		return nil, err
+	}
+	return tf, nil
+}
+
+// Loads the files again if any of them has changed since the last successful load
+func (tf *tlsFiles) reload() (bool, error) {
+	stamps, err := tf.fileStamps()
+	if err != nil {
+		return false, err
+	}
+
+	tf.mu.RLock()
+	unchanged := tf.stamps != nil && slices.Equal(stamps, tf.stamps)
+	tf.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	var cacertPool *x509.CertPool
+	var cacerts []*x509.Certificate
+	if tf.cacertPath != "" {
+		cacertPool, cacerts, err = loadCacerts(tf.cacertPath)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	revoked, crls, err := loadCrls(tf.crlPaths, cacerts)
+	if err != nil {
+		return false, err
+	}
+
+	var cert *tls.Certificate
+	if tf.certPath != "" || tf.keyPath != "" {
+		c, err := tls.LoadX509KeyPair(tf.certPath, tf.keyPath)
+		if err != nil {
+			return false, err
+		}
+		cert = &c
+	}
+
+	tf.mu.Lock()
+	defer tf.mu.Unlock()
+
+	tf.cacertPool = cacertPool
+	tf.cacerts = cacerts
+	tf.cert = cert
+	tf.revoked = revoked
+	tf.crls = crls
+	tf.stamps = stamps
+	tf.warned = nil
+
+	return true, nil
+}
+
+func (tf *tlsFiles) fileStamps() ([]fileStamp, error) {
+	var stamps []fileStamp
+	for _, path := range append([]string{tf.cacertPath, tf.certPath, tf.keyPath}, tf.crlPaths...) {
+		if path == "" {
+			stamps = append(stamps, fileStamp{})
+			continue
+		}
+		// The target of symbolic links is checked, as they are used to replace mounted secrets atomically
+		fileInfo, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		stamps = append(stamps, fileStamp{fileInfo.ModTime(), fileInfo.Size()})
+	}
+	return stamps, nil
+}
+
+func (tf *tlsFiles) certificate() *tls.Certificate {
+	tf.mu.RLock()
+	defer tf.mu.RUnlock()
+	return tf.cert
+}
+
+func (tf *tlsFiles) certPool() *x509.CertPool {
+	tf.mu.RLock()
+	defer tf.mu.RUnlock()
+	return tf.cacertPool
+}
+
+// Exports the expiry time of the certificates and logs a warning once for those that are about to expire
+func (tf *tlsFiles) checkExpiry(gauge *metrics.Gauge, now time.Time) {
+	tf.mu.Lock()
+	defer tf.mu.Unlock()
+
+	expiring := make(map[string]*x509.Certificate)
+	if len(tf.cacerts) > 0 {
+		// The CA that expires first determines when the bundle stops being fully valid
+		first := tf.cacerts[0]
+		for _, c := range tf.cacerts[1:] {
+			if c.NotAfter.Before(first.NotAfter) {
+				first = c
+			}
+		}
+		expiring[tf.cacertPath] = first
+	}
+	if tf.cert != nil && tf.cert.Leaf != nil {
+		expiring[tf.certPath] = tf.cert.Leaf
+	}
+
+	for path, c := range expiring {
+		gauge.Set(float64(c.NotAfter.Unix()), path)
+
+		lifetime := c.NotAfter.Sub(c.NotBefore)
+		remaining := c.NotAfter.Sub(now)
+		if remaining >= lifetime/tlsExpiryWarningFraction || tf.warned[path] {
+			continue
+		}
+		if tf.warned == nil {
+			tf.warned = make(map[string]bool)
+		}
+		tf.warned[path] = true
+
+		if remaining <= 0 {
+			logger.Warningf("certificate %s (%s) expired at %s\n", path, c.Subject, c.NotAfter.Format(time.RFC3339))
+		} else {
+			logger.Warningf("certificate %s (%s) expires at %s\n", path, c.Subject, c.NotAfter.Format(time.RFC3339))
+		}
+	}
+
+	// An outdated CRL is still used, as it is better than none, but it may be missing recent revocations
+	for i, crl := range tf.crls {
+		path := tf.crlPaths[i]
+		if crl.NextUpdate.IsZero() || now.Before(crl.NextUpdate) || tf.warned[path] {
+			continue
+		}
+		if tf.warned == nil {
+			tf.warned = make(map[string]bool)
+		}
+		tf.warned[path] = true
+		logger.Warningf("CRL %s is outdated since %s\n", path, crl.NextUpdate.Format(time.RFC3339))
+	}
+}
+
+// Periodically reloads the TLS files in use and checks their expiry until it is stopped
+type tlsWatcher struct {
+	files    []*tlsFiles
+	gauge    *metrics.Gauge
+	stopCh   chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+func newTlsWatcher(files []*tlsFiles, registry *metrics.Registry) *tlsWatcher {
+	return &tlsWatcher{
+		files: files,
+		gauge: registry.NewGauge(
+			"cetusguard_tls_certificate_expiry_timestamp_seconds",
+			"Time when the certificate loaded from the file expires, in seconds since the Unix epoch",
+			"path",
+		),
+		stopCh: make(chan struct{}),
+	}
+}
+
+func (tw *tlsWatcher) start() {
+	tw.checkAll()
+	if len(tw.files) == 0 {
+		return
+	}
+
+	tw.wg.Add(1)
+	go func() {
+		defer tw.wg.Done()
+
+		ticker := time.NewTicker(tlsReloadInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-tw.stopCh:
+				return
+			case <-ticker.C:
+				tw.checkAll()
+			}
+		}
+	}()
+}
+
+func (tw *tlsWatcher) checkAll() {
+	now := time.Now()
+	for _, tf := range tw.files {
+		reloaded, err := tf.reload()
+		if err != nil {
+			logger.Warningf("error reloading TLS files, keeping the previous ones: %v\n", err)
+		} else if reloaded {
+			logger.Infof("reloaded TLS files %s\n", tf)
+		}
+		tf.checkExpiry(tw.gauge, now)
+	}
+}
+
+func (tw *tlsWatcher) stop() {
+	tw.stopOnce.Do(func() { close(tw.stopCh) })
+	tw.wg.Wait()
+}
+
+func (tf *tlsFiles) String() string {
+	var paths []string
+	for _, path := range append([]string{tf.cacertPath, tf.certPath, tf.keyPath}, tf.crlPaths...) {
+		if path != "" {
+			paths = append(paths, path)
+		}
+	}
+	return fmt.Sprint(paths)
+}
+
+func loadCacerts(path string) (*x509.CertPool, []*x509.Certificate, error) {
+	data, err := os.ReadFile(filepath.Clean(path))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cacertPool := x509.NewCertPool()
+	var cacerts []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" || len(block.Headers) != 0 {
+			continue
+		}
+		c, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			continue
+		}
+		cacertPool.AddCert(c)
+		cacerts = append(cacerts, c)
+	}
+	if len(cacerts) == 0 {
+		return nil, nil, errors.New("error loading CA certificate")
+	}
+
+	return cacertPool, cacerts, nil
+}
+
+// Verifies the certificate chain presented by the daemon against the current CA bundle,
+// which is done here instead of through RootCAs so that the bundle can be reloaded
+func verifyServerChain(cacertPool *x509.CertPool, cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("no peer certificate")
+	}
+
+	opts := x509.VerifyOptions{
+		Roots:         cacertPool,
+		DNSName:       cs.ServerName,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, c := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(c)
+	}
+
+	_, err := cs.PeerCertificates[0].Verify(opts)
+	return err
+}
@@ -0,0 +1,189 @@
+package cetusguard
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hectorm/cetusguard/cetusguard/testdata"
+	"github.com/hectorm/cetusguard/internal/utils/metrics"
+)
+
+func writeTlsFile(t *testing.T, path string, data []byte, modTime time.Time) {
+	t.Helper()
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func parseTestCert(t *testing.T, data []byte) *x509.Certificate {
+	t.Helper()
+	block, _ := pem.Decode(data)
+	if block == nil {
+		t.Fatal("error decoding certificate")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestTlsFilesReload(t *testing.T) {
+	tmpdir := t.TempDir()
+	cacertPath := filepath.Join(tmpdir, "ca.pem")
+	certPath := filepath.Join(tmpdir, "cert.pem")
+	keyPath := filepath.Join(tmpdir, "key.pem")
+
+	modTime := time.Now().Add(-time.Hour)
+	writeTlsFile(t, cacertPath, testdata.TestTlsCacert, modTime)
+	writeTlsFile(t, certPath, testdata.TestTlsServerCert, modTime)
+	writeTlsFile(t, keyPath, testdata.TestTlsServerKey, modTime)
+
+	tf, err := loadTlsFiles(cacertPath, certPath, keyPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cn := tf.certificate().Leaf.Subject.CommonName; !strings.HasPrefix(cn, "daemon:") {
+		t.Errorf("cn = %s, want the original certificate", cn)
+	}
+
+	reloaded, err := tf.reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloaded {
+		t.Errorf("reloaded = %t, want %t", reloaded, false)
+	}
+
+	// A certificate that does not match the key yet is not loaded
+	modTime = modTime.Add(time.Minute)
+	writeTlsFile(t, cacertPath, testdata.TestAltTlsCacert, modTime)
+	writeTlsFile(t, certPath, testdata.TestAltTlsServerCert, modTime)
+	if _, err := tf.reload(); err == nil {
+		t.Errorf("files reloaded, want an error")
+	}
+	if cn := tf.certificate().Leaf.Subject.CommonName; !strings.HasPrefix(cn, "daemon:") {
+		t.Errorf("cn = %s, want the original certificate", cn)
+	}
+
+	writeTlsFile(t, keyPath, testdata.TestAltTlsServerKey, modTime)
+	reloaded, err = tf.reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reloaded {
+		t.Errorf("reloaded = %t, want %t", reloaded, true)
+	}
+	if cn := tf.certificate().Leaf.Subject.CommonName; !strings.HasPrefix(cn, "alt-daemon:") {
+		t.Errorf("cn = %s, want the new certificate", cn)
+	}
+
+	cs := tls.ConnectionState{
+		ServerName:       "localhost",
+		PeerCertificates: []*x509.Certificate{parseTestCert(t, testdata.TestAltTlsServerCert)},
+	}
+	if err := verifyServerChain(tf.certPool(), cs); err != nil {
+		t.Errorf("err = %v, want the new CA to be used", err)
+	}
+}
+
+func TestTlsFilesCheckExpiry(t *testing.T) {
+	tmpdir := t.TempDir()
+	cacertPath := filepath.Join(tmpdir, "ca.pem")
+	certPath := filepath.Join(tmpdir, "cert.pem")
+	keyPath := filepath.Join(tmpdir, "key.pem")
+
+	modTime := time.Now()
+	writeTlsFile(t, cacertPath, []byte(string(testdata.TestTlsCacert)+"\n"+string(testdata.TestAltTlsCacert)), modTime)
+	writeTlsFile(t, certPath, testdata.TestTlsServerCert, modTime)
+	writeTlsFile(t, keyPath, testdata.TestTlsServerKey, modTime)
+
+	tf, err := loadTlsFiles(cacertPath, certPath, keyPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	registry := metrics.NewRegistry()
+	gauge := registry.NewGauge("expiry", "Expiry", "path")
+
+	cert := parseTestCert(t, testdata.TestTlsServerCert)
+	tf.checkExpiry(gauge, cert.NotBefore)
+	if tf.warned[certPath] {
+		t.Errorf("warned = %t, want %t", tf.warned[certPath], false)
+	}
+
+	tf.checkExpiry(gauge, cert.NotAfter.Add(-time.Second))
+	if !tf.warned[certPath] {
+		t.Errorf("warned = %t, want %t", tf.warned[certPath], true)
+	}
+
+	cacert := parseTestCert(t, testdata.TestTlsCacert)
+	altCacert := parseTestCert(t, testdata.TestAltTlsCacert)
+	firstCacert := cacert
+	if altCacert.NotAfter.Before(cacert.NotAfter) {
+		firstCacert = altCacert
+	}
+
+	var sb strings.Builder
+	if _, err := registry.WriteTo(&sb); err != nil {
+		t.Fatal(err)
+	}
+	for path, c := range map[string]*x509.Certificate{certPath: cert, cacertPath: firstCacert} {
+		line := `expiry{path="` + path + `"} ` + strconv.FormatFloat(float64(c.NotAfter.Unix()), 'g', -1, 64)
+		if !strings.Contains(sb.String(), line+"\n") {
+			t.Errorf("metrics = %q, want %q", sb.String(), line)
+		}
+	}
+}
+
+func TestLoadTlsFilesInvalid(t *testing.T) {
+	tmpdir := t.TempDir()
+	invalidCacertPath := filepath.Join(tmpdir, "invalid-ca.pem")
+	writeTlsFile(t, invalidCacertPath, testdata.TestInvalidTlsCacert, time.Now())
+	certPath := filepath.Join(tmpdir, "cert.pem")
+	writeTlsFile(t, certPath, testdata.TestTlsServerCert, time.Now())
+
+	files := [][3]string{
+		{invalidCacertPath, "", ""},
+		{filepath.Join(tmpdir, "nonexistent.pem"), "", ""},
+		{"", certPath, ""},
+	}
+
+	for _, f := range files {
+		if _, err := loadTlsFiles(f[0], f[1], f[2], nil); err == nil {
+			t.Errorf("%v: files loaded, want an error", f)
+		}
+	}
+}
+
+func TestVerifyServerChain(t *testing.T) {
+	cacertPool := x509.NewCertPool()
+	cacertPool.AddCert(parseTestCert(t, testdata.TestTlsCacert))
+	cert := parseTestCert(t, testdata.TestTlsServerCert)
+
+	if err := verifyServerChain(cacertPool, tls.ConnectionState{ServerName: "localhost", PeerCertificates: []*x509.Certificate{cert}}); err != nil {
+		t.Errorf("err = %v, want nil", err)
+	}
+	if err := verifyServerChain(cacertPool, tls.ConnectionState{ServerName: "127.0.0.1", PeerCertificates: []*x509.Certificate{cert}}); err != nil {
+		t.Errorf("err = %v, want nil", err)
+	}
+	if err := verifyServerChain(cacertPool, tls.ConnectionState{ServerName: "daemon.example.com", PeerCertificates: []*x509.Certificate{cert}}); err == nil {
+		t.Errorf("chain verified, want a name mismatch error")
+	}
+	if err := verifyServerChain(cacertPool, tls.ConnectionState{ServerName: "localhost", PeerCertificates: []*x509.Certificate{parseTestCert(t, testdata.TestAltTlsServerCert)}}); err == nil {
+		t.Errorf("chain verified, want an unknown authority error")
+	}
+	if err := verifyServerChain(cacertPool, tls.ConnectionState{ServerName: "localhost"}); err == nil {
+		t.Errorf("chain verified, want an error")
+	}
+}
@@ -3,11 +3,14 @@ package main
 import (
 	"flag"
 	"fmt"
+	"net"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/hectorm/cetusguard/cetusguard"
 	"github.com/hectorm/cetusguard/internal/logger"
+	"github.com/hectorm/cetusguard/internal/utils/dockercli"
 	"github.com/hectorm/cetusguard/internal/utils/env"
 	"github.com/hectorm/cetusguard/internal/utils/flagextra"
 )
@@ -20,12 +23,18 @@ var (
 )
 
 func main() {
-	var backendAddr string
-	flag.StringVar(
-		&backendAddr,
+	var backendAddr []string
+	flag.Var(
+		flagextra.NewStringSliceValue(env.StringSliceEnv([]string{"unix:///var/run/docker.sock"}, "CETUSGUARD_BACKEND_ADDR", "CONTAINER_HOST"), &backendAddr),
 		"backend-addr",
-		env.StringEnv("unix:///var/run/docker.sock", "CETUSGUARD_BACKEND_ADDR", "CONTAINER_HOST", "DOCKER_HOST"),
-		"Container daemon socket to connect to (env CETUSGUARD_BACKEND_ADDR, CONTAINER_HOST, DOCKER_HOST)",
+		"Container daemon socket to connect to, can be specified multiple times for failover (env CETUSGUARD_BACKEND_ADDR, CONTAINER_HOST, DOCKER_HOST, DOCKER_CONTEXT)",
+	)
+
+	var backendList []string
+	flag.Var(
+		flagextra.NewStringSliceValue(env.StringSliceEnv(nil, "CETUSGUARD_BACKEND"), &backendList),
+		"backend",
+		"Named backend that requests can be routed to in NAME=ADDR format, can be specified multiple times (env CETUSGUARD_BACKEND)",
 	)
 
 	var frontendAddr []string
@@ -59,6 +68,53 @@ func main() {
 		"Path to the backend TLS key used to authenticate with the daemon (env CETUSGUARD_BACKEND_TLS_KEY)",
 	)
 
+	var backendTlsServerName string
+	flag.StringVar(
+		&backendTlsServerName,
+		"backend-tls-server-name",
+		env.StringEnv("", "CETUSGUARD_BACKEND_TLS_SERVER_NAME"),
+		"Name used to verify the daemon certificate instead of the host of its address (env CETUSGUARD_BACKEND_TLS_SERVER_NAME)",
+	)
+
+	var backendTlsPin []string
+	flag.Var(
+		flagextra.NewStringSliceValue(env.StringSliceEnv(nil, "CETUSGUARD_BACKEND_TLS_PIN"), &backendTlsPin),
+		"backend-tls-pin",
+		"SHA-256 digest of the public key of the daemon certificate in sha256//BASE64 format, can be specified multiple times (env CETUSGUARD_BACKEND_TLS_PIN)",
+	)
+
+	var backendTlsMinVersion string
+	flag.StringVar(
+		&backendTlsMinVersion,
+		"backend-tls-min-version",
+		env.StringEnv("", "CETUSGUARD_BACKEND_TLS_MIN_VERSION"),
+		"Minimum TLS version used to connect to the daemon, 1.2 or 1.3, defaults to 1.2 (env CETUSGUARD_BACKEND_TLS_MIN_VERSION)",
+	)
+
+	var backendTlsCipherSuites string
+	flag.StringVar(
+		&backendTlsCipherSuites,
+		"backend-tls-cipher-suites",
+		env.StringEnv("", "CETUSGUARD_BACKEND_TLS_CIPHER_SUITES"),
+		"Comma separated list of TLS 1.2 cipher suites used to connect to the daemon (env CETUSGUARD_BACKEND_TLS_CIPHER_SUITES)",
+	)
+
+	var backendHealthCheckInterval time.Duration
+	flag.DurationVar(
+		&backendHealthCheckInterval,
+		"backend-health-check-interval",
+		env.DurationEnv(10*time.Second, "CETUSGUARD_BACKEND_HEALTH_CHECK_INTERVAL"),
+		"Interval between health checks of the backends when more than one is specified (env CETUSGUARD_BACKEND_HEALTH_CHECK_INTERVAL)",
+	)
+
+	var backendAffinityTtl time.Duration
+	flag.DurationVar(
+		&backendAffinityTtl,
+		"backend-affinity-ttl",
+		env.DurationEnv(0, "CETUSGUARD_BACKEND_AFFINITY_TTL"),
+		"Time a client stays pinned to the backend of its last request while it is healthy, 0 to disable (env CETUSGUARD_BACKEND_AFFINITY_TTL)",
+	)
+
 	var frontendTlsCacert string
 	flag.StringVar(
 		&frontendTlsCacert,
@@ -83,6 +139,95 @@ func main() {
 		"Path to the frontend TLS key (env CETUSGUARD_FRONTEND_TLS_KEY)",
 	)
 
+	var frontendTlsCrl []string
+	flag.Var(
+		flagextra.NewStringSliceValue(env.StringSliceEnv(nil, "CETUSGUARD_FRONTEND_TLS_CRL"), &frontendTlsCrl),
+		"frontend-tls-crl",
+		"Path to a CRL of the frontend CA used to reject revoked client certificates, can be specified multiple times (env CETUSGUARD_FRONTEND_TLS_CRL)",
+	)
+
+	var frontendTlsDeny []string
+	flag.Var(
+		flagextra.NewStringSliceValue(env.StringSliceEnv(nil, "CETUSGUARD_FRONTEND_TLS_DENY"), &frontendTlsDeny),
+		"frontend-tls-deny",
+		"Client certificate to reject in serial:HEX or sha256:HEX format, can be specified multiple times (env CETUSGUARD_FRONTEND_TLS_DENY)",
+	)
+
+	var frontendTlsAllowList []string
+	flag.Var(
+		flagextra.NewStringSliceValue(env.StringSliceEnv(nil, "CETUSGUARD_FRONTEND_TLS_ALLOW"), &frontendTlsAllowList),
+		"frontend-tls-allow",
+		"Client certificate allow rules separated by new lines, can be specified multiple times (env CETUSGUARD_FRONTEND_TLS_ALLOW)",
+	)
+
+	var frontendTlsUnix bool
+	flag.BoolVar(
+		&frontendTlsUnix,
+		"frontend-tls-unix",
+		env.BoolEnv(false, "CETUSGUARD_FRONTEND_TLS_UNIX"),
+		"Use TLS also on Unix socket frontend addresses (env CETUSGUARD_FRONTEND_TLS_UNIX)",
+	)
+
+	var frontendTlsBootstrapDir string
+	flag.StringVar(
+		&frontendTlsBootstrapDir,
+		"frontend-tls-bootstrap-dir",
+		env.StringEnv("", "CETUSGUARD_FRONTEND_TLS_BOOTSTRAP_DIR"),
+		"Directory where a self-signed CA, server and client certificate are generated on first start and used for the frontend (env CETUSGUARD_FRONTEND_TLS_BOOTSTRAP_DIR)",
+	)
+
+	var frontendAclList []string
+	flag.Var(
+		flagextra.NewStringSliceValue(env.StringSliceEnv(nil, "CETUSGUARD_FRONTEND_ACL"), &frontendAclList),
+		"frontend-acl",
+		"Network access control lines for TCP listeners, can be specified multiple times (env CETUSGUARD_FRONTEND_ACL)",
+	)
+
+	var frontendProxyProtocol []string
+	flag.Var(
+		flagextra.NewStringSliceValue(env.StringSliceEnv(nil, "CETUSGUARD_FRONTEND_PROXY_PROTOCOL"), &frontendProxyProtocol),
+		"frontend-proxy-protocol",
+		"TCP frontend address whose connections start with a PROXY protocol header, can be specified multiple times (env CETUSGUARD_FRONTEND_PROXY_PROTOCOL)",
+	)
+
+	var frontendProxyTrustedList []string
+	flag.Var(
+		flagextra.NewStringSliceValue(env.StringSliceEnv(nil, "CETUSGUARD_FRONTEND_PROXY_TRUSTED"), &frontendProxyTrustedList),
+		"frontend-proxy-trusted",
+		"IP address or CIDR range of a proxy that may send a PROXY protocol header, can be specified multiple times (env CETUSGUARD_FRONTEND_PROXY_TRUSTED)",
+	)
+
+	var frontendAuthHtpasswd string
+	flag.StringVar(
+		&frontendAuthHtpasswd,
+		"frontend-auth-htpasswd",
+		env.StringEnv("", "CETUSGUARD_FRONTEND_AUTH_HTPASSWD"),
+		"Path to an htpasswd file with bcrypt hashed passwords required for basic authentication (env CETUSGUARD_FRONTEND_AUTH_HTPASSWD)",
+	)
+
+	var frontendAuthTokens string
+	flag.StringVar(
+		&frontendAuthTokens,
+		"frontend-auth-tokens",
+		env.StringEnv("", "CETUSGUARD_FRONTEND_AUTH_TOKENS"),
+		"Path to a file with tokens in NAME:TOKEN format required for bearer authentication (env CETUSGUARD_FRONTEND_AUTH_TOKENS)",
+	)
+
+	var frontendAuthJwks string
+	flag.StringVar(
+		&frontendAuthJwks,
+		"frontend-auth-jwks",
+		env.StringEnv("", "CETUSGUARD_FRONTEND_AUTH_JWKS"),
+		"Path or URL of a JWKS used to verify JWTs for bearer authentication (env CETUSGUARD_FRONTEND_AUTH_JWKS)",
+	)
+
+	var frontendAuthJwtClaimList []string
+	flag.Var(
+		flagextra.NewStringSliceValue(env.StringSliceEnv(nil, "CETUSGUARD_FRONTEND_AUTH_JWT_CLAIMS"), &frontendAuthJwtClaimList),
+		"frontend-auth-jwt-claims",
+		"JWT claim rules separated by new lines, can be specified multiple times (env CETUSGUARD_FRONTEND_AUTH_JWT_CLAIMS)",
+	)
+
 	var ruleList []string
 	flag.Var(
 		flagextra.NewStringSliceValue(env.StringSliceEnv(nil, "CETUSGUARD_RULES"), &ruleList),
@@ -97,6 +242,41 @@ func main() {
 		"Filter rules file, can be specified multiple times (env CETUSGUARD_RULES_FILE)",
 	)
 
+	var anonymousRuleList []string
+	flag.Var(
+		flagextra.NewStringSliceValue(env.StringSliceEnv(nil, "CETUSGUARD_ANONYMOUS_RULES"), &anonymousRuleList),
+		"anonymous-rules",
+		"Filter rules for TLS clients without a certificate separated by new lines, makes client certificates optional, can be specified multiple times (env CETUSGUARD_ANONYMOUS_RULES)",
+	)
+
+	var anonymousRuleFileList []string
+	flag.Var(
+		flagextra.NewStringSliceValue(env.StringSliceEnv(nil, "CETUSGUARD_ANONYMOUS_RULES_FILE"), &anonymousRuleFileList),
+		"anonymous-rules-file",
+		"Filter rules file for TLS clients without a certificate, makes client certificates optional, can be specified multiple times (env CETUSGUARD_ANONYMOUS_RULES_FILE)",
+	)
+
+	var ruleSetList []string
+	flag.Var(
+		flagextra.NewStringSliceValue(env.StringSliceEnv(nil, "CETUSGUARD_RULE_SET"), &ruleSetList),
+		"rule-set",
+		"Named filter rules file that credentials can be mapped to in NAME=PATH format, can be specified multiple times (env CETUSGUARD_RULE_SET)",
+	)
+
+	var routeList []string
+	flag.Var(
+		flagextra.NewStringSliceValue(env.StringSliceEnv(nil, "CETUSGUARD_ROUTES"), &routeList),
+		"routes",
+		"Routing rules separated by new lines, can be specified multiple times (env CETUSGUARD_ROUTES)",
+	)
+
+	var routeFileList []string
+	flag.Var(
+		flagextra.NewStringSliceValue(env.StringSliceEnv(nil, "CETUSGUARD_ROUTES_FILE"), &routeFileList),
+		"routes-file",
+		"Routing rules file, can be specified multiple times (env CETUSGUARD_ROUTES_FILE)",
+	)
+
 	var noBuiltinRules bool
 	flag.BoolVar(
 		&noBuiltinRules,
@@ -105,6 +285,276 @@ func main() {
 		"Do not load the built-in rules (env CETUSGUARD_NO_BUILTIN_RULES)",
 	)
 
+	var recordDir string
+	flag.StringVar(
+		&recordDir,
+		"record-dir",
+		env.StringEnv("", "CETUSGUARD_RECORD_DIR"),
+		"Directory where exec and attach sessions are recorded in asciicast v2 format (env CETUSGUARD_RECORD_DIR)",
+	)
+
+	var sessionMaxLifetime time.Duration
+	flag.DurationVar(
+		&sessionMaxLifetime,
+		"session-max-lifetime",
+		env.DurationEnv(0, "CETUSGUARD_SESSION_MAX_LIFETIME"),
+		"Maximum duration of hijacked connections and stream responses, 0 to disable (env CETUSGUARD_SESSION_MAX_LIFETIME)",
+	)
+
+	var sessionIdleTimeout time.Duration
+	flag.DurationVar(
+		&sessionIdleTimeout,
+		"session-idle-timeout",
+		env.DurationEnv(0, "CETUSGUARD_SESSION_IDLE_TIMEOUT"),
+		"Maximum time without data in either direction for hijacked connections and stream responses, 0 to disable (env CETUSGUARD_SESSION_IDLE_TIMEOUT)",
+	)
+
+	var rateLimitStr string
+	flag.StringVar(
+		&rateLimitStr,
+		"rate-limit",
+		env.StringEnv("", "CETUSGUARD_RATE_LIMIT"),
+		"Requests allowed for each client in N/s, N/m or N/h format, unlimited if empty (env CETUSGUARD_RATE_LIMIT)",
+	)
+
+	var rateLimitBurst int
+	flag.IntVar(
+		&rateLimitBurst,
+		"rate-limit-burst",
+		env.IntEnv(0, "CETUSGUARD_RATE_LIMIT_BURST"),
+		"Requests a client can make in a burst, defaults to the number of requests of the rate limit (env CETUSGUARD_RATE_LIMIT_BURST)",
+	)
+
+	var maxInFlight int
+	flag.IntVar(
+		&maxInFlight,
+		"max-in-flight",
+		env.IntEnv(0, "CETUSGUARD_MAX_IN_FLIGHT"),
+		"Maximum requests of each client handled at the same time, 0 to disable (env CETUSGUARD_MAX_IN_FLIGHT)",
+	)
+
+	var maxSessions int
+	flag.IntVar(
+		&maxSessions,
+		"max-sessions",
+		env.IntEnv(0, "CETUSGUARD_MAX_SESSIONS"),
+		"Maximum hijacked connections open at the same time across all clients, 0 to disable (env CETUSGUARD_MAX_SESSIONS)",
+	)
+
+	var hardeningNoNewPrivileges bool
+	flag.BoolVar(
+		&hardeningNoNewPrivileges,
+		"hardening-no-new-privileges",
+		env.BoolEnv(false, "CETUSGUARD_HARDENING_NO_NEW_PRIVILEGES"),
+		"Prevent the processes of created containers from gaining additional privileges (env CETUSGUARD_HARDENING_NO_NEW_PRIVILEGES)",
+	)
+
+	var hardeningCapDrop bool
+	flag.BoolVar(
+		&hardeningCapDrop,
+		"hardening-cap-drop",
+		env.BoolEnv(false, "CETUSGUARD_HARDENING_CAP_DROP"),
+		"Drop all capabilities of created containers except the allowed ones and disable privileged mode (env CETUSGUARD_HARDENING_CAP_DROP)",
+	)
+
+	var hardeningCapAllowlist string
+	flag.StringVar(
+		&hardeningCapAllowlist,
+		"hardening-cap-allowlist",
+		env.StringEnv("", "CETUSGUARD_HARDENING_CAP_ALLOWLIST"),
+		"Comma separated list of capabilities created containers may keep when capabilities are dropped (env CETUSGUARD_HARDENING_CAP_ALLOWLIST)",
+	)
+
+	var hardeningReadonlyRootfs bool
+	flag.BoolVar(
+		&hardeningReadonlyRootfs,
+		"hardening-readonly-rootfs",
+		env.BoolEnv(false, "CETUSGUARD_HARDENING_READONLY_ROOTFS"),
+		"Mount the root filesystem of created containers as read only (env CETUSGUARD_HARDENING_READONLY_ROOTFS)",
+	)
+
+	var hardeningMemoryStr string
+	flag.StringVar(
+		&hardeningMemoryStr,
+		"hardening-memory",
+		env.StringEnv("", "CETUSGUARD_HARDENING_MEMORY"),
+		"Memory limit with an optional b, k, m or g suffix for created containers that do not set one (env CETUSGUARD_HARDENING_MEMORY)",
+	)
+
+	var hardeningCpusStr string
+	flag.StringVar(
+		&hardeningCpusStr,
+		"hardening-cpus",
+		env.StringEnv("", "CETUSGUARD_HARDENING_CPUS"),
+		"Number of CPUs for created containers that do not set a CPU limit (env CETUSGUARD_HARDENING_CPUS)",
+	)
+
+	var hardeningPidsLimit int
+	flag.IntVar(
+		&hardeningPidsLimit,
+		"hardening-pids-limit",
+		env.IntEnv(0, "CETUSGUARD_HARDENING_PIDS_LIMIT"),
+		"PIDs limit for created containers that do not set one, 0 to disable (env CETUSGUARD_HARDENING_PIDS_LIMIT)",
+	)
+
+	var hardeningSeccompProfile string
+	flag.StringVar(
+		&hardeningSeccompProfile,
+		"hardening-seccomp-profile",
+		env.StringEnv("", "CETUSGUARD_HARDENING_SECCOMP_PROFILE"),
+		"Path to a seccomp profile for created containers that do not set one (env CETUSGUARD_HARDENING_SECCOMP_PROFILE)",
+	)
+
+	var hardeningApparmorProfile string
+	flag.StringVar(
+		&hardeningApparmorProfile,
+		"hardening-apparmor-profile",
+		env.StringEnv("", "CETUSGUARD_HARDENING_APPARMOR_PROFILE"),
+		"AppArmor profile for created containers that do not set one (env CETUSGUARD_HARDENING_APPARMOR_PROFILE)",
+	)
+
+	var execRuleList []string
+	flag.Var(
+		flagextra.NewStringSliceValue(env.StringSliceEnv(nil, "CETUSGUARD_EXEC_RULES"), &execRuleList),
+		"exec-rules",
+		"Exec command rules separated by new lines, can be specified multiple times (env CETUSGUARD_EXEC_RULES)",
+	)
+
+	var execAllowPrivileged bool
+	flag.BoolVar(
+		&execAllowPrivileged,
+		"exec-allow-privileged",
+		env.BoolEnv(false, "CETUSGUARD_EXEC_ALLOW_PRIVILEGED"),
+		"Allow privileged exec instances when the exec policy is enabled (env CETUSGUARD_EXEC_ALLOW_PRIVILEGED)",
+	)
+
+	var execAllowRoot bool
+	flag.BoolVar(
+		&execAllowRoot,
+		"exec-allow-root",
+		env.BoolEnv(false, "CETUSGUARD_EXEC_ALLOW_ROOT"),
+		"Allow exec instances to run as root, as a user name or without a user when the exec policy is enabled (env CETUSGUARD_EXEC_ALLOW_ROOT)",
+	)
+
+	var execDefaultUser string
+	flag.StringVar(
+		&execDefaultUser,
+		"exec-default-user",
+		env.StringEnv("", "CETUSGUARD_EXEC_DEFAULT_USER"),
+		"User set on exec instances that do not set one, with a numeric ID unless exec as root is allowed (env CETUSGUARD_EXEC_DEFAULT_USER)",
+	)
+
+	var execAllowEnv []string
+	flag.Var(
+		flagextra.NewStringSliceValue(env.StringSliceEnv(nil, "CETUSGUARD_EXEC_ALLOW_ENV"), &execAllowEnv),
+		"exec-allow-env",
+		"Shell pattern that the names of the environment variables of exec instances must match, can be specified multiple times (env CETUSGUARD_EXEC_ALLOW_ENV)",
+	)
+
+	var imageAllowRegistry []string
+	flag.Var(
+		flagextra.NewStringSliceValue(env.StringSliceEnv(nil, "CETUSGUARD_IMAGE_ALLOW_REGISTRY"), &imageAllowRegistry),
+		"image-allow-registry",
+		"Registry that pulled and run images may come from, can be specified multiple times (env CETUSGUARD_IMAGE_ALLOW_REGISTRY)",
+	)
+
+	var imageAllowRepository []string
+	flag.Var(
+		flagextra.NewStringSliceValue(env.StringSliceEnv(nil, "CETUSGUARD_IMAGE_ALLOW_REPOSITORY"), &imageAllowRepository),
+		"image-allow-repository",
+		"Shell pattern that the registry and repository of pulled and run images must match, can be specified multiple times (env CETUSGUARD_IMAGE_ALLOW_REPOSITORY)",
+	)
+
+	var imageRequireDigest bool
+	flag.BoolVar(
+		&imageRequireDigest,
+		"image-require-digest",
+		env.BoolEnv(false, "CETUSGUARD_IMAGE_REQUIRE_DIGEST"),
+		"Require pulled and run images to be referenced by digest (env CETUSGUARD_IMAGE_REQUIRE_DIGEST)",
+	)
+
+	var mountAllow []string
+	flag.Var(
+		flagextra.NewStringSliceValue(env.StringSliceEnv(nil, "CETUSGUARD_MOUNT_ALLOW"), &mountAllow),
+		"mount-allow",
+		"Host path prefix that the bind mounts of created containers may use, can be specified multiple times (env CETUSGUARD_MOUNT_ALLOW)",
+	)
+
+	var mountReadonly bool
+	flag.BoolVar(
+		&mountReadonly,
+		"mount-readonly",
+		env.BoolEnv(false, "CETUSGUARD_MOUNT_READONLY"),
+		"Make the bind mounts of created containers read only (env CETUSGUARD_MOUNT_READONLY)",
+	)
+
+	var mountVolumeDriver []string
+	flag.Var(
+		flagextra.NewStringSliceValue(env.StringSliceEnv(nil, "CETUSGUARD_MOUNT_VOLUME_DRIVER"), &mountVolumeDriver),
+		"mount-volume-driver",
+		"Volume driver that created volumes and containers may use, only local if not specified, can be specified multiple times (env CETUSGUARD_MOUNT_VOLUME_DRIVER)",
+	)
+
+	var mountVolumeOpt []string
+	flag.Var(
+		flagextra.NewStringSliceValue(env.StringSliceEnv(nil, "CETUSGUARD_MOUNT_VOLUME_OPT"), &mountVolumeOpt),
+		"mount-volume-opt",
+		"Volume driver option that created volumes and containers may set, can be specified multiple times (env CETUSGUARD_MOUNT_VOLUME_OPT)",
+	)
+
+	var ownerRuleList []string
+	flag.Var(
+		flagextra.NewStringSliceValue(env.StringSliceEnv(nil, "CETUSGUARD_OWNER_RULES"), &ownerRuleList),
+		"owner-rules",
+		"Owner rules separated by new lines that restrict clients to the objects with a label, can be specified multiple times (env CETUSGUARD_OWNER_RULES)",
+	)
+
+	var portAllowIp []string
+	flag.Var(
+		flagextra.NewStringSliceValue(env.StringSliceEnv(nil, "CETUSGUARD_PORT_ALLOW_IP"), &portAllowIp),
+		"port-allow-ip",
+		"Host IP or network in CIDR notation that created containers may publish ports on, can be specified multiple times (env CETUSGUARD_PORT_ALLOW_IP)",
+	)
+
+	var portAllowRange []string
+	flag.Var(
+		flagextra.NewStringSliceValue(env.StringSliceEnv(nil, "CETUSGUARD_PORT_ALLOW_RANGE"), &portAllowRange),
+		"port-allow-range",
+		"Host port or range in START-END format that created containers may publish, can be specified multiple times (env CETUSGUARD_PORT_ALLOW_RANGE)",
+	)
+
+	var portAllowPublishAll bool
+	flag.BoolVar(
+		&portAllowPublishAll,
+		"port-allow-publish-all",
+		env.BoolEnv(false, "CETUSGUARD_PORT_ALLOW_PUBLISH_ALL"),
+		"Allow created containers to publish all exposed ports when the port policy is enabled (env CETUSGUARD_PORT_ALLOW_PUBLISH_ALL)",
+	)
+
+	var portAllowHostNetwork bool
+	flag.BoolVar(
+		&portAllowHostNetwork,
+		"port-allow-host-network",
+		env.BoolEnv(false, "CETUSGUARD_PORT_ALLOW_HOST_NETWORK"),
+		"Allow created containers to use the host network or the network namespace of another container or path when the port policy is enabled (env CETUSGUARD_PORT_ALLOW_HOST_NETWORK)",
+	)
+
+	var shutdownGracePeriod time.Duration
+	flag.DurationVar(
+		&shutdownGracePeriod,
+		"shutdown-grace-period",
+		env.DurationEnv(10*time.Second, "CETUSGUARD_SHUTDOWN_GRACE_PERIOD"),
+		"Time to wait for active requests and sessions to finish before closing them on shutdown (env CETUSGUARD_SHUTDOWN_GRACE_PERIOD)",
+	)
+
+	var metricsAddr string
+	flag.StringVar(
+		&metricsAddr,
+		"metrics-addr",
+		env.StringEnv("", "CETUSGUARD_METRICS_ADDR"),
+		"Address to expose metrics on in Prometheus format at /metrics, disabled if empty (env CETUSGUARD_METRICS_ADDR)",
+	)
+
 	var logLevel int
 	flag.IntVar(
 		&logLevel,
@@ -132,6 +582,29 @@ func main() {
 		os.Exit(0)
 	}
 
+	// Without an explicit backend address, the daemon used by the Docker CLI is used
+	backendAddrSet := env.StringEnv("", "CETUSGUARD_BACKEND_ADDR", "CONTAINER_HOST") != ""
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "backend-addr" {
+			backendAddrSet = true
+		}
+	})
+	if !backendAddrSet {
+		dockerEndpoint, err := dockercli.CurrentEndpoint()
+		if err != nil {
+			logger.Critical(err)
+		}
+		if dockerEndpoint != nil {
+			backendAddr = []string{dockerEndpoint.Host}
+			// Explicit TLS settings take precedence over those of the Docker CLI
+			if backendTlsCacert == "" && backendTlsCert == "" && backendTlsKey == "" {
+				backendTlsCacert = dockerEndpoint.TlsCacert
+				backendTlsCert = dockerEndpoint.TlsCert
+				backendTlsKey = dockerEndpoint.TlsKey
+			}
+		}
+	}
+
 	var rules []cetusguard.Rule
 	if !noBuiltinRules {
 		rawRules := strings.Join(cetusguard.RawBuiltinRules, "\n")
@@ -156,24 +629,250 @@ func main() {
 		rules = append(rules, builtRules...)
 	}
 
+	var anonymousRules []cetusguard.Rule
+	for _, anonymousRuleElem := range anonymousRuleList {
+		builtRules, err := cetusguard.BuildRules(anonymousRuleElem)
+		if err != nil {
+			logger.Critical(err)
+		}
+		anonymousRules = append(anonymousRules, builtRules...)
+	}
+	for _, anonymousRuleFileElem := range anonymousRuleFileList {
+		builtRules, err := cetusguard.BuildRulesFromFilePath(anonymousRuleFileElem)
+		if err != nil {
+			logger.Critical(err)
+		}
+		anonymousRules = append(anonymousRules, builtRules...)
+	}
+
+	ruleSets, err := cetusguard.BuildRuleSets(ruleSetList)
+	if err != nil {
+		logger.Critical(err)
+	}
+
+	backends, err := cetusguard.BuildBackends(backendList)
+	if err != nil {
+		logger.Critical(err)
+	}
+	for _, backend := range backends {
+		backend.HealthCheckInterval = backendHealthCheckInterval
+		backend.AffinityTtl = backendAffinityTtl
+	}
+
+	var routes []cetusguard.Route
+	for _, routeElem := range routeList {
+		builtRoutes, err := cetusguard.BuildRoutes(routeElem)
+		if err != nil {
+			logger.Critical(err)
+		}
+		routes = append(routes, builtRoutes...)
+	}
+	for _, routeFileElem := range routeFileList {
+		builtRoutes, err := cetusguard.BuildRoutesFromFilePath(routeFileElem)
+		if err != nil {
+			logger.Critical(err)
+		}
+		routes = append(routes, builtRoutes...)
+	}
+
+	var frontendTlsAllow []cetusguard.TlsAllowRule
+	for _, frontendTlsAllowElem := range frontendTlsAllowList {
+		builtRules, err := cetusguard.BuildTlsAllowRules(frontendTlsAllowElem)
+		if err != nil {
+			logger.Critical(err)
+		}
+		frontendTlsAllow = append(frontendTlsAllow, builtRules...)
+	}
+
+	var frontendAcl []cetusguard.AclRule
+	for _, frontendAclElem := range frontendAclList {
+		builtRules, err := cetusguard.BuildAclRules(frontendAclElem)
+		if err != nil {
+			logger.Critical(err)
+		}
+		frontendAcl = append(frontendAcl, builtRules...)
+	}
+
+	var frontendAuthJwtClaims []cetusguard.JwtClaimRule
+	for _, frontendAuthJwtClaimElem := range frontendAuthJwtClaimList {
+		builtRules, err := cetusguard.BuildJwtClaimRules(frontendAuthJwtClaimElem)
+		if err != nil {
+			logger.Critical(err)
+		}
+		frontendAuthJwtClaims = append(frontendAuthJwtClaims, builtRules...)
+	}
+
+	var frontendProxyTrusted []*net.IPNet
+	for _, frontendProxyTrustedElem := range frontendProxyTrustedList {
+		network, err := cetusguard.ParseNetwork(frontendProxyTrustedElem)
+		if err != nil {
+			logger.Critical(err)
+		}
+		frontendProxyTrusted = append(frontendProxyTrusted, network)
+	}
+
+	var rateLimit cetusguard.Rate
+	if rateLimitStr != "" {
+		rateLimit, err = cetusguard.ParseRate(rateLimitStr)
+		if err != nil {
+			logger.Critical(err)
+		}
+	}
+
+	hardening := &cetusguard.Hardening{
+		NoNewPrivileges:        hardeningNoNewPrivileges,
+		DropCapabilities:       hardeningCapDrop,
+		ReadonlyRootfs:         hardeningReadonlyRootfs,
+		DefaultPidsLimit:       int64(hardeningPidsLimit),
+		DefaultSeccompProfile:  hardeningSeccompProfile,
+		DefaultApparmorProfile: hardeningApparmorProfile,
+	}
+	if hardeningCapAllowlist != "" {
+		hardening.CapAllowlist = strings.Split(hardeningCapAllowlist, ",")
+	}
+	if hardeningMemoryStr != "" {
+		hardening.DefaultMemory, err = cetusguard.ParseSize(hardeningMemoryStr)
+		if err != nil {
+			logger.Critical(err)
+		}
+	}
+	if hardeningCpusStr != "" {
+		hardening.DefaultNanoCpus, err = cetusguard.ParseCpus(hardeningCpusStr)
+		if err != nil {
+			logger.Critical(err)
+		}
+	}
+
+	var execRules []cetusguard.ExecRule
+	for _, execRuleElem := range execRuleList {
+		builtRules, err := cetusguard.BuildExecRules(execRuleElem)
+		if err != nil {
+			logger.Critical(err)
+		}
+		execRules = append(execRules, builtRules...)
+	}
+
+	// The exec policy is enforced as soon as any of its options is set
+	var execPolicy *cetusguard.ExecPolicy
+	if len(execRules) > 0 || execAllowPrivileged || execAllowRoot || execDefaultUser != "" || len(execAllowEnv) > 0 {
+		execPolicy = &cetusguard.ExecPolicy{
+			Rules:           execRules,
+			AllowPrivileged: execAllowPrivileged,
+			AllowRoot:       execAllowRoot,
+			DefaultUser:     execDefaultUser,
+			AllowedEnv:      execAllowEnv,
+		}
+	}
+
+	// The image policy is enforced as soon as any of its options is set
+	var imagePolicy *cetusguard.ImagePolicy
+	if len(imageAllowRegistry) > 0 || len(imageAllowRepository) > 0 || imageRequireDigest {
+		imagePolicy = &cetusguard.ImagePolicy{
+			Registries:    imageAllowRegistry,
+			Repositories:  imageAllowRepository,
+			RequireDigest: imageRequireDigest,
+		}
+	}
+
+	// The mount policy is enforced as soon as any of its options is set
+	var mountPolicy *cetusguard.MountPolicy
+	if len(mountAllow) > 0 || mountReadonly || len(mountVolumeDriver) > 0 || len(mountVolumeOpt) > 0 {
+		mountPolicy = &cetusguard.MountPolicy{
+			AllowedPaths:  mountAllow,
+			ReadOnly:      mountReadonly,
+			VolumeDrivers: mountVolumeDriver,
+			VolumeOptions: mountVolumeOpt,
+		}
+	}
+
+	var ownerRules []cetusguard.OwnerRule
+	for _, ownerRuleElem := range ownerRuleList {
+		builtRules, err := cetusguard.BuildOwnerRules(ownerRuleElem)
+		if err != nil {
+			logger.Critical(err)
+		}
+		ownerRules = append(ownerRules, builtRules...)
+	}
+
+	// The port policy is enforced as soon as any host IP or port is restricted
+	var portPolicy *cetusguard.PortPolicy
+	if len(portAllowIp) > 0 || len(portAllowRange) > 0 {
+		portPolicy = &cetusguard.PortPolicy{
+			HostIps:          portAllowIp,
+			HostPorts:        portAllowRange,
+			AllowPublishAll:  portAllowPublishAll,
+			AllowHostNetwork: portAllowHostNetwork,
+		}
+	}
+
+	var backendTlsCipherSuiteList []string
+	if backendTlsCipherSuites != "" {
+		backendTlsCipherSuiteList = strings.Split(backendTlsCipherSuites, ",")
+	}
+
+	// The first backend address is the primary one and the rest are used for failover
+	var backendPrimaryAddr string
+	var backendFailoverAddr []string
+	if len(backendAddr) > 0 {
+		backendPrimaryAddr, backendFailoverAddr = backendAddr[0], backendAddr[1:]
+	}
+
 	cg := &cetusguard.Server{
 		Backend: &cetusguard.Backend{
-			Addr:      backendAddr,
-			TlsCacert: backendTlsCacert,
-			TlsCert:   backendTlsCert,
-			TlsKey:    backendTlsKey,
+			Addr:                backendPrimaryAddr,
+			FailoverAddr:        backendFailoverAddr,
+			TlsCacert:           backendTlsCacert,
+			TlsCert:             backendTlsCert,
+			TlsKey:              backendTlsKey,
+			TlsServerName:       backendTlsServerName,
+			TlsPin:              backendTlsPin,
+			TlsMinVersion:       backendTlsMinVersion,
+			TlsCipherSuites:     backendTlsCipherSuiteList,
+			HealthCheckInterval: backendHealthCheckInterval,
+			AffinityTtl:         backendAffinityTtl,
 		},
+		Backends: backends,
 		Frontend: &cetusguard.Frontend{
-			Addr:      frontendAddr,
-			TlsCacert: frontendTlsCacert,
-			TlsCert:   frontendTlsCert,
-			TlsKey:    frontendTlsKey,
+			Addr:            frontendAddr,
+			TlsCacert:       frontendTlsCacert,
+			TlsCert:         frontendTlsCert,
+			TlsKey:          frontendTlsKey,
+			TlsCrl:          frontendTlsCrl,
+			TlsDeny:         frontendTlsDeny,
+			TlsAllow:        frontendTlsAllow,
+			TlsUnix:         frontendTlsUnix,
+			TlsBootstrapDir: frontendTlsBootstrapDir,
+			AuthHtpasswd:    frontendAuthHtpasswd,
+			AuthTokens:      frontendAuthTokens,
+			AuthJwks:        frontendAuthJwks,
+			AuthJwtClaims:   frontendAuthJwtClaims,
+			Acl:             frontendAcl,
+			ProxyProtocol:   frontendProxyProtocol,
+			ProxyTrusted:    frontendProxyTrusted,
 		},
-		Rules: rules,
+		Routes:              routes,
+		Rules:               rules,
+		AnonymousRules:      anonymousRules,
+		RuleSets:            ruleSets,
+		RecordDir:           recordDir,
+		SessionMaxLifetime:  sessionMaxLifetime,
+		SessionIdleTimeout:  sessionIdleTimeout,
+		ShutdownGracePeriod: shutdownGracePeriod,
+		MetricsAddr:         metricsAddr,
+		RateLimit:           rateLimit,
+		RateLimitBurst:      rateLimitBurst,
+		MaxInFlight:         maxInFlight,
+		MaxSessions:         maxSessions,
+		Hardening:           hardening,
+		MountPolicy:         mountPolicy,
+		PortPolicy:          portPolicy,
+		ImagePolicy:         imagePolicy,
+		ExecPolicy:          execPolicy,
+		OwnerRules:          ownerRules,
 	}
 
 	ready := make(chan any, 1)
-	err := cg.Start(ready)
+	err = cg.Start(ready)
 	if err != nil {
 		logger.Critical(err)
 	}
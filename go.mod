@@ -1,3 +1,7 @@
 module github.com/hectorm/cetusguard
 
 go 1.25.6
+
+require golang.org/x/crypto v0.54.0
+
+require golang.org/x/sys v0.47.0 // indirect
@@ -0,0 +1,155 @@
+package dockercli
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// Name of the context that uses the DOCKER_HOST variable or the default socket
+const defaultContextName = "default"
+
+// Daemon endpoint and TLS files that the Docker CLI would use
+type Endpoint struct {
+	Host      string
+	TlsCacert string
+	TlsCert   string
+	TlsKey    string
+}
+
+type config struct {
+	CurrentContext string `json:"currentContext"`
+}
+
+type contextMeta struct {
+	Name      string `json:"Name"`
+	Endpoints map[string]struct {
+		Host          string `json:"Host"`
+		SkipTLSVerify bool   `json:"SkipTLSVerify"`
+	} `json:"Endpoints"`
+}
+
+// Resolves the endpoint from the DOCKER_HOST, DOCKER_TLS_VERIFY and DOCKER_CERT_PATH variables,
+// or else from the context selected with DOCKER_CONTEXT or in the CLI configuration file.
+// It returns nil if the Docker CLI would use the default socket, which is also the case when the configuration
+// directory cannot be found or the configuration file cannot be used, unless DOCKER_CONTEXT names a context
+func CurrentEndpoint() (*Endpoint, error) {
+	if host := os.Getenv("DOCKER_HOST"); host != "" {
+		endpoint := &Endpoint{Host: host}
+		if os.Getenv("DOCKER_TLS_VERIFY") != "" {
+			certPath := os.Getenv("DOCKER_CERT_PATH")
+			if certPath == "" {
+				certPath, _ = configDir()
+			}
+			if certPath != "" {
+				endpoint.setTlsFiles(certPath)
+			}
+		} else if os.Getenv("DOCKER_CERT_PATH") != "" {
+			// The Docker CLI would use the certificates without verifying the daemon
+			return nil, errors.New("DOCKER_CERT_PATH without DOCKER_TLS_VERIFY skips TLS verification, which is not supported")
+		}
+		return endpoint, nil
+	}
+
+	name := os.Getenv("DOCKER_CONTEXT")
+	if name != "" {
+		if name == defaultContextName {
+			return nil, nil
+		}
+		configDir, err := configDir()
+		if err != nil {
+			return nil, err
+		}
+		return contextEndpoint(configDir, name)
+	}
+
+	configDir, err := configDir()
+	if err != nil {
+		return nil, nil
+	}
+	name, err = currentContextName(configDir)
+	if err != nil || name == "" || name == defaultContextName {
+		return nil, nil
+	}
+	endpoint, err := contextEndpoint(configDir, name)
+	if err != nil {
+		return nil, nil
+	}
+	return endpoint, nil
+}
+
+func configDir() (string, error) {
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return dir, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".docker"), nil
+}
+
+func currentContextName(configDir string) (string, error) {
+	data, err := os.ReadFile(filepath.Clean(filepath.Join(configDir, "config.json")))
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	var cfg config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return "", fmt.Errorf("error loading docker CLI configuration: %w", err)
+	}
+	return cfg.CurrentContext, nil
+}
+
+// Contexts are stored in directories named after the SHA-256 digest of their name
+func contextEndpoint(configDir string, name string) (*Endpoint, error) {
+	digest := sha256.Sum256([]byte(name))
+	id := hex.EncodeToString(digest[:])
+
+	data, err := os.ReadFile(filepath.Clean(filepath.Join(configDir, "contexts", "meta", id, "meta.json")))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("docker context not found: %s", name)
+	} else if err != nil {
+		return nil, err
+	}
+
+	var meta contextMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, fmt.Errorf("error loading docker context %s: %w", name, err)
+	}
+
+	docker, ok := meta.Endpoints["docker"]
+	if !ok || docker.Host == "" {
+		return nil, fmt.Errorf("docker context has no docker endpoint: %s", name)
+	}
+	if docker.SkipTLSVerify {
+		return nil, fmt.Errorf("docker context skips TLS verification, which is not supported: %s", name)
+	}
+
+	endpoint := &Endpoint{Host: docker.Host}
+	endpoint.setTlsFiles(filepath.Join(configDir, "contexts", "tls", id, "docker"))
+	return endpoint, nil
+}
+
+// Uses the TLS files that exist in the directory, like the Docker CLI does
+func (endpoint *Endpoint) setTlsFiles(dir string) {
+	files := map[string]*string{
+		"ca.pem":   &endpoint.TlsCacert,
+		"cert.pem": &endpoint.TlsCert,
+		"key.pem":  &endpoint.TlsKey,
+	}
+	for name, field := range files {
+		path := filepath.Join(dir, name)
+		if _, err := os.Stat(path); err == nil {
+			*field = path
+		}
+	}
+}
@@ -0,0 +1,269 @@
+package dockercli
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func setupEnv(t *testing.T) string {
+	t.Helper()
+	configDir := t.TempDir()
+	t.Setenv("DOCKER_CONFIG", configDir)
+	t.Setenv("DOCKER_HOST", "")
+	t.Setenv("DOCKER_TLS_VERIFY", "")
+	t.Setenv("DOCKER_CERT_PATH", "")
+	t.Setenv("DOCKER_CONTEXT", "")
+	return configDir
+}
+
+func writeFile(t *testing.T, path string, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeContext(t *testing.T, configDir string, name string, meta string, tlsFiles ...string) {
+	t.Helper()
+	digest := sha256.Sum256([]byte(name))
+	id := hex.EncodeToString(digest[:])
+	writeFile(t, filepath.Join(configDir, "contexts", "meta", id, "meta.json"), meta)
+	for _, tlsFile := range tlsFiles {
+		writeFile(t, filepath.Join(configDir, "contexts", "tls", id, "docker", tlsFile), "")
+	}
+}
+
+func TestCurrentEndpointDefault(t *testing.T) {
+	setupEnv(t)
+
+	endpoint, err := CurrentEndpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if endpoint != nil {
+		t.Errorf("endpoint = %v, want nil", endpoint)
+	}
+}
+
+func TestCurrentEndpointHost(t *testing.T) {
+	setupEnv(t)
+	t.Setenv("DOCKER_HOST", "tcp://127.0.0.1:2376")
+
+	endpoint, err := CurrentEndpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := &Endpoint{Host: "tcp://127.0.0.1:2376"}
+	if !reflect.DeepEqual(endpoint, want) {
+		t.Errorf("endpoint = %v, want %v", endpoint, want)
+	}
+}
+
+func TestCurrentEndpointHostTlsVerify(t *testing.T) {
+	setupEnv(t)
+	certPath := t.TempDir()
+	writeFile(t, filepath.Join(certPath, "ca.pem"), "")
+	writeFile(t, filepath.Join(certPath, "cert.pem"), "")
+	writeFile(t, filepath.Join(certPath, "key.pem"), "")
+	t.Setenv("DOCKER_HOST", "tcp://127.0.0.1:2376")
+	t.Setenv("DOCKER_TLS_VERIFY", "1")
+	t.Setenv("DOCKER_CERT_PATH", certPath)
+
+	endpoint, err := CurrentEndpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := &Endpoint{
+		Host:      "tcp://127.0.0.1:2376",
+		TlsCacert: filepath.Join(certPath, "ca.pem"),
+		TlsCert:   filepath.Join(certPath, "cert.pem"),
+		TlsKey:    filepath.Join(certPath, "key.pem"),
+	}
+	if !reflect.DeepEqual(endpoint, want) {
+		t.Errorf("endpoint = %v, want %v", endpoint, want)
+	}
+}
+
+func TestCurrentEndpointHostTlsVerifyConfigDir(t *testing.T) {
+	configDir := setupEnv(t)
+	writeFile(t, filepath.Join(configDir, "ca.pem"), "")
+	t.Setenv("DOCKER_HOST", "tcp://127.0.0.1:2376")
+	t.Setenv("DOCKER_TLS_VERIFY", "1")
+
+	endpoint, err := CurrentEndpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := &Endpoint{
+		Host:      "tcp://127.0.0.1:2376",
+		TlsCacert: filepath.Join(configDir, "ca.pem"),
+	}
+	if !reflect.DeepEqual(endpoint, want) {
+		t.Errorf("endpoint = %v, want %v", endpoint, want)
+	}
+}
+
+func TestCurrentEndpointHostCertPathWithoutTlsVerify(t *testing.T) {
+	setupEnv(t)
+	certPath := t.TempDir()
+	writeFile(t, filepath.Join(certPath, "ca.pem"), "")
+	t.Setenv("DOCKER_HOST", "tcp://127.0.0.1:2376")
+	t.Setenv("DOCKER_CERT_PATH", certPath)
+
+	if _, err := CurrentEndpoint(); err == nil {
+		t.Errorf("endpoint resolved, want an error")
+	}
+}
+
+func TestCurrentEndpointContextEnv(t *testing.T) {
+	configDir := setupEnv(t)
+	writeContext(t, configDir, "remote", `{"Name":"remote","Endpoints":{"docker":{"Host":"tcp://10.0.0.1:2376"}}}`, "ca.pem", "cert.pem", "key.pem")
+	t.Setenv("DOCKER_CONTEXT", "remote")
+
+	endpoint, err := CurrentEndpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	digest := sha256.Sum256([]byte("remote"))
+	tlsDir := filepath.Join(configDir, "contexts", "tls", hex.EncodeToString(digest[:]), "docker")
+	want := &Endpoint{
+		Host:      "tcp://10.0.0.1:2376",
+		TlsCacert: filepath.Join(tlsDir, "ca.pem"),
+		TlsCert:   filepath.Join(tlsDir, "cert.pem"),
+		TlsKey:    filepath.Join(tlsDir, "key.pem"),
+	}
+	if !reflect.DeepEqual(endpoint, want) {
+		t.Errorf("endpoint = %v, want %v", endpoint, want)
+	}
+}
+
+func TestCurrentEndpointContextConfig(t *testing.T) {
+	configDir := setupEnv(t)
+	writeContext(t, configDir, "remote", `{"Name":"remote","Endpoints":{"docker":{"Host":"ssh://docker@10.0.0.1"}}}`)
+	writeFile(t, filepath.Join(configDir, "config.json"), `{"currentContext":"remote"}`)
+
+	endpoint, err := CurrentEndpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := &Endpoint{Host: "ssh://docker@10.0.0.1"}
+	if !reflect.DeepEqual(endpoint, want) {
+		t.Errorf("endpoint = %v, want %v", endpoint, want)
+	}
+}
+
+func TestCurrentEndpointHostOverridesContext(t *testing.T) {
+	configDir := setupEnv(t)
+	writeContext(t, configDir, "remote", `{"Name":"remote","Endpoints":{"docker":{"Host":"tcp://10.0.0.1:2376"}}}`)
+	t.Setenv("DOCKER_CONTEXT", "remote")
+	t.Setenv("DOCKER_HOST", "unix:///run/docker.sock")
+
+	endpoint, err := CurrentEndpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := &Endpoint{Host: "unix:///run/docker.sock"}
+	if !reflect.DeepEqual(endpoint, want) {
+		t.Errorf("endpoint = %v, want %v", endpoint, want)
+	}
+}
+
+func TestCurrentEndpointDefaultContext(t *testing.T) {
+	configDir := setupEnv(t)
+	writeFile(t, filepath.Join(configDir, "config.json"), `{"currentContext":"remote"}`)
+	t.Setenv("DOCKER_CONTEXT", "default")
+
+	endpoint, err := CurrentEndpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if endpoint != nil {
+		t.Errorf("endpoint = %v, want nil", endpoint)
+	}
+}
+
+func TestCurrentEndpointInvalidContext(t *testing.T) {
+	metas := map[string]string{
+		"missing":  "",
+		"invalid":  `{`,
+		"noDocker": `{"Name":"noDocker","Endpoints":{}}`,
+		"skipTls":  `{"Name":"skipTls","Endpoints":{"docker":{"Host":"tcp://10.0.0.1:2376","SkipTLSVerify":true}}}`,
+	}
+
+	for name, meta := range metas {
+		configDir := setupEnv(t)
+		if meta != "" {
+			writeContext(t, configDir, name, meta)
+		}
+		t.Setenv("DOCKER_CONTEXT", name)
+
+		if _, err := CurrentEndpoint(); err == nil {
+			t.Errorf("%s: endpoint resolved, want an error", name)
+		}
+	}
+}
+
+func TestCurrentEndpointInvalidConfig(t *testing.T) {
+	configDirs := map[string]string{
+		"invalid": `{`,
+		"stale":   `{"currentContext":"removed"}`,
+	}
+
+	// The Docker CLI configuration is optional, so the default socket is used if it cannot be used
+	for name, cfg := range configDirs {
+		configDir := setupEnv(t)
+		writeFile(t, filepath.Join(configDir, "config.json"), cfg)
+
+		endpoint, err := CurrentEndpoint()
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+		if endpoint != nil {
+			t.Errorf("%s: endpoint = %v, want nil", name, endpoint)
+		}
+	}
+}
+
+func TestCurrentEndpointNoHome(t *testing.T) {
+	setupEnv(t)
+	t.Setenv("DOCKER_CONFIG", "")
+	t.Setenv("HOME", "")
+
+	endpoint, err := CurrentEndpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if endpoint != nil {
+		t.Errorf("endpoint = %v, want nil", endpoint)
+	}
+
+	t.Setenv("DOCKER_HOST", "tcp://127.0.0.1:2376")
+	t.Setenv("DOCKER_TLS_VERIFY", "1")
+	endpoint, err = CurrentEndpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wanted := (&Endpoint{Host: "tcp://127.0.0.1:2376"}); !reflect.DeepEqual(endpoint, wanted) {
+		t.Errorf("endpoint = %v, want %v", endpoint, wanted)
+	}
+
+	// A context named explicitly cannot be resolved without a configuration directory
+	t.Setenv("DOCKER_HOST", "")
+	t.Setenv("DOCKER_CONTEXT", "remote")
+	if _, err := CurrentEndpoint(); err == nil {
+		t.Errorf("endpoint resolved, want an error")
+	}
+}
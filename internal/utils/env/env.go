@@ -3,6 +3,7 @@ package env
 import (
 	"os"
 	"strconv"
+	"time"
 )
 
 func StringEnv(def string, keys ...string) string {
@@ -44,3 +45,14 @@ func BoolEnv(def bool, keys ...string) bool {
 	}
 	return def
 }
+
+func DurationEnv(def time.Duration, keys ...string) time.Duration {
+	for _, key := range keys {
+		if val, ok := os.LookupEnv(key); ok {
+			if d, err := time.ParseDuration(val); err == nil {
+				return d
+			}
+		}
+	}
+	return def
+}
@@ -2,6 +2,7 @@ package env
 
 import (
 	"testing"
+	"time"
 )
 
 func TestStringEnvDefault(t *testing.T) {
@@ -187,3 +188,54 @@ func TestBoolEnvWrongType(t *testing.T) {
 		t.Errorf("val = %t, want %t", val, false)
 	}
 }
+
+func TestDurationEnvDefault(t *testing.T) {
+	val := DurationEnv(time.Second, "FOO")
+
+	if val != time.Second {
+		t.Errorf("val = %s, want %s", val, time.Second)
+	}
+}
+
+func TestDurationEnvFirst(t *testing.T) {
+	t.Setenv("FOO1", "1m")
+	t.Setenv("FOO2", "2m")
+	t.Setenv("FOO3", "3m")
+
+	val := DurationEnv(0, "FOO1", "FOO2", "FOO3")
+
+	if val != time.Minute {
+		t.Errorf("val = %s, want %s", val, time.Minute)
+	}
+}
+
+func TestDurationEnvSecond(t *testing.T) {
+	t.Setenv("FOO2", "2m")
+	t.Setenv("FOO3", "3m")
+
+	val := DurationEnv(0, "FOO1", "FOO2", "FOO3")
+
+	if val != 2*time.Minute {
+		t.Errorf("val = %s, want %s", val, 2*time.Minute)
+	}
+}
+
+func TestDurationEnvWrongType(t *testing.T) {
+	t.Setenv("FOO", "BAR")
+
+	val := DurationEnv(0, "FOO")
+
+	if val != 0 {
+		t.Errorf("val = %s, want %s", val, time.Duration(0))
+	}
+}
+
+func TestDurationEnvEmpty(t *testing.T) {
+	t.Setenv("FOO", "")
+
+	val := DurationEnv(0, "FOO")
+
+	if val != 0 {
+		t.Errorf("val = %s, want %s", val, time.Duration(0))
+	}
+}
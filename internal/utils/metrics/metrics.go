@@ -0,0 +1,129 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Set of metrics exposed in the Prometheus text format
+type Registry struct {
+	gauges []*Gauge
+	mu     sync.Mutex
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// Metric that can go up and down, with a value for each combination of label values
+type Gauge struct {
+	name       string
+	help       string
+	labelNames []string
+	values     map[string]gaugeValue
+	mu         sync.Mutex
+}
+
+type gaugeValue struct {
+	labelValues []string
+	value       float64
+}
+
+func (r *Registry) NewGauge(name string, help string, labelNames ...string) *Gauge {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	g := &Gauge{
+		name:       name,
+		help:       help,
+		labelNames: labelNames,
+		values:     make(map[string]gaugeValue),
+	}
+	r.gauges = append(r.gauges, g)
+	return g
+}
+
+func (g *Gauge) Set(value float64, labelValues ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.values[labelKey(labelValues)] = gaugeValue{labelValues, value}
+}
+
+func (g *Gauge) Delete(labelValues ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	delete(g.values, labelKey(labelValues))
+}
+
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	gauges := slices.Clone(r.gauges)
+	r.mu.Unlock()
+
+	var sb strings.Builder
+	for _, g := range gauges {
+		g.writeTo(&sb)
+	}
+
+	n, err := io.WriteString(w, sb.String())
+	return int64(n), err
+}
+
+func (r *Registry) ServeHTTP(wri http.ResponseWriter, _ *http.Request) {
+	wri.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = r.WriteTo(wri)
+}
+
+func (g *Gauge) writeTo(sb *strings.Builder) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	fmt.Fprintf(sb, "# HELP %s %s\n", g.name, escape(g.help, false))
+	fmt.Fprintf(sb, "# TYPE %s gauge\n", g.name)
+
+	keys := make([]string, 0, len(g.values))
+	for k := range g.values {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	for _, k := range keys {
+		v := g.values[k]
+		sb.WriteString(g.name)
+		if len(g.labelNames) > 0 {
+			sb.WriteByte('{')
+			for i, name := range g.labelNames {
+				if i > 0 {
+					sb.WriteByte(',')
+				}
+				var val string
+				if i < len(v.labelValues) {
+					val = v.labelValues[i]
+				}
+				fmt.Fprintf(sb, `%s="%s"`, name, escape(val, true))
+			}
+			sb.WriteByte('}')
+		}
+		fmt.Fprintf(sb, " %s\n", strconv.FormatFloat(v.value, 'g', -1, 64))
+	}
+}
+
+func labelKey(labelValues []string) string {
+	return strings.Join(labelValues, "\xff")
+}
+
+func escape(s string, quotes bool) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, "\n", `\n`)
+	if quotes {
+		s = strings.ReplaceAll(s, `"`, `\"`)
+	}
+	return s
+}
@@ -0,0 +1,60 @@
+package metrics
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRegistryWriteTo(t *testing.T) {
+	r := NewRegistry()
+
+	g1 := r.NewGauge("test_expiry_seconds", "Expiry of the\ncertificates", "path")
+	g1.Set(2, `/b"\.pem`)
+	g1.Set(1, "/a.pem")
+	g1.Set(3, "/c.pem")
+	g1.Delete("/c.pem")
+
+	g2 := r.NewGauge("test_total", "Total")
+	g2.Set(1.5)
+
+	var sb strings.Builder
+	if _, err := r.WriteTo(&sb); err != nil {
+		t.Fatal(err)
+	}
+
+	wanted := strings.Join([]string{
+		`# HELP test_expiry_seconds Expiry of the\ncertificates`,
+		`# TYPE test_expiry_seconds gauge`,
+		`test_expiry_seconds{path="/a.pem"} 1`,
+		`test_expiry_seconds{path="/b\"\\.pem"} 2`,
+		`# HELP test_total Total`,
+		`# TYPE test_total gauge`,
+		`test_total 1.5`,
+	}, "\n") + "\n"
+	if sb.String() != wanted {
+		t.Errorf("output = %q, want %q", sb.String(), wanted)
+	}
+}
+
+func TestRegistryServeHTTP(t *testing.T) {
+	r := NewRegistry()
+	r.NewGauge("test_gauge", "Test").Set(1)
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	res := rec.Result()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ct := res.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("Content-Type = %s, want text/plain", ct)
+	}
+	if !strings.Contains(string(body), "test_gauge 1\n") {
+		t.Errorf("body = %q, want the gauge value", body)
+	}
+}
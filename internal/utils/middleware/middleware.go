@@ -1,27 +1,88 @@
 package middleware
 
-import "net/http"
+import (
+	"net/http"
+	"sync"
+	"time"
+)
 
 type ResponseWriter struct {
 	http.ResponseWriter
 	http.Flusher
 	http.Hijacker
+
+	// Maximum time written data can be buffered before it is flushed,
+	// if zero every write is flushed immediately
+	FlushInterval time.Duration
+
+	flushPending bool
+	flushTimer   *time.Timer
+	mu           sync.Mutex
 }
 
 func (wri *ResponseWriter) Write(data []byte) (int, error) {
+	wri.mu.Lock()
+	defer wri.mu.Unlock()
+
 	n, err := wri.ResponseWriter.Write(data)
 
 	if wri.Flusher != nil {
-		wri.Flush()
+		if wri.FlushInterval <= 0 {
+			wri.Flusher.Flush()
+		} else if !wri.flushPending {
+			wri.flushPending = true
+			if wri.flushTimer == nil {
+				wri.flushTimer = time.AfterFunc(wri.FlushInterval, wri.delayedFlush)
+			} else {
+				wri.flushTimer.Reset(wri.FlushInterval)
+			}
+		}
 	}
 
 	return n, err
 }
 
 func (wri *ResponseWriter) WriteHeader(statusCode int) {
+	wri.mu.Lock()
+	defer wri.mu.Unlock()
+
 	wri.ResponseWriter.WriteHeader(statusCode)
 
 	if wri.Flusher != nil {
-		wri.Flush()
+		wri.Flusher.Flush()
+	}
+}
+
+func (wri *ResponseWriter) Flush() {
+	wri.mu.Lock()
+	defer wri.mu.Unlock()
+
+	if wri.Flusher != nil {
+		wri.Flusher.Flush()
+	}
+	wri.flushPending = false
+}
+
+// Flushes any pending data and stops the flush timer, it must be called before the handler returns
+func (wri *ResponseWriter) Stop() {
+	wri.mu.Lock()
+	defer wri.mu.Unlock()
+
+	if wri.flushTimer != nil {
+		wri.flushTimer.Stop()
+	}
+	if wri.flushPending {
+		wri.Flusher.Flush()
+		wri.flushPending = false
+	}
+}
+
+func (wri *ResponseWriter) delayedFlush() {
+	wri.mu.Lock()
+	defer wri.mu.Unlock()
+
+	if wri.flushPending {
+		wri.Flusher.Flush()
+		wri.flushPending = false
 	}
 }
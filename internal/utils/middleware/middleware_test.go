@@ -1,10 +1,12 @@
 package middleware
 
 import (
+	"bufio"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 )
 
 func TestMiddlewareResponseWriterFlush(t *testing.T) {
@@ -44,6 +46,56 @@ func TestMiddlewareResponseWriterFlush(t *testing.T) {
 	}
 }
 
+func TestMiddlewareResponseWriterBatchedFlush(t *testing.T) {
+	received := make(chan any)
+	ts := httptest.NewServer(http.HandlerFunc(func(wri http.ResponseWriter, req *http.Request) {
+		mWri := &ResponseWriter{ResponseWriter: wri, Flusher: wri.(http.Flusher), FlushInterval: 50 * time.Millisecond}
+		defer mWri.Stop()
+
+		mWri.WriteHeader(http.StatusTeapot)
+		_, _ = mWri.Write([]byte("I'm "))
+		_, _ = mWri.Write([]byte("a\n"))
+
+		// The pending data must be flushed by the timer
+		select {
+		case <-received:
+		case <-time.After(5 * time.Second):
+			t.Errorf("data not flushed, want flushed")
+		}
+
+		_, _ = mWri.Write([]byte("teapot"))
+	}))
+	defer ts.Close()
+
+	res, err := ts.Client().Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = res.Body.Close()
+	}()
+
+	if res.StatusCode != http.StatusTeapot {
+		t.Fatalf("res.StatusCode = %d, want %d", res.StatusCode, http.StatusTeapot)
+	}
+
+	br := bufio.NewReader(res.Body)
+	line, err := br.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	close(received)
+
+	rest, err := io.ReadAll(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if msg := line + string(rest); msg != "I'm a\nteapot" {
+		t.Fatalf(`msg = "%s", want "%s"`, msg, "I'm a\nteapot")
+	}
+}
+
 func TestMiddlewareResponseWriterHijack(t *testing.T) {
 	ts := httptest.NewServer(http.HandlerFunc(func(wri http.ResponseWriter, req *http.Request) {
 		if hj, ok := wri.(http.Hijacker); ok {
@@ -85,3 +137,46 @@ func TestMiddlewareResponseWriterHijack(t *testing.T) {
 		t.Fatalf(`msg = "%s", want "%s"`, msg, "I'm a teapot")
 	}
 }
+
+func benchmarkMiddlewareResponseWriter(b *testing.B, flushInterval time.Duration) {
+	const chunkSize = 32 * 1024
+
+	chunk := make([]byte, chunkSize)
+	ts := httptest.NewServer(http.HandlerFunc(func(wri http.ResponseWriter, req *http.Request) {
+		mWri := &ResponseWriter{ResponseWriter: wri, Flusher: wri.(http.Flusher), FlushInterval: flushInterval}
+		defer mWri.Stop()
+
+		mWri.WriteHeader(http.StatusOK)
+		for i := 0; i < b.N; i++ {
+			_, _ = mWri.Write(chunk)
+		}
+	}))
+	defer ts.Close()
+
+	b.SetBytes(chunkSize)
+	b.ResetTimer()
+
+	res, err := ts.Client().Get(ts.URL)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer func() {
+		_ = res.Body.Close()
+	}()
+
+	n, err := io.Copy(io.Discard, res.Body)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if n != int64(b.N)*chunkSize {
+		b.Fatalf("n = %d, want %d", n, int64(b.N)*chunkSize)
+	}
+}
+
+func BenchmarkMiddlewareResponseWriterImmediateFlush(b *testing.B) {
+	benchmarkMiddlewareResponseWriter(b, 0)
+}
+
+func BenchmarkMiddlewareResponseWriterBatchedFlush(b *testing.B) {
+	benchmarkMiddlewareResponseWriter(b, 100*time.Millisecond)
+}
@@ -0,0 +1,78 @@
+package netcopy
+
+import (
+	"io"
+	"net"
+	"sync"
+)
+
+const (
+	bufferSize = 32 * 1024
+)
+
+var bufferPool = sync.Pool{
+	New: func() any {
+		b := make([]byte, bufferSize)
+		return &b
+	},
+}
+
+// Copies from src to dst until EOF is reached on src or an error occurs.
+// If both ends are raw sockets and the platform supports it, the data is moved within the kernel,
+// otherwise a pooled buffer is used. If onData is not nil, it is called after every chunk is copied
+func Copy(dst io.Writer, src io.Reader, onData func(int64)) (int64, error) {
+	if Spliceable(dst) && Spliceable(src) {
+		return splice(dst.(net.Conn), src.(net.Conn), onData)
+	}
+	return copyBuffer(dst, src, onData)
+}
+
+// Reports whether data can be moved to or from the given value within the kernel
+func Spliceable(conn any) bool {
+	if !spliceSupported {
+		return false
+	}
+	switch c := conn.(type) {
+	case *net.TCPConn:
+		return true
+	case *net.UnixConn:
+		return c.LocalAddr().Network() == "unix"
+	}
+	return false
+}
+
+// Same as io.CopyBuffer, but the ReaderFrom and WriterTo interfaces are deliberately ignored,
+// because they would allocate their own buffer and onData could not be called
+func copyBuffer(dst io.Writer, src io.Reader, onData func(int64)) (written int64, err error) {
+	bp := bufferPool.Get().(*[]byte)
+	defer bufferPool.Put(bp)
+	buf := *bp
+
+	for {
+		nr, rerr := src.Read(buf)
+		if nr > 0 {
+			nw, werr := dst.Write(buf[:nr])
+			if nw < 0 || nr < nw {
+				nw = 0
+				if werr == nil {
+					werr = io.ErrShortWrite
+				}
+			}
+			written += int64(nw)
+			if onData != nil && nw > 0 {
+				onData(int64(nw))
+			}
+			if werr != nil {
+				return written, werr
+			}
+			if nr != nw {
+				return written, io.ErrShortWrite
+			}
+		}
+		if rerr == io.EOF {
+			return written, nil
+		} else if rerr != nil {
+			return written, rerr
+		}
+	}
+}
@@ -0,0 +1,94 @@
+//go:build linux
+
+package netcopy
+
+import (
+	"io"
+	"net"
+	"syscall"
+)
+
+const (
+	spliceSupported = true
+
+	// Defined in <linux/splice.h>
+	spliceFlagMove     = 0x1
+	spliceFlagNonblock = 0x2
+
+	// Default capacity of a pipe, larger chunks would block until the pipe is drained
+	spliceMaxChunkSize = 64 * 1024
+)
+
+// Moves data from src to dst through an intermediate pipe with splice(2),
+// deadlines and closes of the connections are honored as with regular reads and writes
+func splice(dst net.Conn, src net.Conn, onData func(int64)) (written int64, err error) {
+	srcRc, err := src.(syscall.Conn).SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	dstRc, err := dst.(syscall.Conn).SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	var p [2]int
+	if err := syscall.Pipe2(p[:], syscall.O_CLOEXEC|syscall.O_NONBLOCK); err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = syscall.Close(p[0])
+		_ = syscall.Close(p[1])
+	}()
+
+	for {
+		var n int64
+		var serr error
+		err = srcRc.Read(func(fd uintptr) bool {
+			n, serr = spliceRetry(int(fd), p[1], spliceMaxChunkSize)
+			// Returning false waits until the socket is readable
+			return serr != syscall.EAGAIN
+		})
+		if err == nil {
+			err = serr
+		}
+		if err != nil {
+			return written, err
+		}
+		if n == 0 {
+			return written, nil
+		}
+
+		for remaining := n; remaining > 0; {
+			var m int64
+			err = dstRc.Write(func(fd uintptr) bool {
+				m, serr = spliceRetry(p[0], int(fd), int(remaining))
+				// Returning false waits until the socket is writable
+				return serr != syscall.EAGAIN
+			})
+			if err == nil {
+				err = serr
+			}
+			if err != nil {
+				return written, err
+			}
+			if m <= 0 {
+				return written, io.ErrShortWrite
+			}
+			remaining -= m
+			written += m
+		}
+
+		if onData != nil {
+			onData(n)
+		}
+	}
+}
+
+func spliceRetry(rfd int, wfd int, size int) (int64, error) {
+	for {
+		n, err := syscall.Splice(rfd, nil, wfd, nil, size, spliceFlagMove|spliceFlagNonblock)
+		if err != syscall.EINTR {
+			return n, err
+		}
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package netcopy
+
+import (
+	"errors"
+	"net"
+)
+
+const (
+	spliceSupported = false
+)
+
+func splice(_ net.Conn, _ net.Conn, _ func(int64)) (int64, error) {
+	return 0, errors.ErrUnsupported
+}
@@ -0,0 +1,194 @@
+package netcopy
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Returns both ends of a connection over the given network
+func connPair(tb testing.TB, network string) (net.Conn, net.Conn) {
+	tb.Helper()
+
+	addr := "127.0.0.1:0"
+	if network == "unix" {
+		addr = filepath.Join(tb.TempDir(), "netcopy.sock")
+	}
+
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer func() {
+		_ = ln.Close()
+	}()
+
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			tb.Error(err)
+		}
+		accepted <- conn
+	}()
+
+	client, err := net.Dial(network, ln.Addr().String())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	server := <-accepted
+	if server == nil {
+		tb.FailNow()
+	}
+
+	tb.Cleanup(func() {
+		_ = client.Close()
+		_ = server.Close()
+	})
+
+	return client, server
+}
+
+// Copies the data written to the first pair through the second pair with the given function,
+// returns the number of bytes written to sink on the other side
+func copyThrough(tb testing.TB, network string, data io.Reader, sink io.Writer, copyFunc func(dst net.Conn, src net.Conn) error) int64 {
+	tb.Helper()
+
+	srcW, srcR := connPair(tb, network)
+	dstW, dstR := connPair(tb, network)
+
+	go func() {
+		_, _ = io.Copy(srcW, data)
+		_ = srcW.Close()
+	}()
+
+	received := make(chan int64)
+	go func() {
+		n, _ := io.Copy(sink, dstR)
+		received <- n
+	}()
+
+	if err := copyFunc(dstW, srcR); err != nil {
+		tb.Fatal(err)
+	}
+	_ = dstW.Close()
+
+	return <-received
+}
+
+func TestCopy(t *testing.T) {
+	data := make([]byte, 1024*1024+123)
+	_, _ = rand.Read(data)
+
+	for _, network := range []string{"tcp", "unix"} {
+		t.Run(network, func(t *testing.T) {
+			var total int64
+			var received bytes.Buffer
+			copyThrough(t, network, bytes.NewReader(data), &received, func(dst net.Conn, src net.Conn) error {
+				if Spliceable(dst) != spliceSupported || Spliceable(src) != spliceSupported {
+					t.Errorf("spliceable = %t, want %t", !spliceSupported, spliceSupported)
+				}
+				n, err := Copy(dst, src, func(n int64) { total += n })
+				if n != int64(len(data)) {
+					t.Errorf("n = %d, want %d", n, len(data))
+				}
+				return err
+			})
+
+			if !bytes.Equal(received.Bytes(), data) {
+				t.Errorf("received %d bytes, want the %d bytes sent", received.Len(), len(data))
+			}
+			if total != int64(len(data)) {
+				t.Errorf("total = %d, want %d", total, len(data))
+			}
+		})
+	}
+}
+
+func TestCopyBuffer(t *testing.T) {
+	var dst strings.Builder
+	var calls int
+
+	if Spliceable(&dst) {
+		t.Errorf("builder spliceable, want not spliceable")
+	}
+
+	n, err := Copy(&dst, strings.NewReader("I'm a teapot"), func(int64) { calls++ })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 12 || dst.String() != "I'm a teapot" {
+		t.Errorf(`n = %d, dst = "%s", want %d, "%s"`, n, dst.String(), 12, "I'm a teapot")
+	}
+	if calls != 1 {
+		t.Errorf("calls = %d, want %d", calls, 1)
+	}
+}
+
+func benchmarkCopy(b *testing.B, network string, copyFunc func(dst net.Conn, src net.Conn) error) {
+	const chunkSize = 64 * 1024
+
+	b.SetBytes(chunkSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	data := io.LimitReader(zeroReader{}, int64(b.N)*chunkSize)
+	received := copyThrough(b, network, data, io.Discard, copyFunc)
+	if received != int64(b.N)*chunkSize {
+		b.Fatalf("received %d bytes, want %d", received, int64(b.N)*chunkSize)
+	}
+}
+
+// Baseline, the previous implementation copied through the wrapped response body with io.Copy
+func BenchmarkCopyTcpGeneric(b *testing.B) {
+	benchmarkCopy(b, "tcp", func(dst net.Conn, src net.Conn) error {
+		_, err := io.Copy(dst, struct{ io.Reader }{src})
+		return err
+	})
+}
+
+func BenchmarkCopyTcpPooled(b *testing.B) {
+	benchmarkCopy(b, "tcp", func(dst net.Conn, src net.Conn) error {
+		_, err := Copy(dst, struct{ io.Reader }{src}, nil)
+		return err
+	})
+}
+
+func BenchmarkCopyTcpSplice(b *testing.B) {
+	benchmarkCopy(b, "tcp", func(dst net.Conn, src net.Conn) error {
+		_, err := Copy(dst, src, nil)
+		return err
+	})
+}
+
+func BenchmarkCopyUnixGeneric(b *testing.B) {
+	benchmarkCopy(b, "unix", func(dst net.Conn, src net.Conn) error {
+		_, err := io.Copy(dst, struct{ io.Reader }{src})
+		return err
+	})
+}
+
+func BenchmarkCopyUnixPooled(b *testing.B) {
+	benchmarkCopy(b, "unix", func(dst net.Conn, src net.Conn) error {
+		_, err := Copy(dst, struct{ io.Reader }{src}, nil)
+		return err
+	})
+}
+
+func BenchmarkCopyUnixSplice(b *testing.B) {
+	benchmarkCopy(b, "unix", func(dst net.Conn, src net.Conn) error {
+		_, err := Copy(dst, src, nil)
+		return err
+	})
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
@@ -0,0 +1,221 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Maximum length of a version 1 header, including the CRLF
+	v1MaxLength = 107
+	// Length of the fixed part of a version 2 header
+	v2HeaderLength = 16
+)
+
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var ErrNoHeader = errors.New("missing PROXY protocol header")
+
+// Reads a PROXY protocol version 1 or 2 header and returns the source address it contains,
+// which is nil for connections that the proxy made on its own behalf, e.g. for health checks
+func ReadHeader(r *bufio.Reader) (net.Addr, error) {
+	b, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	switch b[0] {
+	case v2Signature[0]:
+		return readV2Header(r)
+	case 'P':
+		return readV1Header(r)
+	}
+	return nil, ErrNoHeader
+}
+
+func readV1Header(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) >= v1MaxLength {
+			return nil, errors.New("PROXY protocol header too long")
+		}
+	}
+
+	str, ok := strings.CutSuffix(string(line), "\r\n")
+	if !ok {
+		return nil, ErrNoHeader
+	}
+	fields := strings.Split(str, " ")
+	if fields[0] != "PROXY" || len(fields) < 2 {
+		return nil, ErrNoHeader
+	}
+
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil, nil
+	case "TCP4", "TCP6":
+		if len(fields) != 6 {
+			return nil, fmt.Errorf("invalid PROXY protocol header: %s", str)
+		}
+		ip := net.ParseIP(fields[2])
+		if ip == nil || (ip.To4() != nil) != (fields[1] == "TCP4") || net.ParseIP(fields[3]) == nil {
+			return nil, fmt.Errorf("invalid PROXY protocol address: %s", str)
+		}
+		port, err := strconv.ParseUint(fields[4], 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid PROXY protocol port: %s", str)
+		}
+		if _, err := strconv.ParseUint(fields[5], 10, 16); err != nil {
+			return nil, fmt.Errorf("invalid PROXY protocol port: %s", str)
+		}
+		return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+	}
+	return nil, fmt.Errorf("unsupported PROXY protocol family: %s", fields[1])
+}
+
+func readV2Header(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, v2HeaderLength)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[:len(v2Signature)], v2Signature) {
+		return nil, ErrNoHeader
+	}
+	if header[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY protocol version: %d", header[12]>>4)
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	switch header[12] & 0x0f {
+	case 0x0: // LOCAL
+		return nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, fmt.Errorf("unsupported PROXY protocol command: %d", header[12]&0x0f)
+	}
+
+	// Only the address family matters, the transport protocol is expected to be a stream
+	switch header[13] >> 4 {
+	case 0x1: // AF_INET
+		if len(payload) < 12 {
+			return nil, errors.New("invalid PROXY protocol address length")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case 0x2: // AF_INET6
+		if len(payload) < 36 {
+			return nil, errors.New("invalid PROXY protocol address length")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	}
+	// Unspecified or Unix addresses are handled as connections without a known source
+	return nil, nil
+}
+
+// Accepts connections that must start with a PROXY protocol header, which is read on the first
+// call to Read or RemoteAddr so that a slow client does not block the accept loop
+type Listener struct {
+	net.Listener
+	// Maximum time to receive the header
+	Timeout time.Duration
+	// Called with the source address of every connection, or with the address of the proxy if the header
+	// does not have one, the connection is closed if it returns an error
+	Check func(addr net.Addr) error
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{Conn: conn, br: bufio.NewReader(conn), timeout: l.Timeout, check: l.Check}, nil
+}
+
+type Conn struct {
+	net.Conn
+	br      *bufio.Reader
+	timeout time.Duration
+	check   func(addr net.Addr) error
+
+	once       sync.Once
+	remoteAddr net.Addr
+	err        error
+}
+
+func (c *Conn) readHeader() {
+	if c.timeout > 0 {
+		_ = c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+	}
+
+	addr, err := ReadHeader(c.br)
+	if err != nil {
+		c.err = err
+		_ = c.Conn.Close()
+		return
+	}
+	if addr == nil {
+		addr = c.Conn.RemoteAddr()
+	}
+	if c.check != nil {
+		if err := c.check(addr); err != nil {
+			c.err = err
+			_ = c.Conn.Close()
+			return
+		}
+	}
+	c.remoteAddr = addr
+
+	if c.timeout > 0 {
+		_ = c.Conn.SetReadDeadline(time.Time{})
+	}
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.br.Read(b)
+}
+
+// Returns the source address of the header, or the address of the proxy if it could not be read
+func (c *Conn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.remoteAddr == nil {
+		return c.Conn.RemoteAddr()
+	}
+	return c.remoteAddr
+}
+
+func (c *Conn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
+
+func (c *Conn) CloseRead() error {
+	if cr, ok := c.Conn.(interface{ CloseRead() error }); ok {
+		return cr.CloseRead()
+	}
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,145 @@
+package proxyproto
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func v2Header(cmd byte, fam byte, addrs []byte) []byte {
+	header := append([]byte{}, v2Signature...)
+	header = append(header, 0x20|cmd, fam)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(addrs)))
+	return append(header, addrs...)
+}
+
+func TestReadHeader(t *testing.T) {
+	v4Addrs := []byte{192, 0, 2, 1, 198, 51, 100, 1, 0x30, 0x39, 0x09, 0x29}
+	v6Addrs := make([]byte, 36)
+	copy(v6Addrs, net.ParseIP("2001:db8::1"))
+	binary.BigEndian.PutUint16(v6Addrs[32:], 12345)
+	// A TLV after the addresses must be skipped
+	v4AddrsTlv := append(append([]byte{}, v4Addrs...), 0x04, 0x00, 0x01, 0x00)
+
+	testCases := []struct {
+		name   string
+		input  string
+		wanted string
+		fails  bool
+	}{
+		{"v1 TCP4", "PROXY TCP4 192.0.2.1 198.51.100.1 12345 2345\r\n", "192.0.2.1:12345", false},
+		{"v1 TCP6", "PROXY TCP6 2001:db8::1 2001:db8::2 12345 2345\r\n", "[2001:db8::1]:12345", false},
+		{"v1 UNKNOWN", "PROXY UNKNOWN\r\n", "", false},
+		{"v1 mismatched family", "PROXY TCP4 2001:db8::1 2001:db8::2 12345 2345\r\n", "", true},
+		{"v1 invalid port", "PROXY TCP4 192.0.2.1 198.51.100.1 123456 2345\r\n", "", true},
+		{"v1 without CR", "PROXY TCP4 192.0.2.1 198.51.100.1 12345 2345\n", "", true},
+		{"v1 too long", "PROXY UNKNOWN " + strings.Repeat("a", v1MaxLength) + "\r\n", "", true},
+		{"v2 TCP4", string(v2Header(0x1, 0x11, v4Addrs)), "192.0.2.1:12345", false},
+		{"v2 TCP4 with TLV", string(v2Header(0x1, 0x11, v4AddrsTlv)), "192.0.2.1:12345", false},
+		{"v2 TCP6", string(v2Header(0x1, 0x21, v6Addrs)), "[2001:db8::1]:12345", false},
+		{"v2 LOCAL", string(v2Header(0x0, 0x00, nil)), "", false},
+		{"v2 short addresses", string(v2Header(0x1, 0x11, v4Addrs[:8])), "", true},
+		{"v2 truncated", string(v2Header(0x1, 0x11, v4Addrs))[:20], "", true},
+		{"HTTP request", "GET /_ping HTTP/1.1\r\n", "", true},
+	}
+
+	for _, c := range testCases {
+		r := bufio.NewReader(strings.NewReader(c.input + "GET"))
+		addr, err := ReadHeader(r)
+		if c.fails {
+			if err == nil {
+				t.Errorf("%s: addr = %v, want an error", c.name, addr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if (addr == nil && c.wanted != "") || (addr != nil && addr.String() != c.wanted) {
+			t.Errorf("%s: addr = %v, want %q", c.name, addr, c.wanted)
+		}
+
+		rest, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(rest) != "GET" {
+			t.Errorf("%s: rest = %q, want %q", c.name, rest, "GET")
+		}
+	}
+}
+
+func TestListener(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pl := &Listener{
+		Listener: ln,
+		Timeout:  time.Second,
+		Check: func(addr net.Addr) error {
+			if addr.(*net.TCPAddr).IP.Equal(net.ParseIP("192.0.2.2")) {
+				return errors.New("denied")
+			}
+			return nil
+		},
+	}
+	defer func() {
+		_ = pl.Close()
+	}()
+
+	testCases := []struct {
+		input  string
+		wanted string
+		fails  bool
+	}{
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 12345 2345\r\nPING", "192.0.2.1:12345", false},
+		{"PROXY TCP4 192.0.2.2 198.51.100.1 12345 2345\r\nPING", "", true},
+		{"PING", "", true},
+		// The header is not sent in time
+		{"", "", true},
+	}
+
+	for _, c := range testCases {
+		client, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.Write([]byte(c.input)); err != nil {
+			t.Fatal(err)
+		}
+
+		conn, err := pl.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		addr := conn.RemoteAddr()
+		msg := make([]byte, 4)
+		_, err = io.ReadFull(conn, msg)
+		if c.fails {
+			if err == nil {
+				t.Errorf("%q: msg = %q, want an error", c.input, msg)
+			}
+		} else {
+			if err != nil {
+				t.Errorf("%q: %v", c.input, err)
+			}
+			if addr.String() != c.wanted {
+				t.Errorf("%q: addr = %s, want %s", c.input, addr, c.wanted)
+			}
+			if string(msg) != "PING" {
+				t.Errorf("%q: msg = %q, want %q", c.input, msg, "PING")
+			}
+		}
+
+		_ = conn.Close()
+		_ = client.Close()
+	}
+}